@@ -22,6 +22,7 @@ import (
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/metrics"
 )
 
 // ReadPreimage retrieves a single preimage of the provided hash.
@@ -30,15 +31,123 @@ func ReadPreimage(db ethdb.KeyValueReader, hash common.Hash) []byte {
 	return data
 }
 
+// PreimageCounters are the counters of the preimages written to the database.
+type PreimageCounters struct {
+	Total metrics.Counter
+	Hits  metrics.Counter
+}
+
+// NewPreimageCounters returns the counters of the written preimages registered
+// in the given registry, the default one is used if it's nil.
+func NewPreimageCounters(r metrics.Registry) *PreimageCounters {
+	if r == nil {
+		return &PreimageCounters{Total: preimageCounter, Hits: preimageHitCounter}
+	}
+	return &PreimageCounters{
+		Total: metrics.GetOrRegisterCounter("db/preimage/total", r),
+		Hits:  metrics.GetOrRegisterCounter("db/preimage/hits", r),
+	}
+}
+
 // WritePreimages writes the provided set of preimages to the database.
 func WritePreimages(db ethdb.KeyValueWriter, preimages map[common.Hash][]byte) {
+	WritePreimagesCounted(db, preimages, nil)
+}
+
+// WritePreimagesCounted writes the provided set of preimages to the database,
+// counting them into the given counters, or the default ones if nil.
+func WritePreimagesCounted(db ethdb.KeyValueWriter, preimages map[common.Hash][]byte, counters *PreimageCounters) {
 	for hash, preimage := range preimages {
 		if err := db.Put(preimageKey(hash), preimage); err != nil {
 			log.Crit("Failed to store trie preimage", "err", err)
 		}
 	}
-	preimageCounter.Inc(int64(len(preimages)))
-	preimageHitCounter.Inc(int64(len(preimages)))
+	if counters == nil {
+		counters = NewPreimageCounters(nil)
+	}
+	counters.Total.Inc(int64(len(preimages)))
+	counters.Hits.Inc(int64(len(preimages)))
+}
+
+// ReadPreimageBlock retrieves the number of the most recent block the preimage
+// with the given hash is indexed with.
+func ReadPreimageBlock(db ethdb.KeyValueReader, hash common.Hash) (uint64, bool) {
+	data, err := db.Get(preimageHashKey(hash))
+	if err != nil || len(data) != 8 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint64(data), true
+}
+
+// WritePreimageBlock indexes the preimage with the given hash by the number of
+// the block it's associated with. The stale index of the preimage must be
+// removed separately.
+func WritePreimageBlock(db ethdb.KeyValueWriter, hash common.Hash, number uint64) {
+	if err := db.Put(preimageHashKey(hash), encodeBlockNumber(number)); err != nil {
+		log.Crit("Failed to store preimage block", "err", err)
+	}
+	if err := db.Put(preimageBlockKey(number, hash), nil); err != nil {
+		log.Crit("Failed to store preimage block index", "err", err)
+	}
+}
+
+// DeletePreimageBlockIndex removes the index of the preimage by the given block,
+// leaving the block lookup of the preimage untouched.
+func DeletePreimageBlockIndex(db ethdb.KeyValueWriter, hash common.Hash, number uint64) {
+	if err := db.Delete(preimageBlockKey(number, hash)); err != nil {
+		log.Crit("Failed to delete preimage block index", "err", err)
+	}
+}
+
+// DeletePreimage removes the preimage with the given hash along with the index
+// of it by the given block.
+func DeletePreimage(db ethdb.KeyValueWriter, hash common.Hash, number uint64) {
+	if err := db.Delete(preimageKey(hash)); err != nil {
+		log.Crit("Failed to delete trie preimage", "err", err)
+	}
+	if err := db.Delete(preimageHashKey(hash)); err != nil {
+		log.Crit("Failed to delete preimage block", "err", err)
+	}
+	DeletePreimageBlockIndex(db, hash, number)
+}
+
+// IteratePreimageBlocks invokes the callback for the indexed preimages with
+// the hash and the associated block number, in the ascending order of the
+// block, stopping at the given block number exclusively.
+func IteratePreimageBlocks(db ethdb.Iteratee, before uint64, fn func(number uint64, hash common.Hash) error) error {
+	it := db.NewIterator(preimageBlockPrefix, nil)
+	defer it.Release()
+
+	for it.Next() {
+		key := it.Key()
+		if len(key) != len(preimageBlockPrefix)+8+common.HashLength {
+			continue
+		}
+		number := binary.BigEndian.Uint64(key[len(preimageBlockPrefix):])
+		if number >= before {
+			break
+		}
+		if err := fn(number, common.BytesToHash(key[len(preimageBlockPrefix)+8:])); err != nil {
+			return err
+		}
+	}
+	return it.Error()
+}
+
+// ReadPreimageRetained retrieves the number of the preimages indexed by block.
+func ReadPreimageRetained(db ethdb.KeyValueReader) uint64 {
+	data, _ := db.Get(preimageRetainedKey)
+	if len(data) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(data)
+}
+
+// WritePreimageRetained stores the number of the preimages indexed by block.
+func WritePreimageRetained(db ethdb.KeyValueWriter, number uint64) {
+	if err := db.Put(preimageRetainedKey, encodeBlockNumber(number)); err != nil {
+		log.Crit("Failed to store retained preimage number", "err", err)
+	}
 }
 
 // ReadCode retrieves the contract code of the provided code hash.
@@ -137,6 +246,24 @@ func WritePersistentStateID(db ethdb.KeyValueWriter, number uint64) {
 	}
 }
 
+// ReadTrieNodeFormat retrieves the newest encoding version of the trie nodes
+// stored in the database, if it's recorded.
+func ReadTrieNodeFormat(db ethdb.KeyValueReader) (uint8, bool) {
+	data, _ := db.Get(trieNodeFormatKey)
+	if len(data) != 1 {
+		return 0, false
+	}
+	return data[0], true
+}
+
+// WriteTrieNodeFormat stores the newest encoding version of the trie nodes
+// stored in the database.
+func WriteTrieNodeFormat(db ethdb.KeyValueWriter, version uint8) {
+	if err := db.Put(trieNodeFormatKey, []byte{version}); err != nil {
+		log.Crit("Failed to store the trie node format", "err", err)
+	}
+}
+
 // ReadTrieJournal retrieves the serialized in-memory trie nodes of layers saved at
 // the last shutdown.
 func ReadTrieJournal(db ethdb.KeyValueReader) []byte {
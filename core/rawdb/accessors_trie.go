@@ -17,6 +17,7 @@
 package rawdb
 
 import (
+	"encoding/binary"
 	"fmt"
 	"sync"
 
@@ -141,6 +142,19 @@ func DeleteStorageTrieNode(db ethdb.KeyValueWriter, accountHash common.Hash, pat
 	}
 }
 
+// StorageTrieNodeRange returns the key range [start, limit) holding all the
+// storage trie nodes of the specified account.
+func StorageTrieNodeRange(accountHash common.Hash) ([]byte, []byte) {
+	start := storageTrieNodeKey(accountHash, nil)
+	limit := common.CopyBytes(start)
+	for i := len(limit) - 1; i >= 0; i-- {
+		if limit[i]++; limit[i] != 0 {
+			break
+		}
+	}
+	return start, limit
+}
+
 // ReadLegacyTrieNode retrieves the legacy trie node with the given
 // associated node hash.
 func ReadLegacyTrieNode(db ethdb.KeyValueReader, hash common.Hash) []byte {
@@ -171,6 +185,47 @@ func DeleteLegacyTrieNode(db ethdb.KeyValueWriter, hash common.Hash) {
 	}
 }
 
+// ReadArchivedTrieNodeNumber retrieves the item number of the legacy trie node
+// with the given hash in the trie node archive, if it has been moved there.
+func ReadArchivedTrieNodeNumber(db ethdb.KeyValueReader, hash common.Hash) (uint64, bool) {
+	data, err := db.Get(archivedTrieNodeKey(hash))
+	if err != nil || len(data) != 8 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint64(data), true
+}
+
+// WriteArchivedTrieNodeNumber writes the redirect of a legacy trie node moved
+// into the trie node archive, pointing to the item number of the node.
+func WriteArchivedTrieNodeNumber(db ethdb.KeyValueWriter, hash common.Hash, number uint64) {
+	var buff [8]byte
+	binary.BigEndian.PutUint64(buff[:], number)
+	if err := db.Put(archivedTrieNodeKey(hash), buff[:]); err != nil {
+		log.Crit("Failed to store archived trie node redirect", "err", err)
+	}
+}
+
+// DeleteArchivedTrieNodeNumber deletes the redirect of an archived trie node.
+func DeleteArchivedTrieNodeNumber(db ethdb.KeyValueWriter, hash common.Hash) {
+	if err := db.Delete(archivedTrieNodeKey(hash)); err != nil {
+		log.Crit("Failed to delete archived trie node redirect", "err", err)
+	}
+}
+
+// ReadArchivedTrieNode retrieves the legacy trie node with the given hash from
+// the trie node archive, following the redirect in the key-value store.
+func ReadArchivedTrieNode(db ethdb.KeyValueReader, archive ethdb.AncientReaderOp, hash common.Hash) []byte {
+	number, ok := ReadArchivedTrieNodeNumber(db, hash)
+	if !ok {
+		return nil
+	}
+	blob, err := archive.Ancient(TrieNodeArchiveTable, number)
+	if err != nil {
+		return nil
+	}
+	return blob
+}
+
 // HasTrieNode checks the trie node presence with the provided node info and
 // the associated node hash.
 func HasTrieNode(db ethdb.KeyValueReader, owner common.Hash, path []byte, hash common.Hash, scheme string) bool {
@@ -72,6 +72,21 @@ var (
 	stateFreezerName = "state" // the folder name of reverse diff ancient store.
 )
 
+// The table of the trie node archive, which holds the legacy trie nodes moved
+// out of the key-value store.
+const (
+	// trieNodeArchiveTableSize defines the maximum size of trie node archive data files.
+	trieNodeArchiveTableSize = 2 * 1000 * 1000 * 1000
+
+	// TrieNodeArchiveTable indicates the name of the freezer table of the legacy
+	// trie nodes moved out of the key-value store.
+	TrieNodeArchiveTable = "trienodes"
+)
+
+var trieNodeArchiveNoSnappy = map[string]bool{
+	TrieNodeArchiveTable: false,
+}
+
 // freezers the collections of all builtin freezers.
 var freezers = []string{chainFreezerName, stateFreezerName}
 
@@ -79,3 +94,9 @@ var freezers = []string{chainFreezerName, stateFreezerName}
 func NewStateFreezer(ancientDir string, readOnly bool, offset uint64) (*ResettableFreezer, error) {
 	return NewResettableFreezer(filepath.Join(ancientDir, stateFreezerName), "eth/db/state", readOnly, offset, stateHistoryTableSize, stateFreezerNoSnappy)
 }
+
+// NewTrieNodeArchive opens the freezer for archiving the legacy trie nodes in
+// the given directory.
+func NewTrieNodeArchive(dir string, readOnly bool) (*Freezer, error) {
+	return NewFreezer(dir, "eth/db/archive", readOnly, 0, trieNodeArchiveTableSize, trieNodeArchiveNoSnappy)
+}
@@ -100,6 +100,15 @@ func (frdb *freezerdb) Freeze(threshold uint64) error {
 	return nil
 }
 
+// AdviseDontNeed implements ethdb.PageCacheAdviser, forwarding the hint to the
+// key-value store if it's supported.
+func (frdb *freezerdb) AdviseDontNeed() error {
+	if adviser, ok := frdb.KeyValueStore.(ethdb.PageCacheAdviser); ok {
+		return adviser.AdviseDontNeed()
+	}
+	return errNotSupported
+}
+
 // nofreezedb is a database wrapper that disables freezer data retrievals.
 type nofreezedb struct {
 	ethdb.KeyValueStore
@@ -200,6 +209,15 @@ func (db *nofreezedb) AncientDatadir() (string, error) {
 	return "", errNotSupported
 }
 
+// AdviseDontNeed implements ethdb.PageCacheAdviser, forwarding the hint to the
+// key-value store if it's supported.
+func (db *nofreezedb) AdviseDontNeed() error {
+	if adviser, ok := db.KeyValueStore.(ethdb.PageCacheAdviser); ok {
+		return adviser.AdviseDontNeed()
+	}
+	return errNotSupported
+}
+
 // NewDatabase creates a high level database on top of a given key-value data
 // store without a freezer moving immutable chain segments into cold storage.
 func NewDatabase(db ethdb.KeyValueStore) ethdb.Database {
@@ -622,6 +640,7 @@ func InspectDatabase(db ethdb.Database, keyPrefix, keyStart []byte) error {
 		numHashPairings stat
 		hashNumPairings stat
 		legacyTries     stat
+		archivedTries   stat
 		stateLookups    stat
 		accountTries    stat
 		storageTries    stat
@@ -667,6 +686,8 @@ func InspectDatabase(db ethdb.Database, keyPrefix, keyStart []byte) error {
 			hashNumPairings.Add(size)
 		case IsLegacyTrieNode(key, it.Value()):
 			legacyTries.Add(size)
+		case IsArchivedTrieNodeKey(key):
+			archivedTries.Add(size)
 		case bytes.HasPrefix(key, stateIDPrefix) && len(key) == len(stateIDPrefix)+common.HashLength:
 			stateLookups.Add(size)
 		case IsAccountTrieNode(key):
@@ -683,6 +704,10 @@ func InspectDatabase(db ethdb.Database, keyPrefix, keyStart []byte) error {
 			storageSnaps.Add(size)
 		case bytes.HasPrefix(key, PreimagePrefix) && len(key) == (len(PreimagePrefix)+common.HashLength):
 			preimages.Add(size)
+		case bytes.HasPrefix(key, preimageBlockPrefix) && len(key) == (len(preimageBlockPrefix)+8+common.HashLength):
+			preimages.Add(size)
+		case bytes.HasPrefix(key, preimageHashPrefix) && len(key) == (len(preimageHashPrefix)+common.HashLength):
+			preimages.Add(size)
 		case bytes.HasPrefix(key, configPrefix) && len(key) == (len(configPrefix)+common.HashLength):
 			metadata.Add(size)
 		case bytes.HasPrefix(key, genesisPrefix) && len(key) == (len(genesisPrefix)+common.HashLength):
@@ -710,7 +735,8 @@ func InspectDatabase(db ethdb.Database, keyPrefix, keyStart []byte) error {
 				lastPivotKey, fastTrieProgressKey, snapshotDisabledKey, SnapshotRootKey, snapshotJournalKey,
 				snapshotGeneratorKey, snapshotRecoveryKey, txIndexTailKey, fastTxLookupLimitKey,
 				uncleanShutdownKey, badBlockKey, transitionStatusKey, skeletonSyncStatusKey,
-				persistentStateIDKey, trieJournalKey, snapshotSyncStatusKey,
+				persistentStateIDKey, trieJournalKey, snapshotSyncStatusKey, trieNodeFormatKey,
+				preimageRetainedKey,
 			} {
 				if bytes.Equal(key, meta) {
 					metadata.Add(size)
@@ -740,6 +766,7 @@ func InspectDatabase(db ethdb.Database, keyPrefix, keyStart []byte) error {
 		{"Key-Value store", "Bloombit index", bloomBits.Size(), bloomBits.Count()},
 		{"Key-Value store", "Contract codes", codes.Size(), codes.Count()},
 		{"Key-Value store", "Hash trie nodes", legacyTries.Size(), legacyTries.Count()},
+		{"Key-Value store", "Hash trie archive redirects", archivedTries.Size(), archivedTries.Count()},
 		{"Key-Value store", "Path trie state lookups", stateLookups.Size(), stateLookups.Count()},
 		{"Key-Value store", "Path trie account nodes", accountTries.Size(), accountTries.Count()},
 		{"Key-Value store", "Path trie storage nodes", storageTries.Size(), storageTries.Count()},
@@ -43,6 +43,9 @@ var (
 	// persistentStateIDKey tracks the id of latest stored state(for path-based only).
 	persistentStateIDKey = []byte("LastStateID")
 
+	// trieNodeFormatKey tracks the newest encoding version of the stored trie nodes.
+	trieNodeFormatKey = []byte("TrieNodeFormat")
+
 	// lastPivotKey tracks the last pivot block used by fast sync (to reenable on sethead).
 	lastPivotKey = []byte("LastPivot")
 
@@ -103,6 +106,9 @@ var (
 	// transitionStatusKey tracks the eth2 transition status.
 	transitionStatusKey = []byte("eth2-transition")
 
+	// preimageRetainedKey tracks the number of the preimages indexed by block.
+	preimageRetainedKey = []byte("PreimageRetained")
+
 	// Data item prefixes (use single byte to avoid mixing data types, avoid `i`, used for indexes).
 	headerPrefix       = []byte("h") // headerPrefix + num (uint64 big endian) + hash -> header
 	headerTDSuffix     = []byte("t") // headerPrefix + num (uint64 big endian) + hash + headerTDSuffix -> td
@@ -126,10 +132,16 @@ var (
 	trieNodeStoragePrefix = []byte("O") // trieNodeStoragePrefix + accountHash + hexPath -> trie node
 	stateIDPrefix         = []byte("L") // stateIDPrefix + state root -> state id
 
+	// Redirects of the legacy trie nodes moved into the trie node archive.
+	archivedTrieNodePrefix = []byte("trie-archive-") // archivedTrieNodePrefix + node hash -> item number in the trie node archive
+
 	PreimagePrefix = []byte("secure-key-")       // PreimagePrefix + hash -> preimage
 	configPrefix   = []byte("ethereum-config-")  // config prefix for the db
 	genesisPrefix  = []byte("ethereum-genesis-") // genesis state prefix for the db
 
+	preimageBlockPrefix = []byte("preimage-block-") // preimageBlockPrefix + num (uint64 big endian) + hash -> nil
+	preimageHashPrefix  = []byte("preimage-hash-")  // preimageHashPrefix + hash -> num (uint64 big endian)
+
 	// BloomBitsIndexPrefix is the data table of a chain indexer to track its progress
 	BloomBitsIndexPrefix = []byte("iB")
 
@@ -238,6 +250,16 @@ func preimageKey(hash common.Hash) []byte {
 	return append(PreimagePrefix, hash.Bytes()...)
 }
 
+// preimageBlockKey = preimageBlockPrefix + num (uint64 big endian) + hash
+func preimageBlockKey(number uint64, hash common.Hash) []byte {
+	return append(append(preimageBlockPrefix, encodeBlockNumber(number)...), hash.Bytes()...)
+}
+
+// preimageHashKey = preimageHashPrefix + hash
+func preimageHashKey(hash common.Hash) []byte {
+	return append(preimageHashPrefix, hash.Bytes()...)
+}
+
 // codeKey = CodePrefix + hash
 func codeKey(hash common.Hash) []byte {
 	return append(CodePrefix, hash.Bytes()...)
@@ -267,6 +289,17 @@ func stateIDKey(root common.Hash) []byte {
 	return append(stateIDPrefix, root.Bytes()...)
 }
 
+// archivedTrieNodeKey = archivedTrieNodePrefix + hash (32 bytes)
+func archivedTrieNodeKey(hash common.Hash) []byte {
+	return append(archivedTrieNodePrefix, hash.Bytes()...)
+}
+
+// IsArchivedTrieNodeKey reports whether the key is the redirect of a legacy trie
+// node which is moved into the trie node archive.
+func IsArchivedTrieNodeKey(key []byte) bool {
+	return len(key) == len(archivedTrieNodePrefix)+common.HashLength && bytes.HasPrefix(key, archivedTrieNodePrefix)
+}
+
 // accountTrieNodeKey = trieNodeAccountPrefix + nodePath.
 func accountTrieNodeKey(path []byte) []byte {
 	return append(trieNodeAccountPrefix, path...)
@@ -38,6 +38,21 @@ type Batch interface {
 	Replay(w KeyValueWriter) error
 }
 
+// NoSyncWriter is implemented by the batches which can be flushed without
+// waiting for the data to be synced to the disk.
+type NoSyncWriter interface {
+	// WriteNoSync flushes any accumulated data without forcing an fsync.
+	WriteNoSync() error
+}
+
+// PageCacheAdviser is implemented by the data stores which can hint the
+// operating system to drop the pages of the data written so far from the page
+// cache, leaving it to the pages being read.
+type PageCacheAdviser interface {
+	// AdviseDontNeed hints that the data written so far won't be read soon.
+	AdviseDontNeed() error
+}
+
 // Batcher wraps the NewBatch method of a backing data store.
 type Batcher interface {
 	// NewBatch creates a write-only database that buffers changes to its host db
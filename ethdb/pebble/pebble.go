@@ -21,7 +21,10 @@ package pebble
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
 	"runtime"
 	"sync"
 	"sync/atomic"
@@ -84,6 +87,11 @@ type Database struct {
 	writeDelayStartTime time.Time     // The start time of the latest write stall
 	writeDelayCount     atomic.Int64  // Total number of write stall counts
 	writeDelayTime      atomic.Int64  // Total time spent in write stalls
+
+	adviseLock sync.Mutex          // Mutex protecting the files to advise the page cache of
+	advising   bool                // Flag whether the page cache is advised, the files are only tracked afterwards
+	flushed    []string            // Tables written by the flushes since the last page cache advice
+	wals       map[string]struct{} // Write-ahead logs of the database
 }
 
 func (d *Database) onCompactionBegin(info pebble.CompactionInfo) {
@@ -116,6 +124,44 @@ func (d *Database) onWriteStallEnd() {
 	d.writeDelayTime.Add(int64(time.Since(d.writeDelayStartTime)))
 }
 
+func (d *Database) onFlushEnd(info pebble.FlushInfo) {
+	if info.Err != nil {
+		return
+	}
+	d.adviseLock.Lock()
+	defer d.adviseLock.Unlock()
+
+	if !d.advising {
+		return
+	}
+	for _, table := range info.Output {
+		d.flushed = append(d.flushed, filepath.Join(d.fn, table.FileNum.String()+".sst"))
+	}
+}
+
+func (d *Database) onWALCreated(info pebble.WALCreateInfo) {
+	if info.Err != nil {
+		return
+	}
+	d.adviseLock.Lock()
+	defer d.adviseLock.Unlock()
+
+	if !d.advising {
+		return
+	}
+	if info.RecycledFileNum != 0 {
+		delete(d.wals, filepath.Join(d.fn, info.RecycledFileNum.String()+".log"))
+	}
+	d.wals[info.Path] = struct{}{}
+}
+
+func (d *Database) onWALDeleted(info pebble.WALDeleteInfo) {
+	d.adviseLock.Lock()
+	defer d.adviseLock.Unlock()
+
+	delete(d.wals, info.Path)
+}
+
 // New returns a wrapped pebble DB object. The namespace is the prefix that the
 // metrics reporting should use for surfacing internal stats.
 func New(file string, cache int, handles int, namespace string, readonly bool) (*Database, error) {
@@ -145,6 +191,7 @@ func New(file string, cache int, handles int, namespace string, readonly bool) (
 		fn:       file,
 		log:      logger,
 		quitChan: make(chan chan error),
+		wals:     make(map[string]struct{}),
 	}
 	opt := &pebble.Options{
 		// Pebble has a single combined cache area and the write
@@ -185,6 +232,9 @@ func New(file string, cache int, handles int, namespace string, readonly bool) (
 			CompactionEnd:   db.onCompactionEnd,
 			WriteStallBegin: db.onWriteStallBegin,
 			WriteStallEnd:   db.onWriteStallEnd,
+			FlushEnd:        db.onFlushEnd,
+			WALCreated:      db.onWALCreated,
+			WALDeleted:      db.onWALDeleted,
 		},
 	}
 	// Disable seek compaction explicitly. Check https://github.com/ethereum/go-ethereum/pull/20130
@@ -217,6 +267,47 @@ func New(file string, cache int, handles int, namespace string, readonly bool) (
 	return db, nil
 }
 
+// AdviseDontNeed implements ethdb.PageCacheAdviser, hinting the OS to drop the
+// pages of the tables written by the flushes since the last call, as well as the
+// pages of the write-ahead logs which are only read back on recovery. The files
+// written are only tracked once it's called, so the first call covers the
+// write-ahead logs alone.
+func (d *Database) AdviseDontNeed() error {
+	d.adviseLock.Lock()
+	if !d.advising {
+		logs, err := filepath.Glob(filepath.Join(d.fn, "*.log"))
+		if err != nil {
+			d.adviseLock.Unlock()
+			return err
+		}
+		for _, path := range logs {
+			d.wals[path] = struct{}{}
+		}
+		d.advising = true
+	}
+	paths := d.flushed
+	d.flushed = nil
+	for path := range d.wals {
+		paths = append(paths, path)
+	}
+	d.adviseLock.Unlock()
+
+	for _, path := range paths {
+		// The files might be compacted away or recycled already, skip them.
+		err := adviseDontNeed(path)
+		if errors.Is(err, os.ErrNotExist) {
+			d.adviseLock.Lock()
+			delete(d.wals, path)
+			d.adviseLock.Unlock()
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Close stops the metrics collection, flushes any pending data to disk and closes
 // all io accesses to the underlying key-value store.
 func (d *Database) Close() error {
@@ -538,6 +629,17 @@ func (b *batch) Write() error {
 	return b.b.Commit(pebble.Sync)
 }
 
+// WriteNoSync flushes any accumulated data without waiting for it to be synced
+// to the disk.
+func (b *batch) WriteNoSync() error {
+	b.db.quitLock.RLock()
+	defer b.db.quitLock.RUnlock()
+	if b.db.closed {
+		return pebble.ErrClosed
+	}
+	return b.b.Commit(pebble.NoSync)
+}
+
 // Reset resets the batch for reuse.
 func (b *batch) Reset() {
 	b.b.Reset()
@@ -56,3 +56,46 @@ func BenchmarkPebbleDB(b *testing.B) {
 		}
 	})
 }
+
+func TestAdviseDontNeed(t *testing.T) {
+	db, err := New(t.TempDir(), 16, 16, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// The flushed tables aren't tracked until the page cache is advised
+	if err := db.Put([]byte("key"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	db.adviseLock.Lock()
+	flushed, wals := len(db.flushed), len(db.wals)
+	db.adviseLock.Unlock()
+	if flushed != 0 || wals != 0 {
+		t.Fatal("Files are tracked without page cache advice")
+	}
+	if err := db.AdviseDontNeed(); err != nil {
+		t.Fatalf("Failed to advise page cache: %v", err)
+	}
+	if err := db.Put([]byte("key"), []byte("value2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	db.adviseLock.Lock()
+	flushed = len(db.flushed)
+	db.adviseLock.Unlock()
+	if flushed == 0 {
+		t.Fatal("Flushed tables are not tracked")
+	}
+	if err := db.AdviseDontNeed(); err != nil {
+		t.Fatalf("Failed to advise page cache: %v", err)
+	}
+	if len(db.flushed) != 0 {
+		t.Fatal("Advised tables are not released")
+	}
+}
@@ -43,6 +43,12 @@ func NewHistogram(s Sample) Histogram {
 	return &StandardHistogram{sample: s}
 }
 
+// NewHistogramForced constructs a new StandardHistogram from a Sample and
+// returns it no matter if the global switch is enabled or not.
+func NewHistogramForced(s Sample) Histogram {
+	return &StandardHistogram{sample: s}
+}
+
 // NewRegisteredHistogram constructs and registers a new StandardHistogram from
 // a Sample.
 func NewRegisteredHistogram(name string, r Registry, s Sample) Histogram {
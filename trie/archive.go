@@ -0,0 +1,74 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/trie/triedb/hashdb"
+	bloomfilter "github.com/holiman/bloomfilter/v2"
+)
+
+// ArchiveColdNodes moves the trie nodes in the persistent database which are
+// not reachable from the state with the given root into the freezer, keeping
+// a redirect so that they are still found by the reads. The freezer must have
+// the rawdb.TrieNodeArchiveTable, and it has to be supplied through the Archive
+// field of the hash scheme config when the database is reopened. It's only
+// supported by the hash scheme.
+//
+// Hash scheme doesn't track which nodes are used by which states, thus the
+// root is expected to be the most recently committed one; the nodes used
+// only by the states committed later would be moved as well, slowing down
+// their reads but keeping them readable. The nodes still held in memory are
+// never moved. Due to the false-positives of the filter marking the reachable
+// nodes, a few cold nodes might be retained.
+//
+// The operation is aborted with the error of the context of the database once
+// it's cancelled, see WithContext. The nodes moved by then are reported and
+// stay readable.
+func (db *Database) ArchiveColdNodes(before common.Hash, freezer ethdb.AncientStore) (moved int, err error) {
+	if db.readOnly.Load() {
+		return 0, ErrReadOnly
+	}
+	hdb, ok := db.backend.(*hashdb.Database)
+	if !ok {
+		return 0, ErrNotSupported
+	}
+	var (
+		ctx   = db.Context()
+		total uint64
+	)
+	err = db.scanNodes(ctx, db.Scheme(), func(hash common.Hash, size int) {
+		total++
+	})
+	if err != nil {
+		return 0, err
+	}
+	if total == 0 {
+		return 0, nil
+	}
+	bloom, err := bloomfilter.NewOptimal(total, orphanBloomRate)
+	if err != nil {
+		return 0, err
+	}
+	if err := db.markNodes(ctx, before, bloom); err != nil {
+		return 0, err
+	}
+	return hdb.ArchiveNodes(ctx, freezer, func(hash common.Hash) bool {
+		return bloom.Contains(orphanBloomHasher(hash.Bytes()))
+	})
+}
@@ -0,0 +1,75 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/trie/trienode"
+)
+
+// CommitAttestation is a compact record of a state transition applied through
+// Database.Update, emitted by Config.EmitAttestation. Two databases applying
+// the same transition produce the same attestation.
+type CommitAttestation struct {
+	Root    common.Hash // Root of the new state
+	Parent  common.Hash // Root of the state transitioned from
+	Block   uint64      // Number of the block introducing the state
+	Nodes   int         // Number of trie nodes written or deleted
+	KeyHash common.Hash // Hash over the owner, path and hash of every node, see attestNodes
+}
+
+// attestNodes returns the number of the nodes in the set and the hash over
+// them. The nodes are ordered by owner and then by path, and each contributes
+// its owner, the length of its path in one byte, its path and its hash, zero
+// for the deleted ones.
+func attestNodes(nodes *trienode.MergedNodeSet) (int, common.Hash) {
+	if nodes == nil {
+		return 0, crypto.Keccak256Hash()
+	}
+	owners := make([]common.Hash, 0, len(nodes.Sets))
+	for owner := range nodes.Sets {
+		owners = append(owners, owner)
+	}
+	sort.Slice(owners, func(i, j int) bool { return owners[i].Cmp(owners[j]) < 0 })
+
+	var (
+		hasher = crypto.NewKeccakState()
+		count  int
+	)
+	for _, owner := range owners {
+		set := nodes.Sets[owner]
+		paths := make([]string, 0, len(set.Nodes))
+		for path := range set.Nodes {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+
+		for _, path := range paths {
+			hasher.Write(owner.Bytes())
+			hasher.Write([]byte{byte(len(path))})
+			hasher.Write([]byte(path))
+			hasher.Write(set.Nodes[path].Hash.Bytes())
+			count++
+		}
+	}
+	var hash common.Hash
+	hasher.Read(hash[:])
+	return count, hash
+}
@@ -0,0 +1,75 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// StartAutoCommit launches a background loop committing the state returned by
+// rootFn into disk at the given interval, for embedders which don't manage the
+// flushing themselves. Failures are logged and retried at the next tick. Empty
+// roots, roots which have already been committed and the ticks while the
+// database is read-only or the flushing is paused are skipped. The returned
+// function terminates the loop and waits for an in-flight commit to finish. The
+// loop is terminated by Close as well.
+func (db *Database) StartAutoCommit(interval time.Duration, rootFn func() common.Hash) (stop func()) {
+	var (
+		quit = make(chan struct{})
+		done = make(chan struct{})
+		once sync.Once
+	)
+	db.loops.Add(1)
+	go func() {
+		defer db.loops.Done()
+		defer close(done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		var last common.Hash
+		for {
+			select {
+			case <-ticker.C:
+				root := rootFn()
+				if root == (common.Hash{}) || root == types.EmptyRootHash || root == last || db.readOnly.Load() || db.paused.Load() > 0 {
+					continue
+				}
+				if err := db.Commit(root, false); err != nil {
+					log.Error("Failed to auto-commit trie database", "root", root, "err", err)
+					continue
+				}
+				last = root
+			case <-quit:
+				return
+			case <-db.quit:
+				return
+			}
+		}
+	}()
+	return func() {
+		once.Do(func() {
+			close(quit)
+			<-done
+		})
+	}
+}
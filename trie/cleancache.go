@@ -0,0 +1,86 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/ethereum/go-ethereum/trie/trienode"
+)
+
+// errCleanCacheDisabled is returned if the clean cache is requested to be
+// exported or imported while it's disabled.
+var errCleanCacheDisabled = errors.New("clean cache is disabled")
+
+// ExportCleanCache writes the entries of the clean cache of the backend into
+// the writer, prefixed with the state scheme, so that another node with the
+// same scheme and cache allowance can start with a warm cache. ErrNotSupported
+// is returned if the cache, e.g. a custom one, can't be serialized.
+func (db *Database) ExportCleanCache(w io.Writer) error {
+	cache, err := db.serializableCache()
+	if err != nil {
+		return err
+	}
+	scheme := db.Scheme()
+	if _, err := w.Write(append([]byte{byte(len(scheme))}, scheme...)); err != nil {
+		return err
+	}
+	return cache.Save(w)
+}
+
+// ImportCleanCache replaces the entries of the clean cache of the backend with
+// the ones written by ExportCleanCache. The export is rejected if it's made in
+// another state scheme. The path scheme verifies the nodes retrieved from the
+// clean cache against the hash, while the hash scheme trusts them, thus the
+// export must come from a trusted node.
+func (db *Database) ImportCleanCache(r io.Reader) error {
+	if db.readOnly.Load() {
+		return ErrReadOnly
+	}
+	cache, err := db.serializableCache()
+	if err != nil {
+		return err
+	}
+	var size [1]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return err
+	}
+	scheme := make([]byte, size[0])
+	if _, err := io.ReadFull(r, scheme); err != nil {
+		return err
+	}
+	if string(scheme) != db.Scheme() {
+		return fmt.Errorf("incompatible clean cache, scheme: %q, want: %q", scheme, db.Scheme())
+	}
+	return cache.Load(r)
+}
+
+// serializableCache returns the clean cache of the backend if it's enabled and
+// can be serialized.
+func (db *Database) serializableCache() (trienode.CleanCacheSerializer, error) {
+	cache := db.backend.CleanCache()
+	if cache == nil {
+		return nil, errCleanCacheDisabled
+	}
+	serializer, ok := cache.(trienode.CleanCacheSerializer)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	return serializer, nil
+}
@@ -0,0 +1,197 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// CompareWith walks the state with the given root in both databases in lockstep,
+// including the storage tries, and compares every node byte by byte. It returns
+// whether the states are identical, or the location of the first difference in
+// path order: the hex-encoded node path in the account trie, e.g. 0x0a03, or
+// the account hash and the node path joined by a colon for a storage trie node.
+// Nodes are resolved on the fly and released once visited, so the memory usage
+// is bounded regardless of the size of the state.
+//
+// The account trie is split by the first nibble of the path among the given
+// number of concurrent walkers, a value below two walks it sequentially.
+func (db *Database) CompareWith(other *Database, root common.Hash, concurrency int) (equal bool, firstDiff string, err error) {
+	if concurrency < 2 {
+		diff, err := compareState(db, other, root, -1)
+		return diff == "" && err == nil, diff, err
+	}
+	// Compare the root nodes first, the walkers only visit their subtries.
+	if diff, err := compareState(db, other, root, 16); diff != "" || err != nil {
+		return false, diff, err
+	}
+	var (
+		diffs = make([]string, 16)
+		errs  = make([]error, 16)
+		tasks = make(chan int, 16)
+		wg    sync.WaitGroup
+	)
+	for i := 0; i < 16; i++ {
+		tasks <- i
+	}
+	close(tasks)
+
+	for i := 0; i < concurrency && i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for nibble := range tasks {
+				diffs[nibble], errs[nibble] = compareState(db, other, root, nibble)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Report the first difference in path order, regardless of the
+	// order in which the walkers have finished.
+	for i := 0; i < 16; i++ {
+		if errs[i] != nil {
+			return false, "", errs[i]
+		}
+		if diffs[i] != "" {
+			return false, diffs[i], nil
+		}
+	}
+	return true, "", nil
+}
+
+// compareState walks the account trie of the given state in both databases in
+// lockstep along with the storage tries. If nibble is in [0, 16), only the nodes
+// with the given first nibble in the path are compared, 16 compares the root
+// node alone, and a negative value compares all the nodes.
+func compareState(a, b *Database, root common.Hash, nibble int) (string, error) {
+	var start []byte
+	if nibble >= 0 && nibble < 16 {
+		start = []byte{byte(nibble << 4)}
+	}
+	ita, err := openNodeIterator(a, TrieID(root), start)
+	if err != nil {
+		return "", err
+	}
+	itb, err := openNodeIterator(b, TrieID(root), start)
+	if err != nil {
+		return "", err
+	}
+	return compareTries(ita, itb, nibble, func(key []byte, leaf []byte) (string, error) {
+		var acct types.StateAccount
+		if err := rlp.DecodeBytes(leaf, &acct); err != nil {
+			return "", err
+		}
+		if acct.Root == types.EmptyRootHash {
+			return "", nil
+		}
+		id := StorageTrieID(root, common.BytesToHash(key), acct.Root)
+		sa, err := openNodeIterator(a, id, nil)
+		if err != nil {
+			return "", err
+		}
+		sb, err := openNodeIterator(b, id, nil)
+		if err != nil {
+			return "", err
+		}
+		diff, err := compareTries(sa, sb, -1, nil)
+		if diff != "" {
+			diff = fmt.Sprintf("%#x:%s", key, diff)
+		}
+		return diff, err
+	})
+}
+
+// openNodeIterator opens the trie with the given identifier and creates a node
+// iterator on top, starting from the given key.
+func openNodeIterator(db *Database, id *ID, start []byte) (NodeIterator, error) {
+	tr, err := New(id, db)
+	if err != nil {
+		return nil, err
+	}
+	return tr.NodeIterator(start)
+}
+
+// compareTries advances the two iterators in lockstep and returns the path of
+// the first differing node. The leaves with identical content are handed over
+// to onLeaf for comparing the data they reference.
+func compareTries(a, b NodeIterator, nibble int, onLeaf func(key []byte, leaf []byte) (string, error)) (string, error) {
+	for {
+		oka, okb := nextInRange(a, nibble), nextInRange(b, nibble)
+		if a.Error() != nil {
+			return "", a.Error()
+		}
+		if b.Error() != nil {
+			return "", b.Error()
+		}
+		switch {
+		case !oka && !okb:
+			return "", nil
+		case !oka:
+			return hexutil.Encode(b.Path()), nil
+		case !okb:
+			return hexutil.Encode(a.Path()), nil
+		}
+		if c := bytes.Compare(a.Path(), b.Path()); c > 0 {
+			return hexutil.Encode(b.Path()), nil
+		} else if c < 0 {
+			return hexutil.Encode(a.Path()), nil
+		}
+		if a.Hash() != b.Hash() || a.Leaf() != b.Leaf() {
+			return hexutil.Encode(a.Path()), nil
+		}
+		if a.Hash() != (common.Hash{}) && !bytes.Equal(a.NodeBlob(), b.NodeBlob()) {
+			return hexutil.Encode(a.Path()), nil
+		}
+		if !a.Leaf() {
+			continue
+		}
+		if !bytes.Equal(a.LeafKey(), b.LeafKey()) || !bytes.Equal(a.LeafBlob(), b.LeafBlob()) {
+			return hexutil.Encode(a.Path()), nil
+		}
+		if onLeaf != nil {
+			if diff, err := onLeaf(a.LeafKey(), a.LeafBlob()); diff != "" || err != nil {
+				return diff, err
+			}
+		}
+	}
+}
+
+// nextInRange moves the iterator to the next node with the given first nibble
+// in the path, see compareState for the meaning of the nibble.
+func nextInRange(it NodeIterator, nibble int) bool {
+	for it.Next(true) {
+		path := it.Path()
+		switch {
+		case nibble < 0:
+			return true
+		case nibble == 16:
+			return len(path) == 0
+		case len(path) == 0 || int(path[0]) < nibble:
+			continue
+		}
+		return int(path[0]) == nibble
+	}
+	return false
+}
@@ -17,31 +17,178 @@
 package trie
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/lru"
 	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/metrics"
+	"github.com/ethereum/go-ethereum/rlp"
 	"github.com/ethereum/go-ethereum/trie/triedb/hashdb"
+	"github.com/ethereum/go-ethereum/trie/triedb/lockstat"
 	"github.com/ethereum/go-ethereum/trie/triedb/pathdb"
 	"github.com/ethereum/go-ethereum/trie/trienode"
 	"github.com/ethereum/go-ethereum/trie/triestate"
+	"golang.org/x/sync/errgroup"
 )
 
 // Config defines all necessary options for database.
 type Config struct {
-	NoTries   bool
-	Preimages bool // Flag whether the preimage of node key is recorded
-	Cache     int
-	HashDB    *hashdb.Config // Configs for hash-based scheme
-	PathDB    *pathdb.Config // Configs for experimental path-based scheme
+	NoTries       bool
+	Preimages     bool // Flag whether the preimage of node key is recorded
+	RequireStates bool // Flag whether Update rejects a nil state set if the backend needs it
+	WriteThrough  bool // Flag whether every update is persisted immediately, disabling the in-memory buffering
+	TrackLocks    bool // Flag whether the wait and hold time of the backend lock is tracked
+	Cache         int
+	HashDB        *hashdb.Config // Configs for hash-based scheme
+	PathDB        *pathdb.Config // Configs for experimental path-based scheme
+
+	// CommitOrder overrides the order in which the account and storage trie
+	// nodes are written into disk by the backend, if it's not Unordered.
+	CommitOrder trienode.CommitOrder
+
+	// NodeFormatVersion is the encoding version of the trie nodes written, up
+	// to NodeFormatLatest. The newest version written is recorded in a marker
+	// with the first commit and checked when the database is opened, an absent
+	// marker standing for version 0. If either is beyond the supported ones,
+	// the reads and writes are rejected with ErrNodeFormatUnsupported.
+	NodeFormatVersion uint8
+
+	// OnMissingNode, if set, is consulted when a commit meets a node which is
+	// neither cached nor persisted, e.g. to fetch it from a peer. Returning an
+	// error aborts the commit, returning the node lets it proceed. Only the
+	// hash-based scheme resolves nodes during commit.
+	OnMissingNode func(owner common.Hash, path []byte, hash common.Hash) ([]byte, error)
+
+	// Replicator, if set, receives every trie node and preimage write made
+	// while committing and flushing, e.g. to feed a hot standby.
+	Replicator trienode.Replicator
+
+	// CleanCacheFactory, if set, creates the clean cache of the backend in
+	// place of the default fastcache.
+	CleanCacheFactory trienode.CleanCacheFactory
+
+	// PreimageRetention, if non-zero, is the number of recent blocks to keep
+	// the preimages for. The persisted preimages are indexed by the block of
+	// the update which introduced them and pruned once they fall out of the
+	// window. The ones persisted while the retention is disabled are kept.
+	PreimageRetention uint64
+
+	// PreimageSyncEvery, if greater than one, makes only every Nth flush of the
+	// preimages force an fsync, the others are just written. The preimages of
+	// up to N-1 flushes might be lost if the host crashes, but not if just the
+	// process does. They are not consensus critical, and are regenerated by
+	// re-executing the blocks. It only takes effect on the key-value stores
+	// which sync every write, e.g. pebble.
+	PreimageSyncEvery int
+
+	// ReaderRetryOnFlush makes the readers resolve a node once more after the
+	// in-progress flushes settle if it's not found while the dirty nodes are
+	// being written into disk. The hooks invoked during a flush must not read
+	// through the database if it's set.
+	ReaderRetryOnFlush bool
+
+	// OnError, if set, is invoked whenever an operation of the backend fails,
+	// before the error is logged or returned. The operation is one of "read"
+	// for a node which can't be resolved, "flush" for a failed write of the
+	// dirty nodes and "commit" for a failed commit. It might be invoked with
+	// the backend locks held, thus it must not access the database.
+	OnError func(op string, err error)
+
+	// OnContextError, if set, is invoked whenever opening a reader, "reader",
+	// or resolving a node through it, "read", fails, with the context of the
+	// request the database is scoped to by WithContext. The context is the
+	// background one for the database not scoped to any request.
+	OnContextError func(ctx context.Context, op string, err error)
+
+	// ValidateNodeSet makes Update verify that every node in the node set hashes
+	// to its declared hash before handing it to the backend, rejecting the set
+	// with ErrCorruptNodeSet otherwise. It rehashes every node, thus it's meant
+	// for canaries and tests, catching the trie construction bugs upfront
+	// rather than on the later reads.
+	ValidateNodeSet bool
+
+	// EmitAttestation, if set, is invoked with the record of every state
+	// transition once it's successfully applied by Update, e.g. for keeping an
+	// audit log. The hash over the node set costs a sort of the node paths.
+	EmitAttestation func(a CommitAttestation)
+
+	// WAL, if set, is the write-ahead log every batch of the trie nodes is
+	// appended to before it's written into the persistent database, guarding
+	// against the torn writes on the storages without atomic batches. The
+	// records left behind by an interrupted write are replayed when the
+	// database is opened, see RecoverWAL.
+	WAL ethdb.KeyValueStore
+
+	// AdviseDontNeed makes the database hint the OS to drop the pages of the
+	// written trie nodes from the page cache after every operation which might
+	// flush them, keeping the cache to the pages being read, e.g. on the archive
+	// nodes where the big commits evict the hot read pages. It only takes effect
+	// on the key-value stores implementing ethdb.PageCacheAdviser, namely pebble
+	// on linux, it's ignored with a warning on the others.
+	AdviseDontNeed bool
 
 	// Testing hooks
 	OnCommit func(states *triestate.Set) // Hook invoked when commit is performed
 }
 
+// hashConfig returns the hash-based scheme config with the database-wide
+// options applied. The shared config is copied rather than modified.
+func (c *Config) hashConfig() *hashdb.Config {
+	config := *c.HashDB
+	if c.CommitOrder != trienode.Unordered {
+		config.CommitOrder = c.CommitOrder
+	}
+	if c.TrackLocks {
+		config.TrackLocks = true
+	}
+	if c.OnMissingNode != nil {
+		config.OnMissingNode = c.OnMissingNode
+	}
+	if c.Replicator != nil {
+		config.Replicator = c.Replicator
+	}
+	if c.CleanCacheFactory != nil {
+		config.CleanCacheFactory = c.CleanCacheFactory
+	}
+	if c.OnError != nil {
+		config.OnError = c.OnError
+	}
+	return &config
+}
+
+// pathConfig returns the path-based scheme config with the database-wide
+// options applied. The shared config is copied rather than modified.
+func (c *Config) pathConfig() *pathdb.Config {
+	config := *c.PathDB
+	if c.CommitOrder != trienode.Unordered {
+		config.CommitOrder = c.CommitOrder
+	}
+	if c.TrackLocks {
+		config.TrackLocks = true
+	}
+	if c.Replicator != nil {
+		config.Replicator = c.Replicator
+	}
+	if c.CleanCacheFactory != nil {
+		config.CleanCacheFactory = c.CleanCacheFactory
+	}
+	if c.OnError != nil {
+		config.OnError = c.OnError
+	}
+	return &config
+}
+
 // HashDefaults represents a config for using hash-based scheme with
 // default settings.
 var HashDefaults = &Config{
@@ -75,6 +222,39 @@ type backend interface {
 	// to disk. Report specifies whether logs will be displayed in info level.
 	Commit(root common.Hash, report bool) error
 
+	// Dirty reports whether committing the given state would write any trie
+	// node into disk.
+	Dirty(root common.Hash) bool
+
+	// DeltaSize returns the memory accumulated in front of the persistent
+	// database layer since dirty nodes were last written into disk.
+	DeltaSize() common.StorageSize
+
+	// Shrink releases as much memory as safely possible by flushing dirty
+	// nodes into disk and emptying the clean cache, returning the released size.
+	Shrink() (common.StorageSize, error)
+
+	// LockStats returns the contention statistics of the backend lock.
+	LockStats() lockstat.Stats
+
+	// CleanCache returns the cache of the clean nodes, nil if it's disabled.
+	CleanCache() trienode.CleanCache
+
+	// DiskRoot returns the root of the most recent state persisted in disk.
+	DiskRoot() common.Hash
+
+	// LastFlush returns the time at which dirty nodes were last written into
+	// disk, or zero if nothing has been written yet.
+	LastFlush() time.Time
+
+	// SetMetricsRegistry reports the backend activity into the given registry
+	// rather than the default one.
+	SetMetricsRegistry(r metrics.Registry)
+
+	// Truncate wipes all the trie nodes from both memory and disk, leaving
+	// the backend uninitialized.
+	Truncate() error
+
 	// Close closes the trie database backend and releases all held resources.
 	Close() error
 }
@@ -83,10 +263,40 @@ type backend interface {
 // types of node backend as an entrypoint. It's responsible for all interactions
 // relevant with trie nodes and node preimages.
 type Database struct {
-	config    *Config        // Configuration for trie database
-	diskdb    ethdb.Database // Persistent database to store the snapshot
-	preimages *preimageStore // The store for caching preimages
-	backend   backend        // The backend for managing trie nodes
+	*sharedDatabase
+	ctx context.Context // Context of the request the database is scoped to, nil if not scoped
+}
+
+// sharedDatabase is the state of the database shared by all the views scoped
+// to different requests.
+type sharedDatabase struct {
+	config     *Config                                // Configuration for trie database
+	diskdb     ethdb.Database                         // Persistent database to store the snapshot
+	preimages  *preimageStore                         // The store for caching preimages
+	backend    backend                                // The backend for managing trie nodes
+	closed     atomic.Bool                            // Flag whether the database has been closed
+	readOnly   atomic.Bool                            // Flag whether the mutations are rejected
+	committing atomic.Int32                           // Number of commits in progress
+	updated    atomic.Uint64                          // Data storage submitted by updates since the database was opened
+	lastUpdate atomic.Pointer[trienode.MergedNodeSet] // Nodes introduced by the most recent update
+	registry   metrics.Registry                       // Registry the backend metrics are reported to, nil means the default
+	quit       chan struct{}                          // Channel closed on shutdown to terminate the background loops
+	loops      sync.WaitGroup                         // Tracker of the running background loops
+	flushing   atomic.Int32                           // Number of operations in progress which might flush dirty nodes
+	flushes    atomic.Uint64                          // Number of operations finished which might have flushed dirty nodes
+	flushLock  sync.RWMutex                           // Lock held in read mode by the operations which might flush
+	paused     atomic.Int32                           // Number of pauses of the background flushes in effect
+	formatErr  error                                  // Failure of the node format check on open, rejecting reads and writes
+	stamped    atomic.Bool                            // Flag whether the node format marker is known to be up to date
+	pinned     common.Hash                            // Root of the state pinned by OpenAt, zero if not pinned
+	top        atomic.Pointer[topState]               // Most recently updated state along with its cached reader
+
+	storageRoots *lru.Cache[storageRootKey, common.Hash] // Storage roots of the recently looked up accounts
+
+	quarantine     map[string]QuarantinedNode // Trie nodes moved aside, waiting to be fetched again
+	quarantineLock sync.RWMutex               // Lock protecting the quarantine list
+
+	wal *walDatabase // Key-value store of the backend logging its writes, nil if no write-ahead log
 }
 
 // prepare initializes the database with provided configs, but the
@@ -94,19 +304,80 @@ type Database struct {
 func prepare(diskdb ethdb.Database, config *Config) *Database {
 	var preimages *preimageStore
 	if config != nil && config.Preimages {
-		preimages = newPreimageStore(diskdb)
-	}
-	return &Database{
-		config:    config,
-		diskdb:    diskdb,
-		preimages: preimages,
+		preimages = newPreimageStore(diskdb, config)
 	}
+	return &Database{sharedDatabase: &sharedDatabase{
+		config:       config,
+		diskdb:       diskdb,
+		preimages:    preimages,
+		quit:         make(chan struct{}),
+		storageRoots: lru.NewCache[storageRootKey, common.Hash](storageRootCacheSize),
+	}}
 }
 
 // NewDatabase initializes the trie database with default settings, note
 // the legacy hash-based scheme is used by default.
 func NewDatabase(diskdb ethdb.Database, config *Config) *Database {
-	// Sanitize the config and use the default one if it's not specified.
+	config = sanitizeConfig(diskdb, config)
+
+	var preimages *preimageStore
+	if config.Preimages {
+		preimages = newPreimageStore(diskdb, config)
+	}
+	formatErr := checkNodeFormat(diskdb, config)
+	if formatErr != nil {
+		log.Error("Incompatible trie node format", "err", formatErr)
+	}
+	backend, wal := openBackend(diskdb, config)
+	return &Database{sharedDatabase: &sharedDatabase{
+		config:       config,
+		diskdb:       diskdb,
+		preimages:    preimages,
+		backend:      backend,
+		quit:         make(chan struct{}),
+		formatErr:    formatErr,
+		storageRoots: lru.NewCache[storageRootKey, common.Hash](storageRootCacheSize),
+		wal:          wal,
+	}}
+}
+
+// OpenAt initializes a read-only trie database pinned to the state with the
+// given root, e.g. for serving the queries against a historical block. The state
+// must be available, otherwise an error is returned. PinnedReader opens a reader
+// of the pinned state, while the readers of the other available states can still
+// be opened with Reader. All the mutations are rejected with ErrReadOnly.
+//
+// Nothing is written into the persistent database, so that several pinned
+// databases can be opened next to each other and next to a writer: the path
+// scheme backend is opened in read-only mode, leaving the state history freezer
+// alone, the write-ahead log isn't replayed and the preimages aren't flushed on
+// close. The hash scheme backend doesn't write anything until it's mutated.
+func OpenAt(diskdb ethdb.Database, config *Config, root common.Hash) (*Database, error) {
+	var copied Config
+	if config != nil {
+		copied = *config
+	}
+	config = sanitizeConfig(diskdb, &copied)
+	if config.PathDB != nil {
+		pathConfig := *config.PathDB
+		pathConfig.ReadOnly = true
+		config.PathDB = &pathConfig
+	}
+	config.WAL = nil
+
+	db := NewDatabase(diskdb, config)
+	if _, err := db.Reader(root); err != nil {
+		db.Close()
+		return nil, err
+	}
+	db.pinned = root
+	db.readOnly.Store(true)
+	return db, nil
+}
+
+// sanitizeConfig uses the default config according to the state scheme of the
+// persistent database if it's not specified.
+func sanitizeConfig(diskdb ethdb.Database, config *Config) *Config {
 	dbScheme := rawdb.ReadStateScheme(diskdb)
 	if config == nil {
 		if dbScheme == rawdb.PathScheme {
@@ -124,40 +395,161 @@ func NewDatabase(diskdb ethdb.Database, config *Config) *Database {
 			config.HashDB = hashdb.Defaults
 		}
 	}
-	var preimages *preimageStore
-	if config.Preimages {
-		preimages = newPreimageStore(diskdb)
+	if config.AdviseDontNeed {
+		// The database wrappers implement the interface regardless of the
+		// wrapped key-value store, probe it with a hint instead.
+		if adviser, ok := diskdb.(ethdb.PageCacheAdviser); !ok {
+			log.Warn("Page cache advice is not supported by the database")
+		} else if err := adviser.AdviseDontNeed(); err != nil {
+			log.Warn("Page cache advice is not supported by the database", "err", err)
+		}
+	}
+	return config
+}
+
+// openBackend constructs the database backend with the given sanitized config,
+// logging its writes into the write-ahead log if it's configured. The writes
+// interrupted before are completed first, before the backend loads its state.
+func openBackend(diskdb ethdb.Database, config *Config) (backend, *walDatabase) {
+	if config.WAL == nil {
+		return newBackend(diskdb, config), nil
 	}
-	db := &Database{
-		config:    config,
-		diskdb:    diskdb,
-		preimages: preimages,
+	wal := newWALDatabase(diskdb, config.WAL)
+	if err := wal.recover(); err != nil {
+		log.Error("Failed to replay write-ahead log", "err", err)
 	}
+	return newBackend(wal, config), wal
+}
+
+// newBackend constructs the database backend with the given sanitized config.
+func newBackend(diskdb ethdb.Database, config *Config) backend {
 	/*
 	 * 1. First, initialize db according to the user config
 	 * 2. Second, initialize the db according to the scheme already used by db
 	 * 3. Last, use the default scheme, namely hash scheme
 	 */
+	dbScheme := rawdb.ReadStateScheme(diskdb)
 	if config.HashDB != nil {
-		if rawdb.ReadStateScheme(diskdb) == rawdb.PathScheme {
+		if dbScheme == rawdb.PathScheme {
 			log.Warn("incompatible state scheme", "old", rawdb.PathScheme, "new", rawdb.HashScheme)
 		}
-		db.backend = hashdb.New(diskdb, config.HashDB, mptResolver{})
+		return hashdb.New(diskdb, config.hashConfig(), mptResolver{})
 	} else if config.PathDB != nil {
-		if rawdb.ReadStateScheme(diskdb) == rawdb.HashScheme {
+		if dbScheme == rawdb.HashScheme {
 			log.Warn("incompatible state scheme", "old", rawdb.HashScheme, "new", rawdb.PathScheme)
 		}
-		db.backend = pathdb.New(diskdb, config.PathDB)
+		return pathdb.New(diskdb, config.pathConfig())
 	} else if strings.Compare(dbScheme, rawdb.PathScheme) == 0 {
 		if config.PathDB == nil {
 			config.PathDB = pathdb.Defaults
 		}
-		db.backend = pathdb.New(diskdb, config.PathDB)
-	} else {
-		if config.HashDB == nil {
-			config.HashDB = hashdb.Defaults
+		return pathdb.New(diskdb, config.pathConfig())
+	}
+	if config.HashDB == nil {
+		config.HashDB = hashdb.Defaults
+	}
+	return hashdb.New(diskdb, config.hashConfig(), mptResolver{})
+}
+
+// Reopen closes the current backend and constructs a new one in place with the
+// given config, e.g. to switch the state scheme after a migration, without
+// replacing the Database object held by others. The scheme of the persistent
+// state is re-detected if the config is nil or leaves the scheme unspecified.
+// It's rejected if a commit is in progress. The operations which might flush
+// are waited for and held off meanwhile, but the caller must ensure there are
+// no other concurrent accesses. The node format is checked again and the
+// write-ahead log of the new config, if any, is replayed before the backend is
+// constructed, the same as on open.
+func (db *Database) Reopen(config *Config) error {
+	if db.readOnly.Load() {
+		return ErrReadOnly
+	}
+	if db.committing.Load() > 0 {
+		return errors.New("commit is in progress")
+	}
+	db.WritePreimages()
+
+	db.flushLock.Lock()
+	defer db.flushLock.Unlock()
+
+	if err := db.backend.Close(); err != nil {
+		return err
+	}
+	config = sanitizeConfig(db.diskdb, config)
+	switch {
+	case !config.Preimages:
+		db.preimages = nil
+	case db.preimages == nil:
+		db.preimages = newPreimageStore(db.diskdb, config)
+		if db.registry != nil {
+			db.preimages.setMetricsRegistry(db.registry)
 		}
-		db.backend = hashdb.New(diskdb, config.HashDB, mptResolver{})
+	}
+	db.formatErr = checkNodeFormat(db.diskdb, config)
+	if db.formatErr != nil {
+		log.Error("Incompatible trie node format", "err", db.formatErr)
+	}
+	db.stamped.Store(false)
+	db.config = config
+	db.backend, db.wal = openBackend(db.diskdb, config)
+	if db.registry != nil {
+		db.backend.SetMetricsRegistry(db.registry)
+	}
+	// Drop everything derived from the states of the old backend
+	db.top.Store(nil)
+	db.lastUpdate.Store(nil)
+	db.storageRoots.Purge()
+	// Rearm the shutdown channel if the database was closed before.
+	if db.closed.Swap(false) {
+		db.quit = make(chan struct{})
+	}
+	return nil
+}
+
+// DetectScheme returns the scheme of the state persisted in the given database
+// without constructing a backend for it. An empty scheme is returned if the
+// database is empty, and an error if the chain is present but its state isn't
+// stored in any known scheme.
+func DetectScheme(diskdb ethdb.Database) (string, error) {
+	if scheme := rawdb.ReadStateScheme(diskdb); scheme != "" {
+		return scheme, nil
+	}
+	if rawdb.ReadCanonicalHash(diskdb, 0) != (common.Hash{}) {
+		return "", errors.New("unknown state scheme")
+	}
+	return "", nil
+}
+
+// SchemeInitialized returns an indicator if the state in the given database is
+// already initialized in any of the known schemes.
+func SchemeInitialized(diskdb ethdb.Database) bool {
+	scheme, err := DetectScheme(diskdb)
+	return err == nil && scheme != ""
+}
+
+// SetReadOnly toggles the read-only mode of the database at runtime, e.g. to
+// quiesce the writes during a backup. While it's set, all the mutating methods
+// are rejected with ErrReadOnly and Shrink releases nothing, but the operations
+// already in progress are left to complete. The preimages are still flushed by
+// WritePreimages and Close, so that nothing is lost on shutdown. A database
+// opened by OpenAt stays read-only.
+func (db *Database) SetReadOnly(ro bool) {
+	db.readOnly.Store(ro || db.pinned != (common.Hash{}))
+}
+
+// ReadOnly reports whether the database is in read-only mode.
+func (db *Database) ReadOnly() bool {
+	return db.readOnly.Load()
+}
+
+// WithMetrics routes the metrics reported by the database into the given
+// registry instead of the default one, allowing multiple instances to be
+// tracked separately. It's meant to be chained right after construction.
+func (db *Database) WithMetrics(reg metrics.Registry) *Database {
+	db.registry = reg
+	db.backend.SetMetricsRegistry(reg)
+	if db.preimages != nil {
+		db.preimages.setMetricsRegistry(reg)
 	}
 	return db
 }
@@ -166,18 +558,367 @@ func (db *Database) Config() *Config {
 	return db.config
 }
 
+// EffectiveConfig returns a copy of the configuration the database is running
+// with, after the defaults are filled in. Only the backend config of the chosen
+// scheme is set, reflecting the options shared with the backend and, in the
+// path-based scheme, the sanitization too. The backend configs are copied as
+// well, thus they can be modified freely.
+func (db *Database) EffectiveConfig() Config {
+	var config Config
+	if db.config != nil {
+		config = *db.config
+	}
+	config.HashDB, config.PathDB = nil, nil
+
+	switch b := db.backend.(type) {
+	case *hashdb.Database:
+		if db.config != nil && db.config.HashDB != nil {
+			config.HashDB = db.config.hashConfig()
+		}
+	case *pathdb.Database:
+		config.PathDB = b.Config()
+	}
+	return config
+}
+
 // Reader returns a reader for accessing all trie nodes with provided state root.
-// An error will be returned if the requested state is not available.
+// An error will be returned if the requested state is not available, except for
+// the empty state which is always readable, even before the genesis is committed.
 func (db *Database) Reader(blockRoot common.Hash) (Reader, error) {
+	return db.reader(blockRoot, false)
+}
+
+// reader returns a reader for accessing all trie nodes with provided state root,
+// wrapped according to the configuration. If nocache is set, the nodes loaded
+// from disk are not populated into the clean cache of the backend.
+func (db *Database) reader(blockRoot common.Hash, nocache bool) (Reader, error) {
+	if db.formatErr != nil {
+		return nil, db.formatErr
+	}
+	reader, err := db.backendReader(blockRoot, nocache)
+	if err != nil {
+		db.reportContextError("reader", err)
+		return nil, err
+	}
+	if db.config != nil && db.config.ReaderRetryOnFlush {
+		reader = &retryReader{Reader: reader, db: db, root: blockRoot, nocache: nocache}
+	}
+	if db.hasQuarantine() {
+		reader = &quarantineReader{Reader: reader, db: db}
+	}
+	if db.config != nil && db.config.OnContextError != nil {
+		reader = &contextReader{Reader: reader, db: db}
+	}
+	return reader, nil
+}
+
+// PinnedReader returns a reader of the state the database is pinned to by
+// OpenAt.
+func (db *Database) PinnedReader() (Reader, error) {
+	if db.pinned == (common.Hash{}) {
+		return nil, errors.New("database is not pinned to a state")
+	}
+	return db.Reader(db.pinned)
+}
+
+// PinnedRoot returns the root of the state the database is pinned to by OpenAt
+// and whether it's pinned at all.
+func (db *Database) PinnedRoot() (common.Hash, bool) {
+	return db.pinned, db.pinned != (common.Hash{})
+}
+
+// topState is the most recently updated state, along with a reader of it once
+// it's resolved.
+type topState struct {
+	root    common.Hash
+	reader  Reader
+	flushes uint64 // Number of the flush operations finished when the reader was opened
+}
+
+// TopReader returns a reader of the most recently updated state along with its
+// root, or of the most recently persisted one if nothing has been updated since
+// the database was opened. The reader is opened once and reused until the next
+// operation which might flush or drop the layers, e.g. Update, Commit or Cap,
+// sparing the state lookup for the common case of reading the newest state.
+func (db *Database) TopReader() (Reader, common.Hash, error) {
+	top := db.top.Load()
+	if top != nil && top.reader != nil && top.flushes == db.flushes.Load() && db.flushing.Load() == 0 {
+		return top.reader, top.root, nil
+	}
+	root := db.backend.DiskRoot()
+	if top != nil {
+		root = top.root
+	}
+	if root == (common.Hash{}) {
+		return nil, common.Hash{}, errors.New("no state is available")
+	}
+	flushes := db.flushes.Load()
+	reader, err := db.Reader(root)
+	if err != nil {
+		return nil, root, err
+	}
+	db.top.CompareAndSwap(top, &topState{root: root, reader: reader, flushes: flushes})
+	return reader, root, nil
+}
+
+// WithContext returns a view of the database scoped to the given request
+// context, which is passed to the OnContextError hook along with the failures
+// of the readers opened through the view. The view shares everything else with
+// the database, including the backend, and is cheap to create.
+func (db *Database) WithContext(ctx context.Context) *Database {
+	return &Database{sharedDatabase: db.sharedDatabase, ctx: ctx}
+}
+
+// Context returns the context of the request the database is scoped to, or the
+// background context if it's not scoped to any.
+func (db *Database) Context() context.Context {
+	if db.ctx == nil {
+		return context.Background()
+	}
+	return db.ctx
+}
+
+// reportContextError invokes the OnContextError hook, if set, with the failed
+// operation and the context of the database.
+func (db *Database) reportContextError(op string, err error) {
+	if db.config != nil && db.config.OnContextError != nil {
+		db.config.OnContextError(db.Context(), op, err)
+	}
+}
+
+// backendReader returns the reader of the backend with provided state root,
+// which bypasses the clean cache of the backend if nocache is set.
+func (db *Database) backendReader(blockRoot common.Hash, nocache bool) (Reader, error) {
+	if blockRoot == types.EmptyRootHash {
+		return emptyReader{}, nil
+	}
 	switch b := db.backend.(type) {
 	case *hashdb.Database:
+		if nocache {
+			return b.ReaderNoCache(blockRoot)
+		}
 		return b.Reader(blockRoot)
 	case *pathdb.Database:
+		if nocache {
+			return b.ReaderNoCache(blockRoot)
+		}
 		return b.Reader(blockRoot)
+	case *forkBackend:
+		return b.reader(blockRoot, nocache)
 	}
 	return nil, errors.New("unknown backend")
 }
 
+// startFlush marks an operation which might write the dirty nodes into disk
+// as in progress. The returned function must be invoked once it's finished.
+func (db *Database) startFlush() func() {
+	db.flushLock.RLock()
+	db.flushing.Add(1)
+	return func() {
+		if db.config != nil && db.config.AdviseDontNeed {
+			db.adviseDontNeed()
+		}
+		db.flushing.Add(-1)
+		db.flushes.Add(1)
+		db.flushLock.RUnlock()
+	}
+}
+
+// adviseDontNeed hints the OS to drop the pages written into disk from the page
+// cache, if it's supported by the key-value store. It's a hint only, a failure
+// is just logged.
+func (db *Database) adviseDontNeed() {
+	adviser, ok := db.diskdb.(ethdb.PageCacheAdviser)
+	if !ok {
+		return
+	}
+	if err := adviser.AdviseDontNeed(); err != nil {
+		log.Debug("Failed to advise page cache", "err", err)
+	}
+}
+
+// ReaderEx returns a reader for accessing all trie nodes with provided state
+// root, which reports the kind and the leaf value of the resolved nodes along
+// with their blobs.
+func (db *Database) ReaderEx(blockRoot common.Hash) (ReaderEx, error) {
+	reader, err := db.Reader(blockRoot)
+	if err != nil {
+		return nil, err
+	}
+	return readerEx{reader}, nil
+}
+
+// ReaderNoCache returns a reader for accessing all trie nodes with provided
+// state root, which doesn't populate the clean cache of the backend with the
+// nodes loaded from disk. It's meant for one-off scans such as audits, which
+// would otherwise evict the hot nodes from the cache.
+func (db *Database) ReaderNoCache(blockRoot common.Hash) (Reader, error) {
+	return db.reader(blockRoot, true)
+}
+
+// ReaderWithin returns a reader for accessing the trie nodes with provided state
+// root. If the state is not available, the reader of its nearest available
+// ancestor at most maxBlocksBehind blocks older is returned, along with the
+// root of the state actually used. It's only supported by path-based database
+// and will return an error for others.
+func (db *Database) ReaderWithin(root common.Hash, maxBlocksBehind uint64) (Reader, common.Hash, error) {
+	pdb, ok := db.backend.(*pathdb.Database)
+	if !ok {
+		return nil, common.Hash{}, ErrNotSupported
+	}
+	return pdb.ReaderWithin(root, maxBlocksBehind)
+}
+
+// StorageReader returns a reader for accessing the trie nodes of the storage of
+// the given account hash in the specified state, along with its storage root.
+// The reader of the empty trie is returned if the account has no storage or is
+// not present. The owner passed to the returned reader is ignored, the nodes
+// are always resolved in the storage trie of the account.
+func (db *Database) StorageReader(stateRoot common.Hash, account common.Hash) (Reader, common.Hash, error) {
+	root, err := db.storageRoot(stateRoot, account)
+	if err != nil {
+		return nil, common.Hash{}, err
+	}
+	if root == types.EmptyRootHash {
+		return emptyReader{}, root, nil
+	}
+	reader, err := db.Reader(stateRoot)
+	if err != nil {
+		return nil, common.Hash{}, err
+	}
+	return &storageReader{reader: reader, owner: account}, root, nil
+}
+
+// storageRootCacheSize is the number of recently looked up accounts whose
+// storage roots are cached.
+const storageRootCacheSize = 256
+
+// storageRootKey identifies an account in a given state.
+type storageRootKey struct {
+	stateRoot common.Hash
+	account   common.Hash
+}
+
+// storageRoot returns the storage root of the given account hash in the specified
+// state, or the empty root if the account is not present. The roots of the recently
+// looked up accounts are served from a cache, as they never change in a state.
+func (db *Database) storageRoot(stateRoot common.Hash, account common.Hash) (common.Hash, error) {
+	key := storageRootKey{stateRoot: stateRoot, account: account}
+	if root, ok := db.storageRoots.Get(key); ok {
+		return root, nil
+	}
+	tr, err := New(TrieID(stateRoot), db)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	blob, err := tr.Get(account.Bytes())
+	if err != nil {
+		return common.Hash{}, err
+	}
+	root := types.EmptyRootHash
+	if len(blob) != 0 {
+		var acct types.StateAccount
+		if err := rlp.DecodeBytes(blob, &acct); err != nil {
+			return common.Hash{}, err
+		}
+		root = acct.Root
+	}
+	db.storageRoots.Add(key, root)
+	return root, nil
+}
+
+// StorageValue returns the value of the storage slot with the given key hash of
+// the given account hash in the specified state, or nil if the slot is absent.
+// The storage root of the account is cached, so that reading a handful of slots
+// of the same account in a row resolves the account only once.
+func (db *Database) StorageValue(stateRoot common.Hash, account common.Hash, slot common.Hash) ([]byte, error) {
+	root, err := db.storageRoot(stateRoot, account)
+	if err != nil {
+		return nil, err
+	}
+	if root == types.EmptyRootHash {
+		return nil, nil
+	}
+	tr, err := New(StorageTrieID(stateRoot, account, root), db)
+	if err != nil {
+		return nil, err
+	}
+	enc, err := tr.Get(slot.Bytes())
+	if err != nil || len(enc) == 0 {
+		return nil, err
+	}
+	_, content, _, err := rlp.Split(enc)
+	return content, err
+}
+
+// ResolveSubtree resolves all the nodes of the storage trie of the given account
+// hash in the specified state, so that they are loaded into the clean cache of
+// the backend ahead of a read-heavy operation, and reports the number and the
+// size of them. The nodes still held in memory as dirty are resolved from there
+// and counted too. The walk is sequential, it's meant for the small and medium
+// sized storage tries.
+func (db *Database) ResolveSubtree(root common.Hash, account common.Hash) (int, common.StorageSize, error) {
+	storageRoot, err := db.storageRoot(root, account)
+	if err != nil {
+		return 0, 0, err
+	}
+	if storageRoot == types.EmptyRootHash {
+		return 0, 0, nil
+	}
+	tr, err := New(StorageTrieID(root, account, storageRoot), db)
+	if err != nil {
+		return 0, 0, err
+	}
+	it, err := tr.NodeIterator(nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	var (
+		nodes int
+		size  common.StorageSize
+	)
+	for it.Next(true) {
+		if it.Hash() == (common.Hash{}) {
+			continue
+		}
+		nodes++
+		size += common.StorageSize(len(it.NodeBlob()))
+	}
+	if err := it.Error(); err != nil {
+		return 0, 0, err
+	}
+	return nodes, size, nil
+}
+
+// Prewarm resolves the trie nodes along the paths of the given keys in the state
+// with the specified root, so that they are loaded into the clean cache of the
+// backend ahead of time. The keys are resolved concurrently and the absent ones
+// are ignored.
+func (db *Database) Prewarm(root common.Hash, keys [][]byte) error {
+	workers := runtime.NumCPU()
+	if workers > len(keys) {
+		workers = len(keys)
+	}
+	var eg errgroup.Group
+	for i := 0; i < workers; i++ {
+		i := i
+		eg.Go(func() error {
+			// Trie is not thread-safe, open a dedicated one for each worker.
+			tr, err := New(TrieID(root), db)
+			if err != nil {
+				return err
+			}
+			for j := i; j < len(keys); j += workers {
+				if _, err := tr.Get(keys[j]); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	return eg.Wait()
+}
+
 // Update performs a state transition by committing dirty nodes contained in the
 // given set in order to update state from the specified parent to the specified
 // root. The held pre-images accumulated up to this point will be flushed in case
@@ -186,23 +927,188 @@ func (db *Database) Reader(blockRoot common.Hash) (Reader, error) {
 // The passed in maps(nodes, states) will be retained to avoid copying everything.
 // Therefore, these maps must not be changed afterwards.
 func (db *Database) Update(root common.Hash, parent common.Hash, block uint64, nodes *trienode.MergedNodeSet, states *triestate.Set) error {
+	if db.readOnly.Load() {
+		return ErrReadOnly
+	}
+	if db.formatErr != nil {
+		return db.formatErr
+	}
+	// The state set is used by the path-based scheme to construct the
+	// state history, without which the transition can't be reverted.
+	if states == nil && db.config != nil && db.config.RequireStates && db.backend.Scheme() == rawdb.PathScheme {
+		return ErrMissingStates
+	}
+	if db.config != nil && db.config.ValidateNodeSet {
+		if err := validateNodeSet(nodes); err != nil {
+			return err
+		}
+	}
 	if db.config != nil && db.config.OnCommit != nil {
 		db.config.OnCommit(states)
 	}
 	if db.preimages != nil {
+		db.preimages.tag(block)
 		db.preimages.commit(false)
 	}
-	return db.backend.Update(root, parent, block, nodes, states)
+	done := db.startFlush()
+	err := db.backend.Update(root, parent, block, nodes, states)
+	done()
+	if err != nil {
+		return err
+	}
+	// Check the reverse diff against the new state if requested. The update
+	// has been applied already, the error is meant to be treated as fatal.
+	if pdb, ok := db.backend.(*pathdb.Database); ok && states != nil && db.config != nil && db.config.PathDB != nil && db.config.PathDB.VerifyHistory {
+		if err := pdb.VerifyHistory(root, &trieLoader{db: db}); err != nil {
+			return err
+		}
+	}
+	db.updated.Add(updateSize(nodes))
+	db.lastUpdate.Store(nodes)
+	db.top.Store(&topState{root: root})
+
+	if db.config != nil && db.config.EmitAttestation != nil {
+		count, hash := attestNodes(nodes)
+		db.config.EmitAttestation(CommitAttestation{Root: root, Parent: parent, Block: block, Nodes: count, KeyHash: hash})
+	}
+
+	// Persist the state right away in write-through mode, so that the state
+	// in disk always matches with the latest update. Note in the path-based
+	// scheme it also means the state can't be reverted in memory anymore.
+	if db.config != nil && db.config.WriteThrough {
+		return db.Commit(root, false)
+	}
+	return nil
+}
+
+// validateNodeSet checks that every node in the set, except the deleted ones,
+// hashes to its declared hash.
+func validateNodeSet(nodes *trienode.MergedNodeSet) error {
+	if nodes == nil {
+		return nil
+	}
+	h := newHasher(false)
+	defer returnHasherToPool(h)
+
+	for owner, set := range nodes.Sets {
+		for path, n := range set.Nodes {
+			if n.IsDeleted() {
+				continue
+			}
+			if hash := common.BytesToHash(h.hashData(n.Blob)); hash != n.Hash {
+				return fmt.Errorf("%w: owner %x, path %x, want %x, got %x", ErrCorruptNodeSet, owner, path, n.Hash, hash)
+			}
+		}
+	}
+	return nil
+}
+
+// UpdateCopy is a variant of Update which deep-copies the passed node set and
+// state set beforehand, so that the caller may reuse or mutate them afterwards.
+// The copy costs an allocation per node and state entry, on top of doubling the
+// memory held temporarily, so Update is preferred whenever the caller can leave
+// the sets untouched.
+func (db *Database) UpdateCopy(root common.Hash, parent common.Hash, block uint64, nodes *trienode.MergedNodeSet, states *triestate.Set) error {
+	nodes = nodes.Copy()
+	if states != nil {
+		states = states.Copy()
+	}
+	return db.Update(root, parent, block, nodes, states)
+}
+
+// CommitStats describes what a single commit has written into disk. The trie
+// nodes written by concurrent flushes, if any, are accounted too.
+type CommitStats struct {
+	Nodes    uint64             // Number of trie nodes written
+	Size     common.StorageSize // Data storage of the trie nodes written
+	Duration time.Duration      // Time spent on the commit
+	DiskRoot common.Hash        // Root of the persisted state after the commit
 }
 
 // Commit iterates over all the children of a particular node, writes them out
 // to disk. As a side effect, all pre-images accumulated up to this point are
 // also written.
 func (db *Database) Commit(root common.Hash, report bool) error {
+	_, err := db.CommitResult(root, report)
+	return err
+}
+
+// CommitResult is a variant of Commit which also reports what the commit has
+// written into disk.
+func (db *Database) CommitResult(root common.Hash, report bool) (CommitStats, error) {
+	if db.readOnly.Load() {
+		return CommitStats{}, ErrReadOnly
+	}
+	if db.formatErr != nil {
+		return CommitStats{}, db.formatErr
+	}
+	db.committing.Add(1)
+	defer db.committing.Add(-1)
+
 	if db.preimages != nil {
 		db.preimages.commit(true)
 	}
-	return db.backend.Commit(root, report)
+	var (
+		start       = time.Now()
+		size, nodes = db.written()
+	)
+	done := db.startFlush()
+	err := db.backend.Commit(root, report)
+	done()
+	if err != nil {
+		return CommitStats{}, err
+	}
+	db.stampNodeFormat()
+	written, nwritten := db.written()
+	return CommitStats{
+		Nodes:    nwritten - nodes,
+		Size:     written - size,
+		Duration: time.Since(start),
+		DiskRoot: db.backend.DiskRoot(),
+	}, nil
+}
+
+// written returns the data storage and the number of nodes written into disk
+// by the backend since the database was opened.
+func (db *Database) written() (common.StorageSize, uint64) {
+	switch b := db.backend.(type) {
+	case *hashdb.Database:
+		return b.Written()
+	case *pathdb.Database:
+		return b.Written()
+	}
+	return 0, 0
+}
+
+// CommitBarrier commits the states with the given roots into their respective
+// databases, one after another in the given order, e.g. for checkpointing the
+// databases of several shards at a common point. It stops at the first failure,
+// reported as a BarrierError, leaving the databases before it committed and the
+// ones after it untouched, as the commits can't be rolled back.
+func CommitBarrier(dbs []*Database, roots []common.Hash) error {
+	if len(dbs) != len(roots) {
+		return fmt.Errorf("mismatched databases and roots, %d != %d", len(dbs), len(roots))
+	}
+	for i, db := range dbs {
+		if err := db.Commit(roots[i], false); err != nil {
+			return &BarrierError{Index: i, Err: err}
+		}
+	}
+	return nil
+}
+
+// CommitIfDirty is a variant of Commit which skips the commit entirely if it
+// wouldn't write anything into disk, i.e. neither the trie nodes of the given
+// state nor any preimages are pending, avoiding the locking and the logging of
+// an empty commit. It reports whether the commit was performed.
+func (db *Database) CommitIfDirty(root common.Hash, report bool) (bool, error) {
+	if !db.backend.Dirty(root) && (db.preimages == nil || db.preimages.size() == 0) {
+		return false, nil
+	}
+	if err := db.Commit(root, report); err != nil {
+		return false, err
+	}
+	return true, nil
 }
 
 // Size returns the storage size of dirty trie nodes in front of the persistent
@@ -219,22 +1125,281 @@ func (db *Database) Size() (common.StorageSize, common.StorageSize) {
 	return storages, preimages
 }
 
+// DeltaSize returns the memory accumulated by the backend since the dirty nodes
+// were last written into disk, by either a commit or a flush. Unlike Size, it's
+// not affected by the nodes retained across flushes, which makes it a better
+// indicator of when the next flush will happen.
+func (db *Database) DeltaSize() common.StorageSize {
+	return db.backend.DeltaSize()
+}
+
+// Shrink releases as much memory as safely possible, e.g. when the host is under
+// memory pressure. The cached preimages and the dirty nodes are flushed into disk
+// as far as it's safe, the clean cache is emptied. The released size is returned,
+// failures are logged and reduce what's reported.
+func (db *Database) Shrink() common.StorageSize {
+	if db.readOnly.Load() {
+		return 0
+	}
+	var released common.StorageSize
+	if db.preimages != nil {
+		size := db.preimages.size()
+		if err := db.preimages.commit(true); err != nil {
+			log.Error("Failed to flush preimages", "err", err)
+		} else {
+			released += size
+		}
+	}
+	done := db.startFlush()
+	size, err := db.backend.Shrink()
+	done()
+	if err != nil {
+		log.Error("Failed to shrink trie database", "err", err)
+	}
+	return released + size
+}
+
+// LockStats returns the wait and hold time accumulated on the lock of the
+// backend, which serializes the mutations and guards the reads of the dirty
+// nodes. The statistics are all zero unless Config.TrackLocks is set.
+func (db *Database) LockStats() lockstat.Stats {
+	return db.backend.LockStats()
+}
+
 // Initialized returns an indicator if the state data is already initialized
 // according to the state scheme.
 func (db *Database) Initialized(genesisRoot common.Hash) bool {
 	return db.backend.Initialized(genesisRoot)
 }
 
+// MarkInitialized finalizes a database whose initial state with the given root
+// has been written directly into disk, e.g. by a custom importer, so that it's
+// reported by Initialized and served by the readers. The root node must be
+// present in disk. There's no dedicated scheme marker to write, the scheme is
+// detected by the persisted root node. In the path-based scheme, the layers are
+// rebuilt upon the persisted state, discarding the in-memory layers and state
+// histories, unless the state is the disk layer already.
+func (db *Database) MarkInitialized(genesisRoot common.Hash) error {
+	if db.readOnly.Load() {
+		return ErrReadOnly
+	}
+	if genesisRoot == types.EmptyRootHash || genesisRoot == (common.Hash{}) {
+		return errors.New("empty state can't be initialized")
+	}
+	switch b := db.backend.(type) {
+	case *hashdb.Database:
+		if !b.Initialized(genesisRoot) {
+			return fmt.Errorf("root node %#x is not present", genesisRoot)
+		}
+		return nil
+	case *pathdb.Database:
+		if b.DiskRoot() == genesisRoot {
+			return nil
+		}
+		defer db.top.Store(nil)
+		return b.Reset(genesisRoot)
+	}
+	return ErrNotSupported
+}
+
+// InitializedAny returns the first of the given genesis roots for which the
+// state data is initialized according to the state scheme, e.g. for detecting
+// the network of a database, and whether any of them matched. The path-based
+// scheme doesn't retain the genesis state, hence the candidates are matched
+// against the state root of the persisted genesis header instead, nothing is
+// matched without it.
+func (db *Database) InitializedAny(candidates []common.Hash) (common.Hash, bool) {
+	if db.backend.Scheme() == rawdb.PathScheme {
+		if !db.backend.Initialized(common.Hash{}) {
+			return common.Hash{}, false
+		}
+		header := rawdb.ReadHeader(db.diskdb, rawdb.ReadCanonicalHash(db.diskdb, 0), 0)
+		if header == nil {
+			return common.Hash{}, false
+		}
+		for _, root := range candidates {
+			if root == header.Root {
+				return root, true
+			}
+		}
+		return common.Hash{}, false
+	}
+	for _, root := range candidates {
+		if db.backend.Initialized(root) {
+			return root, true
+		}
+	}
+	return common.Hash{}, false
+}
+
 // Scheme returns the node scheme used in the database.
 func (db *Database) Scheme() string {
 	return db.backend.Scheme()
 }
 
+// HealthStatus is a summary of the trie database's readiness to serve state.
+type HealthStatus struct {
+	Initialized bool               // Whether the backend is constructed and not yet closed
+	DiskRoot    common.Hash        // Root of the most recent state persisted in disk
+	Readable    bool               // Whether the root node of the disk state can be resolved
+	BufferSize  common.StorageSize // Memory held by the not-yet-persisted trie nodes
+	BufferLimit common.StorageSize // Memory allowance of the node buffer, zero if unbounded
+	LastFlush   time.Time          // Time of the most recent write into disk, zero if none
+}
+
+// HealthCheck reports whether the database is usable. It's cheap enough to be
+// invoked frequently, only the root node of the disk state is resolved, which
+// is normally served by the cache. An error is returned alongside the status
+// if any of the checks failed.
+func (db *Database) HealthCheck() (HealthStatus, error) {
+	var status HealthStatus
+	if db.backend == nil || db.closed.Load() {
+		return status, errors.New("database is not initialized")
+	}
+	status.Initialized = true
+	if db.formatErr != nil {
+		return status, db.formatErr
+	}
+	status.DiskRoot = db.backend.DiskRoot()
+	status.LastFlush = db.backend.LastFlush()
+
+	switch b := db.backend.(type) {
+	case *hashdb.Database:
+		status.BufferSize = b.Size()
+	case *pathdb.Database:
+		status.BufferSize, status.BufferLimit = b.BufferSize()
+	}
+	// The empty state and a not yet committed hash-based state are
+	// regarded as readable, as there is nothing to resolve.
+	root := status.DiskRoot
+	if root == (common.Hash{}) || root == types.EmptyRootHash {
+		status.Readable = true
+	} else {
+		reader, err := db.Reader(root)
+		if err != nil {
+			return status, err
+		}
+		blob, err := reader.Node(common.Hash{}, nil, root)
+		if err != nil {
+			return status, err
+		}
+		if len(blob) == 0 {
+			return status, fmt.Errorf("disk root %#x is not readable", root)
+		}
+		status.Readable = true
+	}
+	if status.BufferLimit != 0 && status.BufferSize > status.BufferLimit {
+		return status, fmt.Errorf("node buffer over limit, size: %v, limit: %v", status.BufferSize, status.BufferLimit)
+	}
+	return status, nil
+}
+
+// Truncate wipes all the trie nodes of the active scheme along with the preimages
+// from both memory and disk, and resets the database to the uninitialized state
+// while keeping it open. It's safe to call on an empty database. Note the entire
+// key space of the persistent database is iterated, it's only meant to be used
+// in tests and tools.
+func (db *Database) Truncate() error {
+	if db.readOnly.Load() {
+		return ErrReadOnly
+	}
+	if db.preimages != nil {
+		db.preimages.reset()
+	}
+	if err := deletePreimages(db.diskdb); err != nil {
+		return err
+	}
+	defer db.top.Store(nil)
+	return db.backend.Truncate()
+}
+
+// SwapDiskDB re-points the database at another handle of the persistent
+// database, e.g. a copy migrated onto other storage, without reopening it. The
+// persisted state of the new handle must match the one of the backend. The
+// operations which might flush are waited for and held off meanwhile, but the
+// concurrent reads straight from the persistent database must be quiesced by
+// the caller. The preimages cached in memory are flushed into the new handle
+// later on as usual.
+func (db *Database) SwapDiskDB(diskdb ethdb.Database) error {
+	if db.readOnly.Load() {
+		return ErrReadOnly
+	}
+	db.flushLock.Lock()
+	defer db.flushLock.Unlock()
+	defer db.top.Store(nil)
+
+	var (
+		err       error
+		wal       *walDatabase
+		backenddb = diskdb
+	)
+	if db.wal != nil {
+		wal = newWALDatabase(diskdb, db.wal.wal)
+		backenddb = wal
+	}
+	switch b := db.backend.(type) {
+	case *hashdb.Database:
+		err = b.SwapDiskDB(backenddb)
+	case *pathdb.Database:
+		err = b.SwapDiskDB(backenddb)
+	default:
+		return ErrNotSupported
+	}
+	if err != nil {
+		return err
+	}
+	db.wal = wal
+	if db.preimages != nil {
+		db.preimages.lock.Lock()
+		db.preimages.disk = diskdb
+		db.preimages.lock.Unlock()
+	}
+	db.diskdb = diskdb
+	return nil
+}
+
+// Rehydrate rebuilds the view of the persistent database held by the backend,
+// e.g. when resuming a process which shares the database with another writer.
+// The node format marker is checked again, the clean cache is discarded and,
+// in the path scheme, the disk layer is rebuilt from the state persisted now.
+// An error is returned if an incompatible change is detected, such as another
+// state scheme or node format.
+func (db *Database) Rehydrate() error {
+	if db.readOnly.Load() {
+		return ErrReadOnly
+	}
+	db.flushLock.Lock()
+	defer db.flushLock.Unlock()
+	defer db.top.Store(nil)
+
+	config := db.config
+	if config == nil {
+		config = &Config{}
+	}
+	if err := checkNodeFormat(db.diskdb, config); err != nil {
+		return err
+	}
+	switch b := db.backend.(type) {
+	case *hashdb.Database:
+		return b.Rehydrate()
+	case *pathdb.Database:
+		return b.Rehydrate()
+	}
+	return ErrNotSupported
+}
+
 // Close flushes the dangling preimages to disk and closes the trie database.
 // It is meant to be called when closing the blockchain object, so that all
-// resources held can be released correctly.
+// resources held can be released correctly. The background loops, such as the
+// automatic commits, are terminated first.
 func (db *Database) Close() error {
-	db.WritePreimages()
+	if !db.closed.Swap(true) {
+		close(db.quit)
+	}
+	db.loops.Wait()
+	if db.pinned == (common.Hash{}) {
+		db.WritePreimages()
+	}
 	return db.backend.Close()
 }
 
@@ -245,20 +1410,98 @@ func (db *Database) WritePreimages() {
 	}
 }
 
+// PreimageMetrics contains the statistics of the preimage store.
+type PreimageMetrics struct {
+	Cached    int                // Number of the preimages cached in memory
+	CacheSize common.StorageSize // Storage size of the cached preimages
+	Retained  uint64             // Number of the persisted preimages in the retention window
+	Pruned    uint64             // Number of the preimages pruned since the database was opened
+}
+
+// PreimageMetrics returns the statistics of the preimage store. The persisted
+// preimages are only counted if Config.PreimageRetention is set, as they are
+// only tracked for pruning. Zero metrics are returned if preimages are not
+// recorded.
+func (db *Database) PreimageMetrics() PreimageMetrics {
+	if db.preimages == nil {
+		return PreimageMetrics{}
+	}
+	return db.preimages.metrics()
+}
+
+// CompactPreimages flushes the accumulated preimages and then compacts the
+// preimage keyspace in the persistent database, rewriting it into sorted and
+// compressed tables for faster lookups and range scans. The keyspace layout
+// is left untouched, so the operation can be interrupted at any point without
+// affecting reads, and repeating it is harmless.
+func (db *Database) CompactPreimages() error {
+	if db.readOnly.Load() {
+		return ErrReadOnly
+	}
+	if db.preimages != nil {
+		if err := db.preimages.commit(true); err != nil {
+			return err
+		}
+	}
+	start := time.Now()
+	limit := common.CopyBytes(rawdb.PreimagePrefix)
+	limit[len(limit)-1]++
+	if err := db.diskdb.Compact(rawdb.PreimagePrefix, limit); err != nil {
+		return err
+	}
+	log.Info("Compacted preimage keyspace", "elapsed", common.PrettyDuration(time.Since(start)))
+	return nil
+}
+
+// CompactOwner compacts the key range of the storage trie nodes of the given
+// account in the persistent database, e.g. to reclaim the space taken by the
+// tombstones of a large contract destructed or heavily churned. Only the writes
+// already flushed are covered, thus the state should be committed beforehand.
+// It's only supported by the path-based scheme, where the storage nodes of an
+// account are stored contiguously, ErrNotSupported is returned for others.
+func (db *Database) CompactOwner(owner common.Hash) error {
+	if db.readOnly.Load() {
+		return ErrReadOnly
+	}
+	if db.Scheme() != rawdb.PathScheme {
+		return ErrNotSupported
+	}
+	start := time.Now()
+	from, limit := rawdb.StorageTrieNodeRange(owner)
+	if err := db.diskdb.Compact(from, limit); err != nil {
+		return err
+	}
+	log.Info("Compacted storage trie keyspace", "owner", owner, "elapsed", common.PrettyDuration(time.Since(start)))
+	return nil
+}
+
 // Cap iteratively flushes old but still referenced trie nodes until the total
 // memory usage goes below the given threshold. The held pre-images accumulated
 // up to this point will be flushed in case the size exceeds the threshold.
 //
 // It's only supported by hash-based database and will return an error for others.
 func (db *Database) Cap(limit common.StorageSize) error {
+	if db.readOnly.Load() {
+		return ErrReadOnly
+	}
+	if db.formatErr != nil {
+		return db.formatErr
+	}
 	hdb, ok := db.backend.(*hashdb.Database)
 	if !ok {
-		return errors.New("not supported")
+		return ErrNotSupported
 	}
 	if db.preimages != nil {
 		db.preimages.commit(false)
 	}
-	return hdb.Cap(limit)
+	done := db.startFlush()
+	err := hdb.Cap(limit)
+	done()
+	if err != nil {
+		return err
+	}
+	db.stampNodeFormat()
+	return nil
 }
 
 // Reference adds a new reference from a parent node to a child node. This function
@@ -267,9 +1510,12 @@ func (db *Database) Cap(limit common.StorageSize) error {
 //
 // It's only supported by hash-based database and will return an error for others.
 func (db *Database) Reference(root common.Hash, parent common.Hash) error {
+	if db.readOnly.Load() {
+		return ErrReadOnly
+	}
 	hdb, ok := db.backend.(*hashdb.Database)
 	if !ok {
-		return errors.New("not supported")
+		return ErrNotSupported
 	}
 	hdb.Reference(root, parent)
 	return nil
@@ -278,21 +1524,40 @@ func (db *Database) Reference(root common.Hash, parent common.Hash) error {
 // Dereference removes an existing reference from a root node. It's only
 // supported by hash-based database and will return an error for others.
 func (db *Database) Dereference(root common.Hash) error {
+	if db.readOnly.Load() {
+		return ErrReadOnly
+	}
 	hdb, ok := db.backend.(*hashdb.Database)
 	if !ok {
-		return errors.New("not supported")
+		return ErrNotSupported
 	}
 	hdb.Dereference(root)
 	return nil
 }
 
+// RepairReferences rebuilds the reference counters of the cached nodes from the
+// given live state roots, e.g. after the counters are lost in an unclean
+// shutdown. It's only supported by hash-based database and will return an
+// error for others.
+func (db *Database) RepairReferences(roots []common.Hash) error {
+	if db.readOnly.Load() {
+		return ErrReadOnly
+	}
+	hdb, ok := db.backend.(*hashdb.Database)
+	if !ok {
+		return ErrNotSupported
+	}
+	hdb.RepairReferences(roots)
+	return nil
+}
+
 // Node retrieves the rlp-encoded node blob with provided node hash. It's
 // only supported by hash-based database and will return an error for others.
 // Note, this function should be deprecated once ETH66 is deprecated.
 func (db *Database) Node(hash common.Hash) ([]byte, error) {
 	hdb, ok := db.backend.(*hashdb.Database)
 	if !ok {
-		return nil, errors.New("not supported")
+		return nil, ErrNotSupported
 	}
 	return hdb.Node(hash)
 }
@@ -302,10 +1567,14 @@ func (db *Database) Node(hash common.Hash) ([]byte, error) {
 // corresponding trie histories are existent. It's only supported by path-based
 // database and will return an error for others.
 func (db *Database) Recover(target common.Hash) error {
+	if db.readOnly.Load() {
+		return ErrReadOnly
+	}
 	pdb, ok := db.backend.(*pathdb.Database)
 	if !ok {
-		return errors.New("not supported")
+		return ErrNotSupported
 	}
+	defer db.top.Store(nil)
 	return pdb.Recover(target, &trieLoader{db: db})
 }
 
@@ -315,19 +1584,121 @@ func (db *Database) Recover(target common.Hash) error {
 func (db *Database) Recoverable(root common.Hash) (bool, error) {
 	pdb, ok := db.backend.(*pathdb.Database)
 	if !ok {
-		return false, errors.New("not supported")
+		return false, ErrNotSupported
 	}
 	return pdb.Recoverable(root), nil
 }
 
+// FlattenTo merges all the layers from the disk layer up to and including the
+// specified state into a single disk layer, leaving the newer layers intact.
+// It's only supported by path-based database and will return an error for
+// others.
+func (db *Database) FlattenTo(root common.Hash) error {
+	if db.readOnly.Load() {
+		return ErrReadOnly
+	}
+	pdb, ok := db.backend.(*pathdb.Database)
+	if !ok {
+		return ErrNotSupported
+	}
+	defer db.startFlush()()
+	return pdb.FlattenTo(root)
+}
+
+// PauseFlush holds off the background flushes until the returned function is
+// called, for a window of flush-free read latency. The ticks of the auto-commit
+// loop are skipped, and in the path-based scheme the node buffer isn't flushed
+// once it exceeds the allowance, unless it grows past twice of it. Explicit
+// commits are not affected. The pauses may be nested, the flushing resumes once
+// all of them are released. It's rejected with ErrReadOnly in read-only mode, the
+// returned function is a no-op then.
+func (db *Database) PauseFlush() (resume func(), err error) {
+	if db.readOnly.Load() {
+		return func() {}, ErrReadOnly
+	}
+	db.paused.Add(1)
+
+	var backend func()
+	if pdb, ok := db.backend.(*pathdb.Database); ok {
+		backend = pdb.PauseFlush()
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			if backend != nil {
+				backend()
+			}
+			db.paused.Add(-1)
+		})
+	}, nil
+}
+
+// CheckHistory scans the retained state histories and reports the range of
+// blocks covered along with the block numbers whose history is missing. It's
+// only supported by path-based database and will return an error for others.
+func (db *Database) CheckHistory() (oldest, newest uint64, gaps []uint64, err error) {
+	pdb, ok := db.backend.(*pathdb.Database)
+	if !ok {
+		return 0, 0, nil, ErrNotSupported
+	}
+	return pdb.CheckHistory()
+}
+
+// LastCommittedBlock returns the block number of the state persisted in disk.
+// The hash-based database only knows it if the state was updated through the
+// database since it was opened, ErrNotSupported is returned otherwise.
+func (db *Database) LastCommittedBlock() (uint64, error) {
+	switch b := db.backend.(type) {
+	case *hashdb.Database:
+		block, ok := b.LastCommittedBlock()
+		if !ok {
+			return 0, ErrNotSupported
+		}
+		return block, nil
+	case *pathdb.Database:
+		return b.LastCommittedBlock()
+	}
+	return 0, ErrNotSupported
+}
+
+// PendingDiffStats returns the number and the size of the trie nodes held in
+// memory above the state persisted in disk, i.e. what a crash would lose, along
+// with the range of the blocks they belong to. It's only supported by path-based
+// database and will return ErrNotSupported for others.
+func (db *Database) PendingDiffStats() (nodes int, size common.StorageSize, fromBlock, toBlock uint64, err error) {
+	pdb, ok := db.backend.(*pathdb.Database)
+	if !ok {
+		return 0, 0, 0, 0, ErrNotSupported
+	}
+	return pdb.PendingDiff()
+}
+
+// CountStates returns the number of distinct states the database can currently
+// serve. In the path-based scheme these are the layers held in memory and the
+// states recoverable from the state histories, in the hash-based one they are
+// the states retained in the dirty cache and the most recently committed one.
+func (db *Database) CountStates() (int, error) {
+	switch b := db.backend.(type) {
+	case *hashdb.Database:
+		return b.CountStates(), nil
+	case *pathdb.Database:
+		return b.CountStates()
+	}
+	return 0, ErrNotSupported
+}
+
 // Reset wipes all available journal from the persistent database and discard
 // all caches and diff layers. Using the given root to create a new disk layer.
 // It's only supported by path-based database and will return an error for others.
 func (db *Database) Reset(root common.Hash) error {
+	if db.readOnly.Load() {
+		return ErrReadOnly
+	}
 	pdb, ok := db.backend.(*pathdb.Database)
 	if !ok {
-		return errors.New("not supported")
+		return ErrNotSupported
 	}
+	defer db.top.Store(nil)
 	return pdb.Reset(root)
 }
 
@@ -336,20 +1707,77 @@ func (db *Database) Reset(root common.Hash) error {
 // flattening everything down (bad for reorgs). It's only supported by path-based
 // database and will return an error for others.
 func (db *Database) Journal(root common.Hash) error {
+	if db.readOnly.Load() {
+		return ErrReadOnly
+	}
 	pdb, ok := db.backend.(*pathdb.Database)
 	if !ok {
-		return errors.New("not supported")
+		return ErrNotSupported
 	}
 	return pdb.Journal(root)
 }
 
+// Checkpoint commits all the layers up to the specified state into disk and
+// journals the result in one go, leaving the database writable. A crash in the
+// middle leaves either the old or the new checkpoint behind. It's only supported
+// by path-based database and will return ErrNotSupported for others.
+func (db *Database) Checkpoint(root common.Hash, report bool) error {
+	if db.readOnly.Load() {
+		return ErrReadOnly
+	}
+	pdb, ok := db.backend.(*pathdb.Database)
+	if !ok {
+		return ErrNotSupported
+	}
+	db.committing.Add(1)
+	defer db.committing.Add(-1)
+
+	if db.preimages != nil {
+		db.preimages.commit(true)
+	}
+	defer db.startFlush()()
+	return pdb.Checkpoint(root, report)
+}
+
 // SetBufferSize sets the node buffer size to the provided value(in bytes).
 // It's only supported by path-based database and will return an error for
 // others.
 func (db *Database) SetBufferSize(size int) error {
+	if db.readOnly.Load() {
+		return ErrReadOnly
+	}
 	pdb, ok := db.backend.(*pathdb.Database)
 	if !ok {
-		return errors.New("not supported")
+		return ErrNotSupported
 	}
+	defer db.startFlush()()
 	return pdb.SetBufferSize(size)
 }
+
+// The range of the node buffer sizes applied by SetBufferSizeClamped. Too small
+// a buffer keeps the database flushing all the time, while too large a one risks
+// running out of memory.
+var (
+	MinBufferSize = 4 * 1024 * 1024
+	MaxBufferSize = 256 * 1024 * 1024
+)
+
+// SetBufferSizeClamped is a variant of SetBufferSize which clamps the provided
+// value into the range of MinBufferSize and MaxBufferSize beforehand, and returns
+// the size actually applied.
+func (db *Database) SetBufferSizeClamped(size int) (int, error) {
+	applied := size
+	if applied < MinBufferSize {
+		applied = MinBufferSize
+	}
+	if applied > MaxBufferSize {
+		applied = MaxBufferSize
+	}
+	if applied != size {
+		log.Warn("Clamped node buffer size", "provided", common.StorageSize(size), "applied", common.StorageSize(applied))
+	}
+	if err := db.SetBufferSize(applied); err != nil {
+		return 0, err
+	}
+	return applied, nil
+}
@@ -17,10 +17,28 @@
 package trie
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/metrics"
+	"github.com/ethereum/go-ethereum/rlp"
 	"github.com/ethereum/go-ethereum/trie/triedb/hashdb"
 	"github.com/ethereum/go-ethereum/trie/triedb/pathdb"
+	"github.com/ethereum/go-ethereum/trie/trienode"
+	"github.com/ethereum/go-ethereum/trie/triestate"
 )
 
 // newTestDatabase initializes the trie database with specified scheme.
@@ -33,3 +51,3237 @@ func newTestDatabase(diskdb ethdb.Database, scheme string) *Database {
 	}
 	return db
 }
+
+func TestHealthCheck(t *testing.T) {
+	testHealthCheck(t, rawdb.HashScheme)
+	testHealthCheck(t, rawdb.PathScheme)
+}
+
+func testHealthCheck(t *testing.T, scheme string) {
+	db := newTestDatabase(rawdb.NewMemoryDatabase(), scheme)
+	if _, err := db.HealthCheck(); err != nil {
+		t.Fatalf("Unexpected error on empty database: %v", err)
+	}
+	trie := NewEmpty(db)
+	updateString(trie, "120000", "qwerqwerqwerqwerqwerqwerqwerqwer")
+	updateString(trie, "123456", "asdfasdfasdfasdfasdfasdfasdfasdf")
+	root, nodes, _ := trie.Commit(false)
+	db.Update(root, types.EmptyRootHash, 0, trienode.NewWithNodeSet(nodes), nil)
+	if err := db.Commit(root, false); err != nil {
+		t.Fatalf("Failed to commit trie: %v", err)
+	}
+	status, err := db.HealthCheck()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !status.Initialized || !status.Readable {
+		t.Fatalf("Unexpected status: %+v", status)
+	}
+	if status.DiskRoot != root {
+		t.Fatalf("Unexpected disk root, want: %x, got: %x", root, status.DiskRoot)
+	}
+	if status.LastFlush.IsZero() {
+		t.Fatal("Flush time is not tracked")
+	}
+	db.Close()
+	if _, err := db.HealthCheck(); err == nil {
+		t.Fatal("Expected error on closed database")
+	}
+}
+
+func TestCompactPreimages(t *testing.T) {
+	diskdb := rawdb.NewMemoryDatabase()
+	db := NewDatabase(diskdb, &Config{Preimages: true})
+
+	preimages := map[common.Hash][]byte{
+		common.HexToHash("0x01"): []byte("foo"),
+		common.HexToHash("0x02"): []byte("bar"),
+	}
+	db.preimages.insertPreimage(preimages)
+	for i := 0; i < 2; i++ {
+		if err := db.CompactPreimages(); err != nil {
+			t.Fatalf("Failed to compact preimages: %v", err)
+		}
+		for hash, want := range preimages {
+			if got := rawdb.ReadPreimage(diskdb, hash); !bytes.Equal(got, want) {
+				t.Fatalf("Preimage mismatch, want: %x, got: %x", want, got)
+			}
+		}
+	}
+}
+
+func TestWithMetrics(t *testing.T) {
+	var cases = []struct {
+		scheme string
+		metric string
+	}{
+		{rawdb.HashScheme, "hashdb/memcache/dirty/write"},
+		{rawdb.PathScheme, "pathdb/dirty/write"},
+	}
+	for _, c := range cases {
+		reg := metrics.NewRegistry()
+		newTestDatabase(rawdb.NewMemoryDatabase(), c.scheme).WithMetrics(reg)
+		if reg.Get(c.metric) == nil {
+			t.Fatalf("Metric %q is not registered in the provided registry", c.metric)
+		}
+	}
+	// The persisted preimages are counted in the provided registry as well
+	reg := metrics.NewRegistry()
+	db := NewDatabase(rawdb.NewMemoryDatabase(), &Config{Preimages: true}).WithMetrics(reg)
+	db.preimages.insertPreimage(map[common.Hash][]byte{{0x1}: {0x1}})
+	db.WritePreimages()
+	if reg.Get("db/preimage/total") == nil {
+		t.Fatal("Preimage metrics are not registered in the provided registry")
+	}
+}
+
+func TestPrewarm(t *testing.T) {
+	testPrewarm(t, rawdb.HashScheme)
+	testPrewarm(t, rawdb.PathScheme)
+}
+
+func testPrewarm(t *testing.T, scheme string) {
+	db := newTestDatabase(rawdb.NewMemoryDatabase(), scheme)
+	trie := NewEmpty(db)
+	updateString(trie, "120000", "qwerqwerqwerqwerqwerqwerqwerqwer")
+	updateString(trie, "123456", "asdfasdfasdfasdfasdfasdfasdfasdf")
+	root, nodes, _ := trie.Commit(false)
+	db.Update(root, types.EmptyRootHash, 0, trienode.NewWithNodeSet(nodes), nil)
+	if err := db.Commit(root, false); err != nil {
+		t.Fatalf("Failed to commit trie: %v", err)
+	}
+	keys := [][]byte{[]byte("120000"), []byte("123456"), []byte("999999")}
+	if err := db.Prewarm(root, keys); err != nil {
+		t.Fatalf("Failed to prewarm: %v", err)
+	}
+	if err := db.Prewarm(common.Hash{0x1}, keys); err == nil {
+		t.Fatal("Expected error for unknown state")
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	testTruncate(t, rawdb.HashScheme)
+	testTruncate(t, rawdb.PathScheme)
+}
+
+func testTruncate(t *testing.T, scheme string) {
+	diskdb := rawdb.NewMemoryDatabase()
+	db := newTestDatabase(diskdb, scheme)
+	if err := db.Truncate(); err != nil {
+		t.Fatalf("Failed to truncate empty database: %v", err)
+	}
+	trie := NewEmpty(db)
+	updateString(trie, "120000", "qwerqwerqwerqwerqwerqwerqwerqwer")
+	updateString(trie, "123456", "asdfasdfasdfasdfasdfasdfasdfasdf")
+	root, nodes, _ := trie.Commit(false)
+	db.Update(root, types.EmptyRootHash, 0, trienode.NewWithNodeSet(nodes), nil)
+	if err := db.Commit(root, false); err != nil {
+		t.Fatalf("Failed to commit trie: %v", err)
+	}
+	if !db.Initialized(root) {
+		t.Fatal("Database is not initialized")
+	}
+	if err := db.Truncate(); err != nil {
+		t.Fatalf("Failed to truncate database: %v", err)
+	}
+	if db.Initialized(root) {
+		t.Fatal("Database is still initialized")
+	}
+	if _, err := New(TrieID(root), db); err == nil {
+		t.Fatal("Truncated state is still accessible")
+	}
+	for _, n := range nodes.Nodes {
+		if rawdb.HasLegacyTrieNode(diskdb, n.Hash) {
+			t.Fatalf("Trie node %x is not deleted", n.Hash)
+		}
+	}
+}
+
+func TestCommitOrder(t *testing.T) {
+	for _, order := range []trienode.CommitOrder{trienode.Unordered, trienode.StorageFirst, trienode.AccountFirst} {
+		testCommitOrder(t, rawdb.HashScheme, order)
+		testCommitOrder(t, rawdb.PathScheme, order)
+	}
+}
+
+func testCommitOrder(t *testing.T, scheme string, order trienode.CommitOrder) {
+	config := &Config{CommitOrder: order}
+	if scheme == rawdb.HashScheme {
+		config.HashDB = &hashdb.Config{}
+	} else {
+		config.PathDB = &pathdb.Config{}
+	}
+	diskdb := rawdb.NewMemoryDatabase()
+	db := NewDatabase(diskdb, config)
+
+	owner := common.HexToHash("0xdeadbeef")
+	storage, _ := New(StorageTrieID(types.EmptyRootHash, owner, types.EmptyRootHash), db)
+	updateString(storage, "120000", "qwerqwerqwerqwerqwerqwerqwerqwer")
+	updateString(storage, "123456", "asdfasdfasdfasdfasdfasdfasdfasdf")
+	storageRoot, storageNodes, _ := storage.Commit(false)
+
+	account := NewEmpty(db)
+	blob, _ := rlp.EncodeToBytes(&types.StateAccount{Balance: big.NewInt(1), Root: storageRoot, CodeHash: types.EmptyCodeHash.Bytes()})
+	account.MustUpdate(owner.Bytes(), blob)
+	root, accountNodes, _ := account.Commit(true)
+
+	set := trienode.NewWithNodeSet(accountNodes)
+	set.Merge(storageNodes)
+	if err := db.Update(root, types.EmptyRootHash, 0, set, nil); err != nil {
+		t.Fatalf("Failed to update database: %v", err)
+	}
+	if err := db.Commit(root, false); err != nil {
+		t.Fatalf("Failed to commit state (%s, %v): %v", scheme, order, err)
+	}
+	for _, n := range accountNodes.Nodes {
+		if n.IsDeleted() {
+			continue
+		}
+		if scheme == rawdb.HashScheme && !rawdb.HasLegacyTrieNode(diskdb, n.Hash) {
+			t.Fatalf("Account trie node %x is not persisted (%v)", n.Hash, order)
+		}
+	}
+	for _, n := range storageNodes.Nodes {
+		if n.IsDeleted() {
+			continue
+		}
+		if scheme == rawdb.HashScheme && !rawdb.HasLegacyTrieNode(diskdb, n.Hash) {
+			t.Fatalf("Storage trie node %x is not persisted (%v)", n.Hash, order)
+		}
+	}
+	tr, err := New(StorageTrieID(root, owner, storageRoot), db)
+	if err != nil {
+		t.Fatalf("Failed to open storage trie (%s, %v): %v", scheme, order, err)
+	}
+	if got, _ := tr.Get([]byte("123456")); string(got) != "asdfasdfasdfasdfasdfasdfasdfasdf" {
+		t.Fatalf("Unexpected storage value (%s, %v): %q", scheme, order, got)
+	}
+}
+
+func TestSampleNodes(t *testing.T) {
+	testSampleNodes(t, rawdb.HashScheme)
+	testSampleNodes(t, rawdb.PathScheme)
+}
+
+func testSampleNodes(t *testing.T, scheme string) {
+	db := newTestDatabase(rawdb.NewMemoryDatabase(), scheme)
+	trie := NewEmpty(db)
+	for i := 0; i < 256; i++ {
+		key := crypto.Keccak256([]byte{byte(i)})
+		trie.MustUpdate(key, bytes.Repeat([]byte{byte(i)}, 32))
+	}
+	root, nodes, _ := trie.Commit(false)
+	db.Update(root, types.EmptyRootHash, 0, trienode.NewWithNodeSet(nodes), nil)
+
+	samples, err := db.SampleNodes(root, 16, 1)
+	if err != nil {
+		t.Fatalf("Failed to sample nodes: %v", err)
+	}
+	var leaves int
+	for _, s := range samples {
+		if s.Depth == 0 && (s.Hash != root || len(s.Path) != 0) {
+			t.Fatalf("Unexpected root sample: %v", s)
+		}
+		if s.Type == LeafNode {
+			leaves++
+		}
+	}
+	if leaves != 16 {
+		t.Fatalf("Unexpected number of descents: have %d, want 16", leaves)
+	}
+	again, err := db.SampleNodes(root, 16, 1)
+	if err != nil {
+		t.Fatalf("Failed to sample nodes: %v", err)
+	}
+	if !reflect.DeepEqual(samples, again) {
+		t.Fatal("Samples with the same seed are not deterministic")
+	}
+}
+
+func TestNodesAlongPath(t *testing.T) {
+	db := newTestDatabase(rawdb.NewMemoryDatabase(), rawdb.PathScheme)
+	trie := NewEmpty(db)
+	for i := 0; i < 256; i++ {
+		key := crypto.Keccak256([]byte{byte(i)})
+		trie.MustUpdate(key, bytes.Repeat([]byte{byte(i)}, 32))
+	}
+	root, nodes, _ := trie.Commit(false)
+	db.Update(root, types.EmptyRootHash, 0, trienode.NewWithNodeSet(nodes), nil)
+
+	key := crypto.Keccak256([]byte{0})
+	path, err := db.NodesAlongPath(root, key)
+	if err != nil {
+		t.Fatalf("Failed to collect nodes: %v", err)
+	}
+	proof, err := db.Prove(root, key)
+	if err != nil {
+		t.Fatalf("Failed to prove key: %v", err)
+	}
+	if len(path) != len(proof) || path[0].Hash != root || path[len(path)-1].Kind != LeafNode {
+		t.Fatalf("Unexpected nodes along path: %v", path)
+	}
+	for i, n := range path {
+		if n.Depth != i || !bytes.Equal(n.Blob, proof[i]) || crypto.Keccak256Hash(n.Blob) != n.Hash {
+			t.Fatalf("Unexpected node %d along path: %v", i, n)
+		}
+	}
+	// The path of an absent key stops where it diverges.
+	absent := crypto.Keccak256([]byte("absent"))
+	path, err = db.NodesAlongPath(root, absent)
+	if err != nil {
+		t.Fatalf("Failed to collect nodes: %v", err)
+	}
+	if len(path) == 0 || len(path) > len(proof)+1 {
+		t.Fatalf("Unexpected nodes along path of absent key: %v", path)
+	}
+	for _, n := range path {
+		if !bytes.HasPrefix(keybytesToHex(absent), n.Path) {
+			t.Fatalf("Node off the path of absent key: %v", n)
+		}
+	}
+}
+
+func TestDeltaSize(t *testing.T) {
+	testDeltaSize(t, rawdb.HashScheme)
+	testDeltaSize(t, rawdb.PathScheme)
+}
+
+func testDeltaSize(t *testing.T, scheme string) {
+	db := newTestDatabase(rawdb.NewMemoryDatabase(), scheme)
+	if size := db.DeltaSize(); size != 0 {
+		t.Fatalf("Unexpected delta size of empty database: %v", size)
+	}
+	trie := NewEmpty(db)
+	updateString(trie, "120000", "qwerqwerqwerqwerqwerqwerqwerqwer")
+	updateString(trie, "123456", "asdfasdfasdfasdfasdfasdfasdfasdf")
+	root, nodes, _ := trie.Commit(false)
+	db.Update(root, types.EmptyRootHash, 0, trienode.NewWithNodeSet(nodes), nil)
+	if size := db.DeltaSize(); size == 0 {
+		t.Fatal("Delta size is not accumulated")
+	}
+	if err := db.Commit(root, false); err != nil {
+		t.Fatalf("Failed to commit trie: %v", err)
+	}
+	if size := db.DeltaSize(); size != 0 {
+		t.Fatalf("Unexpected delta size after commit: %v", size)
+	}
+}
+
+func TestDetectScheme(t *testing.T) {
+	diskdb := rawdb.NewMemoryDatabase()
+	if scheme, err := DetectScheme(diskdb); scheme != "" || err != nil {
+		t.Fatalf("Unexpected scheme of empty database: %q, %v", scheme, err)
+	}
+	if SchemeInitialized(diskdb) {
+		t.Fatal("Empty database is initialized")
+	}
+	db := newTestDatabase(diskdb, rawdb.PathScheme)
+	trie := NewEmpty(db)
+	updateString(trie, "120000", "qwerqwerqwerqwerqwerqwerqwerqwer")
+	root, nodes, _ := trie.Commit(false)
+	db.Update(root, types.EmptyRootHash, 0, trienode.NewWithNodeSet(nodes), nil)
+	if err := db.Commit(root, false); err != nil {
+		t.Fatalf("Failed to commit trie: %v", err)
+	}
+	if scheme, err := DetectScheme(diskdb); scheme != rawdb.PathScheme || err != nil {
+		t.Fatalf("Unexpected scheme: %q, %v", scheme, err)
+	}
+	if !SchemeInitialized(diskdb) {
+		t.Fatal("Database is not initialized")
+	}
+}
+
+func TestRepairReferences(t *testing.T) {
+	db := newTestDatabase(rawdb.NewMemoryDatabase(), rawdb.HashScheme)
+	trie := NewEmpty(db)
+	updateString(trie, "120000", "qwerqwerqwerqwerqwerqwerqwerqwer")
+	updateString(trie, "123456", "asdfasdfasdfasdfasdfasdfasdfasdf")
+	root1, nodes, _ := trie.Commit(false)
+	db.Update(root1, types.EmptyRootHash, 0, trienode.NewWithNodeSet(nodes), nil)
+
+	trie, _ = New(TrieID(root1), db)
+	updateString(trie, "123456", "zxcvzxcvzxcvzxcvzxcvzxcvzxcvzxcv")
+	root2, nodes, _ := trie.Commit(false)
+	db.Update(root2, root1, 1, trienode.NewWithNodeSet(nodes), nil)
+
+	// Reference the first root twice, the counters should be rebuilt
+	// regardless of the existing references.
+	db.Reference(root1, common.Hash{})
+	db.Reference(root1, common.Hash{})
+	if err := db.RepairReferences([]common.Hash{root1, root2}); err != nil {
+		t.Fatalf("Failed to repair references: %v", err)
+	}
+	db.Dereference(root1)
+	if _, err := New(TrieID(root2), db); err != nil {
+		t.Fatalf("Live state is pruned: %v", err)
+	}
+	db.Dereference(root2)
+	if size, _ := db.Size(); size != 0 {
+		t.Fatalf("Unexpected dirty cache size: %v", size)
+	}
+	pdb := newTestDatabase(rawdb.NewMemoryDatabase(), rawdb.PathScheme)
+	if err := pdb.RepairReferences(nil); err == nil {
+		t.Fatal("Expected error for path-based scheme")
+	}
+}
+
+func TestRequireStates(t *testing.T) {
+	for _, scheme := range []string{rawdb.HashScheme, rawdb.PathScheme} {
+		db := newTestDatabase(rawdb.NewMemoryDatabase(), scheme)
+		db.config = &Config{RequireStates: true}
+
+		trie := NewEmpty(db)
+		updateString(trie, "120000", "qwerqwerqwerqwerqwerqwerqwerqwer")
+		root, nodes, _ := trie.Commit(false)
+		err := db.Update(root, types.EmptyRootHash, 0, trienode.NewWithNodeSet(nodes), nil)
+		if scheme == rawdb.PathScheme && !errors.Is(err, ErrMissingStates) {
+			t.Fatalf("Unexpected error, want: %v, got: %v", ErrMissingStates, err)
+		}
+		if scheme == rawdb.HashScheme && err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+}
+
+func TestReopen(t *testing.T) {
+	diskdb := rawdb.NewMemoryDatabase()
+	db := NewDatabase(diskdb, &Config{PathDB: &pathdb.Config{}})
+
+	trie := NewEmpty(db)
+	updateString(trie, "120000", "qwerqwerqwerqwerqwerqwerqwerqwer")
+	root, nodes, _ := trie.Commit(false)
+	db.Update(root, types.EmptyRootHash, 0, trienode.NewWithNodeSet(nodes), nil)
+	if err := db.Commit(root, false); err != nil {
+		t.Fatalf("Failed to commit trie: %v", err)
+	}
+	// Reopen the database with the scheme detected from disk
+	if err := db.Reopen(nil); err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	if scheme := db.Scheme(); scheme != rawdb.PathScheme {
+		t.Fatalf("Unexpected scheme, want: %s, got: %s", rawdb.PathScheme, scheme)
+	}
+	if _, err := New(TrieID(root), db); err != nil {
+		t.Fatalf("Failed to open trie after reopen: %v", err)
+	}
+	// Reopen the database with the explicitly specified scheme
+	if err := db.Reopen(&Config{HashDB: &hashdb.Config{}}); err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	if scheme := db.Scheme(); scheme != rawdb.HashScheme {
+		t.Fatalf("Unexpected scheme, want: %s, got: %s", rawdb.HashScheme, scheme)
+	}
+	// Reopen the database with a write-ahead log, the record left behind is
+	// replayed and the writes of the new backend are logged.
+	wal := rawdb.NewMemoryDatabase()
+	blob, _ := rlp.EncodeToBytes([]walEntry{{Key: []byte("a"), Value: []byte("b")}})
+	wal.Put(walKey(1), blob)
+	db.Update(root, types.EmptyRootHash, 0, trienode.NewWithNodeSet(nodes), nil)
+	if db.lastUpdate.Load() == nil {
+		t.Fatal("Last update is not tracked")
+	}
+	if err := db.Reopen(&Config{HashDB: &hashdb.Config{}, WAL: wal}); err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	if value, _ := diskdb.Get([]byte("a")); !bytes.Equal(value, []byte("b")) {
+		t.Fatal("Write-ahead log is not replayed on reopen")
+	}
+	if db.wal == nil {
+		t.Fatal("Write-ahead log is not wrapped around the backend")
+	}
+	if db.lastUpdate.Load() != nil || db.top.Load() != nil {
+		t.Fatal("Derived state of the old backend is retained")
+	}
+	// Reopen the database without the write-ahead log
+	if err := db.Reopen(&Config{HashDB: &hashdb.Config{}}); err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	if db.wal != nil {
+		t.Fatal("Write-ahead log is retained")
+	}
+}
+
+func TestOrphanScan(t *testing.T) {
+	testOrphanScan(t, rawdb.HashScheme)
+	testOrphanScan(t, rawdb.PathScheme)
+}
+
+func testOrphanScan(t *testing.T, scheme string) {
+	db := newTestDatabase(rawdb.NewMemoryDatabase(), scheme)
+	account := func(balance int64) []byte {
+		blob, _ := rlp.EncodeToBytes(&types.StateAccount{Balance: big.NewInt(balance), Root: types.EmptyRootHash, CodeHash: types.EmptyCodeHash.Bytes()})
+		return blob
+	}
+	trie := NewEmpty(db)
+	for i := 0; i < 16; i++ {
+		trie.MustUpdate(crypto.Keccak256([]byte{byte(i)}), account(int64(i)))
+	}
+	root1, nodes, _ := trie.Commit(false)
+	db.Update(root1, types.EmptyRootHash, 0, trienode.NewWithNodeSet(nodes), nil)
+	if err := db.Commit(root1, false); err != nil {
+		t.Fatalf("Failed to commit trie: %v", err)
+	}
+	trie, _ = New(TrieID(root1), db)
+	trie.MustUpdate(crypto.Keccak256([]byte{0}), account(100))
+	root2, nodes, _ := trie.Commit(false)
+	db.Update(root2, root1, 1, trienode.NewWithNodeSet(nodes), nil)
+	if err := db.Commit(root2, false); err != nil {
+		t.Fatalf("Failed to commit trie: %v", err)
+	}
+	orphans, size, err := db.OrphanScan([]common.Hash{root2})
+	if err != nil {
+		t.Fatalf("Failed to scan orphans: %v", err)
+	}
+	// The stale nodes are left in the hash scheme, while they are
+	// overwritten in place in the path scheme.
+	if scheme == rawdb.HashScheme && (orphans == 0 || size == 0) {
+		t.Fatal("Stale nodes are not reported as orphans")
+	}
+	if scheme == rawdb.PathScheme && orphans != 0 {
+		t.Fatalf("Unexpected orphans: %d", orphans)
+	}
+	if scheme == rawdb.HashScheme {
+		if orphans, _, _ := db.OrphanScan([]common.Hash{root1, root2}); orphans != 0 {
+			t.Fatalf("Unexpected orphans with all roots live: %d", orphans)
+		}
+	}
+}
+
+func TestWriteThrough(t *testing.T) {
+	for _, scheme := range []string{rawdb.HashScheme, rawdb.PathScheme} {
+		diskdb := rawdb.NewMemoryDatabase()
+		db := newTestDatabase(diskdb, scheme)
+		db.config = &Config{WriteThrough: true}
+
+		trie := NewEmpty(db)
+		updateString(trie, "120000", "qwerqwerqwerqwerqwerqwerqwerqwer")
+		updateString(trie, "123456", "asdfasdfasdfasdfasdfasdfasdfasdf")
+		root, nodes, _ := trie.Commit(false)
+		if err := db.Update(root, types.EmptyRootHash, 0, trienode.NewWithNodeSet(nodes), nil); err != nil {
+			t.Fatalf("Failed to update database: %v", err)
+		}
+		if size, _ := db.Size(); size != 0 {
+			t.Fatalf("Unexpected dirty size in write-through mode (%s): %v", scheme, size)
+		}
+		if db.backend.DiskRoot() != root {
+			t.Fatalf("State is not persisted (%s)", scheme)
+		}
+	}
+}
+
+func TestStreamAccounts(t *testing.T) {
+	db := newTestDatabase(rawdb.NewMemoryDatabase(), rawdb.HashScheme)
+
+	owner := common.HexToHash("0xdeadbeef")
+	storage, _ := New(StorageTrieID(types.EmptyRootHash, owner, types.EmptyRootHash), db)
+	updateString(storage, "120000", "qwerqwerqwerqwerqwerqwerqwerqwer")
+	updateString(storage, "123456", "asdfasdfasdfasdfasdfasdfasdfasdf")
+	storageRoot, storageNodes, _ := storage.Commit(false)
+
+	account := NewEmpty(db)
+	for i, acct := range []*types.StateAccount{
+		{Balance: big.NewInt(1), Root: storageRoot, CodeHash: types.EmptyCodeHash.Bytes()},
+		{Balance: big.NewInt(2), Root: types.EmptyRootHash, CodeHash: types.EmptyCodeHash.Bytes()},
+	} {
+		key := owner.Bytes()
+		if i > 0 {
+			key = common.HexToHash("0xcafe").Bytes()
+		}
+		blob, _ := rlp.EncodeToBytes(acct)
+		account.MustUpdate(key, blob)
+	}
+	root, accountNodes, _ := account.Commit(true)
+	set := trienode.NewWithNodeSet(accountNodes)
+	set.Merge(storageNodes)
+	db.Update(root, types.EmptyRootHash, 0, set, nil)
+
+	var accounts, slots int
+	err := db.StreamAccounts(root, func(accHash common.Hash, acc []byte, storageRoot common.Hash) error {
+		accounts++
+		return db.StreamStorage(root, accHash, storageRoot, func(key []byte, value []byte) error {
+			slots++
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatalf("Failed to stream accounts: %v", err)
+	}
+	if accounts != 2 || slots != 2 {
+		t.Fatalf("Unexpected items, accounts: %d, slots: %d", accounts, slots)
+	}
+	stop := errors.New("stop")
+	if err := db.StreamAccounts(root, func(common.Hash, []byte, common.Hash) error { return stop }); err != stop {
+		t.Fatalf("Unexpected error, want: %v, got: %v", stop, err)
+	}
+}
+
+func TestLockStats(t *testing.T) {
+	for _, scheme := range []string{rawdb.HashScheme, rawdb.PathScheme} {
+		for _, track := range []bool{false, true} {
+			config := &Config{TrackLocks: track, HashDB: &hashdb.Config{}}
+			if scheme == rawdb.PathScheme {
+				config = &Config{TrackLocks: track, PathDB: &pathdb.Config{}}
+			}
+			db := NewDatabase(rawdb.NewMemoryDatabase(), config)
+
+			trie := NewEmpty(db)
+			updateString(trie, "120000", "qwerqwerqwerqwerqwerqwerqwerqwer")
+			updateString(trie, "123456", "asdfasdfasdfasdfasdfasdfasdfasdf")
+			root, nodes, _ := trie.Commit(false)
+			if err := db.Update(root, types.EmptyRootHash, 0, trienode.NewWithNodeSet(nodes), nil); err != nil {
+				t.Fatalf("Failed to update database: %v", err)
+			}
+			if err := db.Commit(root, false); err != nil {
+				t.Fatalf("Failed to commit database: %v", err)
+			}
+			stats := db.LockStats()
+			if !track && stats.Acquired != 0 {
+				t.Fatalf("Untracked lock reported acquisitions (%s): %d", scheme, stats.Acquired)
+			}
+			if track && stats.Acquired == 0 {
+				t.Fatalf("Tracked lock reported no acquisitions (%s)", scheme)
+			}
+			if stats.MaxWait > stats.Wait {
+				t.Fatalf("Maximum wait exceeds the total (%s): %v > %v", scheme, stats.MaxWait, stats.Wait)
+			}
+		}
+	}
+}
+
+func TestOnMissingNode(t *testing.T) {
+	testOnMissingNode(t, false)
+	testOnMissingNode(t, true)
+}
+
+func testOnMissingNode(t *testing.T, archived bool) {
+	diskdb := rawdb.NewMemoryDatabase()
+	db := newTestDatabase(diskdb, rawdb.HashScheme)
+
+	trie := NewEmpty(db)
+	updateString(trie, "a1", "qwerqwerqwerqwerqwerqwerqwerqwer")
+	updateString(trie, "b1", "asdfasdfasdfasdfasdfasdfasdfasdf")
+	updateString(trie, "c1", "zxcvzxcvzxcvzxcvzxcvzxcvzxcvzxcv")
+	root, nodes, _ := trie.Commit(false)
+	if err := db.Update(root, types.EmptyRootHash, 0, trienode.NewWithNodeSet(nodes), nil); err != nil {
+		t.Fatalf("Failed to update database: %v", err)
+	}
+	if err := db.Commit(root, false); err != nil {
+		t.Fatalf("Failed to commit database: %v", err)
+	}
+	// Modify one of the leaves, leaving the others referenced from disk.
+	trie, _ = New(TrieID(root), db)
+	updateString(trie, "a1", "poiupoiupoiupoiupoiupoiupoiupoiu")
+	updated, nodes, _ := trie.Commit(false)
+
+	// Wipe one of the untouched nodes referenced by the modified ones from disk.
+	modified := make(map[common.Hash]bool)
+	for _, n := range nodes.Nodes {
+		modified[n.Hash] = true
+	}
+	var lost common.Hash
+	for _, n := range nodes.Nodes {
+		mptResolver{}.ForEach(n.Blob, func(hash common.Hash) {
+			if !modified[hash] {
+				lost = hash
+			}
+		})
+	}
+	blob := rawdb.ReadLegacyTrieNode(diskdb, lost)
+	if len(blob) == 0 {
+		t.Fatalf("Untouched node %x is not persisted", lost)
+	}
+	rawdb.DeleteLegacyTrieNode(diskdb, lost)
+
+	// Nodes moved into the archive are not missing, only stored elsewhere
+	if archived {
+		rawdb.WriteArchivedTrieNodeNumber(diskdb, lost, 0)
+	}
+	var requested []common.Hash
+	db.backend = hashdb.New(diskdb, &hashdb.Config{OnMissingNode: func(owner common.Hash, path []byte, hash common.Hash) ([]byte, error) {
+		requested = append(requested, hash)
+		if hash != lost {
+			return nil, errors.New("unknown node")
+		}
+		return blob, nil
+	}}, mptResolver{})
+	if err := db.Update(updated, root, 0, trienode.NewWithNodeSet(nodes), nil); err != nil {
+		t.Fatalf("Failed to update database: %v", err)
+	}
+	if err := db.Commit(updated, false); err != nil {
+		t.Fatalf("Failed to commit database: %v", err)
+	}
+	if archived {
+		if len(requested) != 0 {
+			t.Fatalf("Unexpected missing node requests: %v", requested)
+		}
+		return
+	}
+	if len(requested) != 1 || requested[0] != lost {
+		t.Fatalf("Unexpected missing node requests: %v", requested)
+	}
+	if !rawdb.HasLegacyTrieNode(diskdb, lost) {
+		t.Fatal("Missing node is not healed")
+	}
+}
+
+// testReplicator records all the replicated writes.
+type testReplicator map[string][]byte
+
+func (r testReplicator) Replicate(key, value []byte) {
+	r[string(key)] = common.CopyBytes(value)
+}
+
+func TestReplicator(t *testing.T) {
+	for _, scheme := range []string{rawdb.HashScheme, rawdb.PathScheme} {
+		var (
+			diskdb   = rawdb.NewMemoryDatabase()
+			replica  = make(testReplicator)
+			config   = &Config{Preimages: true, Replicator: replica, HashDB: &hashdb.Config{}}
+			preimage = []byte("preimage")
+		)
+		if scheme == rawdb.PathScheme {
+			config = &Config{Preimages: true, Replicator: replica, PathDB: &pathdb.Config{}}
+		}
+		db := NewDatabase(diskdb, config)
+		db.preimages.insertPreimage(map[common.Hash][]byte{crypto.Keccak256Hash(preimage): preimage})
+
+		trie := NewEmpty(db)
+		updateString(trie, "120000", "qwerqwerqwerqwerqwerqwerqwerqwer")
+		updateString(trie, "123456", "asdfasdfasdfasdfasdfasdfasdfasdf")
+		root, nodes, _ := trie.Commit(false)
+		if err := db.Update(root, types.EmptyRootHash, 0, trienode.NewWithNodeSet(nodes), nil); err != nil {
+			t.Fatalf("Failed to update database: %v", err)
+		}
+		if err := db.Commit(root, false); err != nil {
+			t.Fatalf("Failed to commit database: %v", err)
+		}
+		if len(replica) < len(nodes.Nodes)+1 {
+			t.Fatalf("Too few writes replicated (%s): have %d, want at least %d", scheme, len(replica), len(nodes.Nodes)+1)
+		}
+		if !bytes.Equal(rawdb.ReadPreimage(diskdb, crypto.Keccak256Hash(preimage)), preimage) {
+			t.Fatalf("Preimage is not persisted (%s)", scheme)
+		}
+		for key, value := range replica {
+			blob, err := diskdb.Get([]byte(key))
+			if err != nil {
+				t.Fatalf("Replicated key %x is not persisted (%s): %v", key, scheme, err)
+			}
+			if !bytes.Equal(blob, value) {
+				t.Fatalf("Replicated value mismatch for %x (%s)", key, scheme)
+			}
+		}
+	}
+}
+
+func TestShrink(t *testing.T) {
+	diskdb := rawdb.NewMemoryDatabase()
+	db := newTestDatabase(diskdb, rawdb.HashScheme)
+	db.backend = hashdb.New(diskdb, &hashdb.Config{CleanCacheSize: 1024 * 1024}, mptResolver{})
+
+	trie := NewEmpty(db)
+	updateString(trie, "120000", "qwerqwerqwerqwerqwerqwerqwerqwer")
+	updateString(trie, "123456", "asdfasdfasdfasdfasdfasdfasdfasdf")
+	root, nodes, _ := trie.Commit(false)
+	if err := db.Update(root, types.EmptyRootHash, 0, trienode.NewWithNodeSet(nodes), nil); err != nil {
+		t.Fatalf("Failed to update database: %v", err)
+	}
+	if err := db.Commit(root, false); err != nil {
+		t.Fatalf("Failed to commit database: %v", err)
+	}
+	if released := db.Shrink(); released == 0 {
+		t.Fatal("Nothing is released")
+	}
+	if released := db.Shrink(); released != 0 {
+		t.Fatalf("Released twice: %v", released)
+	}
+	trie, err := New(TrieID(root), db)
+	if err != nil {
+		t.Fatalf("Failed to open trie: %v", err)
+	}
+	if val, _ := trie.Get([]byte("123456")); string(val) != "asdfasdfasdfasdfasdfasdfasdfasdf" {
+		t.Fatalf("Unexpected value after shrink: %q", val)
+	}
+}
+
+func TestVerifyRoot(t *testing.T) {
+	for _, scheme := range []string{rawdb.HashScheme, rawdb.PathScheme} {
+		diskdb := rawdb.NewMemoryDatabase()
+		db := newTestDatabase(diskdb, scheme)
+
+		trie := NewEmpty(db)
+		updateString(trie, "120000", "qwerqwerqwerqwerqwerqwerqwerqwer")
+		updateString(trie, "123456", "asdfasdfasdfasdfasdfasdfasdfasdf")
+		root, nodes, _ := trie.Commit(false)
+		if err := db.Update(root, types.EmptyRootHash, 0, trienode.NewWithNodeSet(nodes), nil); err != nil {
+			t.Fatalf("Failed to update database: %v", err)
+		}
+		if err := db.Commit(root, false); err != nil {
+			t.Fatalf("Failed to commit database: %v", err)
+		}
+		if have, err := db.VerifyRoot(); err != nil || have != root {
+			t.Fatalf("Failed to verify root (%s): have %x, want %x, err %v", scheme, have, root, err)
+		}
+		// Corrupt the root node on disk
+		if scheme == rawdb.HashScheme {
+			rawdb.WriteLegacyTrieNode(diskdb, root, []byte{0x1})
+		} else {
+			rawdb.WriteAccountTrieNode(diskdb, nil, []byte{0x1})
+		}
+		if _, err := db.VerifyRoot(); err == nil {
+			t.Fatalf("Corrupted root is not detected (%s)", scheme)
+		}
+	}
+}
+
+// testCleanCache is a map based clean cache.
+type testCleanCache struct {
+	lock    sync.Mutex
+	entries map[string][]byte
+}
+
+func (c *testCleanCache) Get(key []byte) []byte {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.entries[string(key)]
+}
+
+func (c *testCleanCache) Set(key []byte, value []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.entries[string(key)] = common.CopyBytes(value)
+}
+
+func (c *testCleanCache) Del(key []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.entries, string(key))
+}
+
+func (c *testCleanCache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var size int
+	for key, value := range c.entries {
+		size += len(key) + len(value)
+	}
+	return size
+}
+
+func (c *testCleanCache) Reset() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.entries = make(map[string][]byte)
+}
+
+func TestCleanCacheFactory(t *testing.T) {
+	for _, scheme := range []string{rawdb.HashScheme, rawdb.PathScheme} {
+		var (
+			cache   = &testCleanCache{entries: make(map[string][]byte)}
+			factory = func(bytes int) trienode.CleanCache { return cache }
+			config  = &Config{CleanCacheFactory: factory, HashDB: &hashdb.Config{CleanCacheSize: 1024 * 1024}}
+		)
+		if scheme == rawdb.PathScheme {
+			config = &Config{CleanCacheFactory: factory, PathDB: &pathdb.Config{CleanCacheSize: 1024 * 1024}}
+		}
+		db := NewDatabase(rawdb.NewMemoryDatabase(), config)
+
+		trie := NewEmpty(db)
+		updateString(trie, "120000", "qwerqwerqwerqwerqwerqwerqwerqwer")
+		updateString(trie, "123456", "asdfasdfasdfasdfasdfasdfasdfasdf")
+		root, nodes, _ := trie.Commit(false)
+		if err := db.Update(root, types.EmptyRootHash, 0, trienode.NewWithNodeSet(nodes), nil); err != nil {
+			t.Fatalf("Failed to update database: %v", err)
+		}
+		if err := db.Commit(root, false); err != nil {
+			t.Fatalf("Failed to commit database: %v", err)
+		}
+		if cache.Len() == 0 {
+			t.Fatalf("Custom clean cache is not used (%s)", scheme)
+		}
+		if released := db.Shrink(); released == 0 || cache.Len() != 0 {
+			t.Fatalf("Custom clean cache is not released (%s)", scheme)
+		}
+	}
+}
+
+func TestObserve(t *testing.T) {
+	for _, scheme := range []string{rawdb.HashScheme, rawdb.PathScheme} {
+		db := newTestDatabase(rawdb.NewMemoryDatabase(), scheme)
+
+		trie := NewEmpty(db)
+		updateString(trie, "120000", "qwerqwerqwerqwerqwerqwerqwerqwer")
+		updateString(trie, "123456", "asdfasdfasdfasdfasdfasdfasdfasdf")
+		root, nodes, _ := trie.Commit(false)
+		if err := db.Update(root, types.EmptyRootHash, 0, trienode.NewWithNodeSet(nodes), nil); err != nil {
+			t.Fatalf("Failed to update database: %v", err)
+		}
+		if o := db.Observe(); o.DirtySize == 0 || o.Updated == 0 || o.Written != 0 {
+			t.Fatalf("Unexpected observation before commit (%s): %+v", scheme, o)
+		}
+		if err := db.Commit(root, false); err != nil {
+			t.Fatalf("Failed to commit database: %v", err)
+		}
+		o := db.Observe()
+		if o.Scheme != scheme || o.Root != root {
+			t.Fatalf("Unexpected scheme or root (%s): %+v", scheme, o)
+		}
+		if o.Written == 0 || o.WriteAmplification == 0 || o.LastFlush.IsZero() {
+			t.Fatalf("Unexpected write statistics (%s): %+v", scheme, o)
+		}
+		if scheme == rawdb.PathScheme && o.Layers != 1 {
+			t.Fatalf("Unexpected layers, want: 1, got: %d", o.Layers)
+		}
+	}
+}
+
+func TestMemStats(t *testing.T) {
+	db := newTestDatabase(rawdb.NewMemoryDatabase(), rawdb.HashScheme)
+
+	trie := NewEmpty(db)
+	updateString(trie, "120000", "qwerqwerqwerqwerqwerqwerqwerqwer")
+	root, nodes, _ := trie.Commit(false)
+	if err := db.Update(root, types.EmptyRootHash, 0, trienode.NewWithNodeSet(nodes), nil); err != nil {
+		t.Fatalf("Failed to update database: %v", err)
+	}
+	estimate, heap := db.MemStats()
+	if dirties, preimages := db.Size(); estimate == 0 || estimate != dirties+preimages {
+		t.Fatalf("Unexpected memory estimate, want: %v, got: %v", dirties+preimages, estimate)
+	}
+	if heap == 0 {
+		t.Fatal("Heap usage is not reported")
+	}
+}
+
+func TestLastUpdateNodes(t *testing.T) {
+	db := newTestDatabase(rawdb.NewMemoryDatabase(), rawdb.PathScheme)
+	if _, err := db.LastUpdateNodes(); err == nil {
+		t.Fatal("Expected error without update")
+	}
+	trie := NewEmpty(db)
+	updateString(trie, "120000", "qwerqwerqwerqwerqwerqwerqwerqwer")
+	updateString(trie, "123456", "asdfasdfasdfasdfasdfasdfasdfasdf")
+	root, nodes, _ := trie.Commit(false)
+	if err := db.Update(root, types.EmptyRootHash, 0, trienode.NewWithNodeSet(nodes), nil); err != nil {
+		t.Fatalf("Failed to update database: %v", err)
+	}
+	it, err := db.LastUpdateNodes()
+	if err != nil {
+		t.Fatalf("Failed to iterate last update: %v", err)
+	}
+	var count int
+	for it.Next() {
+		n, ok := nodes.Nodes[string(it.Path())]
+		if !ok || n.Hash != it.Hash() || !bytes.Equal(n.Blob, it.Blob()) || it.Owner() != (common.Hash{}) {
+			t.Fatalf("Unexpected node at path %x", it.Path())
+		}
+		count++
+	}
+	if it.Error() != nil || count != len(nodes.Nodes) {
+		t.Fatalf("Unexpected iteration, nodes: %d, want: %d, err: %v", count, len(nodes.Nodes), it.Error())
+	}
+	// The iterator is invalidated by the next update
+	it, _ = db.LastUpdateNodes()
+	trie, _ = New(TrieID(root), db)
+	updateString(trie, "120000", "poiupoiupoiupoiupoiupoiupoiupoiu")
+	next, nodes, _ := trie.Commit(false)
+	if err := db.Update(next, root, 1, trienode.NewWithNodeSet(nodes), nil); err != nil {
+		t.Fatalf("Failed to update database: %v", err)
+	}
+	if it.Next() || !errors.Is(it.Error(), ErrStaleUpdate) {
+		t.Fatalf("Stale iterator is not detected, err: %v", it.Error())
+	}
+}
+
+func TestReaderEx(t *testing.T) {
+	for _, scheme := range []string{rawdb.HashScheme, rawdb.PathScheme} {
+		db := newTestDatabase(rawdb.NewMemoryDatabase(), scheme)
+
+		vals := map[string]string{
+			"120000": "qwerqwerqwerqwerqwerqwerqwerqwer",
+			"123456": "asdfasdfasdfasdfasdfasdfasdfasdf",
+			"923456": "zxcvzxcvzxcvzxcvzxcvzxcvzxcvzxcv",
+		}
+		trie := NewEmpty(db)
+		for k, v := range vals {
+			updateString(trie, k, v)
+		}
+		root, nodes, _ := trie.Commit(false)
+		if err := db.Update(root, types.EmptyRootHash, 0, trienode.NewWithNodeSet(nodes), nil); err != nil {
+			t.Fatalf("Failed to update database: %v", err)
+		}
+		reader, err := db.ReaderEx(root)
+		if err != nil {
+			t.Fatalf("Failed to open reader (%s): %v", scheme, err)
+		}
+		kinds := make(map[NodeKind]int)
+		for path, n := range nodes.Nodes {
+			blob, kind, value, err := reader.NodeEx(common.Hash{}, []byte(path), n.Hash)
+			if err != nil {
+				t.Fatalf("Failed to resolve node %x (%s): %v", path, scheme, err)
+			}
+			if !bytes.Equal(blob, n.Blob) {
+				t.Fatalf("Unexpected blob of node %x (%s)", path, scheme)
+			}
+			if kind == LeafNode {
+				var found bool
+				for _, v := range vals {
+					found = found || v == string(value)
+				}
+				if !found {
+					t.Fatalf("Unexpected leaf value %q (%s)", value, scheme)
+				}
+			} else if value != nil {
+				t.Fatalf("Value reported for %s node (%s)", kind, scheme)
+			}
+			kinds[kind]++
+		}
+		if kinds[LeafNode] != len(vals) || kinds[BranchNode] == 0 {
+			t.Fatalf("Unexpected node kinds (%s): %v", scheme, kinds)
+		}
+		if _, _, _, err := reader.NodeEx(common.Hash{}, []byte{0xf}, common.HexToHash("0xdeadbeef")); err == nil {
+			t.Fatalf("Missing node is not reported (%s)", scheme)
+		}
+	}
+}
+
+func TestUpdateCopy(t *testing.T) {
+	for _, scheme := range []string{rawdb.HashScheme, rawdb.PathScheme} {
+		db := newTestDatabase(rawdb.NewMemoryDatabase(), scheme)
+
+		trie := NewEmpty(db)
+		updateString(trie, "120000", "qwerqwerqwerqwerqwerqwerqwerqwer")
+		updateString(trie, "123456", "asdfasdfasdfasdfasdfasdfasdfasdf")
+		root, nodes, _ := trie.Commit(false)
+		if err := db.UpdateCopy(root, types.EmptyRootHash, 0, trienode.NewWithNodeSet(nodes), nil); err != nil {
+			t.Fatalf("Failed to update database: %v", err)
+		}
+		// Mutate the passed set, the database must not be affected
+		for path, n := range nodes.Nodes {
+			for i := range n.Blob {
+				n.Blob[i] = 0
+			}
+			delete(nodes.Nodes, path)
+		}
+		trie, err := New(TrieID(root), db)
+		if err != nil {
+			t.Fatalf("Failed to open trie (%s): %v", scheme, err)
+		}
+		if val, err := trie.Get([]byte("123456")); err != nil || string(val) != "asdfasdfasdfasdfasdfasdfasdfasdf" {
+			t.Fatalf("Unexpected value (%s): %q, err: %v", scheme, val, err)
+		}
+	}
+}
+
+func TestReaderNodeNotFound(t *testing.T) {
+	for _, scheme := range []string{rawdb.HashScheme, rawdb.PathScheme} {
+		db := newTestDatabase(rawdb.NewMemoryDatabase(), scheme)
+
+		trie := NewEmpty(db)
+		updateString(trie, "120000", "qwerqwerqwerqwerqwerqwerqwerqwer")
+		updateString(trie, "123456", "asdfasdfasdfasdfasdfasdfasdfasdf")
+		root, nodes, _ := trie.Commit(false)
+		if err := db.Update(root, types.EmptyRootHash, 0, trienode.NewWithNodeSet(nodes), nil); err != nil {
+			t.Fatalf("Failed to update database: %v", err)
+		}
+		reader, err := db.Reader(root)
+		if err != nil {
+			t.Fatalf("Failed to open reader (%s): %v", scheme, err)
+		}
+		var (
+			owner = common.Hash{0x1}
+			path  = []byte{0xf, 0xf}
+			hash  = common.Hash{0x2}
+		)
+		_, err = reader.Node(owner, path, hash)
+		if !errors.Is(err, ErrNodeNotFound) {
+			t.Fatalf("Unexpected error (%s): %v", scheme, err)
+		}
+		var nerr *trienode.NotFoundError
+		if !errors.As(err, &nerr) || nerr.Owner != owner || !bytes.Equal(nerr.Path, path) || nerr.Hash != hash {
+			t.Fatalf("Unexpected error details (%s): %v", scheme, err)
+		}
+		// The missing node error of the trie wraps the reader error.
+		tr, err := newTrieReader(root, owner, db)
+		if err != nil {
+			t.Fatalf("Failed to open trie reader (%s): %v", scheme, err)
+		}
+		_, err = tr.node(path, hash)
+		if !errors.Is(err, ErrNodeNotFound) {
+			t.Fatalf("Unexpected trie error (%s): %v", scheme, err)
+		}
+	}
+}
+
+func TestAutoCommit(t *testing.T) {
+	for _, scheme := range []string{rawdb.HashScheme, rawdb.PathScheme} {
+		diskdb := rawdb.NewMemoryDatabase()
+		db := newTestDatabase(diskdb, scheme)
+
+		trie := NewEmpty(db)
+		updateString(trie, "120000", "qwerqwerqwerqwerqwerqwerqwerqwer")
+		updateString(trie, "123456", "asdfasdfasdfasdfasdfasdfasdfasdf")
+		root, nodes, _ := trie.Commit(false)
+		if err := db.Update(root, types.EmptyRootHash, 0, trienode.NewWithNodeSet(nodes), nil); err != nil {
+			t.Fatalf("Failed to update database: %v", err)
+		}
+		var calls atomic.Int32
+		stop := db.StartAutoCommit(time.Millisecond, func() common.Hash {
+			calls.Add(1)
+			return root
+		})
+		committed := func() bool {
+			if scheme == rawdb.HashScheme {
+				return rawdb.HasLegacyTrieNode(diskdb, root)
+			}
+			_, hash := rawdb.ReadAccountTrieNode(diskdb, nil)
+			return hash == root
+		}
+		for deadline := time.Now().Add(5 * time.Second); !committed(); {
+			if time.Now().After(deadline) {
+				t.Fatalf("State is not committed (%s)", scheme)
+			}
+			time.Sleep(time.Millisecond)
+		}
+		stop()
+		stop() // stopping twice is a noop
+
+		n := calls.Load()
+		time.Sleep(10 * time.Millisecond)
+		if calls.Load() != n {
+			t.Fatalf("Auto-commit is still running after stop (%s)", scheme)
+		}
+		// Close terminates the running loops as well
+		db.StartAutoCommit(time.Millisecond, func() common.Hash { return root })
+		db.Close()
+	}
+}
+
+func TestArchiveColdNodes(t *testing.T) {
+	diskdb := rawdb.NewMemoryDatabase()
+	db := newTestDatabase(diskdb, rawdb.HashScheme)
+	account := func(balance int64) []byte {
+		blob, _ := rlp.EncodeToBytes(&types.StateAccount{Balance: big.NewInt(balance), Root: types.EmptyRootHash, CodeHash: types.EmptyCodeHash.Bytes()})
+		return blob
+	}
+	trie := NewEmpty(db)
+	for i := 0; i < 16; i++ {
+		trie.MustUpdate(crypto.Keccak256([]byte{byte(i)}), account(int64(i)))
+	}
+	root1, nodes, _ := trie.Commit(false)
+	db.Update(root1, types.EmptyRootHash, 0, trienode.NewWithNodeSet(nodes), nil)
+	if err := db.Commit(root1, false); err != nil {
+		t.Fatalf("Failed to commit trie: %v", err)
+	}
+	trie, _ = New(TrieID(root1), db)
+	trie.MustUpdate(crypto.Keccak256([]byte{0}), account(100))
+	root2, nodes, _ := trie.Commit(false)
+	db.Update(root2, root1, 1, trienode.NewWithNodeSet(nodes), nil)
+	if err := db.Commit(root2, false); err != nil {
+		t.Fatalf("Failed to commit trie: %v", err)
+	}
+	orphans, _, err := db.OrphanScan([]common.Hash{root2})
+	if err != nil {
+		t.Fatalf("Failed to scan orphans: %v", err)
+	}
+	freezer, err := rawdb.NewTrieNodeArchive(t.TempDir(), false)
+	if err != nil {
+		t.Fatalf("Failed to open archive: %v", err)
+	}
+	defer freezer.Close()
+
+	// The operations are aborted once the context is cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := db.WithContext(ctx).OrphanScan([]common.Hash{root2}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Unexpected error of cancelled scan: %v", err)
+	}
+	if moved, err := db.WithContext(ctx).ArchiveColdNodes(root2, freezer); !errors.Is(err, context.Canceled) || moved != 0 {
+		t.Fatalf("Unexpected result of cancelled archiving: %d, %v", moved, err)
+	}
+	if !rawdb.HasLegacyTrieNode(diskdb, root1) {
+		t.Fatal("Cold node is moved by cancelled archiving")
+	}
+	moved, err := db.ArchiveColdNodes(root2, freezer)
+	if err != nil {
+		t.Fatalf("Failed to archive nodes: %v", err)
+	}
+	if moved == 0 || moved != orphans {
+		t.Fatalf("Unexpected archived nodes, want: %d, got: %d", orphans, moved)
+	}
+	if rawdb.HasLegacyTrieNode(diskdb, root1) {
+		t.Fatal("Cold node is not moved")
+	}
+	if !rawdb.HasLegacyTrieNode(diskdb, root2) {
+		t.Fatal("Live node is moved")
+	}
+	// The archived nodes are still readable, including after a reopen.
+	reopened := NewDatabase(diskdb, &Config{HashDB: &hashdb.Config{Archive: freezer}})
+	for _, tdb := range []*Database{db, reopened} {
+		tr, err := New(TrieID(root1), tdb)
+		if err != nil {
+			t.Fatalf("Failed to open archived state: %v", err)
+		}
+		for i := 0; i < 16; i++ {
+			if !bytes.Equal(tr.MustGet(crypto.Keccak256([]byte{byte(i)})), account(int64(i))) {
+				t.Fatalf("Unexpected account %d in archived state", i)
+			}
+		}
+	}
+	if _, err := newTestDatabase(rawdb.NewMemoryDatabase(), rawdb.PathScheme).ArchiveColdNodes(root2, freezer); !errors.Is(err, ErrNotSupported) {
+		t.Fatalf("Unexpected error for path scheme: %v", err)
+	}
+}
+
+func TestCompareWith(t *testing.T) {
+	owner := common.HexToHash("0xdeadbeef")
+	makeState := func() (ethdb.Database, common.Hash, common.Hash) {
+		diskdb := rawdb.NewMemoryDatabase()
+		db := newTestDatabase(diskdb, rawdb.HashScheme)
+
+		storage, _ := New(StorageTrieID(types.EmptyRootHash, owner, types.EmptyRootHash), db)
+		updateString(storage, "120000", "qwerqwerqwerqwerqwerqwerqwerqwer")
+		updateString(storage, "123456", "asdfasdfasdfasdfasdfasdfasdfasdf")
+		storageRoot, storageNodes, _ := storage.Commit(false)
+
+		account := NewEmpty(db)
+		blob, _ := rlp.EncodeToBytes(&types.StateAccount{Balance: big.NewInt(1), Root: storageRoot, CodeHash: types.EmptyCodeHash.Bytes()})
+		account.MustUpdate(owner.Bytes(), blob)
+		for i := 0; i < 32; i++ {
+			blob, _ := rlp.EncodeToBytes(&types.StateAccount{Balance: big.NewInt(int64(i)), Root: types.EmptyRootHash, CodeHash: types.EmptyCodeHash.Bytes()})
+			account.MustUpdate(crypto.Keccak256([]byte{byte(i)}), blob)
+		}
+		root, accountNodes, _ := account.Commit(true)
+		set := trienode.NewWithNodeSet(accountNodes)
+		set.Merge(storageNodes)
+		db.Update(root, types.EmptyRootHash, 0, set, nil)
+		if err := db.Commit(root, false); err != nil {
+			t.Fatalf("Failed to commit database: %v", err)
+		}
+		return diskdb, root, storageRoot
+	}
+	diskA, root, storageRoot := makeState()
+	diskB, _, _ := makeState()
+	a := NewDatabase(diskA, &Config{HashDB: hashdb.Defaults})
+
+	for _, concurrency := range []int{1, 4} {
+		equal, diff, err := a.CompareWith(NewDatabase(diskB, &Config{HashDB: hashdb.Defaults}), root, concurrency)
+		if err != nil || !equal || diff != "" {
+			t.Fatalf("Unexpected result of identical states (%d): %v %q %v", concurrency, equal, diff, err)
+		}
+	}
+	// Replace the storage root with another valid node, it's reported with
+	// the hash of the owner.
+	rawdb.WriteLegacyTrieNode(diskB, storageRoot, rawdb.ReadLegacyTrieNode(diskA, root))
+	for _, concurrency := range []int{1, 4} {
+		equal, diff, err := a.CompareWith(NewDatabase(diskB, &Config{HashDB: hashdb.Defaults}), root, concurrency)
+		if err != nil || equal || diff != fmt.Sprintf("%#x:0x", owner) {
+			t.Fatalf("Unexpected result of corrupted storage (%d): %v %q %v", concurrency, equal, diff, err)
+		}
+	}
+	// Replace the account root as well, which precedes the storage in path order.
+	rawdb.WriteLegacyTrieNode(diskB, root, rawdb.ReadLegacyTrieNode(diskA, storageRoot))
+	for _, concurrency := range []int{1, 4} {
+		equal, diff, err := a.CompareWith(NewDatabase(diskB, &Config{HashDB: hashdb.Defaults}), root, concurrency)
+		if err != nil || equal || diff != "0x" {
+			t.Fatalf("Unexpected result of corrupted root (%d): %v %q %v", concurrency, equal, diff, err)
+		}
+	}
+}
+
+func TestPreimageRetention(t *testing.T) {
+	diskdb := rawdb.NewMemoryDatabase()
+	db := NewDatabase(diskdb, &Config{Preimages: true, PreimageRetention: 2})
+
+	var (
+		hot    = common.Hash{0xff}
+		hashes []common.Hash
+	)
+	for block := uint64(1); block <= 5; block++ {
+		hash := common.Hash{byte(block)}
+		hashes = append(hashes, hash)
+		db.preimages.insertPreimage(map[common.Hash][]byte{hash: {byte(block)}, hot: {0xff}})
+		db.preimages.tag(block)
+		db.WritePreimages()
+	}
+	// The preimages of the blocks before 3 are pruned, the hot one is
+	// refreshed by every block.
+	for i, hash := range hashes {
+		if have := rawdb.ReadPreimage(diskdb, hash) != nil; have != (i >= 2) {
+			t.Fatalf("Unexpected presence of preimage %d: %v", i+1, have)
+		}
+	}
+	if rawdb.ReadPreimage(diskdb, hot) == nil {
+		t.Fatal("Refreshed preimage is pruned")
+	}
+	if m := db.PreimageMetrics(); m.Retained != 4 || m.Pruned != 2 {
+		t.Fatalf("Unexpected metrics: %+v", m)
+	}
+	// The retained number is persisted.
+	db = NewDatabase(diskdb, &Config{Preimages: true, PreimageRetention: 2})
+	if m := db.PreimageMetrics(); m.Retained != 4 || m.Pruned != 0 {
+		t.Fatalf("Unexpected metrics after reopen: %+v", m)
+	}
+	if err := db.Truncate(); err != nil {
+		t.Fatalf("Failed to truncate: %v", err)
+	}
+	if m := db.PreimageMetrics(); m.Retained != 0 || rawdb.ReadPreimageRetained(diskdb) != 0 {
+		t.Fatalf("Unexpected metrics after truncation: %+v", m)
+	}
+	if _, ok := rawdb.ReadPreimageBlock(diskdb, hot); ok {
+		t.Fatal("Preimage index is not truncated")
+	}
+}
+
+func TestRootExists(t *testing.T) {
+	for _, scheme := range []string{rawdb.HashScheme, rawdb.PathScheme} {
+		db := newTestDatabase(rawdb.NewMemoryDatabase(), scheme)
+
+		trie := NewEmpty(db)
+		updateString(trie, "120000", "qwerqwerqwerqwerqwerqwerqwerqwer")
+		updateString(trie, "123456", "asdfasdfasdfasdfasdfasdfasdfasdf")
+		root, nodes, _ := trie.Commit(false)
+
+		for _, c := range []struct {
+			root  common.Hash
+			exist bool
+		}{{root, false}, {types.EmptyRootHash, true}, {common.Hash{0x1}, false}} {
+			if exist, err := db.RootExists(c.root); err != nil || exist != c.exist {
+				t.Fatalf("Unexpected existence of %x before update (%s): %v %v", c.root, scheme, exist, err)
+			}
+		}
+		if err := db.Update(root, types.EmptyRootHash, 0, trienode.NewWithNodeSet(nodes), nil); err != nil {
+			t.Fatalf("Failed to update database: %v", err)
+		}
+		if exist, err := db.RootExists(root); err != nil || !exist {
+			t.Fatalf("Root is not found in memory (%s): %v", scheme, err)
+		}
+		if err := db.Commit(root, false); err != nil {
+			t.Fatalf("Failed to commit database: %v", err)
+		}
+		if exist, err := db.RootExists(root); err != nil || !exist {
+			t.Fatalf("Root is not found on disk (%s): %v", scheme, err)
+		}
+	}
+}
+
+func TestExportCleanCache(t *testing.T) {
+	newDatabase := func(scheme string, size int) *Database {
+		config := &Config{HashDB: &hashdb.Config{CleanCacheSize: size}}
+		if scheme == rawdb.PathScheme {
+			config = &Config{PathDB: &pathdb.Config{CleanCacheSize: size}}
+		}
+		return NewDatabase(rawdb.NewMemoryDatabase(), config)
+	}
+	for _, scheme := range []string{rawdb.HashScheme, rawdb.PathScheme} {
+		db := newDatabase(scheme, 1024*1024)
+
+		trie := NewEmpty(db)
+		updateString(trie, "120000", "qwerqwerqwerqwerqwerqwerqwerqwer")
+		updateString(trie, "123456", "asdfasdfasdfasdfasdfasdfasdfasdf")
+		root, nodes, _ := trie.Commit(false)
+		if err := db.Update(root, types.EmptyRootHash, 0, trienode.NewWithNodeSet(nodes), nil); err != nil {
+			t.Fatalf("Failed to update database: %v", err)
+		}
+		if err := db.Commit(root, false); err != nil {
+			t.Fatalf("Failed to commit database: %v", err)
+		}
+		var buf bytes.Buffer
+		if err := db.ExportCleanCache(&buf); err != nil {
+			t.Fatalf("Failed to export clean cache (%s): %v", scheme, err)
+		}
+		warm := newDatabase(scheme, 1024*1024)
+		if err := warm.ImportCleanCache(bytes.NewReader(buf.Bytes())); err != nil {
+			t.Fatalf("Failed to import clean cache (%s): %v", scheme, err)
+		}
+		if have, want := warm.backend.CleanCache().Len(), db.backend.CleanCache().Len(); have != want || have == 0 {
+			t.Fatalf("Unexpected imported cache size (%s), want: %d, got: %d", scheme, want, have)
+		}
+		if scheme == rawdb.HashScheme {
+			if blob := warm.backend.CleanCache().Get(root.Bytes()); !bytes.Equal(blob, nodes.Nodes[""].Blob) {
+				t.Fatal("Root node is not imported")
+			}
+		}
+		// Caches of another scheme or size are rejected
+		other := rawdb.PathScheme
+		if scheme == rawdb.PathScheme {
+			other = rawdb.HashScheme
+		}
+		if err := newDatabase(other, 1024*1024).ImportCleanCache(bytes.NewReader(buf.Bytes())); err == nil {
+			t.Fatalf("Cache of scheme %s imported into %s", scheme, other)
+		}
+		if err := newDatabase(scheme, 2*1024*1024).ImportCleanCache(bytes.NewReader(buf.Bytes())); err == nil {
+			t.Fatalf("Cache of mismatched size imported (%s)", scheme)
+		}
+		if err := newDatabase(scheme, 0).ExportCleanCache(&buf); err == nil {
+			t.Fatalf("Disabled cache exported (%s)", scheme)
+		}
+	}
+}
+
+func TestOnError(t *testing.T) {
+	for _, scheme := range []string{rawdb.HashScheme, rawdb.PathScheme} {
+		var ops []string
+		config := &Config{
+			OnError: func(op string, err error) {
+				ops = append(ops, op)
+			},
+		}
+		if scheme == rawdb.HashScheme {
+			config.HashDB = &hashdb.Config{}
+		} else {
+			config.PathDB = &pathdb.Config{}
+		}
+		db := NewDatabase(rawdb.NewMemoryDatabase(), config)
+
+		trie := NewEmpty(db)
+		updateString(trie, "120000", "qwerqwerqwerqwerqwerqwerqwerqwer")
+		updateString(trie, "123456", "asdfasdfasdfasdfasdfasdfasdfasdf")
+		root, nodes, _ := trie.Commit(false)
+		if err := db.Update(root, types.EmptyRootHash, 0, trienode.NewWithNodeSet(nodes), nil); err != nil {
+			t.Fatalf("Failed to update database: %v", err)
+		}
+		if err := db.Commit(root, false); err != nil {
+			t.Fatalf("Failed to commit database: %v", err)
+		}
+		if len(ops) != 0 {
+			t.Fatalf("Unexpected errors reported (%s): %v", scheme, ops)
+		}
+		reader, err := db.Reader(root)
+		if err != nil {
+			t.Fatalf("Failed to open reader: %v", err)
+		}
+		if _, err := reader.Node(common.Hash{}, []byte{0x5}, common.Hash{0x1}); !errors.Is(err, ErrNodeNotFound) {
+			t.Fatalf("Unexpected read error (%s): %v", scheme, err)
+		}
+		want := []string{"read"}
+		if scheme == rawdb.PathScheme {
+			if err := db.Commit(common.Hash{0x1}, false); err == nil {
+				t.Fatal("Unknown state is committed")
+			}
+			want = append(want, "commit")
+		}
+		if !reflect.DeepEqual(ops, want) {
+			t.Fatalf("Unexpected errors reported (%s), want: %v, got: %v", scheme, want, ops)
+		}
+	}
+}
+
+func TestNodeSizeHistogram(t *testing.T) {
+	db := newTestDatabase(rawdb.NewMemoryDatabase(), rawdb.HashScheme)
+
+	owner := common.HexToHash("0xdeadbeef")
+	storage, _ := New(StorageTrieID(types.EmptyRootHash, owner, types.EmptyRootHash), db)
+	updateString(storage, "120000", "qwerqwerqwerqwerqwerqwerqwerqwer")
+	updateString(storage, "123456", "asdfasdfasdfasdfasdfasdfasdfasdf")
+	storageRoot, storageNodes, _ := storage.Commit(false)
+
+	account := NewEmpty(db)
+	for i, acct := range []*types.StateAccount{
+		{Balance: big.NewInt(1), Root: storageRoot, CodeHash: types.EmptyCodeHash.Bytes()},
+		{Balance: big.NewInt(2), Root: types.EmptyRootHash, CodeHash: types.EmptyCodeHash.Bytes()},
+	} {
+		key := owner.Bytes()
+		if i > 0 {
+			key = common.HexToHash("0xcafe").Bytes()
+		}
+		blob, _ := rlp.EncodeToBytes(acct)
+		account.MustUpdate(key, blob)
+	}
+	root, accountNodes, _ := account.Commit(true)
+	set := trienode.NewWithNodeSet(accountNodes)
+	set.Merge(storageNodes)
+	db.Update(root, types.EmptyRootHash, 0, set, nil)
+
+	hist, err := db.NodeSizeHistogram(context.Background(), root)
+	if err != nil {
+		t.Fatalf("Failed to tally nodes: %v", err)
+	}
+	// Both tries consist of an extension, a branch and two leaves.
+	if hist.Branches != 2 || hist.Extensions != 2 || hist.Leaves != 4 {
+		t.Fatalf("Unexpected node types, branches: %d, extensions: %d, leaves: %d", hist.Branches, hist.Extensions, hist.Leaves)
+	}
+	var nodes uint64
+	for _, n := range hist.Buckets {
+		nodes += n
+	}
+	if nodes != 8 || hist.Size == 0 || hist.LargestSize == 0 {
+		t.Fatalf("Unexpected node sizes, nodes: %d, size: %v, largest: %d", nodes, hist.Size, hist.LargestSize)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := db.NodeSizeHistogram(ctx, root); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Unexpected error of cancelled walk: %v", err)
+	}
+}
+
+func TestCommitIfDirty(t *testing.T) {
+	for _, scheme := range []string{rawdb.HashScheme, rawdb.PathScheme} {
+		db := newTestDatabase(rawdb.NewMemoryDatabase(), scheme)
+
+		trie := NewEmpty(db)
+		updateString(trie, "120000", "qwerqwerqwerqwerqwerqwerqwerqwer")
+		updateString(trie, "123456", "asdfasdfasdfasdfasdfasdfasdfasdf")
+		root, nodes, _ := trie.Commit(false)
+		if err := db.Update(root, types.EmptyRootHash, 0, trienode.NewWithNodeSet(nodes), nil); err != nil {
+			t.Fatalf("Failed to update database: %v", err)
+		}
+		if committed, err := db.CommitIfDirty(root, false); err != nil || !committed {
+			t.Fatalf("Dirty state is not committed (%s): %v", scheme, err)
+		}
+		if committed, err := db.CommitIfDirty(root, false); err != nil || committed {
+			t.Fatalf("Clean state is committed again (%s): %v", scheme, err)
+		}
+		if exist, err := db.RootExists(root); err != nil || !exist {
+			t.Fatalf("Committed root is not found (%s): %v", scheme, err)
+		}
+	}
+	// The pending preimages are committed even if the state is already on disk
+	for _, config := range []*Config{{Preimages: true, HashDB: &hashdb.Config{}}, {Preimages: true, PathDB: &pathdb.Config{}}} {
+		db := NewDatabase(rawdb.NewMemoryDatabase(), config)
+
+		trie := NewEmpty(db)
+		updateString(trie, "120000", "qwerqwerqwerqwerqwerqwerqwerqwer")
+		root, nodes, _ := trie.Commit(false)
+		if err := db.Update(root, types.EmptyRootHash, 0, trienode.NewWithNodeSet(nodes), nil); err != nil {
+			t.Fatalf("Failed to update database: %v", err)
+		}
+		if err := db.Commit(root, false); err != nil {
+			t.Fatalf("Failed to commit database: %v", err)
+		}
+		hash := common.HexToHash("0xdeadbeef")
+		db.preimages.insertPreimage(map[common.Hash][]byte{hash: []byte("preimage")})
+		if committed, err := db.CommitIfDirty(root, false); err != nil || !committed {
+			t.Fatalf("Pending preimages are not committed (%s): %v", db.Scheme(), err)
+		}
+		if blob := rawdb.ReadPreimage(db.diskdb, hash); string(blob) != "preimage" {
+			t.Fatalf("Preimage is not persisted (%s)", db.Scheme())
+		}
+	}
+}
+
+func TestCommitResult(t *testing.T) {
+	for _, scheme := range []string{rawdb.HashScheme, rawdb.PathScheme} {
+		db := newTestDatabase(rawdb.NewMemoryDatabase(), scheme)
+
+		trie := NewEmpty(db)
+		updateString(trie, "120000", "qwerqwerqwerqwerqwerqwerqwerqwer")
+		updateString(trie, "123456", "asdfasdfasdfasdfasdfasdfasdfasdf")
+		root, nodes, _ := trie.Commit(false)
+		if err := db.Update(root, types.EmptyRootHash, 0, trienode.NewWithNodeSet(nodes), nil); err != nil {
+			t.Fatalf("Failed to update database: %v", err)
+		}
+		stats, err := db.CommitResult(root, false)
+		if err != nil {
+			t.Fatalf("Failed to commit (%s): %v", scheme, err)
+		}
+		if stats.Nodes == 0 || stats.Size == 0 || stats.DiskRoot != root {
+			t.Fatalf("Unexpected commit stats (%s): %+v", scheme, stats)
+		}
+		if o := db.Observe(); stats.Nodes != o.NWritten || stats.Size != o.Written {
+			t.Fatalf("Mismatched commit stats (%s): %+v, observed %+v", scheme, stats, o)
+		}
+	}
+}
+
+func TestCountStates(t *testing.T) {
+	db := newTestDatabase(rawdb.NewMemoryDatabase(), rawdb.HashScheme)
+
+	trie := NewEmpty(db)
+	updateString(trie, "120000", "qwerqwerqwerqwerqwerqwerqwerqwer")
+	root, nodes, _ := trie.Commit(false)
+	db.Update(root, types.EmptyRootHash, 0, trienode.NewWithNodeSet(nodes), nil)
+	if err := db.Commit(root, false); err != nil {
+		t.Fatalf("Failed to commit: %v", err)
+	}
+	trie, _ = New(TrieID(root), db)
+	updateString(trie, "123456", "asdfasdfasdfasdfasdfasdfasdfasdf")
+	root2, nodes, _ := trie.Commit(false)
+	db.Update(root2, root, 1, trienode.NewWithNodeSet(nodes), nil)
+
+	if count, err := db.CountStates(); err != nil || count != 2 {
+		t.Fatalf("Unexpected state count, want: 2, got: %d (%v)", count, err)
+	}
+}
+
+func TestWithContext(t *testing.T) {
+	type ctxKey struct{}
+	var (
+		seen []any
+		ops  []string
+	)
+	db := NewDatabase(rawdb.NewMemoryDatabase(), &Config{
+		HashDB: &hashdb.Config{},
+		OnContextError: func(ctx context.Context, op string, err error) {
+			seen, ops = append(seen, ctx.Value(ctxKey{})), append(ops, op)
+		},
+	})
+	trie := NewEmpty(db)
+	updateString(trie, "120000", "qwerqwerqwerqwerqwerqwerqwerqwer")
+	root, nodes, _ := trie.Commit(false)
+	db.Update(root, types.EmptyRootHash, 0, trienode.NewWithNodeSet(nodes), nil)
+
+	scoped := db.WithContext(context.WithValue(context.Background(), ctxKey{}, "request"))
+	if scoped.backend != db.backend || scoped.Context().Value(ctxKey{}) != "request" {
+		t.Fatal("Scoped database is not sharing the backend or missing the context")
+	}
+	reader, err := scoped.Reader(root)
+	if err != nil {
+		t.Fatalf("Failed to open reader: %v", err)
+	}
+	if _, err := reader.Node(common.Hash{}, nil, root); err != nil {
+		t.Fatalf("Failed to resolve root: %v", err)
+	}
+	if _, err := reader.Node(common.Hash{}, nil, common.Hash{0x1}); err == nil {
+		t.Fatal("Missing node is resolved")
+	}
+	if _, err := db.Reader(common.Hash{0x1}); err == nil {
+		t.Fatal("Reader of missing state is opened")
+	}
+	if !reflect.DeepEqual(seen, []any{"request", nil}) || !reflect.DeepEqual(ops, []string{"read", "reader"}) {
+		t.Fatalf("Unexpected reports: %v %v", seen, ops)
+	}
+}
+
+func TestLastCommittedBlock(t *testing.T) {
+	for _, scheme := range []string{rawdb.HashScheme, rawdb.PathScheme} {
+		diskdb, _ := rawdb.NewDatabaseWithFreezer(rawdb.NewMemoryDatabase(), t.TempDir(), "", false, false, false, false)
+		db := newTestDatabase(diskdb, scheme)
+
+		if scheme == rawdb.HashScheme {
+			if _, err := db.LastCommittedBlock(); !errors.Is(err, ErrNotSupported) {
+				t.Fatalf("Unexpected error without commit: %v", err)
+			}
+		}
+		trie := NewEmpty(db)
+		updateString(trie, "120000", "qwerqwerqwerqwerqwerqwerqwerqwer")
+		root, nodes, _ := trie.Commit(false)
+		db.Update(root, types.EmptyRootHash, 5, trienode.NewWithNodeSet(nodes), triestate.New(nil, nil, nil))
+		if err := db.Commit(root, false); err != nil {
+			t.Fatalf("Failed to commit (%s): %v", scheme, err)
+		}
+		if block, err := db.LastCommittedBlock(); err != nil || block != 5 {
+			t.Fatalf("Unexpected committed block (%s), want: 5, got: %d (%v)", scheme, block, err)
+		}
+		diskdb.Close()
+	}
+}
+
+func TestEstimateKeyCount(t *testing.T) {
+	for _, scheme := range []string{rawdb.HashScheme, rawdb.PathScheme} {
+		db := newTestDatabase(rawdb.NewMemoryDatabase(), scheme)
+
+		trie := NewEmpty(db)
+		for i := 0; i < 64; i++ {
+			trie.MustUpdate(crypto.Keccak256([]byte{byte(i)}), []byte{byte(i), 0x1})
+		}
+		root, nodes, _ := trie.Commit(false)
+		db.Update(root, types.EmptyRootHash, 0, trienode.NewWithNodeSet(nodes), nil)
+		if err := db.Commit(root, false); err != nil {
+			t.Fatalf("Failed to commit (%s): %v", scheme, err)
+		}
+		var want uint64
+		db.scanNodes(context.Background(), scheme, func(hash common.Hash, size int) { want++ })
+
+		// The small key space is covered entirely, the count is exact
+		if count, err := db.EstimateKeyCount(); err != nil || count != want {
+			t.Fatalf("Unexpected key count (%s), want: %d, got: %d (%v)", scheme, want, count, err)
+		}
+	}
+	// Fill up the hash-keyed space beyond the sampled keys
+	diskdb := rawdb.NewMemoryDatabase()
+	db := newTestDatabase(diskdb, rawdb.HashScheme)
+	for i := 0; i < 32768; i++ {
+		blob := []byte{0xc2, byte(i >> 8), byte(i)}
+		rawdb.WriteLegacyTrieNode(diskdb, crypto.Keccak256Hash(blob), blob)
+	}
+	count, err := db.EstimateKeyCount()
+	if err != nil {
+		t.Fatalf("Failed to estimate key count: %v", err)
+	}
+	if count < 32768*9/10 || count > 32768*11/10 {
+		t.Fatalf("Key count estimate is off, want: ~%d, got: %d", 32768, count)
+	}
+}
+
+func TestNodeFormatVersion(t *testing.T) {
+	diskdb := rawdb.NewMemoryDatabase()
+	db := NewDatabase(diskdb, &Config{HashDB: &hashdb.Config{}})
+
+	trie := NewEmpty(db)
+	updateString(trie, "120000", "qwerqwerqwerqwerqwerqwerqwerqwer")
+	root, nodes, _ := trie.Commit(false)
+	db.Update(root, types.EmptyRootHash, 0, trienode.NewWithNodeSet(nodes), nil)
+	if err := db.Commit(root, false); err != nil {
+		t.Fatalf("Failed to commit: %v", err)
+	}
+	if version, _ := rawdb.ReadTrieNodeFormat(diskdb); version != NodeFormatLatest {
+		t.Fatalf("Unexpected node format marker: %d", version)
+	}
+	// Configuring an unknown version is rejected
+	db = NewDatabase(diskdb, &Config{HashDB: &hashdb.Config{}, NodeFormatVersion: NodeFormatLatest + 1})
+	if _, err := db.Reader(root); !errors.Is(err, ErrNodeFormatUnsupported) {
+		t.Fatalf("Unexpected reader error: %v", err)
+	}
+	// Nodes stored in an unknown version are rejected
+	rawdb.WriteTrieNodeFormat(diskdb, NodeFormatLatest+1)
+	db = NewDatabase(diskdb, &Config{HashDB: &hashdb.Config{}})
+	if err := db.Commit(root, false); !errors.Is(err, ErrNodeFormatUnsupported) {
+		t.Fatalf("Unexpected commit error: %v", err)
+	}
+	if _, err := db.HealthCheck(); !errors.Is(err, ErrNodeFormatUnsupported) {
+		t.Fatalf("Unexpected health check error: %v", err)
+	}
+}
+
+func TestReaderRetryOnFlush(t *testing.T) {
+	diskdb := rawdb.NewMemoryDatabase()
+	db := NewDatabase(diskdb, &Config{HashDB: &hashdb.Config{}, ReaderRetryOnFlush: true})
+
+	trie := NewEmpty(db)
+	updateString(trie, "120000", "qwerqwerqwerqwerqwerqwerqwerqwer")
+	root, nodes, _ := trie.Commit(false)
+	db.Update(root, types.EmptyRootHash, 0, trienode.NewWithNodeSet(nodes), nil)
+
+	reader, err := db.Reader(root)
+	if err != nil {
+		t.Fatalf("Failed to open reader: %v", err)
+	}
+	blob := []byte{0xc2, 0x20, 0x01}
+	hash := crypto.Keccak256Hash(blob)
+	if _, err := reader.Node(common.Hash{}, nil, hash); !errors.Is(err, ErrNodeNotFound) {
+		t.Fatalf("Unexpected error without flush: %v", err)
+	}
+	// The node missed during a flush is resolved again once it's settled.
+	done := db.startFlush()
+	result := make(chan error)
+	go func() {
+		_, err := reader.Node(common.Hash{}, nil, hash)
+		result <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	rawdb.WriteLegacyTrieNode(diskdb, hash, blob)
+	done()
+
+	if err := <-result; err != nil {
+		t.Fatalf("Node is not resolved after flush: %v", err)
+	}
+}
+
+func TestSetReadOnly(t *testing.T) {
+	for _, scheme := range []string{rawdb.HashScheme, rawdb.PathScheme} {
+		db := newTestDatabase(rawdb.NewMemoryDatabase(), scheme)
+
+		trie := NewEmpty(db)
+		updateString(trie, "120000", "qwerqwerqwerqwerqwerqwerqwerqwer")
+		root, nodes, _ := trie.Commit(false)
+
+		db.SetReadOnly(true)
+		if err := db.Update(root, types.EmptyRootHash, 0, trienode.NewWithNodeSet(nodes), nil); !errors.Is(err, ErrReadOnly) {
+			t.Fatalf("Unexpected update error in read-only mode (%s): %v", scheme, err)
+		}
+		if err := db.Commit(root, false); !errors.Is(err, ErrReadOnly) {
+			t.Fatalf("Unexpected commit error in read-only mode (%s): %v", scheme, err)
+		}
+		db.SetReadOnly(false)
+		if err := db.Update(root, types.EmptyRootHash, 0, trienode.NewWithNodeSet(nodes), nil); err != nil {
+			t.Fatalf("Failed to update database (%s): %v", scheme, err)
+		}
+		db.SetReadOnly(true)
+		if exist, err := db.RootExists(root); err != nil || !exist {
+			t.Fatalf("State is not readable in read-only mode (%s): %v", scheme, err)
+		}
+		if err := db.Commit(root, false); !errors.Is(err, ErrReadOnly) {
+			t.Fatalf("Unexpected commit error in read-only mode (%s): %v", scheme, err)
+		}
+		if resume, err := db.PauseFlush(); !errors.Is(err, ErrReadOnly) {
+			t.Fatalf("Unexpected pause error in read-only mode (%s): %v", scheme, err)
+		} else {
+			resume()
+		}
+		if err := db.ImportCleanCache(bytes.NewReader(nil)); !errors.Is(err, ErrReadOnly) {
+			t.Fatalf("Unexpected import error in read-only mode (%s): %v", scheme, err)
+		}
+		if err := db.Rehydrate(); !errors.Is(err, ErrReadOnly) {
+			t.Fatalf("Unexpected rehydrate error in read-only mode (%s): %v", scheme, err)
+		}
+		if err := db.Reopen(nil); !errors.Is(err, ErrReadOnly) {
+			t.Fatalf("Unexpected reopen error in read-only mode (%s): %v", scheme, err)
+		}
+		db.SetReadOnly(false)
+		if err := db.Commit(root, false); err != nil {
+			t.Fatalf("Failed to commit database (%s): %v", scheme, err)
+		}
+	}
+}
+
+func TestReplayHistory(t *testing.T) {
+	var (
+		addrA, addrB, addrC = common.Address{0xa}, common.Address{0xb}, common.Address{0xc}
+		slot1, slot2        = common.Hash{0x1}, common.Hash{0x2}
+		value1, value2      = []byte{0x81, 0xaa}, []byte{0x81, 0xbb}
+	)
+	// buildState commits the given accounts and slots as a fresh state into
+	// the database, returning the state root and the storage roots.
+	buildState := func(db *Database, accts map[common.Address]int64, slots map[common.Address]map[common.Hash][]byte) (common.Hash, map[common.Address]common.Hash) {
+		set := trienode.NewMergedNodeSet()
+		roots := make(map[common.Address]common.Hash)
+		tr := NewEmpty(db)
+		for addr, balance := range accts {
+			addrHash := crypto.Keccak256Hash(addr.Bytes())
+			st, _ := New(StorageTrieID(types.EmptyRootHash, addrHash, types.EmptyRootHash), db)
+			for key, val := range slots[addr] {
+				st.MustUpdate(key.Bytes(), val)
+			}
+			root, nodes, _ := st.Commit(false)
+			if nodes != nil {
+				set.Merge(nodes)
+			}
+			roots[addr] = root
+			blob, _ := rlp.EncodeToBytes(&types.StateAccount{Balance: big.NewInt(balance), Root: root, CodeHash: types.EmptyCodeHash.Bytes()})
+			tr.MustUpdate(addrHash.Bytes(), blob)
+		}
+		root, nodes, _ := tr.Commit(false)
+		set.Merge(nodes)
+		if err := db.Update(root, types.EmptyRootHash, 0, set, nil); err != nil {
+			t.Fatalf("Failed to update database: %v", err)
+		}
+		return root, roots
+	}
+	slim := func(balance int64, root common.Hash) []byte {
+		return types.SlimAccountRLP(types.StateAccount{Balance: big.NewInt(balance), Root: root, CodeHash: types.EmptyCodeHash.Bytes()})
+	}
+	db := newTestDatabase(rawdb.NewMemoryDatabase(), rawdb.PathScheme)
+	base, _ := buildState(db, map[common.Address]int64{addrA: 1, addrB: 2}, map[common.Address]map[common.Hash][]byte{addrA: {slot1: value1}})
+
+	// Compute the expected intermediate and final states in a separate database.
+	expect := newTestDatabase(rawdb.NewMemoryDatabase(), rawdb.PathScheme)
+	_, roots1 := buildState(expect, map[common.Address]int64{addrA: 3}, map[common.Address]map[common.Hash][]byte{addrA: {slot1: value1, slot2: value2}})
+	want, roots2 := buildState(expect, map[common.Address]int64{addrA: 3, addrC: 4}, map[common.Address]map[common.Hash][]byte{addrA: {slot2: value2}})
+
+	diffs := []*triestate.Set{
+		triestate.New(map[common.Address][]byte{addrA: slim(3, roots1[addrA]), addrB: nil}, map[common.Address]map[common.Hash][]byte{addrA: {slot2: value2}}, nil),
+		triestate.New(map[common.Address][]byte{addrA: slim(3, roots2[addrA]), addrC: slim(4, types.EmptyRootHash)}, map[common.Address]map[common.Hash][]byte{addrA: {slot1: nil}}, nil),
+	}
+	root, err := db.ReplayHistory(base, diffs)
+	if err != nil {
+		t.Fatalf("Failed to replay history: %v", err)
+	}
+	if root != want {
+		t.Fatalf("Unexpected replayed root, want: %#x, got: %#x", want, root)
+	}
+	// A diff with an inconsistent storage root is rejected.
+	diffs[1].Accounts[addrA] = slim(3, roots1[addrA])
+	if _, err := db.ReplayHistory(base, diffs); err == nil {
+		t.Fatal("Inconsistent storage root is accepted")
+	}
+	// The replay fails if the base state is not available.
+	if _, err := db.ReplayHistory(common.Hash{0x1}, diffs[:1]); err == nil {
+		t.Fatal("Unknown base state is accepted")
+	}
+}
+
+// syncCountingDB is a database counting the synced and unsynced batch writes.
+type syncCountingDB struct {
+	ethdb.Database
+	synced, unsynced int
+}
+
+func (db *syncCountingDB) NewBatch() ethdb.Batch {
+	return &syncCountingBatch{Batch: db.Database.NewBatch(), db: db}
+}
+
+type syncCountingBatch struct {
+	ethdb.Batch
+	db *syncCountingDB
+}
+
+func (b *syncCountingBatch) Write() error {
+	b.db.synced++
+	return b.Batch.Write()
+}
+
+func (b *syncCountingBatch) WriteNoSync() error {
+	b.db.unsynced++
+	return b.Batch.Write()
+}
+
+func TestPreimageSyncEvery(t *testing.T) {
+	diskdb := &syncCountingDB{Database: rawdb.NewMemoryDatabase()}
+	db := NewDatabase(diskdb, &Config{Preimages: true, PreimageSyncEvery: 3})
+
+	for i := 0; i < 6; i++ {
+		hash := common.Hash{byte(i)}
+		db.preimages.insertPreimage(map[common.Hash][]byte{hash: {byte(i)}})
+		db.WritePreimages()
+		if rawdb.ReadPreimage(diskdb, hash) == nil {
+			t.Fatalf("Preimage %d is not written", i)
+		}
+	}
+	if diskdb.synced != 2 || diskdb.unsynced != 4 {
+		t.Fatalf("Unexpected writes, synced: %d, unsynced: %d", diskdb.synced, diskdb.unsynced)
+	}
+}
+
+func TestInitializedAny(t *testing.T) {
+	db := newTestDatabase(rawdb.NewMemoryDatabase(), rawdb.HashScheme)
+	trie := NewEmpty(db)
+	updateString(trie, "120000", "qwerqwerqwerqwerqwerqwerqwerqwer")
+	root, nodes, _ := trie.Commit(false)
+	db.Update(root, types.EmptyRootHash, 0, trienode.NewWithNodeSet(nodes), nil)
+
+	candidates := []common.Hash{{0x1}, root, {0x2}}
+	if _, ok := db.InitializedAny(candidates); ok {
+		t.Fatal("Uncommitted state is reported as initialized")
+	}
+	if err := db.Commit(root, false); err != nil {
+		t.Fatalf("Failed to commit database: %v", err)
+	}
+	if match, ok := db.InitializedAny(candidates); !ok || match != root {
+		t.Fatalf("Unexpected match, want: %#x, got: %#x %v", root, match, ok)
+	}
+	if _, ok := db.InitializedAny(nil); ok {
+		t.Fatal("Empty candidates matched")
+	}
+	// The path scheme matches the candidates against the genesis header
+	diskdb := rawdb.NewMemoryDatabase()
+	db = newTestDatabase(diskdb, rawdb.PathScheme)
+	db.Update(root, types.EmptyRootHash, 0, trienode.NewWithNodeSet(nodes), nil)
+	if err := db.Commit(root, false); err != nil {
+		t.Fatalf("Failed to commit database: %v", err)
+	}
+	if _, ok := db.InitializedAny(candidates); ok {
+		t.Fatal("State without genesis header is matched")
+	}
+	genesis := &types.Header{Number: common.Big0, Root: root}
+	rawdb.WriteHeader(diskdb, genesis)
+	rawdb.WriteCanonicalHash(diskdb, genesis.Hash(), 0)
+	if match, ok := db.InitializedAny(candidates); !ok || match != root {
+		t.Fatalf("Unexpected match, want: %#x, got: %#x %v", root, match, ok)
+	}
+	if _, ok := db.InitializedAny([]common.Hash{{0x1}, {0x2}}); ok {
+		t.Fatal("Unknown genesis is matched")
+	}
+}
+
+func TestEmptyReader(t *testing.T) {
+	for _, scheme := range []string{rawdb.HashScheme, rawdb.PathScheme} {
+		db := newTestDatabase(rawdb.NewMemoryDatabase(), scheme)
+		check := func() {
+			for _, open := range []func(common.Hash) (Reader, error){db.Reader, db.ReaderNoCache} {
+				reader, err := open(types.EmptyRootHash)
+				if err != nil {
+					t.Fatalf("Failed to open reader of empty state (%s): %v", scheme, err)
+				}
+				if _, err := reader.Node(common.Hash{}, nil, types.EmptyRootHash); !errors.Is(err, ErrNodeNotFound) {
+					t.Fatalf("Unexpected error of empty reader (%s): %v", scheme, err)
+				}
+			}
+		}
+		check()
+
+		trie := NewEmpty(db)
+		updateString(trie, "120000", "qwerqwerqwerqwerqwerqwerqwerqwer")
+		root, nodes, _ := trie.Commit(false)
+		db.Update(root, types.EmptyRootHash, 0, trienode.NewWithNodeSet(nodes), nil)
+		if err := db.Commit(root, false); err != nil {
+			t.Fatalf("Failed to commit database: %v", err)
+		}
+		check()
+	}
+}
+
+func TestReaderNoCache(t *testing.T) {
+	diskdb := rawdb.NewMemoryDatabase()
+	db := NewDatabase(diskdb, &Config{PathDB: &pathdb.Config{}, ReaderRetryOnFlush: true})
+
+	trie := NewEmpty(db)
+	updateString(trie, "120000", "qwerqwerqwerqwerqwerqwerqwerqwer")
+	root, nodes, _ := trie.Commit(false)
+	db.Update(root, types.EmptyRootHash, 0, trienode.NewWithNodeSet(nodes), nil)
+
+	// The uncached reader is wrapped in the same way as the regular one
+	reader, err := db.ReaderNoCache(root)
+	if err != nil {
+		t.Fatalf("Failed to open reader: %v", err)
+	}
+	if r, ok := reader.(*retryReader); !ok || !r.nocache {
+		t.Fatalf("Unexpected reader: %T", reader)
+	}
+	if _, err := reader.Node(common.Hash{}, nil, root); err != nil {
+		t.Fatalf("Failed to resolve root: %v", err)
+	}
+	// The state of a fork is readable without the cache
+	fork, err := db.Fork()
+	if err != nil {
+		t.Fatalf("Failed to fork: %v", err)
+	}
+	tr, _ := New(TrieID(root), fork)
+	updateString(tr, "123456", "asdfasdfasdfasdfasdfasdfasdfasdf")
+	next, nodes, _ := tr.Commit(false)
+	if err := fork.Update(next, root, 1, trienode.NewWithNodeSet(nodes), nil); err != nil {
+		t.Fatalf("Failed to update fork: %v", err)
+	}
+	reader, err = fork.ReaderNoCache(next)
+	if err != nil {
+		t.Fatalf("Failed to open forked reader: %v", err)
+	}
+	if _, err := reader.Node(common.Hash{}, nil, next); err != nil {
+		t.Fatalf("Failed to resolve forked root: %v", err)
+	}
+	// Nodes stored in an unknown version are rejected
+	diskdb = rawdb.NewMemoryDatabase()
+	rawdb.WriteTrieNodeFormat(diskdb, NodeFormatLatest+1)
+	db = NewDatabase(diskdb, &Config{HashDB: &hashdb.Config{}})
+	if _, err := db.ReaderNoCache(root); !errors.Is(err, ErrNodeFormatUnsupported) {
+		t.Fatalf("Unexpected reader error: %v", err)
+	}
+}
+
+func TestStorageReader(t *testing.T) {
+	db := newTestDatabase(rawdb.NewMemoryDatabase(), rawdb.PathScheme)
+
+	owner := common.HexToHash("0xdeadbeef")
+	storage, _ := New(StorageTrieID(types.EmptyRootHash, owner, types.EmptyRootHash), db)
+	updateString(storage, "120000", "qwerqwerqwerqwerqwerqwerqwerqwer")
+	updateString(storage, "123456", "asdfasdfasdfasdfasdfasdfasdfasdf")
+	storageRoot, storageNodes, _ := storage.Commit(false)
+
+	account := NewEmpty(db)
+	blob, _ := rlp.EncodeToBytes(&types.StateAccount{Balance: big.NewInt(1), Root: storageRoot, CodeHash: types.EmptyCodeHash.Bytes()})
+	account.MustUpdate(owner.Bytes(), blob)
+	blob, _ = rlp.EncodeToBytes(&types.StateAccount{Balance: big.NewInt(2), Root: types.EmptyRootHash, CodeHash: types.EmptyCodeHash.Bytes()})
+	account.MustUpdate(common.HexToHash("0xcafe").Bytes(), blob)
+	root, accountNodes, _ := account.Commit(true)
+	set := trienode.NewWithNodeSet(accountNodes)
+	set.Merge(storageNodes)
+	db.Update(root, types.EmptyRootHash, 0, set, nil)
+
+	reader, sroot, err := db.StorageReader(root, owner)
+	if err != nil || sroot != storageRoot {
+		t.Fatalf("Unexpected storage root, want: %#x, got: %#x, err: %v", storageRoot, sroot, err)
+	}
+	// The owner given to the reader is ignored.
+	node, err := reader.Node(common.Hash{}, nil, storageRoot)
+	if err != nil || crypto.Keccak256Hash(node) != storageRoot {
+		t.Fatalf("Failed to resolve storage root node: %v", err)
+	}
+	for _, acct := range []common.Hash{common.HexToHash("0xcafe"), {0x1}} {
+		reader, sroot, err := db.StorageReader(root, acct)
+		if err != nil || sroot != types.EmptyRootHash {
+			t.Fatalf("Unexpected storage root of %#x: %#x, err: %v", acct, sroot, err)
+		}
+		if _, err := reader.Node(common.Hash{}, nil, storageRoot); !errors.Is(err, ErrNodeNotFound) {
+			t.Fatalf("Unexpected error of empty storage reader: %v", err)
+		}
+	}
+}
+
+func TestStorageValue(t *testing.T) {
+	db := newTestDatabase(rawdb.NewMemoryDatabase(), rawdb.HashScheme)
+
+	var (
+		owner = common.HexToHash("0xdeadbeef")
+		slot  = common.HexToHash("0x01")
+		value = []byte{0xca, 0xfe}
+	)
+	storage, _ := New(StorageTrieID(types.EmptyRootHash, owner, types.EmptyRootHash), db)
+	enc, _ := rlp.EncodeToBytes(value)
+	storage.MustUpdate(slot.Bytes(), enc)
+	storageRoot, storageNodes, _ := storage.Commit(false)
+
+	account := NewEmpty(db)
+	blob, _ := rlp.EncodeToBytes(&types.StateAccount{Balance: big.NewInt(1), Root: storageRoot, CodeHash: types.EmptyCodeHash.Bytes()})
+	account.MustUpdate(owner.Bytes(), blob)
+	root, accountNodes, _ := account.Commit(true)
+	set := trienode.NewWithNodeSet(accountNodes)
+	set.Merge(storageNodes)
+	db.Update(root, types.EmptyRootHash, 0, set, nil)
+
+	for i := 0; i < 2; i++ {
+		got, err := db.StorageValue(root, owner, slot)
+		if err != nil || !bytes.Equal(got, value) {
+			t.Fatalf("Unexpected slot value, want: %x, got: %x, err: %v", value, got, err)
+		}
+	}
+	if db.storageRoots.Len() != 1 {
+		t.Fatalf("Unexpected cached storage roots: %d", db.storageRoots.Len())
+	}
+	if got, err := db.StorageValue(root, owner, common.HexToHash("0x02")); err != nil || got != nil {
+		t.Fatalf("Unexpected absent slot value: %x, err: %v", got, err)
+	}
+	if got, err := db.StorageValue(root, common.HexToHash("0xcafe"), slot); err != nil || got != nil {
+		t.Fatalf("Unexpected slot value of absent account: %x, err: %v", got, err)
+	}
+}
+
+func TestMarkInitialized(t *testing.T) {
+	for _, scheme := range []string{rawdb.HashScheme, rawdb.PathScheme} {
+		var (
+			diskdb = rawdb.NewMemoryDatabase()
+			db     = newTestDatabase(diskdb, scheme)
+		)
+		// Write the state behind the back of the database
+		importer := newTestDatabase(diskdb, scheme)
+		trie := NewEmpty(importer)
+		updateString(trie, "120000", "qwerqwerqwerqwerqwerqwerqwerqwer")
+		root, nodes, _ := trie.Commit(false)
+		importer.Update(root, types.EmptyRootHash, 0, trienode.NewWithNodeSet(nodes), nil)
+		if err := importer.Commit(root, false); err != nil {
+			t.Fatalf("Failed to commit (%s): %v", scheme, err)
+		}
+		if err := db.MarkInitialized(common.Hash{0x1}); err == nil {
+			t.Fatalf("Absent root is marked as initialized (%s)", scheme)
+		}
+		if err := db.MarkInitialized(root); err != nil {
+			t.Fatalf("Failed to mark initialized (%s): %v", scheme, err)
+		}
+		if !db.Initialized(root) {
+			t.Fatalf("Database is not initialized (%s)", scheme)
+		}
+		reader, err := db.Reader(root)
+		if err != nil {
+			t.Fatalf("Failed to open reader (%s): %v", scheme, err)
+		}
+		if _, err := reader.Node(common.Hash{}, nil, root); err != nil {
+			t.Fatalf("Failed to resolve root (%s): %v", scheme, err)
+		}
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	for _, scheme := range []string{rawdb.HashScheme, rawdb.PathScheme} {
+		var (
+			diskdb = rawdb.NewMemoryDatabase()
+			db     = newTestDatabase(diskdb, scheme)
+		)
+		trie := NewEmpty(db)
+		updateString(trie, "120000", "qwerqwerqwerqwerqwerqwerqwerqwer")
+		updateString(trie, "123456", "asdfasdfasdfasdfasdfasdfasdfasdf")
+		root, nodes, _ := trie.Commit(false)
+
+		// Pick a node below the root, which is required for opening readers
+		var (
+			path []byte
+			hash common.Hash
+			blob []byte
+		)
+		for p, n := range nodes.Nodes {
+			if len(p) > 0 {
+				path, hash, blob = []byte(p), n.Hash, n.Blob
+				break
+			}
+		}
+		db.Update(root, types.EmptyRootHash, 0, trienode.NewWithNodeSet(nodes), nil)
+		if err := db.Commit(root, false); err != nil {
+			t.Fatalf("Failed to commit (%s): %v", scheme, err)
+		}
+		if err := db.Quarantine(common.Hash{}, path, hash); err != nil {
+			t.Fatalf("Failed to quarantine (%s): %v", scheme, err)
+		}
+		if quarantined := db.QuarantinedNodes(); len(quarantined) != 1 || quarantined[0].Hash != hash {
+			t.Fatalf("Unexpected quarantined nodes (%s): %v", scheme, quarantined)
+		}
+		reader, err := db.Reader(root)
+		if err != nil {
+			t.Fatalf("Failed to open reader (%s): %v", scheme, err)
+		}
+		if _, err := reader.Node(common.Hash{}, path, hash); !errors.Is(err, ErrNodeNotFound) {
+			t.Fatalf("Quarantined node is resolved (%s): %v", scheme, err)
+		}
+		// Write the node back as the state sync would do
+		if scheme == rawdb.HashScheme {
+			rawdb.WriteLegacyTrieNode(diskdb, hash, blob)
+		} else {
+			rawdb.WriteAccountTrieNode(diskdb, path, blob)
+		}
+		if _, err := reader.Node(common.Hash{}, path, hash); err != nil {
+			t.Fatalf("Failed to resolve fetched node (%s): %v", scheme, err)
+		}
+		if quarantined := db.QuarantinedNodes(); len(quarantined) != 0 {
+			t.Fatalf("Fetched node is still quarantined (%s): %v", scheme, quarantined)
+		}
+	}
+}
+
+func TestOpenAt(t *testing.T) {
+	for _, scheme := range []string{rawdb.HashScheme, rawdb.PathScheme} {
+		var (
+			diskdb = rawdb.NewMemoryDatabase()
+			db     = newTestDatabase(diskdb, scheme)
+		)
+		trie := NewEmpty(db)
+		updateString(trie, "120000", "qwerqwerqwerqwerqwerqwerqwerqwer")
+		root, nodes, _ := trie.Commit(false)
+		db.Update(root, types.EmptyRootHash, 0, trienode.NewWithNodeSet(nodes), nil)
+		if err := db.Commit(root, false); err != nil {
+			t.Fatalf("Failed to commit (%s): %v", scheme, err)
+		}
+		db.Close()
+
+		if _, err := OpenAt(diskdb, nil, common.Hash{0x1}); err == nil {
+			t.Fatalf("Opened at absent state (%s)", scheme)
+		}
+		pinned, err := OpenAt(diskdb, nil, root)
+		if err != nil {
+			t.Fatalf("Failed to open at state (%s): %v", scheme, err)
+		}
+		if got, ok := pinned.PinnedRoot(); !ok || got != root {
+			t.Fatalf("Unexpected pinned root (%s): %x %v", scheme, got, ok)
+		}
+		reader, err := pinned.PinnedReader()
+		if err != nil {
+			t.Fatalf("Failed to open pinned reader (%s): %v", scheme, err)
+		}
+		if _, err := reader.Node(common.Hash{}, nil, root); err != nil {
+			t.Fatalf("Failed to resolve root (%s): %v", scheme, err)
+		}
+		pinned.SetReadOnly(false)
+		if err := pinned.Update(common.Hash{0x2}, root, 1, trienode.NewMergedNodeSet(), nil); !errors.Is(err, ErrReadOnly) {
+			t.Fatalf("Update is not rejected (%s): %v", scheme, err)
+		}
+		if pdb, ok := pinned.backend.(*pathdb.Database); ok {
+			if err := pdb.Update(common.Hash{0x2}, root, 1, trienode.NewMergedNodeSet(), nil); err == nil {
+				t.Fatalf("Path backend is not opened read-only")
+			}
+		}
+		pinned.Close()
+	}
+}
+
+func TestOpenAtNoWrite(t *testing.T) {
+	var (
+		diskdb = rawdb.NewMemoryDatabase()
+		config = &Config{Preimages: true, PathDB: pathdb.Defaults}
+		db     = NewDatabase(diskdb, config)
+	)
+	trie := NewEmpty(db)
+	updateString(trie, "120000", "qwerqwerqwerqwerqwerqwerqwerqwer")
+	root, nodes, _ := trie.Commit(false)
+	db.Update(root, types.EmptyRootHash, 0, trienode.NewWithNodeSet(nodes), nil)
+	if err := db.Commit(root, false); err != nil {
+		t.Fatalf("Failed to commit: %v", err)
+	}
+	db.Close()
+
+	pinned, err := OpenAt(diskdb, config, root)
+	if err != nil {
+		t.Fatalf("Failed to open at state: %v", err)
+	}
+	if config.PathDB.ReadOnly || pathdb.Defaults.ReadOnly {
+		t.Fatal("Caller config is mutated")
+	}
+	preimage := []byte("preimage")
+	pinned.preimages.insertPreimage(map[common.Hash][]byte{crypto.Keccak256Hash(preimage): preimage})
+	pinned.Close()
+
+	if blob := rawdb.ReadPreimage(diskdb, crypto.Keccak256Hash(preimage)); len(blob) != 0 {
+		t.Fatal("Preimages are flushed by the pinned database")
+	}
+}
+
+func TestWarmupFromDisk(t *testing.T) {
+	for _, scheme := range []string{rawdb.HashScheme, rawdb.PathScheme} {
+		config := &Config{HashDB: &hashdb.Config{CleanCacheSize: 1024 * 1024}}
+		if scheme == rawdb.PathScheme {
+			config = &Config{PathDB: &pathdb.Config{CleanCacheSize: 1024 * 1024}}
+		}
+		db := NewDatabase(rawdb.NewMemoryDatabase(), config)
+
+		trie := NewEmpty(db)
+		updateString(trie, "120000", "qwerqwerqwerqwerqwerqwerqwerqwer")
+		updateString(trie, "123456", "asdfasdfasdfasdfasdfasdfasdfasdf")
+		root, nodes, _ := trie.Commit(false)
+		if err := db.Update(root, types.EmptyRootHash, 0, trienode.NewWithNodeSet(nodes), nil); err != nil {
+			t.Fatalf("Failed to update database: %v", err)
+		}
+		if err := db.Commit(root, false); err != nil {
+			t.Fatalf("Failed to commit database: %v", err)
+		}
+		keyOf := func(path string, n *trienode.Node) []byte {
+			if scheme == rawdb.HashScheme {
+				return n.Hash.Bytes()
+			}
+			return []byte(path)
+		}
+		var child string
+		for path := range nodes.Nodes {
+			if len(path) > 0 {
+				child = path
+				break
+			}
+		}
+		cache := db.backend.CleanCache()
+
+		// Only the root node fits into the budget
+		cache.Reset()
+		budget := len(keyOf("", nodes.Nodes[""])) + len(nodes.Nodes[""].Blob)
+		if err := db.WarmupFromDisk(budget); err != nil {
+			t.Fatalf("Failed to warm up (%s): %v", scheme, err)
+		}
+		if blob := cache.Get(keyOf("", nodes.Nodes[""])); !bytes.Equal(blob, nodes.Nodes[""].Blob) {
+			t.Fatalf("Root node is not loaded (%s)", scheme)
+		}
+		if blob := cache.Get(keyOf(child, nodes.Nodes[child])); blob != nil {
+			t.Fatalf("Node is loaded beyond the budget (%s)", scheme)
+		}
+		// The whole trie fits into the budget
+		cache.Reset()
+		if err := db.WarmupFromDisk(1024 * 1024); err != nil {
+			t.Fatalf("Failed to warm up (%s): %v", scheme, err)
+		}
+		for path, n := range nodes.Nodes {
+			if blob := cache.Get(keyOf(path, n)); !bytes.Equal(blob, n.Blob) {
+				t.Fatalf("Node %x is not loaded (%s)", path, scheme)
+			}
+		}
+	}
+}
+
+func TestValidateNodeSet(t *testing.T) {
+	for _, scheme := range []string{rawdb.HashScheme, rawdb.PathScheme} {
+		config := &Config{ValidateNodeSet: true, HashDB: hashdb.Defaults}
+		if scheme == rawdb.PathScheme {
+			config = &Config{ValidateNodeSet: true, PathDB: pathdb.Defaults}
+		}
+		db := NewDatabase(rawdb.NewMemoryDatabase(), config)
+
+		trie := NewEmpty(db)
+		updateString(trie, "120000", "qwerqwerqwerqwerqwerqwerqwerqwer")
+		updateString(trie, "123456", "asdfasdfasdfasdfasdfasdfasdfasdf")
+		root, nodes, _ := trie.Commit(false)
+
+		// Corrupt a copy of the node set
+		corrupt := trienode.NewWithNodeSet(nodes).Copy()
+		for path, n := range corrupt.Sets[common.Hash{}].Nodes {
+			if len(path) > 0 {
+				blob := common.CopyBytes(n.Blob)
+				blob[len(blob)-1] ^= 0xff
+				corrupt.Sets[common.Hash{}].Nodes[path] = trienode.New(n.Hash, blob)
+				break
+			}
+		}
+		if err := db.Update(root, types.EmptyRootHash, 0, corrupt, nil); !errors.Is(err, ErrCorruptNodeSet) {
+			t.Fatalf("Corrupt node set is not rejected (%s): %v", scheme, err)
+		}
+		if err := db.Update(root, types.EmptyRootHash, 0, trienode.NewWithNodeSet(nodes), nil); err != nil {
+			t.Fatalf("Failed to update database (%s): %v", scheme, err)
+		}
+	}
+}
+
+func TestSetBufferSizeClamped(t *testing.T) {
+	db := newTestDatabase(rawdb.NewMemoryDatabase(), rawdb.PathScheme)
+	for _, tc := range []struct {
+		size, want int
+	}{
+		{1, MinBufferSize},
+		{MinBufferSize + 1, MinBufferSize + 1},
+		{MaxBufferSize * 2, MaxBufferSize},
+	} {
+		applied, err := db.SetBufferSizeClamped(tc.size)
+		if err != nil {
+			t.Fatalf("Failed to set buffer size %d: %v", tc.size, err)
+		}
+		if applied != tc.want {
+			t.Fatalf("Unexpected applied size of %d, want: %d, got: %d", tc.size, tc.want, applied)
+		}
+		if _, limit := db.backend.(*pathdb.Database).BufferSize(); int(limit) != tc.want {
+			t.Fatalf("Unexpected buffer limit of %d, want: %d, got: %d", tc.size, tc.want, int(limit))
+		}
+	}
+	hdb := newTestDatabase(rawdb.NewMemoryDatabase(), rawdb.HashScheme)
+	if _, err := hdb.SetBufferSizeClamped(MinBufferSize); err == nil {
+		t.Fatal("Buffer size is set in hash scheme")
+	}
+}
+
+func TestFork(t *testing.T) {
+	db := newTestDatabase(rawdb.NewMemoryDatabase(), rawdb.PathScheme)
+
+	trie := NewEmpty(db)
+	updateString(trie, "120000", "qwerqwerqwerqwerqwerqwerqwerqwer")
+	root, nodes, _ := trie.Commit(false)
+	if err := db.Update(root, types.EmptyRootHash, 0, trienode.NewWithNodeSet(nodes), nil); err != nil {
+		t.Fatalf("Failed to update database: %v", err)
+	}
+	// Apply a transition on a fork, on top of the state of the base
+	update := func(fork *Database, key string) common.Hash {
+		trie, err := New(TrieID(root), fork)
+		if err != nil {
+			t.Fatalf("Failed to open trie: %v", err)
+		}
+		updateString(trie, key, "asdfasdfasdfasdfasdfasdfasdfasdf")
+		next, nodes, _ := trie.Commit(false)
+		if err := fork.Update(next, root, 1, trienode.NewWithNodeSet(nodes), nil); err != nil {
+			t.Fatalf("Failed to update fork: %v", err)
+		}
+		tr, err := New(TrieID(next), fork)
+		if err != nil {
+			t.Fatalf("Failed to open forked trie: %v", err)
+		}
+		if v, err := tr.Get([]byte(key)); err != nil || string(v) != "asdfasdfasdfasdfasdfasdfasdfasdf" {
+			t.Fatalf("Unexpected forked value: %q %v", v, err)
+		}
+		if _, err := db.Reader(next); err == nil {
+			t.Fatal("Forked state is visible in the base")
+		}
+		return next
+	}
+	discarded, err := db.Fork()
+	if err != nil {
+		t.Fatalf("Failed to fork: %v", err)
+	}
+	next := update(discarded, "123456")
+	if err := discarded.Discard(); err != nil {
+		t.Fatalf("Failed to discard fork: %v", err)
+	}
+	if _, err := discarded.Reader(next); err == nil {
+		t.Fatal("Discarded state is still available")
+	}
+	merged, err := db.Fork()
+	if err != nil {
+		t.Fatalf("Failed to fork: %v", err)
+	}
+	next = update(merged, "123457")
+	if err := merged.Commit(next, false); err == nil {
+		t.Fatal("Forked state is committed")
+	}
+	if err := merged.Merge(); err != nil {
+		t.Fatalf("Failed to merge fork: %v", err)
+	}
+	if _, err := db.Reader(next); err != nil {
+		t.Fatalf("Merged state is not available: %v", err)
+	}
+	if err := merged.Merge(); err == nil {
+		t.Fatal("Fork is merged twice")
+	}
+	if _, err := newTestDatabase(rawdb.NewMemoryDatabase(), rawdb.HashScheme).Fork(); !errors.Is(err, ErrNotSupported) {
+		t.Fatalf("Unexpected error forking hash scheme: %v", err)
+	}
+}
+
+func TestPrunePreimages(t *testing.T) {
+	diskdb := rawdb.NewMemoryDatabase()
+	db := newTestDatabase(diskdb, rawdb.HashScheme)
+
+	owner := common.HexToHash("0xdeadbeef")
+	storage, _ := New(StorageTrieID(types.EmptyRootHash, owner, types.EmptyRootHash), db)
+	updateString(storage, "120000", "qwerqwerqwerqwerqwerqwerqwerqwer")
+	storageRoot, storageNodes, _ := storage.Commit(false)
+
+	account := NewEmpty(db)
+	blob, _ := rlp.EncodeToBytes(&types.StateAccount{Balance: big.NewInt(1), Root: storageRoot, CodeHash: types.EmptyCodeHash.Bytes()})
+	account.MustUpdate(owner.Bytes(), blob)
+	root, accountNodes, _ := account.Commit(true)
+	set := trienode.NewWithNodeSet(accountNodes)
+	set.Merge(storageNodes)
+	db.Update(root, types.EmptyRootHash, 0, set, nil)
+
+	var (
+		live  = []common.Hash{owner, common.BytesToHash([]byte("120000"))}
+		stale = []common.Hash{common.HexToHash("0x01"), common.HexToHash("0x02")}
+	)
+	preimages := make(map[common.Hash][]byte)
+	for _, hash := range append(live, stale...) {
+		preimages[hash] = []byte("preimage")
+	}
+	rawdb.WritePreimages(diskdb, preimages)
+
+	count, size, err := db.UnreferencedPreimages([]common.Hash{root})
+	if err != nil {
+		t.Fatalf("Failed to count unreferenced preimages: %v", err)
+	}
+	if want := common.StorageSize(2 * (len(rawdb.PreimagePrefix) + common.HashLength + len("preimage"))); count != 2 || size != want {
+		t.Fatalf("Unexpected unreferenced preimages, count: %d, size: %v", count, size)
+	}
+	if err := db.PrunePreimages([]common.Hash{root}); err != nil {
+		t.Fatalf("Failed to prune preimages: %v", err)
+	}
+	for _, hash := range live {
+		if rawdb.ReadPreimage(diskdb, hash) == nil {
+			t.Fatalf("Referenced preimage %x is pruned", hash)
+		}
+	}
+	for _, hash := range stale {
+		if rawdb.ReadPreimage(diskdb, hash) != nil {
+			t.Fatalf("Unreferenced preimage %x is not pruned", hash)
+		}
+	}
+	if count, _, _ := db.UnreferencedPreimages([]common.Hash{root}); count != 0 {
+		t.Fatalf("Unexpected unreferenced preimages after pruning: %d", count)
+	}
+}
+
+func TestEmitAttestation(t *testing.T) {
+	var attestations []CommitAttestation
+	for _, scheme := range []string{rawdb.HashScheme, rawdb.PathScheme} {
+		emit := func(a CommitAttestation) { attestations = append(attestations, a) }
+		config := &Config{EmitAttestation: emit, HashDB: hashdb.Defaults}
+		if scheme == rawdb.PathScheme {
+			config = &Config{EmitAttestation: emit, PathDB: pathdb.Defaults}
+		}
+		db := NewDatabase(rawdb.NewMemoryDatabase(), config)
+
+		trie := NewEmpty(db)
+		updateString(trie, "120000", "qwerqwerqwerqwerqwerqwerqwerqwer")
+		updateString(trie, "123456", "asdfasdfasdfasdfasdfasdfasdfasdf")
+		root, nodes, _ := trie.Commit(false)
+		if err := db.Update(root, types.EmptyRootHash, 1, trienode.NewWithNodeSet(nodes), nil); err != nil {
+			t.Fatalf("Failed to update database (%s): %v", scheme, err)
+		}
+		a := attestations[len(attestations)-1]
+		if a.Root != root || a.Parent != types.EmptyRootHash || a.Block != 1 || a.Nodes != len(nodes.Nodes) {
+			t.Fatalf("Unexpected attestation (%s): %+v", scheme, a)
+		}
+	}
+	if len(attestations) != 2 || attestations[0] != attestations[1] {
+		t.Fatalf("Attestations of the same transition differ: %+v", attestations)
+	}
+}
+
+func TestResolveSubtree(t *testing.T) {
+	db := NewDatabase(rawdb.NewMemoryDatabase(), &Config{HashDB: &hashdb.Config{CleanCacheSize: 1024 * 1024}})
+
+	owner := common.HexToHash("0xdeadbeef")
+	storage, _ := New(StorageTrieID(types.EmptyRootHash, owner, types.EmptyRootHash), db)
+	updateString(storage, "120000", "qwerqwerqwerqwerqwerqwerqwerqwer")
+	updateString(storage, "123456", "asdfasdfasdfasdfasdfasdfasdfasdf")
+	storageRoot, storageNodes, _ := storage.Commit(false)
+
+	account := NewEmpty(db)
+	blob, _ := rlp.EncodeToBytes(&types.StateAccount{Balance: big.NewInt(1), Root: storageRoot, CodeHash: types.EmptyCodeHash.Bytes()})
+	account.MustUpdate(owner.Bytes(), blob)
+	root, accountNodes, _ := account.Commit(true)
+	set := trienode.NewWithNodeSet(accountNodes)
+	set.Merge(storageNodes)
+	db.Update(root, types.EmptyRootHash, 0, set, nil)
+	if err := db.Commit(root, false); err != nil {
+		t.Fatalf("Failed to commit database: %v", err)
+	}
+	cache := db.backend.CleanCache()
+	cache.Reset()
+
+	nodes, size, err := db.ResolveSubtree(root, owner)
+	if err != nil {
+		t.Fatalf("Failed to resolve subtree: %v", err)
+	}
+	var want common.StorageSize
+	for _, n := range storageNodes.Nodes {
+		want += common.StorageSize(len(n.Blob))
+		if cache.Get(n.Hash.Bytes()) == nil {
+			t.Fatalf("Node %x is not cached", n.Hash)
+		}
+	}
+	if nodes != len(storageNodes.Nodes) || size != want {
+		t.Fatalf("Unexpected resolved subtree, nodes: %d, size: %v", nodes, size)
+	}
+	if nodes, _, err := db.ResolveSubtree(root, common.HexToHash("0xcafe")); err != nil || nodes != 0 {
+		t.Fatalf("Unexpected resolved absent subtree, nodes: %d, err: %v", nodes, err)
+	}
+}
+
+func TestTopReader(t *testing.T) {
+	for _, scheme := range []string{rawdb.HashScheme, rawdb.PathScheme} {
+		db := newTestDatabase(rawdb.NewMemoryDatabase(), scheme)
+		// The hash scheme knows no state before the first update, while the
+		// path scheme starts with the empty one.
+		if _, top, err := db.TopReader(); err == nil && top != types.EmptyRootHash {
+			t.Fatalf("Unexpected initial top state (%s): %x", scheme, top)
+		}
+		var (
+			parent = types.EmptyRootHash
+			trie   = NewEmpty(db)
+		)
+		for _, key := range []string{"120000", "123456"} {
+			updateString(trie, key, "qwerqwerqwerqwerqwerqwerqwerqwer")
+			root, nodes, _ := trie.Commit(false)
+			if err := db.Update(root, parent, 0, trienode.NewWithNodeSet(nodes), nil); err != nil {
+				t.Fatalf("Failed to update database (%s): %v", scheme, err)
+			}
+			reader, top, err := db.TopReader()
+			if err != nil {
+				t.Fatalf("Failed to open top reader (%s): %v", scheme, err)
+			}
+			if top != root {
+				t.Fatalf("Unexpected top state (%s), want: %x, got: %x", scheme, root, top)
+			}
+			if again, _, _ := db.TopReader(); again != reader {
+				t.Fatalf("Top reader is not reused (%s)", scheme)
+			}
+			if _, err := reader.Node(common.Hash{}, nil, root); err != nil {
+				t.Fatalf("Failed to resolve root (%s): %v", scheme, err)
+			}
+			parent = root
+			trie, _ = New(TrieID(root), db)
+		}
+		if err := db.Commit(parent, false); err != nil {
+			t.Fatalf("Failed to commit (%s): %v", scheme, err)
+		}
+		reader, top, err := db.TopReader()
+		if err != nil || top != parent {
+			t.Fatalf("Unexpected top state after commit (%s): %x %v", scheme, top, err)
+		}
+		if _, err := reader.Node(common.Hash{}, nil, parent); err != nil {
+			t.Fatalf("Failed to resolve root after commit (%s): %v", scheme, err)
+		}
+	}
+}
+
+func TestTopReaderReset(t *testing.T) {
+	for _, scheme := range []string{rawdb.HashScheme, rawdb.PathScheme} {
+		var (
+			diskdb = rawdb.NewMemoryDatabase()
+			db     = newTestDatabase(diskdb, scheme)
+			trie   = NewEmpty(db)
+		)
+		updateString(trie, "120000", "qwerqwerqwerqwerqwerqwerqwerqwer")
+		root, nodes, _ := trie.Commit(false)
+		db.Update(root, types.EmptyRootHash, 0, trienode.NewWithNodeSet(nodes), nil)
+		if err := db.Commit(root, false); err != nil {
+			t.Fatalf("Failed to commit (%s): %v", scheme, err)
+		}
+		trie, _ = New(TrieID(root), db)
+		updateString(trie, "123456", "asdfasdfasdfasdfasdfasdfasdfasdf")
+		dirty, nodes, _ := trie.Commit(false)
+		db.Update(dirty, root, 1, trienode.NewWithNodeSet(nodes), nil)
+
+		// The reader is dropped along with the backend on reopen, the dirty
+		// state isn't available anymore.
+		if _, top, err := db.TopReader(); err != nil || top != dirty {
+			t.Fatalf("Unexpected top state (%s): %x %v", scheme, top, err)
+		}
+		if err := db.Reopen(db.config); err != nil {
+			t.Fatalf("Failed to reopen (%s): %v", scheme, err)
+		}
+		if _, top, err := db.TopReader(); err == nil && top == dirty {
+			t.Fatalf("Stale top reader is served after reopen (%s)", scheme)
+		}
+		// The reader is dropped on swapping the persistent database as well
+		if err := db.Update(dirty, root, 1, trienode.NewWithNodeSet(nodes), nil); err != nil {
+			t.Fatalf("Failed to update (%s): %v", scheme, err)
+		}
+		stale, _, err := db.TopReader()
+		if err != nil {
+			t.Fatalf("Failed to open top reader (%s): %v", scheme, err)
+		}
+		if err := db.SwapDiskDB(diskdb); err != nil {
+			t.Fatalf("Failed to swap database (%s): %v", scheme, err)
+		}
+		if reader, _, err := db.TopReader(); err == nil && reader == stale {
+			t.Fatalf("Stale top reader is served after swap (%s): %v", scheme, err)
+		}
+	}
+}
+
+func TestExportPreimages(t *testing.T) {
+	var (
+		src       = newTestDatabase(rawdb.NewMemoryDatabase(), rawdb.HashScheme)
+		preimages = make(map[common.Hash][]byte)
+	)
+	for i := 0; i < 10; i++ {
+		preimage := []byte(fmt.Sprintf("preimage-%d", i))
+		preimages[crypto.Keccak256Hash(preimage)] = preimage
+	}
+	rawdb.WritePreimages(src.diskdb, preimages)
+
+	var buf bytes.Buffer
+	if err := src.ExportPreimages(&buf); err != nil {
+		t.Fatalf("Failed to export preimages: %v", err)
+	}
+	// Pre-populate a preimage in the destination, which must be skipped
+	dst := newTestDatabase(rawdb.NewMemoryDatabase(), rawdb.HashScheme)
+	known := crypto.Keccak256Hash([]byte("preimage-0"))
+	rawdb.WritePreimages(dst.diskdb, map[common.Hash][]byte{known: preimages[known]})
+
+	added, err := dst.ImportPreimages(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("Failed to import preimages: %v", err)
+	}
+	if added != len(preimages)-1 {
+		t.Fatalf("Unexpected imported preimages, want: %d, got: %d", len(preimages)-1, added)
+	}
+	for hash, preimage := range preimages {
+		if got := rawdb.ReadPreimage(dst.diskdb, hash); !bytes.Equal(got, preimage) {
+			t.Fatalf("Preimage %x is not imported", hash)
+		}
+	}
+	// Corrupted records are rejected
+	buf.Reset()
+	rlp.Encode(&buf, &preimageRecord{Hash: common.Hash{0x1}, Preimage: []byte("corrupted")})
+	if _, err := dst.ImportPreimages(&buf); err == nil {
+		t.Fatal("Corrupted preimage is imported")
+	}
+	if rawdb.ReadPreimage(dst.diskdb, common.Hash{0x1}) != nil {
+		t.Fatal("Corrupted preimage is written")
+	}
+}
+
+func TestMaxDepth(t *testing.T) {
+	db := newTestDatabase(rawdb.NewMemoryDatabase(), rawdb.HashScheme)
+	trie := NewEmpty(db)
+	updateString(trie, "120000", "qwerqwerqwerqwerqwerqwerqwerqwer")
+	updateString(trie, "123456", "asdfasdfasdfasdfasdfasdfasdfasdf")
+	updateString(trie, "abcdef", "zxcvzxcvzxcvzxcvzxcvzxcvzxcvzxcv")
+	root, nodes, _ := trie.Commit(false)
+	db.Update(root, types.EmptyRootHash, 0, trienode.NewWithNodeSet(nodes), nil)
+
+	// root branch -> extension -> branch -> leaf
+	depth, path, err := db.MaxDepth(root)
+	if err != nil {
+		t.Fatalf("Failed to measure depth: %v", err)
+	}
+	if want := []byte{3, 1, 3, 2, 3, 0}; depth != 3 || !bytes.Equal(path, want) {
+		t.Fatalf("Unexpected deepest leaf, depth: %d, path: %x", depth, path)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := db.WithContext(ctx).MaxDepth(root); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Unexpected error with cancelled context: %v", err)
+	}
+}
+
+func TestSwapDiskDB(t *testing.T) {
+	for _, scheme := range []string{rawdb.HashScheme, rawdb.PathScheme} {
+		var (
+			olddb = rawdb.NewMemoryDatabase()
+			db    = newTestDatabase(olddb, scheme)
+		)
+		trie := NewEmpty(db)
+		updateString(trie, "120000", "qwerqwerqwerqwerqwerqwerqwerqwer")
+		root, nodes, _ := trie.Commit(false)
+		db.Update(root, types.EmptyRootHash, 0, trienode.NewWithNodeSet(nodes), nil)
+		if err := db.Commit(root, false); err != nil {
+			t.Fatalf("Failed to commit (%s): %v", scheme, err)
+		}
+		if err := db.SwapDiskDB(rawdb.NewMemoryDatabase()); err == nil {
+			t.Fatalf("Swapped to database without the state (%s)", scheme)
+		}
+		// Migrate the persisted data and swap to the copy
+		newdb := rawdb.NewMemoryDatabase()
+		it := olddb.NewIterator(nil, nil)
+		for it.Next() {
+			newdb.Put(it.Key(), it.Value())
+		}
+		it.Release()
+		if err := db.SwapDiskDB(newdb); err != nil {
+			t.Fatalf("Failed to swap database (%s): %v", scheme, err)
+		}
+		trie, _ = New(TrieID(root), db)
+		updateString(trie, "123456", "asdfasdfasdfasdfasdfasdfasdfasdf")
+		next, nodes, _ := trie.Commit(false)
+		db.Update(next, root, 1, trienode.NewWithNodeSet(nodes), nil)
+		if err := db.Commit(next, false); err != nil {
+			t.Fatalf("Failed to commit after swap (%s): %v", scheme, err)
+		}
+		if !rawdb.HasTrieNode(newdb, common.Hash{}, nil, next, scheme) {
+			t.Fatalf("Root node is not written into the new database (%s)", scheme)
+		}
+		if rawdb.HasTrieNode(olddb, common.Hash{}, nil, next, scheme) {
+			t.Fatalf("Root node is written into the old database (%s)", scheme)
+		}
+	}
+}
+
+func TestCommitBarrier(t *testing.T) {
+	var (
+		dbs   []*Database
+		roots []common.Hash
+	)
+	for i, scheme := range []string{rawdb.HashScheme, rawdb.PathScheme, rawdb.HashScheme} {
+		db := newTestDatabase(rawdb.NewMemoryDatabase(), scheme)
+		trie := NewEmpty(db)
+		updateString(trie, fmt.Sprintf("key%d", i), "qwerqwerqwerqwerqwerqwerqwerqwer")
+		root, nodes, _ := trie.Commit(false)
+		db.Update(root, types.EmptyRootHash, 0, trienode.NewWithNodeSet(nodes), nil)
+		dbs, roots = append(dbs, db), append(roots, root)
+	}
+	// Fail the commit of the second database, the third is left untouched
+	dbs[1].SetReadOnly(true)
+	err := CommitBarrier(dbs, roots)
+	var berr *BarrierError
+	if !errors.As(err, &berr) || berr.Index != 1 || !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("Unexpected barrier error: %v", err)
+	}
+	if dbs[0].backend.DiskRoot() != roots[0] || dbs[2].backend.DiskRoot() == roots[2] {
+		t.Fatal("Unexpected databases committed")
+	}
+	dbs[1].SetReadOnly(false)
+	if err := CommitBarrier(dbs, roots); err != nil {
+		t.Fatalf("Failed to commit barrier: %v", err)
+	}
+	for i, db := range dbs {
+		if db.backend.DiskRoot() != roots[i] {
+			t.Fatalf("Database %d is not committed", i)
+		}
+	}
+}
+
+func TestEffectiveConfig(t *testing.T) {
+	// The hash scheme is chosen by default on a fresh database
+	db := NewDatabase(rawdb.NewMemoryDatabase(), nil)
+	config := db.EffectiveConfig()
+	if config.HashDB == nil || config.PathDB != nil {
+		t.Fatalf("Unexpected backend configs, hash: %v, path: %v", config.HashDB, config.PathDB)
+	}
+	if config.HashDB.CleanCacheSize != hashdb.Defaults.CleanCacheSize {
+		t.Fatalf("Unexpected clean cache size: %d", config.HashDB.CleanCacheSize)
+	}
+	config.HashDB.CleanCacheSize++
+	if hashdb.Defaults.CleanCacheSize == config.HashDB.CleanCacheSize {
+		t.Fatal("Defaults are modified through the effective config")
+	}
+	// The sanitized values are reported in the path scheme
+	db = NewDatabase(rawdb.NewMemoryDatabase(), &Config{TrackLocks: true, PathDB: &pathdb.Config{DirtyCacheSize: 1 << 40}})
+	config = db.EffectiveConfig()
+	if config.PathDB == nil || config.HashDB != nil {
+		t.Fatalf("Unexpected backend configs, hash: %v, path: %v", config.HashDB, config.PathDB)
+	}
+	if config.PathDB.DirtyCacheSize != MaxBufferSize || !config.PathDB.TrackLocks {
+		t.Fatalf("Unexpected path config: %+v", config.PathDB)
+	}
+}
+
+func TestIntegrityScan(t *testing.T) {
+	var (
+		key   = []byte("integrity-checkpoint")
+		owner = common.HexToHash("0xdeadbeef")
+	)
+	makeState := func(scheme string) (ethdb.Database, *Database, common.Hash, common.Hash) {
+		diskdb := rawdb.NewMemoryDatabase()
+		db := newTestDatabase(diskdb, scheme)
+
+		storage, _ := New(StorageTrieID(types.EmptyRootHash, owner, types.EmptyRootHash), db)
+		updateString(storage, "120000", "qwerqwerqwerqwerqwerqwerqwerqwer")
+		updateString(storage, "123456", "asdfasdfasdfasdfasdfasdfasdfasdf")
+		storageRoot, storageNodes, _ := storage.Commit(false)
+
+		account := NewEmpty(db)
+		blob, _ := rlp.EncodeToBytes(&types.StateAccount{Balance: big.NewInt(1), Root: storageRoot, CodeHash: types.EmptyCodeHash.Bytes()})
+		account.MustUpdate(owner.Bytes(), blob)
+		for i := 0; i < 32; i++ {
+			blob, _ := rlp.EncodeToBytes(&types.StateAccount{Balance: big.NewInt(int64(i)), Root: types.EmptyRootHash, CodeHash: types.EmptyCodeHash.Bytes()})
+			account.MustUpdate(crypto.Keccak256([]byte{byte(i)}), blob)
+		}
+		root, accountNodes, _ := account.Commit(true)
+		set := trienode.NewWithNodeSet(accountNodes)
+		set.Merge(storageNodes)
+		db.Update(root, types.EmptyRootHash, 0, set, nil)
+		if err := db.Commit(root, false); err != nil {
+			t.Fatalf("Failed to commit database (%s): %v", scheme, err)
+		}
+		return diskdb, db, root, storageRoot
+	}
+	for _, scheme := range []string{rawdb.HashScheme, rawdb.PathScheme} {
+		diskdb, db, root, _ := makeState(scheme)
+
+		// An interrupted scan leaves the progress behind
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, err := db.WithContext(ctx).IntegrityScan(key); !errors.Is(err, context.Canceled) {
+			t.Fatalf("Unexpected error with cancelled context (%s): %v", scheme, err)
+		}
+		if ok, _ := diskdb.Has(key); !ok {
+			t.Fatalf("Checkpoint not saved (%s)", scheme)
+		}
+		result, err := db.IntegrityScan(key)
+		if err != nil {
+			t.Fatalf("Failed to scan (%s): %v", scheme, err)
+		}
+		if result.Root != root || !result.Resumed || !result.Completed || result.Nodes == 0 {
+			t.Fatalf("Unexpected result (%s): %+v", scheme, result)
+		}
+		if ok, _ := diskdb.Has(key); ok {
+			t.Fatalf("Checkpoint not deleted (%s)", scheme)
+		}
+		rescan, err := db.IntegrityScan(key)
+		if err != nil || rescan.Resumed || !rescan.Completed || rescan.Nodes != result.Nodes {
+			t.Fatalf("Unexpected rescan (%s): %+v, %v", scheme, rescan, err)
+		}
+	}
+	// Replace the storage root with another valid node
+	diskdb, db, root, storageRoot := makeState(rawdb.HashScheme)
+	rawdb.WriteLegacyTrieNode(diskdb, storageRoot, rawdb.ReadLegacyTrieNode(diskdb, root))
+	if _, err := db.IntegrityScan(key); err == nil {
+		t.Fatal("Corrupted storage root not detected")
+	}
+}
+
+// adviseCountingDB is a database counting the page cache advices.
+type adviseCountingDB struct {
+	ethdb.Database
+	advised int
+}
+
+func (db *adviseCountingDB) AdviseDontNeed() error {
+	db.advised++
+	return nil
+}
+
+func TestAdviseDontNeed(t *testing.T) {
+	for _, scheme := range []string{rawdb.HashScheme, rawdb.PathScheme} {
+		for _, advise := range []bool{false, true} {
+			diskdb := &adviseCountingDB{Database: rawdb.NewMemoryDatabase()}
+			config := &Config{AdviseDontNeed: advise}
+			if scheme == rawdb.HashScheme {
+				config.HashDB = &hashdb.Config{}
+			} else {
+				config.PathDB = &pathdb.Config{}
+			}
+			db := NewDatabase(diskdb, config)
+			trie := NewEmpty(db)
+			updateString(trie, "120000", "qwerqwerqwerqwerqwerqwerqwerqwer")
+			root, nodes, _ := trie.Commit(false)
+			db.Update(root, types.EmptyRootHash, 0, trienode.NewWithNodeSet(nodes), nil)
+			diskdb.advised = 0
+			if err := db.Commit(root, false); err != nil {
+				t.Fatalf("Failed to commit (%s): %v", scheme, err)
+			}
+			if want := map[bool]int{false: 0, true: 1}[advise]; diskdb.advised != want {
+				t.Fatalf("Unexpected advices (%s, %v): have %d, want %d", scheme, advise, diskdb.advised, want)
+			}
+		}
+	}
+	// The stores not supporting the advice are left alone
+	db := NewDatabase(rawdb.NewMemoryDatabase(), &Config{AdviseDontNeed: true, HashDB: &hashdb.Config{}})
+	trie := NewEmpty(db)
+	updateString(trie, "120000", "qwerqwerqwerqwerqwerqwerqwerqwer")
+	root, nodes, _ := trie.Commit(false)
+	db.Update(root, types.EmptyRootHash, 0, trienode.NewWithNodeSet(nodes), nil)
+	if err := db.Commit(root, false); err != nil {
+		t.Fatalf("Failed to commit: %v", err)
+	}
+}
+
+// writeFailingDB is a database whose batch writes fail while it's broken.
+type writeFailingDB struct {
+	ethdb.Database
+	broken bool
+}
+
+func (db *writeFailingDB) NewBatch() ethdb.Batch {
+	return &writeFailingBatch{Batch: db.Database.NewBatch(), db: db}
+}
+
+func (db *writeFailingDB) NewBatchWithSize(size int) ethdb.Batch {
+	return &writeFailingBatch{Batch: db.Database.NewBatchWithSize(size), db: db}
+}
+
+type writeFailingBatch struct {
+	ethdb.Batch
+	db *writeFailingDB
+}
+
+func (b *writeFailingBatch) Write() error {
+	if b.db.broken {
+		return errors.New("disk failure")
+	}
+	return b.Batch.Write()
+}
+
+func TestIsRetryable(t *testing.T) {
+	for _, scheme := range []string{rawdb.HashScheme, rawdb.PathScheme} {
+		diskdb := &writeFailingDB{Database: rawdb.NewMemoryDatabase()}
+		db := newTestDatabase(diskdb, scheme)
+		trie := NewEmpty(db)
+		updateString(trie, "120000", "qwerqwerqwerqwerqwerqwerqwerqwer")
+		root, nodes, _ := trie.Commit(false)
+		db.Update(root, types.EmptyRootHash, 0, trienode.NewWithNodeSet(nodes), nil)
+
+		// A failed disk write is retryable in the hash scheme, while the path
+		// scheme has already merged the layers being flushed.
+		diskdb.broken = true
+		err := db.Commit(root, false)
+		if err == nil {
+			t.Fatalf("Commit succeeded with failing disk (%s)", scheme)
+		}
+		if scheme == rawdb.PathScheme {
+			var fatal *FatalError
+			if IsRetryable(err) || !errors.As(err, &fatal) {
+				t.Fatalf("Disk failure is retryable (%s): %v", scheme, err)
+			}
+			continue
+		}
+		var transient *TransientError
+		if !IsRetryable(err) || !errors.As(err, &transient) {
+			t.Fatalf("Disk failure is not retryable (%s): %v", scheme, err)
+		}
+		diskdb.broken = false
+		if err := db.Commit(root, false); err != nil {
+			t.Fatalf("Failed to retry commit (%s): %v", scheme, err)
+		}
+	}
+	// Anything else is fatal
+	for _, err := range []error{
+		ErrReadOnly,
+		&FatalError{Err: errors.New("corrupted")},
+		&FatalError{Err: &TransientError{Err: errors.New("disk failure")}},
+		nil,
+	} {
+		if IsRetryable(err) {
+			t.Fatalf("Error is retryable: %v", err)
+		}
+	}
+}
+
+func TestWAL(t *testing.T) {
+	for _, scheme := range []string{rawdb.HashScheme, rawdb.PathScheme} {
+		var (
+			diskdb = rawdb.NewMemoryDatabase()
+			wal    = rawdb.NewMemoryDatabase()
+			config = &Config{WAL: wal}
+		)
+		if scheme == rawdb.HashScheme {
+			config.HashDB = &hashdb.Config{}
+		} else {
+			config.PathDB = &pathdb.Config{}
+		}
+		db := NewDatabase(diskdb, config)
+		trie := NewEmpty(db)
+		updateString(trie, "120000", "qwerqwerqwerqwerqwerqwerqwerqwer")
+		root, nodes, _ := trie.Commit(false)
+		db.Update(root, types.EmptyRootHash, 0, trienode.NewWithNodeSet(nodes), nil)
+		if err := db.Commit(root, false); err != nil {
+			t.Fatalf("Failed to commit (%s): %v", scheme, err)
+		}
+		if it := wal.NewIterator(walPrefix, nil); it.Next() {
+			t.Fatalf("Completed write left in log (%s): %x", scheme, it.Key())
+		}
+		if _, err := NewDatabase(diskdb, config).Reader(root); err != nil {
+			t.Fatalf("Committed state is not available (%s): %v", scheme, err)
+		}
+	}
+	// A record left behind is replayed on open
+	var (
+		diskdb = rawdb.NewMemoryDatabase()
+		wal    = rawdb.NewMemoryDatabase()
+	)
+	blob, _ := rlp.EncodeToBytes([]walEntry{{Key: []byte("a"), Value: []byte("b")}, {Key: []byte("c"), Delete: true}})
+	wal.Put(walKey(3), blob)
+	diskdb.Put([]byte("c"), []byte("d"))
+	NewDatabase(diskdb, &Config{WAL: wal, HashDB: &hashdb.Config{}})
+	if val, _ := diskdb.Get([]byte("a")); string(val) != "b" {
+		t.Fatalf("Logged write is not replayed: %q", val)
+	}
+	if ok, _ := diskdb.Has([]byte("c")); ok {
+		t.Fatal("Logged deletion is not replayed")
+	}
+	if ok, _ := wal.Has(walKey(3)); ok {
+		t.Fatal("Replayed record is not dropped")
+	}
+	// A failed write is kept until it's recovered, rejecting the later ones
+	failing := &writeFailingDB{Database: rawdb.NewMemoryDatabase()}
+	db := NewDatabase(failing, &Config{WAL: wal, HashDB: &hashdb.Config{}})
+	trie := NewEmpty(db)
+	updateString(trie, "120000", "qwerqwerqwerqwerqwerqwerqwerqwer")
+	root, nodes, _ := trie.Commit(false)
+	db.Update(root, types.EmptyRootHash, 0, trienode.NewWithNodeSet(nodes), nil)
+
+	failing.broken = true
+	if err := db.Commit(root, false); err == nil {
+		t.Fatal("Commit succeeded with failing disk")
+	}
+	failing.broken = false
+	if err := db.Commit(root, false); !errors.Is(err, errWALPending) {
+		t.Fatalf("Unexpected error with pending record: %v", err)
+	}
+	if err := db.RecoverWAL(); err != nil {
+		t.Fatalf("Failed to recover log: %v", err)
+	}
+	if !rawdb.HasLegacyTrieNode(failing, root) {
+		t.Fatal("Failed write is not replayed")
+	}
+	if err := db.Commit(root, false); err != nil {
+		t.Fatalf("Failed to commit after recovery: %v", err)
+	}
+}
+
+func TestRehydrate(t *testing.T) {
+	for _, scheme := range []string{rawdb.HashScheme, rawdb.PathScheme} {
+		var (
+			diskdb = rawdb.NewMemoryDatabase()
+			writer = newTestDatabase(diskdb, scheme)
+			reader = newTestDatabase(diskdb, scheme)
+		)
+		// Advance the persisted state behind the back of the reader
+		trie := NewEmpty(writer)
+		updateString(trie, "120000", "qwerqwerqwerqwerqwerqwerqwerqwer")
+		root, nodes, _ := trie.Commit(false)
+		writer.Update(root, types.EmptyRootHash, 0, trienode.NewWithNodeSet(nodes), nil)
+		if err := writer.Commit(root, false); err != nil {
+			t.Fatalf("Failed to commit (%s): %v", scheme, err)
+		}
+		if scheme == rawdb.PathScheme {
+			if _, err := reader.Reader(root); err == nil {
+				t.Fatalf("Unknown state is readable (%s)", scheme)
+			}
+		}
+		if err := reader.Rehydrate(); err != nil {
+			t.Fatalf("Failed to rehydrate (%s): %v", scheme, err)
+		}
+		if _, err := reader.Reader(root); err != nil {
+			t.Fatalf("Persisted state is not readable (%s): %v", scheme, err)
+		}
+		// Switching to another scheme or rewinding the state is rejected
+		if scheme == rawdb.HashScheme {
+			rawdb.WriteAccountTrieNode(diskdb, nil, rawdb.ReadLegacyTrieNode(diskdb, root))
+		} else {
+			rawdb.DeleteAccountTrieNode(diskdb, nil)
+			rawdb.WritePersistentStateID(diskdb, 0)
+		}
+		if err := reader.Rehydrate(); err == nil {
+			t.Fatalf("Incompatible change is not detected (%s)", scheme)
+		}
+	}
+}
+
+// compactRecordingDB is a database recording the compacted ranges.
+type compactRecordingDB struct {
+	ethdb.Database
+	ranges [][2][]byte
+}
+
+func (db *compactRecordingDB) Compact(start []byte, limit []byte) error {
+	db.ranges = append(db.ranges, [2][]byte{start, limit})
+	return db.Database.Compact(start, limit)
+}
+
+func TestCompactOwner(t *testing.T) {
+	owner := common.HexToHash("0xdeadbeef")
+	for _, scheme := range []string{rawdb.HashScheme, rawdb.PathScheme} {
+		diskdb := &compactRecordingDB{Database: rawdb.NewMemoryDatabase()}
+		db := newTestDatabase(diskdb, scheme)
+
+		err := db.CompactOwner(owner)
+		if scheme == rawdb.HashScheme {
+			if !errors.Is(err, ErrNotSupported) {
+				t.Fatalf("Unexpected error in hash scheme: %v", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Failed to compact: %v", err)
+		}
+		if len(diskdb.ranges) != 1 {
+			t.Fatalf("Unexpected compactions: %d", len(diskdb.ranges))
+		}
+		start, limit := diskdb.ranges[0][0], diskdb.ranges[0][1]
+		within := func(owner common.Hash, path []byte) bool {
+			key := append(append([]byte("O"), owner.Bytes()...), path...)
+			return bytes.Compare(key, start) >= 0 && bytes.Compare(key, limit) < 0
+		}
+		if !within(owner, nil) || !within(owner, []byte{0xf, 0xf, 0xf}) {
+			t.Fatal("Storage nodes of the owner are not covered")
+		}
+		if within(common.HexToHash("0xdeadbeee"), []byte{0xf}) || within(common.HexToHash("0xdeadbef0"), nil) {
+			t.Fatal("Storage nodes of other owners are covered")
+		}
+	}
+}
+
+func TestDeferredDereference(t *testing.T) {
+	db := NewDatabase(rawdb.NewMemoryDatabase(), &Config{HashDB: &hashdb.Config{DeferredDereference: true}})
+
+	trie := NewEmpty(db)
+	updateString(trie, "120000", "qwerqwerqwerqwerqwerqwerqwerqwer")
+	updateString(trie, "123456", "asdfasdfasdfasdfasdfasdfasdfasdf")
+	root, nodes, _ := trie.Commit(false)
+	if err := db.Update(root, types.EmptyRootHash, 0, trienode.NewWithNodeSet(nodes), nil); err != nil {
+		t.Fatalf("Failed to update database: %v", err)
+	}
+	if err := db.Reference(root, common.Hash{}); err != nil {
+		t.Fatalf("Failed to reference root: %v", err)
+	}
+	dirties := db.Observe().DirtyNodes
+
+	// The dereference is only recorded, the nodes are retained
+	if err := db.Dereference(root); err != nil {
+		t.Fatalf("Failed to dereference root: %v", err)
+	}
+	if o := db.Observe(); o.Tombstones != 1 || o.DirtyNodes != dirties {
+		t.Fatalf("Unexpected observation after dereference: %+v", o)
+	}
+	// Referencing the root again cancels the pending dereference
+	if err := db.Reference(root, common.Hash{}); err != nil {
+		t.Fatalf("Failed to reference root: %v", err)
+	}
+	if o := db.Observe(); o.Tombstones != 0 || o.DirtyNodes != dirties {
+		t.Fatalf("Unexpected observation after re-reference: %+v", o)
+	}
+	// The pending dereferences are applied by the next flush
+	if err := db.Dereference(root); err != nil {
+		t.Fatalf("Failed to dereference root: %v", err)
+	}
+	if err := db.Cap(1 << 30); err != nil {
+		t.Fatalf("Failed to cap database: %v", err)
+	}
+	if o := db.Observe(); o.Tombstones != 0 || o.DirtyNodes != 0 {
+		t.Fatalf("Unexpected observation after cap: %+v", o)
+	}
+}
+
+func TestDeferredDereferenceTruncate(t *testing.T) {
+	db := NewDatabase(rawdb.NewMemoryDatabase(), &Config{HashDB: &hashdb.Config{DeferredDereference: true}})
+
+	trie := NewEmpty(db)
+	updateString(trie, "120000", "qwerqwerqwerqwerqwerqwerqwerqwer")
+	updateString(trie, "123456", "asdfasdfasdfasdfasdfasdfasdfasdf")
+	root, nodes, _ := trie.Commit(false)
+	set := trienode.NewWithNodeSet(nodes)
+	if err := db.Update(root, types.EmptyRootHash, 0, set, nil); err != nil {
+		t.Fatalf("Failed to update database: %v", err)
+	}
+	if err := db.Reference(root, common.Hash{}); err != nil {
+		t.Fatalf("Failed to reference root: %v", err)
+	}
+	if err := db.Dereference(root); err != nil {
+		t.Fatalf("Failed to dereference root: %v", err)
+	}
+	// The pending dereferences are dropped along with the cached nodes
+	if err := db.Truncate(); err != nil {
+		t.Fatalf("Failed to truncate database: %v", err)
+	}
+	if o := db.Observe(); o.Tombstones != 0 || o.DirtyNodes != 0 {
+		t.Fatalf("Unexpected observation after truncate: %+v", o)
+	}
+	// The same state inserted again must survive the next flush
+	if err := db.Update(root, types.EmptyRootHash, 0, set, nil); err != nil {
+		t.Fatalf("Failed to update database: %v", err)
+	}
+	if err := db.Reference(root, common.Hash{}); err != nil {
+		t.Fatalf("Failed to reference root: %v", err)
+	}
+	dirties := db.Observe().DirtyNodes
+	if err := db.Cap(1 << 30); err != nil {
+		t.Fatalf("Failed to cap database: %v", err)
+	}
+	if o := db.Observe(); o.Tombstones != 0 || o.DirtyNodes != dirties {
+		t.Fatalf("Unexpected observation after cap: %+v", o)
+	}
+}
+
+func TestStats(t *testing.T) {
+	for _, scheme := range []string{rawdb.HashScheme, rawdb.PathScheme} {
+		db := newTestDatabase(rawdb.NewMemoryDatabase(), scheme)
+
+		stats := db.Stats()
+		if scheme == rawdb.HashScheme && (stats.HashDB == nil || stats.PathDB != nil) {
+			t.Fatalf("Unexpected statistics in hash scheme: %+v", stats)
+		}
+		if scheme == rawdb.PathScheme && (stats.PathDB == nil || stats.HashDB != nil) {
+			t.Fatalf("Unexpected statistics in path scheme: %+v", stats)
+		}
+	}
+	// The histograms are tracked even if the metrics collection is disabled
+	db := newTestDatabase(rawdb.NewMemoryDatabase(), rawdb.PathScheme)
+	for _, val := range []string{"qwerqwerqwerqwerqwerqwerqwerqwer", "asdfasdfasdfasdfasdfasdfasdfasdf"} {
+		trie := NewEmpty(db)
+		updateString(trie, "120000", val)
+		root, nodes, _ := trie.Commit(false)
+		if err := db.Update(root, types.EmptyRootHash, 0, trienode.NewWithNodeSet(nodes), nil); err != nil {
+			t.Fatalf("Failed to update database: %v", err)
+		}
+	}
+	if n := db.Stats().PathDB.ReorgDepth.Count(); n != 1 {
+		t.Fatalf("Unexpected reorgs recorded, want: 1, got: %d", n)
+	}
+}
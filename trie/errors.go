@@ -21,6 +21,7 @@ import (
 	"fmt"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/trie/trienode"
 )
 
 // ErrCommitted is returned when a already committed trie is requested for usage.
@@ -28,6 +29,54 @@ import (
 // and so on.
 var ErrCommitted = errors.New("trie is already committed")
 
+// ErrNotSupported is returned if the requested operation is not supported by
+// the backend of the database.
+var ErrNotSupported = errors.New("not supported")
+
+// ErrReadOnly is returned by the mutating methods of the database while it's
+// switched into read-only mode.
+var ErrReadOnly = errors.New("database is read-only")
+
+// ErrMissingStates is returned by Database.Update if the state set is not
+// provided while it's required by the backend for reverting the transition.
+var ErrMissingStates = errors.New("state set is missing")
+
+// ErrNodeFormatUnsupported is returned if the trie nodes are stored, or are
+// configured to be written, in an encoding version this release can't handle.
+var ErrNodeFormatUnsupported = errors.New("unsupported trie node format")
+
+// ErrCorruptNodeSet is returned by Database.Update if Config.ValidateNodeSet is
+// set and a node of the node set doesn't hash to its declared hash.
+var ErrCorruptNodeSet = errors.New("corrupt node set")
+
+// ErrStaleUpdate is reported by the iterator of the nodes introduced by the
+// most recent update, if another update is applied before it's exhausted.
+var ErrStaleUpdate = errors.New("update is superseded")
+
+// ErrNodeNotFound is matched with errors.Is by the errors of the database readers
+// if the requested node is not present. The concrete error is a
+// trienode.NotFoundError carrying the owner, path and hash of the node. Since
+// MissingNodeError wraps the reader error, it matches as well.
+var ErrNodeNotFound = trienode.ErrNodeNotFound
+
+// TransientError wraps the error of a failed commit or flush caused by the
+// environment, e.g. a failed disk write in the hash scheme, which is safe to
+// retry. The path scheme has no such failures, its disk layer is already
+// advanced once the write of the node buffer fails.
+type TransientError = trienode.TransientError
+
+// FatalError wraps the error of a failed commit or flush caused by the data,
+// e.g. a missing node, or by an unknown cause, which is pointless to retry.
+type FatalError = trienode.FatalError
+
+// IsRetryable reports whether the failed commit or flush of the database is
+// safe to retry, i.e. whether the error is a TransientError. All the errors not
+// classified as transient, including the ones of the database itself like
+// ErrReadOnly, are deemed fatal.
+func IsRetryable(err error) bool {
+	return trienode.IsRetryable(err)
+}
+
 // MissingNodeError is returned by the trie functions (Get, Update, Delete)
 // in the case where a trie node is not present in the local database. It contains
 // information necessary for retrieving the missing node.
@@ -50,3 +99,39 @@ func (err *MissingNodeError) Error() string {
 	}
 	return fmt.Sprintf("missing trie node %x (owner %x) (path %x) %v", err.NodeHash, err.Owner, err.Path, err.err)
 }
+
+// PartialProofError is returned by Database.BulkProve if some of the keys
+// couldn't be proven, along with the proofs of the rest.
+type PartialProofError struct {
+	Failed map[string]error // Errors of the unproven keys, indexed by the key
+}
+
+func (err *PartialProofError) Error() string {
+	// Report the smallest failed key for a deterministic message
+	var (
+		first string
+		found bool
+	)
+	for key := range err.Failed {
+		if !found || key < first {
+			first, found = key, true
+		}
+	}
+	return fmt.Sprintf("%d keys not proven, key %x: %v", len(err.Failed), first, err.Failed[first])
+}
+
+// BarrierError is returned by CommitBarrier if a database fails to commit. The
+// databases before it are committed, while the ones after it are untouched.
+type BarrierError struct {
+	Index int   // Index of the database failed to commit
+	Err   error // Error of the failed commit
+}
+
+// Unwrap returns the error of the failed commit.
+func (err *BarrierError) Unwrap() error {
+	return err.Err
+}
+
+func (err *BarrierError) Error() string {
+	return fmt.Sprintf("database %d failed to commit: %v", err.Index, err.Err)
+}
@@ -0,0 +1,296 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/lru"
+	"github.com/ethereum/go-ethereum/metrics"
+	"github.com/ethereum/go-ethereum/trie/triedb/lockstat"
+	"github.com/ethereum/go-ethereum/trie/triedb/pathdb"
+	"github.com/ethereum/go-ethereum/trie/trienode"
+	"github.com/ethereum/go-ethereum/trie/triestate"
+)
+
+var (
+	// errNotFork is returned if a fork specific operation is requested on a
+	// database which is not forked off by Fork.
+	errNotFork = errors.New("database is not a fork")
+
+	// errForkClosed is returned if a fork is used after being merged or
+	// discarded.
+	errForkClosed = errors.New("fork is merged or discarded")
+
+	// errForkCommit is returned if the states of a fork are requested to be
+	// written into disk, they must be merged into the base database instead.
+	errForkCommit = errors.New("fork can't be committed, merge it instead")
+)
+
+// forkUpdate is a state transition applied on a fork.
+type forkUpdate struct {
+	root   common.Hash
+	parent common.Hash
+	block  uint64
+	nodes  *trienode.MergedNodeSet
+	states *triestate.Set
+}
+
+// node returns the node with the given owner and path changed by the update,
+// and whether it's changed at all.
+func (u *forkUpdate) node(owner common.Hash, path []byte) (*trienode.Node, bool) {
+	set, ok := u.nodes.Sets[owner]
+	if !ok {
+		return nil, false
+	}
+	n, ok := set.Nodes[string(path)]
+	return n, ok
+}
+
+// forkBackend is the backend of a database forked off by Fork. The updates are
+// accumulated in memory on top of the states of the base database, which is
+// left untouched until they're merged.
+type forkBackend struct {
+	base    *Database                   // Database the fork is based on
+	updates map[common.Hash]*forkUpdate // Updates applied on the fork, indexed by the state root
+	order   []*forkUpdate               // Updates applied on the fork, in order
+	closed  bool                        // Flag whether the fork is merged or discarded
+	lock    sync.RWMutex
+}
+
+// Fork returns a copy-on-write overlay of the database, e.g. for executing a
+// block speculatively. The updates applied on the fork are accumulated in its
+// memory only, on top of the states of the database, and are visible through
+// the readers of the fork alone. They are either applied on the database with
+// Merge, in order, or dropped with Discard. The states of a fork can't be
+// written into disk, and the maintenance operations are not supported on it.
+// Only the path-based scheme supports forking.
+func (db *Database) Fork() (*Database, error) {
+	if _, ok := db.backend.(*pathdb.Database); !ok {
+		return nil, ErrNotSupported
+	}
+	return &Database{sharedDatabase: &sharedDatabase{
+		config:       db.config,
+		diskdb:       db.diskdb,
+		backend:      &forkBackend{base: db, updates: make(map[common.Hash]*forkUpdate)},
+		quit:         make(chan struct{}),
+		formatErr:    db.formatErr,
+		storageRoots: lru.NewCache[storageRootKey, common.Hash](storageRootCacheSize),
+	}}, nil
+}
+
+// Merge applies the updates accumulated on the fork on the base database, in
+// the order they're applied on the fork. The fork can't be used afterwards. If
+// an update is rejected by the base database, e.g. since its parent state is
+// gone meanwhile, the merge is aborted and the updates applied till then are
+// left in place.
+func (db *Database) Merge() error {
+	fork, ok := db.backend.(*forkBackend)
+	if !ok {
+		return errNotFork
+	}
+	fork.lock.Lock()
+	defer fork.lock.Unlock()
+
+	if fork.closed {
+		return errForkClosed
+	}
+	fork.closed = true
+
+	for _, u := range fork.order {
+		if err := fork.base.Update(u.root, u.parent, u.block, u.nodes, u.states); err != nil {
+			return fmt.Errorf("failed to merge state %x: %w", u.root, err)
+		}
+	}
+	fork.updates, fork.order = nil, nil
+	return nil
+}
+
+// Discard drops the updates accumulated on the fork, leaving the base database
+// untouched. The fork can't be used afterwards.
+func (db *Database) Discard() error {
+	fork, ok := db.backend.(*forkBackend)
+	if !ok {
+		return errNotFork
+	}
+	fork.lock.Lock()
+	defer fork.lock.Unlock()
+
+	fork.closed = true
+	fork.updates, fork.order = nil, nil
+	return nil
+}
+
+// Scheme implements backend, returning the scheme of the base database.
+func (f *forkBackend) Scheme() string {
+	return f.base.Scheme()
+}
+
+// Initialized implements backend, reporting the base database.
+func (f *forkBackend) Initialized(genesisRoot common.Hash) bool {
+	return f.base.Initialized(genesisRoot)
+}
+
+// Size implements backend, returning the memory held by the updates of the
+// fork.
+func (f *forkBackend) Size() common.StorageSize {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	var size uint64
+	for _, u := range f.order {
+		size += updateSize(u.nodes)
+	}
+	return common.StorageSize(size)
+}
+
+// Update implements backend, accumulating the state transition on the fork. The
+// parent state is either a state of the fork or one of the base database.
+func (f *forkBackend) Update(root common.Hash, parent common.Hash, block uint64, nodes *trienode.MergedNodeSet, states *triestate.Set) error {
+	if root == parent {
+		return errors.New("layer cycle")
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.closed {
+		return errForkClosed
+	}
+	if _, ok := f.updates[parent]; !ok {
+		if _, err := f.base.Reader(parent); err != nil {
+			return fmt.Errorf("parent state %x is missing: %w", parent, err)
+		}
+	}
+	u := &forkUpdate{root: root, parent: parent, block: block, nodes: nodes, states: states}
+	f.updates[root] = u
+	f.order = append(f.order, u)
+	return nil
+}
+
+// Commit implements backend, the states of the fork can't be written into disk.
+func (f *forkBackend) Commit(root common.Hash, report bool) error {
+	return errForkCommit
+}
+
+// Dirty implements backend, the states of the fork can't be written into disk.
+func (f *forkBackend) Dirty(root common.Hash) bool {
+	return false
+}
+
+// DeltaSize implements backend, returning the memory held by the updates of the
+// fork, none of which can be written into disk.
+func (f *forkBackend) DeltaSize() common.StorageSize {
+	return f.Size()
+}
+
+// Shrink implements backend, the updates of the fork can't be released.
+func (f *forkBackend) Shrink() (common.StorageSize, error) {
+	return 0, nil
+}
+
+// LockStats implements backend, the lock of the fork is not tracked.
+func (f *forkBackend) LockStats() lockstat.Stats {
+	return lockstat.Stats{}
+}
+
+// CleanCache implements backend, the fork has no cache of its own.
+func (f *forkBackend) CleanCache() trienode.CleanCache {
+	return nil
+}
+
+// DiskRoot implements backend, reporting the base database.
+func (f *forkBackend) DiskRoot() common.Hash {
+	return f.base.backend.DiskRoot()
+}
+
+// LastFlush implements backend, reporting the base database.
+func (f *forkBackend) LastFlush() time.Time {
+	return f.base.backend.LastFlush()
+}
+
+// SetMetricsRegistry implements backend, the fork reports no metrics.
+func (f *forkBackend) SetMetricsRegistry(r metrics.Registry) {}
+
+// Truncate implements backend, the base database can't be truncated through
+// the fork.
+func (f *forkBackend) Truncate() error {
+	return ErrNotSupported
+}
+
+// Close implements backend, the updates of the fork are left in place until
+// it's merged or discarded.
+func (f *forkBackend) Close() error {
+	return nil
+}
+
+// reader returns a reader of the state with the given root, resolving the nodes
+// changed by the updates of the fork leading to the state first and the rest
+// from the base database, bypassing its clean cache if nocache is set.
+func (f *forkBackend) reader(root common.Hash, nocache bool) (Reader, error) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	if f.closed {
+		return nil, errForkClosed
+	}
+	var chain []*forkUpdate
+	for {
+		u, ok := f.updates[root]
+		if !ok {
+			break
+		}
+		chain = append(chain, u)
+		root = u.parent
+	}
+	base, err := f.base.reader(root, nocache)
+	if err != nil {
+		return nil, err
+	}
+	if len(chain) == 0 {
+		return base, nil
+	}
+	return &forkReader{chain: chain, base: base}, nil
+}
+
+// forkReader is a node reader of a state of a fork.
+type forkReader struct {
+	chain []*forkUpdate // Updates leading to the state, the most recent first
+	base  Reader        // Reader of the state of the base database the updates start from
+}
+
+// Node implements Reader, resolving the node from the most recent update which
+// changed it, or from the base database if none did.
+func (r *forkReader) Node(owner common.Hash, path []byte, hash common.Hash) ([]byte, error) {
+	for _, u := range r.chain {
+		n, ok := u.node(owner, path)
+		if !ok {
+			continue
+		}
+		if n.IsDeleted() {
+			return nil, &trienode.NotFoundError{Owner: owner, Path: path, Hash: hash}
+		}
+		if n.Hash != hash {
+			return nil, fmt.Errorf("unexpected node in fork: (%x %v), %x!=%x", owner, path, hash, n.Hash)
+		}
+		return n.Blob, nil
+	}
+	return r.base.Node(owner, path, hash)
+}
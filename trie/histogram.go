@@ -0,0 +1,154 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// NodeSizeBuckets are the inclusive upper bounds in bytes of the node size
+// ranges tallied by NodeSizeHistogram. The nodes larger than the last bound
+// are counted in an extra overflow bucket.
+var NodeSizeBuckets = [...]int{64, 128, 256, 384, 512}
+
+// Histogram is the distribution of the sizes and types of the trie nodes in
+// a state. Only the nodes stored standalone are counted, the ones embedded in
+// their parents are accounted as part of the parent.
+type Histogram struct {
+	Buckets    [len(NodeSizeBuckets) + 1]uint64 // Number of nodes within each size range
+	Size       common.StorageSize               // Total size of the nodes
+	Branches   uint64                           // Number of branch nodes
+	Extensions uint64                           // Number of extension nodes
+	Leaves     uint64                           // Number of leaf nodes
+
+	LargestSize  int         // Size of the largest node
+	LargestOwner common.Hash // Owner of the largest node, zero for the account trie
+	LargestPath  []byte      // Path of the largest node
+}
+
+// add tallies a node with the given owner, path and blob.
+func (h *Histogram) add(owner common.Hash, path []byte, blob []byte) error {
+	n, err := decodeNodeUnsafe(nil, blob)
+	if err != nil {
+		return err
+	}
+	switch n := n.(type) {
+	case *fullNode:
+		h.Branches++
+	case *shortNode:
+		if hasTerm(n.Key) {
+			h.Leaves++
+		} else {
+			h.Extensions++
+		}
+	default:
+		return fmt.Errorf("invalid node: %v", n)
+	}
+	bucket := len(NodeSizeBuckets)
+	for i, limit := range NodeSizeBuckets {
+		if len(blob) <= limit {
+			bucket = i
+			break
+		}
+	}
+	h.Buckets[bucket]++
+	h.Size += common.StorageSize(len(blob))
+
+	if len(blob) > h.LargestSize {
+		h.LargestSize, h.LargestOwner, h.LargestPath = len(blob), owner, common.CopyBytes(path)
+	}
+	return nil
+}
+
+// NodeSizeHistogram walks the state with the given root, including all the
+// storage tries, and tallies the sizes and types of the trie nodes. Nodes are
+// resolved on the fly and released once visited, so the memory usage is
+// bounded regardless of the size of the state. The walk is aborted with the
+// error of the context once it's cancelled.
+func (db *Database) NodeSizeHistogram(ctx context.Context, root common.Hash) (Histogram, error) {
+	var hist Histogram
+	if root == (common.Hash{}) || root == types.EmptyRootHash {
+		return hist, nil
+	}
+	tr, err := New(TrieID(root), db)
+	if err != nil {
+		return Histogram{}, err
+	}
+	it, err := tr.NodeIterator(nil)
+	if err != nil {
+		return Histogram{}, err
+	}
+	for it.Next(true) {
+		if err := ctx.Err(); err != nil {
+			return Histogram{}, err
+		}
+		if it.Hash() != (common.Hash{}) {
+			blob := it.NodeBlob()
+			if blob == nil {
+				return Histogram{}, it.Error()
+			}
+			if err := hist.add(common.Hash{}, it.Path(), blob); err != nil {
+				return Histogram{}, err
+			}
+		}
+		if !it.Leaf() {
+			continue
+		}
+		var acct types.StateAccount
+		if err := rlp.DecodeBytes(it.LeafBlob(), &acct); err != nil {
+			return Histogram{}, err
+		}
+		if acct.Root == types.EmptyRootHash {
+			continue
+		}
+		owner := common.BytesToHash(it.LeafKey())
+		storage, err := New(StorageTrieID(root, owner, acct.Root), db)
+		if err != nil {
+			return Histogram{}, err
+		}
+		sit, err := storage.NodeIterator(nil)
+		if err != nil {
+			return Histogram{}, err
+		}
+		for sit.Next(true) {
+			if err := ctx.Err(); err != nil {
+				return Histogram{}, err
+			}
+			if sit.Hash() != (common.Hash{}) {
+				blob := sit.NodeBlob()
+				if blob == nil {
+					return Histogram{}, sit.Error()
+				}
+				if err := hist.add(owner, sit.Path(), blob); err != nil {
+					return Histogram{}, err
+				}
+			}
+		}
+		if sit.Error() != nil {
+			return Histogram{}, sit.Error()
+		}
+	}
+	if it.Error() != nil {
+		return Histogram{}, it.Error()
+	}
+	return hist, nil
+}
@@ -0,0 +1,171 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// integrityCheckpointInterval is the number of nodes checked between the saves
+// of the progress of an integrity scan.
+const integrityCheckpointInterval = 10000
+
+// integrityCheckpoint is the progress of an integrity scan saved in disk.
+type integrityCheckpoint struct {
+	Root common.Hash // Root of the state being scanned
+	Next []byte      // Hash of the account to resume the scan from
+}
+
+// ScanResult is the outcome of a session of IntegrityScan.
+type ScanResult struct {
+	Root      common.Hash // Root of the state scanned
+	Resumed   bool        // Whether the session resumed a previous one
+	Nodes     int         // Number of the nodes checked in the session
+	Completed bool        // Whether the scan of the whole state is completed
+}
+
+// IntegrityScan verifies the hashes of all the trie nodes of the most recently
+// committed state, including all the storage tries, saving the progress under
+// the given key of the persistent database now and then, so that a scan which
+// is interrupted, e.g. by a restart or by cancelling the context of the
+// database, is resumed from there by the next call. The scan starts over if the
+// state has changed meanwhile. Once completed, the progress is deleted and the
+// next call starts a new scan. The progress is kept at the last account fully
+// checked if a corrupted node is met, which is reported as an error.
+func (db *Database) IntegrityScan(checkpointKey []byte) (*ScanResult, error) {
+	root := db.committedRoot()
+	if root == (common.Hash{}) {
+		return nil, errors.New("no committed state is known")
+	}
+	var checkpoint integrityCheckpoint
+	if blob, err := db.diskdb.Get(checkpointKey); err == nil && len(blob) > 0 {
+		if err := rlp.DecodeBytes(blob, &checkpoint); err != nil {
+			return nil, fmt.Errorf("invalid integrity checkpoint: %v", err)
+		}
+	}
+	result := &ScanResult{Root: root}
+	if checkpoint.Root == root {
+		result.Resumed = true
+	} else {
+		checkpoint = integrityCheckpoint{Root: root}
+	}
+	if root == types.EmptyRootHash {
+		result.Completed = true
+		return result, db.diskdb.Delete(checkpointKey)
+	}
+	var (
+		ctx   = db.Context()
+		saved int
+	)
+	save := func() error {
+		blob, err := rlp.EncodeToBytes(&checkpoint)
+		if err != nil {
+			return err
+		}
+		saved = result.Nodes
+		return db.diskdb.Put(checkpointKey, blob)
+	}
+	check := func(it NodeIterator) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		hash := it.Hash()
+		if hash == (common.Hash{}) {
+			return nil
+		}
+		blob := it.NodeBlob()
+		if blob == nil {
+			return it.Error()
+		}
+		if got := crypto.Keccak256Hash(blob); got != hash {
+			return fmt.Errorf("corrupted node (path %x), want hash %x, got %x", it.Path(), hash, got)
+		}
+		result.Nodes++
+		return nil
+	}
+	fail := func(err error) (*ScanResult, error) {
+		if serr := save(); serr != nil {
+			log.Error("Failed to save integrity checkpoint", "err", serr)
+		}
+		return result, err
+	}
+	tr, err := New(TrieID(root), db)
+	if err != nil {
+		return nil, err
+	}
+	it, err := tr.NodeIterator(checkpoint.Next)
+	if err != nil {
+		return nil, err
+	}
+	for it.Next(true) {
+		if err := check(it); err != nil {
+			return fail(err)
+		}
+		if !it.Leaf() {
+			continue
+		}
+		var acct types.StateAccount
+		if err := rlp.DecodeBytes(it.LeafBlob(), &acct); err != nil {
+			return fail(err)
+		}
+		owner := common.BytesToHash(it.LeafKey())
+		if acct.Root != types.EmptyRootHash {
+			storage, err := New(StorageTrieID(root, owner, acct.Root), db)
+			if err != nil {
+				return fail(err)
+			}
+			sit, err := storage.NodeIterator(nil)
+			if err != nil {
+				return fail(err)
+			}
+			for sit.Next(true) {
+				if err := check(sit); err != nil {
+					return fail(fmt.Errorf("storage of %x: %w", owner, err))
+				}
+			}
+			if err := sit.Error(); err != nil {
+				return fail(err)
+			}
+		}
+		// Resume from the account after the one fully checked
+		next := owner
+		for i := len(next) - 1; i >= 0; i-- {
+			if next[i]++; next[i] != 0 {
+				break
+			}
+		}
+		checkpoint.Next = next.Bytes()
+		if result.Nodes-saved >= integrityCheckpointInterval {
+			if err := save(); err != nil {
+				return result, err
+			}
+		}
+	}
+	if err := it.Error(); err != nil {
+		return fail(err)
+	}
+	result.Completed = true
+	log.Info("Completed integrity scan", "root", root, "nodes", result.Nodes, "resumed", result.Resumed)
+	return result, db.diskdb.Delete(checkpointKey)
+}
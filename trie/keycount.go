@@ -0,0 +1,170 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"encoding/binary"
+	"math"
+
+	"github.com/ethereum/go-ethereum/core/rawdb"
+)
+
+const (
+	// keyCountSamples is the number of evenly spaced positions in the key
+	// space at which EstimateKeyCount samples the keys.
+	keyCountSamples = 64
+
+	// keyCountSampleSize is the number of keys iterated at each position.
+	keyCountSampleSize = 256
+)
+
+// keySpace describes a range of the persistent database holding trie nodes,
+// where the position of a key is mapped into [0, 1) in key order.
+type keySpace struct {
+	prefix []byte                     // Common prefix of the keys in the space
+	seek   func(pos float64) []byte   // Key suffix after the prefix at the given position
+	pos    func(key []byte) float64   // Position of the given key with the prefix
+	isNode func(key, val []byte) bool // Whether the given entry is a trie node
+}
+
+// EstimateKeyCount estimates the number of trie node keys in the persistent
+// database without a full scan. The nodes are counted in the keys following a
+// number of evenly spaced positions of the key space, and extrapolated by the
+// portion of the key space covered. If the whole key space is covered by the
+// first sample, the count is exact.
+//
+// The keys are assumed to be spread uniformly over the key space, which holds
+// for the hash-based scheme and the account trie of the path-based one. The
+// relative error is then expected to be within a few percent, roughly the
+// inverse square root of the number of keys sampled. In the path-based scheme
+// the storage trie nodes are clustered by their owners, the estimate of them
+// is less accurate and tends to be low if a few large storage tries dominate.
+func (db *Database) EstimateKeyCount() (uint64, error) {
+	switch db.Scheme() {
+	case rawdb.HashScheme:
+		return db.estimateKeys(keySpace{
+			seek: seekFraction,
+			pos:  keyFraction,
+			isNode: func(key, val []byte) bool {
+				return rawdb.IsLegacyTrieNode(key, val)
+			},
+		})
+	case rawdb.PathScheme:
+		accounts, err := db.estimateKeys(keySpace{
+			prefix: []byte("A"),
+			seek: func(pos float64) []byte {
+				nibbles := make([]byte, 16)
+				for i := range nibbles {
+					pos *= 16
+					nibbles[i] = byte(pos)
+					pos -= float64(nibbles[i])
+				}
+				return nibbles
+			},
+			pos: func(key []byte) float64 {
+				var (
+					pos   float64
+					scale = 1.0
+				)
+				for i := 1; i < len(key) && i <= 16; i++ {
+					scale /= 16
+					pos += float64(key[i]) * scale
+				}
+				return pos
+			},
+			isNode: func(key, val []byte) bool {
+				return rawdb.IsAccountTrieNode(key)
+			},
+		})
+		if err != nil {
+			return 0, err
+		}
+		storages, err := db.estimateKeys(keySpace{
+			prefix: []byte("O"),
+			seek:   seekFraction,
+			pos: func(key []byte) float64 {
+				return keyFraction(key[1:])
+			},
+			isNode: func(key, val []byte) bool {
+				return rawdb.IsStorageTrieNode(key)
+			},
+		})
+		if err != nil {
+			return 0, err
+		}
+		return accounts + storages, nil
+	}
+	return 0, ErrNotSupported
+}
+
+// estimateKeys estimates the number of trie nodes in the given key space.
+func (db *Database) estimateKeys(space keySpace) (uint64, error) {
+	var nodes, span float64
+	for i := 0; i < keyCountSamples; i++ {
+		var (
+			start = float64(i) / keyCountSamples
+			end   = 1.0
+			keys  int
+			found int
+		)
+		// Iterate the first sample from the very beginning, the short keys
+		// like the root node in the path-based scheme precede the seek key.
+		var seek []byte
+		if i > 0 {
+			seek = space.seek(start)
+		}
+		it := db.diskdb.NewIterator(space.prefix, seek)
+		for keys < keyCountSampleSize && it.Next() {
+			keys++
+			if space.isNode(it.Key(), it.Value()) {
+				found++
+			}
+		}
+		if keys == keyCountSampleSize {
+			end = space.pos(it.Key())
+		}
+		it.Release()
+		if err := it.Error(); err != nil {
+			return 0, err
+		}
+		// The first sample running out of keys has covered the entire space
+		if i == 0 && keys < keyCountSampleSize {
+			return uint64(found), nil
+		}
+		nodes, span = nodes+float64(found), span+end-start
+	}
+	if span <= 0 {
+		return 0, nil
+	}
+	return uint64(nodes / span), nil
+}
+
+// seekFraction returns the 8-byte big-endian key at the given position of the
+// key space, spanning all the possible keys.
+func seekFraction(pos float64) []byte {
+	var key [8]byte
+	binary.BigEndian.PutUint64(key[:], uint64(math.Ldexp(pos, 64)))
+	return key[:]
+}
+
+// keyFraction returns the position of the given key in the key space spanning
+// all the possible keys, determined by the first 8 bytes of it.
+func keyFraction(key []byte) float64 {
+	var buf [8]byte
+	copy(buf[:], key)
+	return math.Ldexp(float64(binary.BigEndian.Uint64(buf[:])), -64)
+}
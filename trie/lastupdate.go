@@ -0,0 +1,119 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/trie/trienode"
+)
+
+// updatedNode is a node introduced by an update, along with its location.
+type updatedNode struct {
+	owner common.Hash
+	path  string
+	node  *trienode.Node
+}
+
+// UpdateIterator iterates the trie nodes introduced by the most recent update
+// of the database, including the deleted ones. Unlike NodeIterator, it doesn't
+// traverse a trie but the flat node set, so the nodes of the account and the
+// storage tries are visited in the order of owner and path. The iterator is
+// only valid until the next update, after which it stops with ErrStaleUpdate.
+type UpdateIterator struct {
+	db    *Database
+	set   *trienode.MergedNodeSet
+	nodes []updatedNode
+	index int
+	err   error
+}
+
+// LastUpdateNodes returns an iterator over the trie nodes introduced by the most
+// recent Update, which is valid until the next one. It's far cheaper than diffing
+// the states, e.g. for incremental indexing.
+func (db *Database) LastUpdateNodes() (*UpdateIterator, error) {
+	set := db.lastUpdate.Load()
+	if set == nil {
+		return nil, errors.New("no update applied")
+	}
+	var nodes []updatedNode
+	for owner, subset := range set.Sets {
+		for path, n := range subset.Nodes {
+			nodes = append(nodes, updatedNode{owner: owner, path: path, node: n})
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		if c := bytes.Compare(nodes[i].owner[:], nodes[j].owner[:]); c != 0 {
+			return c < 0
+		}
+		return nodes[i].path < nodes[j].path
+	})
+	return &UpdateIterator{db: db, set: set, nodes: nodes, index: -1}, nil
+}
+
+// Next moves the iterator to the next node, returning whether there is any.
+// If the update has been superseded meanwhile, it returns false and the error
+// is set to ErrStaleUpdate.
+func (it *UpdateIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	if it.db.lastUpdate.Load() != it.set {
+		it.err = ErrStaleUpdate
+		return false
+	}
+	if it.index+1 >= len(it.nodes) {
+		return false
+	}
+	it.index++
+	return true
+}
+
+// Error returns the error which stopped the iteration, if any.
+func (it *UpdateIterator) Error() error {
+	return it.err
+}
+
+// Owner returns the owner of the trie the current node belongs to, zero for
+// the account trie.
+func (it *UpdateIterator) Owner() common.Hash {
+	return it.nodes[it.index].owner
+}
+
+// Path returns the hex-encoded path of the current node in its trie.
+func (it *UpdateIterator) Path() []byte {
+	return []byte(it.nodes[it.index].path)
+}
+
+// Hash returns the hash of the current node, zero if it's deleted.
+func (it *UpdateIterator) Hash() common.Hash {
+	return it.nodes[it.index].node.Hash
+}
+
+// Blob returns the encoded current node, nil if it's deleted. The returned
+// slice must not be modified.
+func (it *UpdateIterator) Blob() []byte {
+	return it.nodes[it.index].node.Blob
+}
+
+// Deleted returns whether the current node is deleted by the update.
+func (it *UpdateIterator) Deleted() bool {
+	return it.nodes[it.index].node.IsDeleted()
+}
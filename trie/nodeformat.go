@@ -0,0 +1,59 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/ethdb"
+)
+
+// NodeFormatLatest is the newest encoding version of the trie nodes supported.
+// All the versions up to it can be read, while the nodes are written in the
+// version configured. Version 0 is the RLP encoding of the nodes.
+const NodeFormatLatest uint8 = 0
+
+// checkNodeFormat ensures the trie nodes stored in the database, as recorded by
+// the marker, and the ones to be written in the configured version can both be
+// handled by this release.
+func checkNodeFormat(diskdb ethdb.KeyValueReader, config *Config) error {
+	if config.NodeFormatVersion > NodeFormatLatest {
+		return fmt.Errorf("%w: configured version %d, latest supported %d", ErrNodeFormatUnsupported, config.NodeFormatVersion, NodeFormatLatest)
+	}
+	if stored, ok := rawdb.ReadTrieNodeFormat(diskdb); ok && stored > NodeFormatLatest {
+		return fmt.Errorf("%w: stored version %d, latest supported %d", ErrNodeFormatUnsupported, stored, NodeFormatLatest)
+	}
+	return nil
+}
+
+// stampNodeFormat records the configured encoding version of the trie nodes in
+// the marker once they have been written into disk, unless the same or a newer
+// version has been recorded already. The absent marker stands for version 0.
+func (db *Database) stampNodeFormat() {
+	if db.stamped.Load() {
+		return
+	}
+	var version uint8
+	if db.config != nil {
+		version = db.config.NodeFormatVersion
+	}
+	if stored, _ := rawdb.ReadTrieNodeFormat(db.diskdb); stored < version {
+		rawdb.WriteTrieNodeFormat(db.diskdb, version)
+	}
+	db.stamped.Store(true)
+}
@@ -0,0 +1,101 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// PathNode is a trie node encountered along the path of a key.
+type PathNode struct {
+	Depth int         // Number of nodes above it along the path
+	Path  []byte      // Nibble path of the node from the trie root
+	Hash  common.Hash // Hash of the node, zero if it's embedded in the parent
+	Kind  NodeKind    // Type of the node, one of branch, extension or leaf
+	Blob  []byte      // RLP-encoded node, or its encoding within the parent if it's embedded
+}
+
+// NodesAlongPath returns the nodes in the account trie with the given root from
+// the root down to the leaf of the given key. If the key is not present, the
+// nodes up to the point where the path diverges are returned, including the
+// diverging leaf or extension if any. Nil is returned for the empty trie.
+func (db *Database) NodesAlongPath(root common.Hash, key []byte) ([]PathNode, error) {
+	if root == (common.Hash{}) || root == types.EmptyRootHash {
+		return nil, nil
+	}
+	reader, err := newTrieReader(root, common.Hash{}, db)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		hexKey = keybytesToHex(key)
+		nodes  []PathNode
+		path   []byte
+		hash   common.Hash
+		blob   []byte
+		cur    node = hashNode(root.Bytes())
+	)
+	for {
+		if n, ok := cur.(hashNode); ok {
+			hash = common.BytesToHash(n)
+			if blob, err = reader.node(path, hash); err != nil {
+				return nil, err
+			}
+			if cur, err = decodeNode(n, blob); err != nil {
+				return nil, err
+			}
+		}
+		// The value stored in a branch terminates the path
+		if _, ok := cur.(valueNode); ok {
+			return nodes, nil
+		}
+		if blob == nil {
+			blob = nodeToBytes(cur)
+		}
+		pn := PathNode{Depth: len(nodes), Path: common.CopyBytes(path), Hash: hash, Blob: blob}
+		hash, blob = common.Hash{}, nil
+
+		switch n := cur.(type) {
+		case *shortNode:
+			pn.Kind = ExtensionNode
+			if hasTerm(n.Key) {
+				pn.Kind = LeafNode
+			}
+			nodes = append(nodes, pn)
+			if pn.Kind == LeafNode || !bytes.HasPrefix(hexKey[len(path):], n.Key) {
+				return nodes, nil
+			}
+			path = append(path, n.Key...)
+			cur = n.Val
+		case *fullNode:
+			pn.Kind = BranchNode
+			nodes = append(nodes, pn)
+			child := n.Children[hexKey[len(path)]]
+			if child == nil {
+				return nodes, nil
+			}
+			path = append(path, hexKey[len(path)])
+			cur = child
+		default:
+			return nil, fmt.Errorf("invalid node: %v", cur)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"runtime"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/trie/triedb/hashdb"
+	"github.com/ethereum/go-ethereum/trie/triedb/pathdb"
+	"github.com/ethereum/go-ethereum/trie/trienode"
+)
+
+// Observation is a flat snapshot of all the statistics tracked by the database.
+// The fields which don't apply to the state scheme in use are left zero.
+type Observation struct {
+	Scheme string      // State scheme of the backend
+	Root   common.Hash // Root of the most recent state persisted in disk
+
+	DirtySize    common.StorageSize // Memory held in front of the persistent database
+	DeltaSize    common.StorageSize // Memory accumulated since dirty nodes were last written into disk
+	PreimageSize common.StorageSize // Memory held by the cached preimages
+	CleanSize    common.StorageSize // Memory held by the clean cache
+	DirtyNodes   int                // Number of nodes in the dirty cache, hash scheme only
+	Tombstones   int                // Number of the dereferences deferred to the next flush, hash scheme only
+
+	Layers      int                // Number of layers including the disk layer, path scheme only
+	BufferSize  common.StorageSize // Memory held by the node buffer, path scheme only
+	BufferLimit common.StorageSize // Memory allowance of the node buffer, path scheme only
+
+	LastFlush          time.Time          // Time at which dirty nodes were last written into disk
+	Updated            common.StorageSize // Data storage submitted by updates since the database was opened
+	Written            common.StorageSize // Data storage written into disk since the database was opened
+	NWritten           uint64             // Number of nodes written into disk since the database was opened
+	WriteAmplification float64            // Ratio of the written data storage to the submitted one
+
+	LockWait time.Duration // Total time spent waiting for the backend lock, if tracked
+	LockHold time.Duration // Total time the backend lock was held exclusively, if tracked
+}
+
+// Observe returns a consistent snapshot of all the statistics tracked by the
+// database. The backend statistics are collected with a single acquisition of
+// its lock, which makes it cheaper than calling the individual accessors.
+func (db *Database) Observe() Observation {
+	o := Observation{
+		Scheme:  db.backend.Scheme(),
+		Updated: common.StorageSize(db.updated.Load()),
+	}
+	switch b := db.backend.(type) {
+	case *hashdb.Database:
+		obs := b.Observe()
+		o.Root, o.DirtySize, o.DeltaSize, o.CleanSize = obs.Root, obs.Size, obs.Delta, obs.Cleans
+		o.DirtyNodes, o.Written, o.NWritten, o.LastFlush = obs.Nodes, obs.Written, obs.NWritten, obs.LastFlush
+		o.Tombstones = b.Stats().Tombstones
+	case *pathdb.Database:
+		obs := b.Observe()
+		o.Root, o.DirtySize, o.DeltaSize, o.CleanSize = obs.Root, obs.Size, obs.Delta, obs.Cleans
+		o.Layers, o.BufferSize, o.BufferLimit = obs.Layers, obs.Buffer, obs.BufferLimit
+		o.Written, o.NWritten, o.LastFlush = obs.Written, obs.NWritten, obs.LastFlush
+	}
+	if db.preimages != nil {
+		o.PreimageSize = db.preimages.size()
+	}
+	if o.Updated > 0 {
+		o.WriteAmplification = float64(o.Written / o.Updated)
+	}
+	locks := db.backend.LockStats()
+	o.LockWait, o.LockHold = locks.Wait, locks.Hold
+	return o
+}
+
+// Stats is the statistics of the database activity reported by the backend.
+// Only the one matching the state scheme in use is set.
+type Stats struct {
+	HashDB *hashdb.Stats
+	PathDB *pathdb.Stats
+}
+
+// Stats returns the statistics of the database activity collected by the
+// backend, e.g. the reorg depth and node read latency histograms of pathdb.
+func (db *Database) Stats() Stats {
+	var stats Stats
+	switch b := db.backend.(type) {
+	case *hashdb.Database:
+		s := b.Stats()
+		stats.HashDB = &s
+	case *pathdb.Database:
+		s := b.Stats()
+		stats.PathDB = &s
+	}
+	return stats
+}
+
+// MemStats returns the memory estimated to be held by the dirty nodes and the
+// cached preimages, alongside the heap memory in use reported by the runtime,
+// captured together for validating the estimate. The clean cache isn't counted
+// as fastcache allocates it off the Go heap. Note reading the runtime memory
+// statistics stops the world briefly, so it's not meant to be called often.
+func (db *Database) MemStats() (trieEstimate common.StorageSize, heapInUse uint64) {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+
+	dirties, preimages := db.Size()
+	return dirties + preimages, stats.HeapInuse
+}
+
+// updateSize returns the data storage of the nodes submitted by an update.
+func updateSize(nodes *trienode.MergedNodeSet) uint64 {
+	var size uint64
+	for _, set := range nodes.Sets {
+		for path, n := range set.Nodes {
+			size += uint64(len(path) + len(n.Blob))
+		}
+	}
+	return size
+}
@@ -0,0 +1,181 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"context"
+	"encoding/binary"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rlp"
+	bloomfilter "github.com/holiman/bloomfilter/v2"
+)
+
+// orphanBloomRate is the false-positive rate of the bloom filter used to mark
+// the reachable nodes. A false-positive makes an orphan node counted as live.
+const orphanBloomRate = 0.0001
+
+// orphanBloomHasher is a wrapper around a node hash to satisfy the interface
+// API requirements of the bloom library used.
+type orphanBloomHasher []byte
+
+func (f orphanBloomHasher) Write(p []byte) (n int, err error) { panic("not implemented") }
+func (f orphanBloomHasher) Sum(b []byte) []byte               { panic("not implemented") }
+func (f orphanBloomHasher) Reset()                            { panic("not implemented") }
+func (f orphanBloomHasher) BlockSize() int                    { panic("not implemented") }
+func (f orphanBloomHasher) Size() int                         { return 8 }
+func (f orphanBloomHasher) Sum64() uint64                     { return binary.BigEndian.Uint64(f) }
+
+// OrphanScan counts the trie nodes in the persistent database which are not
+// reachable from any of the given state roots, along with their total size.
+// The reachable nodes, including the ones of the storage tries, are marked in
+// a bloom filter sized by the number of nodes on disk, so the memory usage is
+// bounded. Due to false-positives, a few orphans might be counted as live, but
+// never the other way around. Nothing is deleted. The scan is aborted with the
+// error of the context of the database once it's cancelled, see WithContext.
+func (db *Database) OrphanScan(roots []common.Hash) (int, common.StorageSize, error) {
+	var (
+		ctx    = db.Context()
+		start  = time.Now()
+		scheme = db.Scheme()
+		total  uint64
+	)
+	// Count the nodes in the persistent database for sizing the bloom filter.
+	err := db.scanNodes(ctx, scheme, func(hash common.Hash, size int) {
+		total++
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	if total == 0 {
+		return 0, 0, nil
+	}
+	bloom, err := bloomfilter.NewOptimal(total, orphanBloomRate)
+	if err != nil {
+		return 0, 0, err
+	}
+	// Mark all the nodes reachable from the live roots.
+	for _, root := range roots {
+		if err := db.markNodes(ctx, root, bloom); err != nil {
+			return 0, 0, err
+		}
+	}
+	// Count the nodes which are not marked.
+	var (
+		orphans int
+		size    common.StorageSize
+	)
+	err = db.scanNodes(ctx, scheme, func(hash common.Hash, n int) {
+		if !bloom.Contains(orphanBloomHasher(hash.Bytes())) {
+			orphans++
+			size += common.StorageSize(n)
+		}
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	log.Info("Scanned orphan trie nodes", "nodes", total, "orphans", orphans, "size", size, "elapsed", common.PrettyDuration(time.Since(start)))
+	return orphans, size, nil
+}
+
+// markNodes adds the hashes of all the nodes in the state with the given root
+// into the bloom filter, including the ones of the storage tries. It's aborted
+// once the given context is cancelled.
+func (db *Database) markNodes(ctx context.Context, root common.Hash, bloom *bloomfilter.Filter) error {
+	if root == types.EmptyRootHash {
+		return nil
+	}
+	tr, err := New(TrieID(root), db)
+	if err != nil {
+		return err
+	}
+	it, err := tr.NodeIterator(nil)
+	if err != nil {
+		return err
+	}
+	for it.Next(true) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if hash := it.Hash(); hash != (common.Hash{}) {
+			bloom.Add(orphanBloomHasher(hash.Bytes()))
+		}
+		if !it.Leaf() {
+			continue
+		}
+		var acct types.StateAccount
+		if err := rlp.DecodeBytes(it.LeafBlob(), &acct); err != nil {
+			return err
+		}
+		if acct.Root == types.EmptyRootHash {
+			continue
+		}
+		storage, err := New(StorageTrieID(root, common.BytesToHash(it.LeafKey()), acct.Root), db)
+		if err != nil {
+			return err
+		}
+		sit, err := storage.NodeIterator(nil)
+		if err != nil {
+			return err
+		}
+		for sit.Next(true) {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if hash := sit.Hash(); hash != (common.Hash{}) {
+				bloom.Add(orphanBloomHasher(hash.Bytes()))
+			}
+		}
+		if sit.Error() != nil {
+			return sit.Error()
+		}
+	}
+	return it.Error()
+}
+
+// scanNodes iterates all the trie nodes in the persistent database in the
+// given scheme, invoking the callback with their hashes and sizes. It's aborted
+// once the given context is cancelled.
+func (db *Database) scanNodes(ctx context.Context, scheme string, onNode func(hash common.Hash, size int)) error {
+	it := db.diskdb.NewIterator(nil, nil)
+	defer it.Release()
+
+	for count := 0; it.Next(); count++ {
+		if count%1000 == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+		key, val := it.Key(), it.Value()
+		switch scheme {
+		case rawdb.HashScheme:
+			if rawdb.IsLegacyTrieNode(key, val) {
+				onNode(common.BytesToHash(key), len(val))
+			}
+		case rawdb.PathScheme:
+			if rawdb.IsAccountTrieNode(key) || rawdb.IsStorageTrieNode(key) {
+				onNode(crypto.Keccak256Hash(val), len(val))
+			}
+		}
+	}
+	return it.Error()
+}
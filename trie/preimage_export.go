@@ -0,0 +1,130 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// preimageRecord is a preimage exported by ExportPreimages.
+type preimageRecord struct {
+	Hash     common.Hash
+	Preimage []byte
+}
+
+// ExportPreimages writes all the persisted preimages into the writer, each as
+// an RLP encoded record of the hash and the preimage, so that they can be loaded
+// by another node with ImportPreimages. The preimages cached in memory are
+// flushed beforehand so that they're exported as well.
+func (db *Database) ExportPreimages(w io.Writer) error {
+	if db.preimages != nil {
+		if err := db.preimages.commit(true); err != nil {
+			return err
+		}
+	}
+	it := db.diskdb.NewIterator(rawdb.PreimagePrefix, nil)
+	defer it.Release()
+
+	var count int
+	for it.Next() {
+		key := it.Key()
+		if len(key) != len(rawdb.PreimagePrefix)+common.HashLength {
+			continue
+		}
+		record := preimageRecord{
+			Hash:     common.BytesToHash(key[len(rawdb.PreimagePrefix):]),
+			Preimage: it.Value(),
+		}
+		if err := rlp.Encode(w, &record); err != nil {
+			return err
+		}
+		count++
+	}
+	if err := it.Error(); err != nil {
+		return err
+	}
+	log.Info("Exported preimages", "count", count)
+	return nil
+}
+
+// ImportPreimages loads the preimages written by ExportPreimages into the
+// persistent database and returns the number of the ones added, the ones
+// already known are skipped. Each record is verified against its hash, the
+// import is aborted at the first corrupted one, leaving the records before it
+// imported. The imported preimages are not indexed by block, thus they're never
+// pruned by Config.PreimageRetention.
+func (db *Database) ImportPreimages(r io.Reader) (int, error) {
+	if db.readOnly.Load() {
+		return 0, ErrReadOnly
+	}
+	var (
+		stream   = rlp.NewStream(r, 0)
+		batch    = db.diskdb.NewBatch()
+		counters = rawdb.NewPreimageCounters(db.registry)
+		added    int
+	)
+	write := func() error {
+		if err := batch.Write(); err != nil {
+			return err
+		}
+		batch.Reset()
+		return nil
+	}
+	for index := 0; ; index++ {
+		var record preimageRecord
+		if err := stream.Decode(&record); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if werr := write(); werr != nil {
+				return 0, werr
+			}
+			return added, fmt.Errorf("record %d: %w", index, err)
+		}
+		if hash := crypto.Keccak256Hash(record.Preimage); hash != record.Hash {
+			if err := write(); err != nil {
+				return 0, err
+			}
+			return added, fmt.Errorf("record %d: corrupted preimage, want hash %x, got %x", index, record.Hash, hash)
+		}
+		if rawdb.ReadPreimage(db.diskdb, record.Hash) != nil {
+			continue
+		}
+		rawdb.WritePreimagesCounted(batch, map[common.Hash][]byte{record.Hash: record.Preimage}, counters)
+		added++
+
+		if batch.ValueSize() >= ethdb.IdealBatchSize {
+			if err := write(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if err := write(); err != nil {
+		return 0, err
+	}
+	log.Info("Imported preimages", "added", added)
+	return added, nil
+}
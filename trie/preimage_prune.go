@@ -0,0 +1,153 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// referencedKeys walks the states with the given roots, including all the
+// storage tries, and collects the hashes of the account and storage slot keys.
+func (db *Database) referencedKeys(liveRoots []common.Hash) (map[common.Hash]struct{}, error) {
+	keys := make(map[common.Hash]struct{})
+	for _, root := range liveRoots {
+		err := db.StreamAccounts(root, func(accHash common.Hash, acc []byte, storageRoot common.Hash) error {
+			keys[accHash] = struct{}{}
+			return db.StreamStorage(root, accHash, storageRoot, func(key []byte, value []byte) error {
+				keys[common.BytesToHash(key)] = struct{}{}
+				return nil
+			})
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// iterateUnreferencedPreimages invokes the callback with the hash and the size
+// of each persisted preimage whose key is not used by any of the given states.
+func (db *Database) iterateUnreferencedPreimages(liveRoots []common.Hash, fn func(hash common.Hash, size int) error) error {
+	keys, err := db.referencedKeys(liveRoots)
+	if err != nil {
+		return err
+	}
+	it := db.diskdb.NewIterator(rawdb.PreimagePrefix, nil)
+	defer it.Release()
+
+	for it.Next() {
+		key := it.Key()
+		if len(key) != len(rawdb.PreimagePrefix)+common.HashLength {
+			continue
+		}
+		hash := common.BytesToHash(key[len(rawdb.PreimagePrefix):])
+		if _, ok := keys[hash]; ok {
+			continue
+		}
+		if err := fn(hash, len(key)+len(it.Value())); err != nil {
+			return err
+		}
+	}
+	return it.Error()
+}
+
+// UnreferencedPreimages reports the number and the size of the persisted
+// preimages whose keys are not used by any of the given states, namely the ones
+// PrunePreimages would delete. The given states are walked entirely, including
+// all the storage tries, and the keys used are held in memory meanwhile. The
+// preimages still cached in memory are not counted.
+func (db *Database) UnreferencedPreimages(liveRoots []common.Hash) (int, common.StorageSize, error) {
+	var (
+		count int
+		size  common.StorageSize
+	)
+	err := db.iterateUnreferencedPreimages(liveRoots, func(hash common.Hash, n int) error {
+		count++
+		size += common.StorageSize(n)
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return count, size, nil
+}
+
+// PrunePreimages deletes the persisted preimages whose keys are not used by
+// any of the given states, which must cover all the states still in use. The
+// preimages cached in memory are flushed beforehand so that they're judged as
+// well. See UnreferencedPreimages.
+func (db *Database) PrunePreimages(liveRoots []common.Hash) error {
+	if db.readOnly.Load() {
+		return ErrReadOnly
+	}
+	if db.preimages != nil {
+		if err := db.preimages.commit(true); err != nil {
+			return err
+		}
+	}
+	var (
+		batch   = db.diskdb.NewBatch()
+		count   int
+		indexed uint64
+	)
+	err := db.iterateUnreferencedPreimages(liveRoots, func(hash common.Hash, size int) error {
+		number, ok := rawdb.ReadPreimageBlock(db.diskdb, hash)
+		if ok {
+			indexed++
+		}
+		rawdb.DeletePreimage(batch, hash, number)
+		count++
+		if batch.ValueSize() >= ethdb.IdealBatchSize {
+			if err := batch.Write(); err != nil {
+				return err
+			}
+			batch.Reset()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := batch.Write(); err != nil {
+		return err
+	}
+	if indexed > 0 {
+		db.releaseRetained(indexed)
+	}
+	log.Info("Pruned unreferenced preimages", "count", count)
+	return nil
+}
+
+// releaseRetained deducts the given number of the deleted preimages from the
+// counter of the ones indexed by block.
+func (db *Database) releaseRetained(n uint64) {
+	if db.preimages != nil {
+		db.preimages.lock.Lock()
+		defer db.preimages.lock.Unlock()
+	}
+	retained := rawdb.ReadPreimageRetained(db.diskdb)
+	if n > retained {
+		n = retained
+	}
+	rawdb.WritePreimageRetained(db.diskdb, retained-n)
+	if db.preimages != nil && db.preimages.retention != 0 {
+		db.preimages.retained = retained - n
+	}
+}
@@ -17,27 +17,62 @@
 package trie
 
 import (
+	"math"
 	"sync"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/rawdb"
 	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/metrics"
+	"github.com/ethereum/go-ethereum/trie/trienode"
 )
 
 // preimageStore is the store for caching preimages of node key.
 type preimageStore struct {
 	lock          sync.RWMutex
 	disk          ethdb.KeyValueStore
-	preimages     map[common.Hash][]byte // Preimages of nodes from the secure trie
-	preimagesSize common.StorageSize     // Storage size of the preimages cache
+	preimages     map[common.Hash][]byte  // Preimages of nodes from the secure trie
+	preimagesSize common.StorageSize      // Storage size of the preimages cache
+	replicator    trienode.Replicator     // Receiver of the persisted preimages, nil if not replicated
+	syncEvery     int                     // Number of flushes per fsync, zero or one means syncing every flush
+	flushes       uint64                  // Number of flushes since the store was opened
+	counters      *rawdb.PreimageCounters // Counters of the persisted preimages, nil means the default ones
+
+	// Fields for pruning the preimages beyond the retention window, all the
+	// persisted preimages are indexed by the block of the introducing update.
+	retention uint64                 // Number of recent blocks to retain preimages for, zero means keep all
+	block     uint64                 // Number of the most recent update
+	fresh     []common.Hash          // Preimages inserted since the most recent update
+	blocks    map[common.Hash]uint64 // Block numbers of the cached preimages
+	retained  uint64                 // Number of the persisted preimages indexed by block
+	pruned    uint64                 // Number of the preimages pruned since the store was opened
 }
 
-// newPreimageStore initializes the store for caching preimages.
-func newPreimageStore(disk ethdb.KeyValueStore) *preimageStore {
-	return &preimageStore{
-		disk:      disk,
-		preimages: make(map[common.Hash][]byte),
+// newPreimageStore initializes the store for caching preimages with the options
+// of the given database config. The persisted preimages older than the retention
+// window are pruned, unless the retention is zero.
+func newPreimageStore(disk ethdb.KeyValueStore, config *Config) *preimageStore {
+	store := &preimageStore{
+		disk:       disk,
+		preimages:  make(map[common.Hash][]byte),
+		replicator: config.Replicator,
+		retention:  config.PreimageRetention,
+		syncEvery:  config.PreimageSyncEvery,
+	}
+	if store.retention != 0 {
+		store.blocks = make(map[common.Hash]uint64)
+		store.retained = rawdb.ReadPreimageRetained(disk)
 	}
+	return store
+}
+
+// setMetricsRegistry counts the persisted preimages in the given registry rather
+// than the default one.
+func (store *preimageStore) setMetricsRegistry(r metrics.Registry) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	store.counters = rawdb.NewPreimageCounters(r)
 }
 
 // insertPreimage writes a new trie node pre-image to the memory database if it's
@@ -53,6 +88,33 @@ func (store *preimageStore) insertPreimage(preimages map[common.Hash][]byte) {
 		}
 		store.preimages[hash] = preimage
 		store.preimagesSize += common.StorageSize(common.HashLength + len(preimage))
+		if store.retention != 0 {
+			store.fresh = append(store.fresh, hash)
+		}
+	}
+}
+
+// tag associates the preimages inserted since the last update with the block
+// of the given update.
+func (store *preimageStore) tag(block uint64) {
+	if store.retention == 0 {
+		return
+	}
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	store.tagFresh(block)
+}
+
+// tagFresh associates the fresh preimages with the given block. The caller
+// must hold the lock.
+func (store *preimageStore) tagFresh(block uint64) {
+	for _, hash := range store.fresh {
+		store.blocks[hash] = block
+	}
+	store.fresh = store.fresh[:0]
+	if block > store.block {
+		store.block = block
 	}
 }
 
@@ -77,13 +139,97 @@ func (store *preimageStore) commit(force bool) error {
 	if store.preimagesSize <= 4*1024*1024 && !force {
 		return nil
 	}
-	batch := store.disk.NewBatch()
-	rawdb.WritePreimages(batch, store.preimages)
-	if err := batch.Write(); err != nil {
+	batch := trienode.NewReplicatedBatch(store.disk.NewBatch(), store.replicator)
+	rawdb.WritePreimagesCounted(batch, store.preimages, store.counters)
+	if store.retention != 0 {
+		store.tagFresh(store.block)
+		retained := store.retained
+		for hash, block := range store.blocks {
+			if old, ok := rawdb.ReadPreimageBlock(store.disk, hash); !ok {
+				retained++
+			} else if old != block {
+				rawdb.DeletePreimageBlockIndex(batch, hash, old)
+			}
+			rawdb.WritePreimageBlock(batch, hash, block)
+		}
+		rawdb.WritePreimageRetained(batch, retained)
+		store.retained = retained
+	}
+	store.flushes++
+	fsync := store.syncEvery <= 1 || store.flushes%uint64(store.syncEvery) == 0
+	if err := writeBatch(batch, fsync); err != nil {
 		return err
 	}
 	store.preimages, store.preimagesSize = make(map[common.Hash][]byte), 0
-	return nil
+	if store.retention == 0 {
+		return nil
+	}
+	store.blocks = make(map[common.Hash]uint64)
+	if store.block <= store.retention {
+		return nil
+	}
+	return store.prune(store.block-store.retention, fsync)
+}
+
+// writeBatch flushes the batch into disk, without forcing an fsync unless it's
+// requested or it's not supported by the batch.
+func writeBatch(batch ethdb.Batch, fsync bool) error {
+	if w, ok := batch.(ethdb.NoSyncWriter); ok && !fsync {
+		return w.WriteNoSync()
+	}
+	return batch.Write()
+}
+
+// prune removes the persisted preimages associated with the blocks before the
+// given number, forcing an fsync of the writes only if requested. The caller
+// must hold the lock.
+func (store *preimageStore) prune(before uint64, fsync bool) error {
+	var (
+		batch = trienode.NewReplicatedBatch(store.disk.NewBatch(), store.replicator)
+		count uint64
+	)
+	write := func() error {
+		if count > store.retained {
+			count = store.retained
+		}
+		rawdb.WritePreimageRetained(batch, store.retained-count)
+		if err := writeBatch(batch, fsync); err != nil {
+			return err
+		}
+		store.retained -= count
+		store.pruned += count
+		batch.Reset()
+		count = 0
+		return nil
+	}
+	err := rawdb.IteratePreimageBlocks(store.disk, before, func(number uint64, hash common.Hash) error {
+		rawdb.DeletePreimage(batch, hash, number)
+		count++
+		if batch.ValueSize() >= ethdb.IdealBatchSize {
+			return write()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return nil
+	}
+	return write()
+}
+
+// metrics returns the statistics of the preimages, see PreimageMetrics.
+func (store *preimageStore) metrics() PreimageMetrics {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	return PreimageMetrics{
+		Cached:    len(store.preimages),
+		CacheSize: store.preimagesSize,
+		Retained:  store.retained,
+		Pruned:    store.pruned,
+	}
 }
 
 // size returns the current storage size of accumulated preimages.
@@ -93,3 +239,54 @@ func (store *preimageStore) size() common.StorageSize {
 
 	return store.preimagesSize
 }
+
+// reset discards all the cached preimages.
+func (store *preimageStore) reset() {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	store.preimages, store.preimagesSize = make(map[common.Hash][]byte), 0
+	if store.retention != 0 {
+		store.fresh, store.blocks = store.fresh[:0], make(map[common.Hash]uint64)
+		store.block, store.retained = 0, 0
+	}
+}
+
+// deletePreimages removes all the preimages stored in the persistent database,
+// along with their block index.
+func deletePreimages(db ethdb.KeyValueStore) error {
+	batch := db.NewBatch()
+	err := rawdb.IteratePreimageBlocks(db, math.MaxUint64, func(number uint64, hash common.Hash) error {
+		rawdb.DeletePreimage(batch, hash, number)
+		if batch.ValueSize() >= ethdb.IdealBatchSize {
+			if err := batch.Write(); err != nil {
+				return err
+			}
+			batch.Reset()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	rawdb.WritePreimageRetained(batch, 0)
+
+	it := db.NewIterator(rawdb.PreimagePrefix, nil)
+	defer it.Release()
+
+	for it.Next() {
+		if err := batch.Delete(it.Key()); err != nil {
+			return err
+		}
+		if batch.ValueSize() >= ethdb.IdealBatchSize {
+			if err := batch.Write(); err != nil {
+				return err
+			}
+			batch.Reset()
+		}
+	}
+	if err := it.Error(); err != nil {
+		return err
+	}
+	return batch.Write()
+}
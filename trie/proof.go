@@ -20,10 +20,13 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"math/big"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rlp"
 )
 
 // Prove constructs a merkle proof for key. The result contains all encoded nodes
@@ -100,6 +103,255 @@ func (t *Trie) Prove(key []byte, proofDb ethdb.KeyValueWriter) error {
 	return nil
 }
 
+// Prove constructs a merkle proof for key in the account trie of the specified
+// state, by resolving the nodes along the path straight from the database. The
+// returned proof contains the encoded nodes in order, starting from the root.
+//
+// If the trie does not contain a value for key, the returned proof contains all
+// nodes of the longest existing prefix of the key (at least the root node), ending
+// with the node that proves the absence of the key.
+func (db *Database) Prove(root common.Hash, key []byte) ([][]byte, error) {
+	proof, _, err := db.prove(root, common.Hash{}, root, key)
+	return proof, err
+}
+
+// ProveStorage constructs a merkle proof for key in the storage trie of the given
+// account in the specified state. The account is identified by the hash of its
+// address, namely its key in the account trie.
+func (db *Database) ProveStorage(root common.Hash, account common.Hash, key []byte) ([][]byte, error) {
+	_, blob, err := db.prove(root, common.Hash{}, root, account.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	storageRoot := types.EmptyRootHash
+	if len(blob) != 0 {
+		var acct types.StateAccount
+		if err := rlp.DecodeBytes(blob, &acct); err != nil {
+			return nil, err
+		}
+		storageRoot = acct.Root
+	}
+	if storageRoot == types.EmptyRootHash {
+		return nil, fmt.Errorf("account %#x has no storage", account)
+	}
+	proof, _, err := db.prove(root, account, storageRoot, key)
+	return proof, err
+}
+
+// StorageProof is the merkle proof of a storage slot reported by GetProof.
+type StorageProof struct {
+	Key   common.Hash // Hash of the slot key, namely its key in the storage trie
+	Value []byte      // Value of the slot with the leading zeroes trimmed, nil if absent
+	Proof [][]byte    // Encoded nodes on the path to the slot, starting from the root
+}
+
+// ProofResult is the merkle proof of an account and some of its storage slots
+// reported by GetProof, in the format of the eth_getProof RPC.
+type ProofResult struct {
+	AccountProof [][]byte       // Encoded nodes on the path to the account, starting from the root
+	Nonce        uint64         // Nonce of the account, zero if absent
+	Balance      *big.Int       // Balance of the account, zero if absent
+	CodeHash     common.Hash    // Code hash of the account, the empty one if absent
+	StorageHash  common.Hash    // Root of the storage trie, the empty one if absent
+	StorageProof []StorageProof // Proofs of the requested slots, in the requested order
+}
+
+// GetProof constructs the merkle proofs of the given account and of the given
+// storage slots of it in the specified state, as served by the eth_getProof
+// RPC. The account and the slots are identified by the hashes of the address
+// and of the slot keys, namely their keys in the tries. All the nodes are
+// resolved through the same reader, hence from the same state even if it's
+// being flushed meanwhile.
+//
+// The absent account or slots are not an error, they are reported with their
+// proofs of absence and zero values, the proofs being empty if the trie is.
+func (db *Database) GetProof(root common.Hash, account common.Hash, storageKeys []common.Hash) (*ProofResult, error) {
+	var reader Reader = emptyReader{}
+	if root != types.EmptyRootHash {
+		r, err := db.Reader(root)
+		if err != nil {
+			return nil, &MissingNodeError{NodeHash: root, err: err}
+		}
+		reader = r
+	}
+	prove := func(owner common.Hash, trieRoot common.Hash, key []byte) ([][]byte, []byte, error) {
+		tr := &trieReader{owner: owner, reader: reader}
+		proof, value, err := proveKey(trieRoot, key, func(prefix []byte, hash common.Hash) ([]byte, node, error) {
+			blob, err := tr.node(prefix, hash)
+			if err != nil {
+				return nil, nil, err
+			}
+			return blob, mustDecodeNode(hash.Bytes(), blob), nil
+		})
+		if proof == nil {
+			proof = [][]byte{}
+		}
+		return proof, value, err
+	}
+	accountProof, blob, err := prove(common.Hash{}, root, account.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	result := &ProofResult{
+		AccountProof: accountProof,
+		Balance:      new(big.Int),
+		CodeHash:     types.EmptyCodeHash,
+		StorageHash:  types.EmptyRootHash,
+		StorageProof: make([]StorageProof, 0, len(storageKeys)),
+	}
+	if len(blob) != 0 {
+		var acct types.StateAccount
+		if err := rlp.DecodeBytes(blob, &acct); err != nil {
+			return nil, err
+		}
+		result.Nonce, result.StorageHash = acct.Nonce, acct.Root
+		if acct.Balance != nil {
+			result.Balance = acct.Balance
+		}
+		if len(acct.CodeHash) != 0 {
+			result.CodeHash = common.BytesToHash(acct.CodeHash)
+		}
+	}
+	for _, key := range storageKeys {
+		proof, value, err := prove(account, result.StorageHash, key.Bytes())
+		if err != nil {
+			return nil, err
+		}
+		if len(value) != 0 {
+			if _, value, _, err = rlp.Split(value); err != nil {
+				return nil, err
+			}
+		}
+		result.StorageProof = append(result.StorageProof, StorageProof{Key: key, Value: value, Proof: proof})
+	}
+	return result, nil
+}
+
+// prove collects the encoded nodes on the path to key in the trie identified by
+// the given owner and root, returning them along with the value found at key.
+func (db *Database) prove(stateRoot common.Hash, owner common.Hash, root common.Hash, key []byte) ([][]byte, []byte, error) {
+	reader, err := newTrieReader(stateRoot, owner, db)
+	if err != nil {
+		return nil, nil, err
+	}
+	return proveKey(root, key, func(prefix []byte, hash common.Hash) ([]byte, node, error) {
+		blob, err := reader.node(prefix, hash)
+		if err != nil {
+			return nil, nil, err
+		}
+		return blob, mustDecodeNode(hash.Bytes(), blob), nil
+	})
+}
+
+// bulkProofNodeLimit is the maximum number of trie nodes resolved by a single
+// BulkProve call, the keys beyond it are left unproven.
+const bulkProofNodeLimit = 65536
+
+// errBulkProofLimit is reported for the keys left unproven by BulkProve, since
+// the limit of the resolved nodes has been reached.
+var errBulkProofLimit = errors.New("proof work limit reached")
+
+// BulkProve constructs the merkle proofs for all the given keys in the account
+// trie of the specified state, in the format of Prove. The nodes shared by the
+// paths of multiple keys are resolved and decoded only once, and the proofs
+// share the same node blobs, which must not be modified.
+//
+// At most bulkProofNodeLimit nodes are resolved. If some of the keys couldn't
+// be proven, the proofs of the rest are returned along with a PartialProofError
+// identifying the failed ones.
+func (db *Database) BulkProve(root common.Hash, keys [][]byte) (map[string][][]byte, error) {
+	reader, err := newTrieReader(root, common.Hash{}, db)
+	if err != nil {
+		return nil, err
+	}
+	type resolved struct {
+		blob []byte
+		node node
+	}
+	var (
+		cache  = make(map[common.Hash]resolved)
+		proofs = make(map[string][][]byte, len(keys))
+		failed = make(map[string]error)
+	)
+	resolve := func(prefix []byte, hash common.Hash) ([]byte, node, error) {
+		if r, ok := cache[hash]; ok {
+			return r.blob, r.node, nil
+		}
+		if len(cache) >= bulkProofNodeLimit {
+			return nil, nil, errBulkProofLimit
+		}
+		blob, err := reader.node(prefix, hash)
+		if err != nil {
+			return nil, nil, err
+		}
+		n := mustDecodeNode(hash.Bytes(), blob)
+		cache[hash] = resolved{blob: blob, node: n}
+		return blob, n, nil
+	}
+	for _, key := range keys {
+		if _, ok := proofs[string(key)]; ok {
+			continue
+		}
+		proof, _, err := proveKey(root, key, resolve)
+		if err != nil {
+			failed[string(key)] = err
+			continue
+		}
+		proofs[string(key)] = proof
+	}
+	if len(failed) > 0 {
+		return proofs, &PartialProofError{Failed: failed}
+	}
+	return proofs, nil
+}
+
+// proveKey collects the encoded nodes on the path to key in the trie with the
+// given root, returning them along with the value found at key. The nodes
+// referenced by hash are retrieved through resolve.
+func proveKey(root common.Hash, key []byte, resolve func(prefix []byte, hash common.Hash) ([]byte, node, error)) ([][]byte, []byte, error) {
+	var (
+		prefix []byte
+		proof  [][]byte
+		tn     node
+	)
+	if root != types.EmptyRootHash {
+		tn = hashNode(root.Bytes())
+	}
+	key = keybytesToHex(key)
+	for len(key) > 0 && tn != nil {
+		switch n := tn.(type) {
+		case *shortNode:
+			if len(key) < len(n.Key) || !bytes.Equal(n.Key, key[:len(n.Key)]) {
+				// The trie doesn't contain the key.
+				tn = nil
+			} else {
+				tn = n.Val
+				prefix = append(prefix, n.Key...)
+				key = key[len(n.Key):]
+			}
+		case *fullNode:
+			tn = n.Children[key[0]]
+			prefix = append(prefix, key[0])
+			key = key[1:]
+		case hashNode:
+			// The nodes referenced by hash are exactly the proof elements,
+			// the embedded ones are included in their parents.
+			blob, resolved, err := resolve(prefix, common.BytesToHash(n))
+			if err != nil {
+				return nil, nil, err
+			}
+			proof = append(proof, blob)
+			tn = resolved
+		default:
+			panic(fmt.Sprintf("%T: invalid node: %v", tn, tn))
+		}
+	}
+	if value, ok := tn.(valueNode); ok && len(key) == 0 {
+		return proof, value, nil
+	}
+	return proof, nil, nil
+}
+
 // Prove constructs a merkle proof for key. The result contains all encoded nodes
 // on the path to the value at key. The value itself is also included in the last
 // node and can be retrieved by verifying the proof.
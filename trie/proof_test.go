@@ -20,14 +20,21 @@ import (
 	"bytes"
 	crand "crypto/rand"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"math/big"
 	mrand "math/rand"
+	"reflect"
 	"testing"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/trie/trienode"
+	"golang.org/x/exp/maps"
 	"golang.org/x/exp/slices"
 )
 
@@ -142,6 +149,235 @@ func TestBadProof(t *testing.T) {
 	}
 }
 
+// Tests that the proofs constructed by database directly are identical to
+// the ones generated by trie.
+func TestDatabaseProof(t *testing.T) {
+	testDatabaseProof(t, rawdb.HashScheme)
+	testDatabaseProof(t, rawdb.PathScheme)
+}
+
+func testDatabaseProof(t *testing.T, scheme string) {
+	db := newTestDatabase(rawdb.NewMemoryDatabase(), scheme)
+	tr := NewEmpty(db)
+	vals := make(map[string][]byte)
+	for i := 0; i < 500; i++ {
+		k, v := randBytes(32), randBytes(20)
+		tr.MustUpdate(k, v)
+		vals[string(k)] = v
+	}
+	root, nodes, _ := tr.Commit(false)
+	db.Update(root, types.EmptyRootHash, 0, trienode.NewWithNodeSet(nodes), nil)
+
+	tr, _ = New(TrieID(root), db)
+	for _, key := range append(maps.Keys(vals), string(randBytes(32))) {
+		key := []byte(key)
+		proof, err := db.Prove(root, key)
+		if err != nil {
+			t.Fatalf("Failed to construct proof for key %x: %v", key, err)
+		}
+		want := memorydb.New()
+		tr.Prove(key, want)
+		if len(proof) != want.Len() {
+			t.Fatalf("Unexpected proof size for key %x, want: %d, got: %d", key, want.Len(), len(proof))
+		}
+		have := memorydb.New()
+		for _, blob := range proof {
+			have.Put(crypto.Keccak256(blob), blob)
+		}
+		val, err := VerifyProof(root, key, have)
+		if err != nil {
+			t.Fatalf("Failed to verify proof for key %x: %v", key, err)
+		}
+		if !bytes.Equal(val, vals[string(key)]) {
+			t.Fatalf("Verified value mismatch for key %x: have %x, want %x", key, val, vals[string(key)])
+		}
+	}
+}
+
+func TestDatabaseStorageProof(t *testing.T) {
+	db := newTestDatabase(rawdb.NewMemoryDatabase(), rawdb.PathScheme)
+
+	owner := common.HexToHash("0xdeadbeef")
+	storage, _ := New(StorageTrieID(types.EmptyRootHash, owner, types.EmptyRootHash), db)
+	updateString(storage, "120000", "qwerqwerqwerqwerqwerqwerqwerqwer")
+	updateString(storage, "123456", "asdfasdfasdfasdfasdfasdfasdfasdf")
+	storageRoot, storageNodes, _ := storage.Commit(false)
+
+	account := NewEmpty(db)
+	blob, _ := rlp.EncodeToBytes(&types.StateAccount{Balance: big.NewInt(1), Root: storageRoot, CodeHash: types.EmptyCodeHash.Bytes()})
+	account.MustUpdate(owner.Bytes(), blob)
+	root, accountNodes, _ := account.Commit(true)
+
+	set := trienode.NewWithNodeSet(accountNodes)
+	set.Merge(storageNodes)
+	db.Update(root, types.EmptyRootHash, 0, set, nil)
+
+	proof, err := db.ProveStorage(root, owner, []byte("123456"))
+	if err != nil {
+		t.Fatalf("Failed to construct storage proof: %v", err)
+	}
+	proofDb := memorydb.New()
+	for _, blob := range proof {
+		proofDb.Put(crypto.Keccak256(blob), blob)
+	}
+	val, err := VerifyProof(storageRoot, []byte("123456"), proofDb)
+	if err != nil {
+		t.Fatalf("Failed to verify storage proof: %v", err)
+	}
+	if string(val) != "asdfasdfasdfasdfasdfasdfasdfasdf" {
+		t.Fatalf("Verified value mismatch: %q", val)
+	}
+	if _, err := db.ProveStorage(root, common.HexToHash("0xcafe"), []byte("123456")); err == nil {
+		t.Fatal("Expected error for account without storage")
+	}
+}
+
+func TestGetProof(t *testing.T) {
+	for _, scheme := range []string{rawdb.HashScheme, rawdb.PathScheme} {
+		db := newTestDatabase(rawdb.NewMemoryDatabase(), scheme)
+
+		var (
+			owner = common.HexToHash("0xdeadbeef")
+			slot  = common.HexToHash("0x01")
+			value = []byte{0x00, 0x2a}
+		)
+		storage, _ := New(StorageTrieID(types.EmptyRootHash, owner, types.EmptyRootHash), db)
+		enc, _ := rlp.EncodeToBytes(common.TrimLeftZeroes(value))
+		storage.MustUpdate(slot.Bytes(), enc)
+		storage.MustUpdate(common.HexToHash("0x02").Bytes(), enc)
+		storageRoot, storageNodes, _ := storage.Commit(false)
+
+		account := NewEmpty(db)
+		blob, _ := rlp.EncodeToBytes(&types.StateAccount{Nonce: 3, Balance: big.NewInt(7), Root: storageRoot, CodeHash: types.EmptyCodeHash.Bytes()})
+		account.MustUpdate(owner.Bytes(), blob)
+		blob, _ = rlp.EncodeToBytes(&types.StateAccount{Balance: big.NewInt(1), Root: types.EmptyRootHash, CodeHash: types.EmptyCodeHash.Bytes()})
+		account.MustUpdate(common.HexToHash("0xcafe").Bytes(), blob)
+		root, accountNodes, _ := account.Commit(true)
+
+		set := trienode.NewWithNodeSet(accountNodes)
+		set.Merge(storageNodes)
+		db.Update(root, types.EmptyRootHash, 0, set, nil)
+
+		verify := func(root common.Hash, key []byte, proof [][]byte) []byte {
+			proofDb := memorydb.New()
+			for _, blob := range proof {
+				proofDb.Put(crypto.Keccak256(blob), blob)
+			}
+			val, err := VerifyProof(root, key, proofDb)
+			if err != nil {
+				t.Fatalf("Failed to verify proof (%s): %v", scheme, err)
+			}
+			return val
+		}
+		absent := common.HexToHash("0x03")
+		result, err := db.GetProof(root, owner, []common.Hash{slot, absent})
+		if err != nil {
+			t.Fatalf("Failed to construct proof (%s): %v", scheme, err)
+		}
+		if result.Nonce != 3 || result.Balance.Int64() != 7 || result.CodeHash != types.EmptyCodeHash || result.StorageHash != storageRoot {
+			t.Fatalf("Unexpected account (%s): %+v", scheme, result)
+		}
+		if val := verify(root, owner.Bytes(), result.AccountProof); len(val) == 0 {
+			t.Fatalf("Account proof proves absence (%s)", scheme)
+		}
+		if len(result.StorageProof) != 2 || result.StorageProof[0].Key != slot || result.StorageProof[1].Key != absent {
+			t.Fatalf("Unexpected storage proofs (%s): %v", scheme, result.StorageProof)
+		}
+		if have := result.StorageProof[0].Value; !bytes.Equal(have, common.TrimLeftZeroes(value)) {
+			t.Fatalf("Unexpected slot value (%s): %x", scheme, have)
+		}
+		if val := verify(storageRoot, slot.Bytes(), result.StorageProof[0].Proof); !bytes.Equal(val, enc) {
+			t.Fatalf("Unexpected proven slot (%s): %x", scheme, val)
+		}
+		if result.StorageProof[1].Value != nil || verify(storageRoot, absent.Bytes(), result.StorageProof[1].Proof) != nil {
+			t.Fatalf("Absent slot is not proven absent (%s)", scheme)
+		}
+		// The absent account is proven absent, with the empty storage
+		missing := common.HexToHash("0xbeef")
+		result, err = db.GetProof(root, missing, []common.Hash{slot})
+		if err != nil {
+			t.Fatalf("Failed to construct proof of absent account (%s): %v", scheme, err)
+		}
+		if result.Nonce != 0 || result.Balance.Sign() != 0 || result.CodeHash != types.EmptyCodeHash || result.StorageHash != types.EmptyRootHash {
+			t.Fatalf("Unexpected absent account (%s): %+v", scheme, result)
+		}
+		if verify(root, missing.Bytes(), result.AccountProof) != nil {
+			t.Fatalf("Absent account is not proven absent (%s)", scheme)
+		}
+		if len(result.StorageProof) != 1 || result.StorageProof[0].Proof == nil || len(result.StorageProof[0].Proof) != 0 {
+			t.Fatalf("Unexpected storage proofs of absent account (%s): %v", scheme, result.StorageProof)
+		}
+	}
+}
+
+func TestBulkProve(t *testing.T) {
+	testBulkProve(t, rawdb.HashScheme)
+	testBulkProve(t, rawdb.PathScheme)
+}
+
+func testBulkProve(t *testing.T, scheme string) {
+	diskdb := rawdb.NewMemoryDatabase()
+	db := newTestDatabase(diskdb, scheme)
+	tr := NewEmpty(db)
+	var keys [][]byte
+	for i := 0; i < 500; i++ {
+		k := randBytes(32)
+		tr.MustUpdate(k, randBytes(20))
+		keys = append(keys, k)
+	}
+	keys = append(keys, randBytes(32), keys[0])
+
+	root, nodes, _ := tr.Commit(false)
+	db.Update(root, types.EmptyRootHash, 0, trienode.NewWithNodeSet(nodes), nil)
+
+	proofs, err := db.BulkProve(root, keys)
+	if err != nil {
+		t.Fatalf("Failed to construct proofs: %v", err)
+	}
+	if len(proofs) != len(keys)-1 {
+		t.Fatalf("Unexpected number of proofs, want: %d, got: %d", len(keys)-1, len(proofs))
+	}
+	for _, key := range keys {
+		want, err := db.Prove(root, key)
+		if err != nil {
+			t.Fatalf("Failed to construct proof for key %x: %v", key, err)
+		}
+		if !reflect.DeepEqual(proofs[string(key)], want) {
+			t.Fatalf("Unexpected proof for key %x", key)
+		}
+	}
+	if scheme != rawdb.HashScheme {
+		return
+	}
+	// Drop a node below the root from the disk, the keys beneath it are
+	// reported as unproven while the others are still proven.
+	if err := db.Commit(root, false); err != nil {
+		t.Fatalf("Failed to commit: %v", err)
+	}
+	var dropped *trienode.Node
+	for path, n := range nodes.Nodes {
+		if len(path) == 1 && !n.IsDeleted() {
+			dropped = n
+			break
+		}
+	}
+	rawdb.DeleteLegacyTrieNode(diskdb, dropped.Hash)
+
+	proofs, err = NewDatabase(diskdb, nil).BulkProve(root, keys)
+	var perr *PartialProofError
+	if !errors.As(err, &perr) || len(perr.Failed) == 0 {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(proofs)+len(perr.Failed) != len(keys)-1 {
+		t.Fatalf("Unexpected number of results, proofs: %d, failed: %d", len(proofs), len(perr.Failed))
+	}
+	for key := range perr.Failed {
+		if _, ok := proofs[key]; ok {
+			t.Fatalf("Failed key %x is proven", key)
+		}
+	}
+}
+
 // Tests that missing keys can also be proven. The test explicitly uses a single
 // entry trie and checks for missing keys both before and after the single entry.
 func TestMissingKeyProof(t *testing.T) {
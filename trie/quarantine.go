@@ -0,0 +1,134 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/trie/triedb/hashdb"
+	"github.com/ethereum/go-ethereum/trie/triedb/pathdb"
+	"github.com/ethereum/go-ethereum/trie/trienode"
+)
+
+// QuarantinedNode is a trie node moved aside by Quarantine, waiting to be
+// fetched again.
+type QuarantinedNode struct {
+	Owner common.Hash // Owner of the node, zero for the account trie
+	Path  []byte      // Path of the node
+	Hash  common.Hash // Hash the node is expected to have
+}
+
+// quarantineKey returns the key the node is tracked under in the quarantine
+// list. The nodes are identified by the hash alone in the hash-based scheme,
+// as they're stored by hash regardless of the trie containing them.
+func (db *Database) quarantineKey(owner common.Hash, path []byte, hash common.Hash) string {
+	if db.backend.Scheme() == rawdb.HashScheme {
+		return string(hash.Bytes())
+	}
+	return string(owner.Bytes()) + string(path) + string(hash.Bytes())
+}
+
+// Quarantine moves the given trie node aside, e.g. once it's been flagged as
+// corrupted by VerifyRoot, so that it's fetched again instead of being read
+// over and over. The node is evicted from the clean cache, deleted from disk
+// and recorded in the quarantine list reported by QuarantinedNodes. The readers
+// opened afterwards treat it as not found until a copy matching the hash is
+// available again, e.g. written back by the state sync, at which point it's
+// released from the list. A copy still held in memory as dirty is left in
+// place, as it's not the one loaded from disk.
+func (db *Database) Quarantine(owner common.Hash, path []byte, hash common.Hash) error {
+	if db.readOnly.Load() {
+		return ErrReadOnly
+	}
+	var err error
+	switch b := db.backend.(type) {
+	case *hashdb.Database:
+		err = b.Quarantine(hash)
+	case *pathdb.Database:
+		err = b.Quarantine(owner, path)
+	default:
+		return ErrNotSupported
+	}
+	if err != nil {
+		return err
+	}
+	db.quarantineLock.Lock()
+	defer db.quarantineLock.Unlock()
+
+	if db.quarantine == nil {
+		db.quarantine = make(map[string]QuarantinedNode)
+	}
+	db.quarantine[db.quarantineKey(owner, path, hash)] = QuarantinedNode{
+		Owner: owner,
+		Path:  common.CopyBytes(path),
+		Hash:  hash,
+	}
+	return nil
+}
+
+// QuarantinedNodes returns the trie nodes moved aside by Quarantine which
+// haven't been fetched again yet, in no particular order.
+func (db *Database) QuarantinedNodes() []QuarantinedNode {
+	db.quarantineLock.RLock()
+	defer db.quarantineLock.RUnlock()
+
+	nodes := make([]QuarantinedNode, 0, len(db.quarantine))
+	for _, n := range db.quarantine {
+		nodes = append(nodes, QuarantinedNode{Owner: n.Owner, Path: common.CopyBytes(n.Path), Hash: n.Hash})
+	}
+	return nodes
+}
+
+// hasQuarantine reports whether any trie node is in the quarantine list.
+func (db *Database) hasQuarantine() bool {
+	db.quarantineLock.RLock()
+	defer db.quarantineLock.RUnlock()
+
+	return len(db.quarantine) > 0
+}
+
+// quarantineReader is a node reader which treats the quarantined nodes as not
+// found, unless the resolved copy matches the expected hash.
+type quarantineReader struct {
+	Reader
+	db *Database
+}
+
+// Node implements Reader, releasing the quarantined node from the list once
+// it's resolved intact.
+func (r *quarantineReader) Node(owner common.Hash, path []byte, hash common.Hash) ([]byte, error) {
+	blob, err := r.Reader.Node(owner, path, hash)
+	if err != nil {
+		return blob, err
+	}
+	key := r.db.quarantineKey(owner, path, hash)
+
+	r.db.quarantineLock.RLock()
+	_, ok := r.db.quarantine[key]
+	r.db.quarantineLock.RUnlock()
+	if !ok {
+		return blob, nil
+	}
+	if crypto.Keccak256Hash(blob) != hash {
+		return nil, &trienode.NotFoundError{Owner: owner, Path: path, Hash: hash}
+	}
+	r.db.quarantineLock.Lock()
+	delete(r.db.quarantine, key)
+	r.db.quarantineLock.Unlock()
+	return blob, nil
+}
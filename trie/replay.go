@@ -0,0 +1,129 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/trie/triestate"
+)
+
+// ReplayHistory applies the given state diffs in order on top of the state
+// with the specified root and returns the root of the resulting state. Unlike
+// the sets passed to Update, the diffs are forward ones: the values are the
+// content of the states after each transition, in the same encoding, and nil
+// means the state is deleted. The storage root of every account with mutated
+// slots is verified against the one recomputed from the slots.
+//
+// It's independent from the layers maintained by the database, the resulting
+// nodes are only held in memory and discarded afterwards. An error is returned
+// if any node needed is not available in the base state, which is meant to be
+// the disk layer in the path-based scheme.
+func (db *Database) ReplayHistory(base common.Hash, diffs []*triestate.Set) (common.Hash, error) {
+	accounts, err := New(TrieID(base), db)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	// The storage tries mutated so far are kept open, as their nodes are
+	// only available in memory.
+	storages := make(map[common.Hash]*Trie)
+
+	for i, diff := range diffs {
+		for addr := range diff.Storages {
+			if _, ok := diff.Accounts[addr]; !ok {
+				return common.Hash{}, fmt.Errorf("diff %d: storage of %#x mutated without the account", i, addr)
+			}
+		}
+		for addr, blob := range diff.Accounts {
+			addrHash := crypto.Keccak256Hash(addr.Bytes())
+			if len(blob) == 0 {
+				for key, val := range diff.Storages[addr] {
+					if len(val) != 0 {
+						return common.Hash{}, fmt.Errorf("diff %d: slot %#x of deleted account %#x is not deleted", i, key, addr)
+					}
+				}
+				delete(storages, addrHash)
+				if err := accounts.Delete(addrHash.Bytes()); err != nil {
+					return common.Hash{}, err
+				}
+				continue
+			}
+			account, err := types.FullAccount(blob)
+			if err != nil {
+				return common.Hash{}, fmt.Errorf("diff %d: invalid account %#x: %v", i, addr, err)
+			}
+			if slots := diff.Storages[addr]; len(slots) > 0 {
+				st, err := replayStorage(db, base, accounts, storages, addrHash)
+				if err != nil {
+					return common.Hash{}, err
+				}
+				for key, val := range slots {
+					if len(val) == 0 {
+						err = st.Delete(key.Bytes())
+					} else {
+						err = st.Update(key.Bytes(), val)
+					}
+					if err != nil {
+						return common.Hash{}, err
+					}
+				}
+				if root := st.Hash(); root != account.Root {
+					return common.Hash{}, fmt.Errorf("diff %d: storage root mismatch of %#x, want %#x, got %#x", i, addr, account.Root, root)
+				}
+			}
+			full, err := rlp.EncodeToBytes(account)
+			if err != nil {
+				return common.Hash{}, err
+			}
+			if err := accounts.Update(addrHash.Bytes(), full); err != nil {
+				return common.Hash{}, err
+			}
+		}
+	}
+	return accounts.Hash(), nil
+}
+
+// replayStorage returns the storage trie of the given account for replaying,
+// which is either the one mutated by the previous diffs or the one of the
+// account in its current state, which is unchanged since the base state.
+func replayStorage(db *Database, base common.Hash, accounts *Trie, storages map[common.Hash]*Trie, addrHash common.Hash) (*Trie, error) {
+	if st, ok := storages[addrHash]; ok {
+		return st, nil
+	}
+	root := types.EmptyRootHash
+	blob, err := accounts.Get(addrHash.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	if len(blob) != 0 {
+		var account types.StateAccount
+		if err := rlp.DecodeBytes(blob, &account); err != nil {
+			return nil, err
+		}
+		root = account.Root
+	}
+	st, err := New(StorageTrieID(base, addrHash, root), db)
+	if err != nil {
+		return nil, err
+	}
+	storages[addrHash] = st
+	return st, nil
+}
@@ -0,0 +1,180 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"fmt"
+	"math/rand"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// NodeKind is the type of a decoded trie node.
+type NodeKind string
+
+// Node types reported in the sampled and the resolved nodes.
+const (
+	BranchNode    NodeKind = "branch"
+	ExtensionNode NodeKind = "extension"
+	LeafNode      NodeKind = "leaf"
+)
+
+// SampledNode is a trie node encountered during a randomized descent.
+type SampledNode struct {
+	Path  []byte      // Nibble path of the node from the trie root
+	Hash  common.Hash // Hash of the node, zero if it's embedded in the parent
+	Depth int         // Number of nodes above it along the descent
+	Type  NodeKind    // Type of the node, one of branch, extension or leaf
+}
+
+// SampleNodes performs n randomized root-to-leaf descents in the account trie
+// with the given root and returns all the nodes encountered along the way. At
+// every branch node, one of the non-empty children is picked uniformly. The
+// same seed always yields the same samples of a given state.
+func (db *Database) SampleNodes(root common.Hash, n int, seed int64) ([]SampledNode, error) {
+	if root == (common.Hash{}) || root == types.EmptyRootHash {
+		return nil, nil
+	}
+	reader, err := newTrieReader(root, common.Hash{}, db)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		rng     = rand.New(rand.NewSource(seed))
+		samples []SampledNode
+	)
+	for i := 0; i < n; i++ {
+		var (
+			path  []byte
+			hash  common.Hash
+			depth int
+			cur   node = hashNode(root.Bytes())
+		)
+	descent:
+		for {
+			switch nd := cur.(type) {
+			case hashNode:
+				hash = common.BytesToHash(nd)
+				blob, err := reader.node(path, hash)
+				if err != nil {
+					return nil, err
+				}
+				cur, err = decodeNode(nd, blob)
+				if err != nil {
+					return nil, err
+				}
+				continue
+			case *shortNode:
+				typ := ExtensionNode
+				if hasTerm(nd.Key) {
+					typ = LeafNode
+				}
+				samples = append(samples, SampledNode{Path: common.CopyBytes(path), Hash: hash, Depth: depth, Type: typ})
+				if typ == LeafNode {
+					break descent
+				}
+				path = append(path, nd.Key...)
+				cur = nd.Val
+			case *fullNode:
+				samples = append(samples, SampledNode{Path: common.CopyBytes(path), Hash: hash, Depth: depth, Type: BranchNode})
+
+				var children []int
+				for j, child := range nd.Children[:16] {
+					if child != nil {
+						children = append(children, j)
+					}
+				}
+				if len(children) == 0 {
+					break descent
+				}
+				pick := children[rng.Intn(len(children))]
+				path = append(path, byte(pick))
+				cur = nd.Children[pick]
+			case valueNode:
+				break descent
+			default:
+				return nil, fmt.Errorf("invalid node: %v", cur)
+			}
+			hash, depth = common.Hash{}, depth+1
+		}
+	}
+	return samples, nil
+}
+
+// MaxDepth walks the account trie with the given root and returns the depth and
+// the path of its deepest leaf, e.g. for detecting the tries deliberately made
+// deep. The depth is the number of nodes above the leaf, as in SampledNode, and
+// the first one met is reported among the equally deep leaves. The walk is depth
+// first, holding only the nodes along the current path, and is aborted with the
+// error of the context of the database once it's cancelled, see WithContext.
+func (db *Database) MaxDepth(root common.Hash) (int, []byte, error) {
+	if root == (common.Hash{}) || root == types.EmptyRootHash {
+		return 0, nil, nil
+	}
+	reader, err := newTrieReader(root, common.Hash{}, db)
+	if err != nil {
+		return 0, nil, err
+	}
+	var (
+		ctx      = db.Context()
+		maxDepth = -1
+		deepest  []byte
+		walk     func(n node, path []byte, depth int) error
+	)
+	walk = func(n node, path []byte, depth int) error {
+		switch n := n.(type) {
+		case hashNode:
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			blob, err := reader.node(path, common.BytesToHash(n))
+			if err != nil {
+				return err
+			}
+			resolved, err := decodeNode(n, blob)
+			if err != nil {
+				return err
+			}
+			return walk(resolved, path, depth)
+		case *shortNode:
+			if hasTerm(n.Key) {
+				if depth > maxDepth {
+					maxDepth, deepest = depth, common.CopyBytes(path)
+				}
+				return nil
+			}
+			return walk(n.Val, append(path, n.Key...), depth+1)
+		case *fullNode:
+			for i, child := range n.Children[:16] {
+				if child == nil {
+					continue
+				}
+				if err := walk(child, append(path, byte(i)), depth+1); err != nil {
+					return err
+				}
+			}
+			return nil
+		default:
+			return fmt.Errorf("invalid node: %v", n)
+		}
+	}
+	if err := walk(hashNode(root.Bytes()), nil, 0); err != nil {
+		return 0, nil, err
+	}
+	return maxDepth, deepest, nil
+}
@@ -0,0 +1,77 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// StreamAccounts walks the account trie of the specified state in order and
+// invokes the handler with the hash, the encoded body and the storage root of
+// each account. The handler can descend into the storage of the account with
+// StreamStorage. Nodes are resolved on the fly and released once visited, so
+// the memory usage is bounded regardless of the size of the state. Iteration
+// stops at the first error returned by the handler. The handler must not retain
+// the passed slices.
+func (db *Database) StreamAccounts(root common.Hash, handler func(accHash common.Hash, acc []byte, storageRoot common.Hash) error) error {
+	tr, err := New(TrieID(root), db)
+	if err != nil {
+		return err
+	}
+	it, err := tr.NodeIterator(nil)
+	if err != nil {
+		return err
+	}
+	iter := NewIterator(it)
+	for iter.Next() {
+		var acct types.StateAccount
+		if err := rlp.DecodeBytes(iter.Value, &acct); err != nil {
+			return err
+		}
+		if err := handler(common.BytesToHash(iter.Key), iter.Value, acct.Root); err != nil {
+			return err
+		}
+	}
+	return iter.Err
+}
+
+// StreamStorage walks the storage trie of the given account in the specified
+// state in order and invokes the handler with each slot key hash and encoded
+// value. Iteration stops at the first error returned by the handler, which must
+// not retain the passed slices.
+func (db *Database) StreamStorage(root common.Hash, accHash common.Hash, storageRoot common.Hash, handler func(key []byte, value []byte) error) error {
+	if storageRoot == types.EmptyRootHash {
+		return nil
+	}
+	tr, err := New(StorageTrieID(root, accHash, storageRoot), db)
+	if err != nil {
+		return err
+	}
+	it, err := tr.NodeIterator(nil)
+	if err != nil {
+		return err
+	}
+	iter := NewIterator(it)
+	for iter.Next() {
+		if err := handler(iter.Key, iter.Value); err != nil {
+			return err
+		}
+	}
+	return iter.Err
+}
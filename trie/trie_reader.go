@@ -17,16 +17,21 @@
 package trie
 
 import (
+	"errors"
+	"fmt"
+
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/trie/trienode"
 	"github.com/ethereum/go-ethereum/trie/triestate"
 )
 
 // Reader wraps the Node method of a backing trie store.
 type Reader interface {
 	// Node retrieves the trie node blob with the provided trie identifier, node path and
-	// the corresponding node hash. No error will be returned if the node is not found.
+	// the corresponding node hash. If the node is not found, an error matching
+	// ErrNodeNotFound is returned, allowing to tell it apart from corruption.
 	//
 	// When looking up nodes in the account trie, 'owner' is the zero hash. For contract
 	// storage trie nodes, 'owner' is the hash of the account address that containing the
@@ -36,6 +41,112 @@ type Reader interface {
 	Node(owner common.Hash, path []byte, hash common.Hash) ([]byte, error)
 }
 
+// ReaderEx is a node reader which also reports what the resolved nodes are,
+// saving the callers from decoding them again.
+type ReaderEx interface {
+	Reader
+
+	// NodeEx retrieves the trie node like Node, along with its kind and the
+	// value it holds if it's a leaf. Unlike Node, an error is returned if the
+	// node is not found.
+	NodeEx(owner common.Hash, path []byte, hash common.Hash) ([]byte, NodeKind, []byte, error)
+}
+
+// emptyReader is the reader of the empty state, which holds no node at all.
+type emptyReader struct{}
+
+// Node implements Reader, reporting every node as not found.
+func (emptyReader) Node(owner common.Hash, path []byte, hash common.Hash) ([]byte, error) {
+	return nil, &trienode.NotFoundError{Owner: owner, Path: path, Hash: hash}
+}
+
+// storageReader is a node reader scoped to the storage trie of an account.
+type storageReader struct {
+	reader Reader
+	owner  common.Hash
+}
+
+// Node implements Reader, resolving the node in the storage trie of the account
+// regardless of the given owner.
+func (r *storageReader) Node(owner common.Hash, path []byte, hash common.Hash) ([]byte, error) {
+	return r.reader.Node(r.owner, path, hash)
+}
+
+// retryReader is a node reader which resolves a node once more with a fresh
+// backend reader if it's found missing while a flush is in progress, as the
+// node might be moving from the memory into disk at the same time.
+type retryReader struct {
+	Reader
+	db      *Database
+	root    common.Hash
+	nocache bool // Flag whether the clean cache of the backend is bypassed
+}
+
+// Node implements Reader, retrying the not found nodes once the flushes which
+// were in progress during the lookup have settled.
+func (r *retryReader) Node(owner common.Hash, path []byte, hash common.Hash) ([]byte, error) {
+	flushes := r.db.flushes.Load()
+	blob, err := r.Reader.Node(owner, path, hash)
+	if !errors.Is(err, ErrNodeNotFound) {
+		return blob, err
+	}
+	if r.db.flushing.Load() == 0 && r.db.flushes.Load() == flushes {
+		return blob, err
+	}
+	r.db.flushLock.Lock()
+	r.db.flushLock.Unlock()
+
+	reader, rerr := r.db.backendReader(r.root, r.nocache)
+	if rerr != nil {
+		return blob, err
+	}
+	return reader.Node(owner, path, hash)
+}
+
+// contextReader is a node reader which reports the nodes failed to be resolved
+// along with the context of the database it's opened from.
+type contextReader struct {
+	Reader
+	db *Database
+}
+
+// Node implements Reader, reporting the failure if the node can't be resolved.
+func (r *contextReader) Node(owner common.Hash, path []byte, hash common.Hash) ([]byte, error) {
+	blob, err := r.Reader.Node(owner, path, hash)
+	if err != nil {
+		r.db.reportContextError("read", err)
+	}
+	return blob, err
+}
+
+// readerEx implements ReaderEx by decoding the nodes of a backend reader.
+type readerEx struct {
+	Reader
+}
+
+// NodeEx implements ReaderEx, retrieving the trie node and decoding it once.
+func (r readerEx) NodeEx(owner common.Hash, path []byte, hash common.Hash) ([]byte, NodeKind, []byte, error) {
+	blob, err := r.Node(owner, path, hash)
+	if err != nil || len(blob) == 0 {
+		return nil, "", nil, &MissingNodeError{Owner: owner, NodeHash: hash, Path: path, err: err}
+	}
+	n, err := decodeNode(hash.Bytes(), blob)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	switch n := n.(type) {
+	case *shortNode:
+		if value, ok := n.Val.(valueNode); ok {
+			return blob, LeafNode, value, nil
+		}
+		return blob, ExtensionNode, nil, nil
+	case *fullNode:
+		return blob, BranchNode, nil, nil
+	default:
+		return nil, "", nil, fmt.Errorf("invalid node %x: %T", hash, n)
+	}
+}
+
 // trieReader is a wrapper of the underlying node reader. It's not safe
 // for concurrent usage.
 type trieReader struct {
@@ -17,47 +17,82 @@
 package hashdb
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"reflect"
-	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/VictoriaMetrics/fastcache"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/rawdb"
 	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/log"
 	"github.com/ethereum/go-ethereum/metrics"
 	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/trie/triedb/lockstat"
 	"github.com/ethereum/go-ethereum/trie/trienode"
 	"github.com/ethereum/go-ethereum/trie/triestate"
 )
 
-var (
-	memcacheCleanHitMeter   = metrics.NewRegisteredMeter("hashdb/memcache/clean/hit", nil)
-	memcacheCleanMissMeter  = metrics.NewRegisteredMeter("hashdb/memcache/clean/miss", nil)
-	memcacheCleanReadMeter  = metrics.NewRegisteredMeter("hashdb/memcache/clean/read", nil)
-	memcacheCleanWriteMeter = metrics.NewRegisteredMeter("hashdb/memcache/clean/write", nil)
-
-	memcacheDirtyHitMeter   = metrics.NewRegisteredMeter("hashdb/memcache/dirty/hit", nil)
-	memcacheDirtyMissMeter  = metrics.NewRegisteredMeter("hashdb/memcache/dirty/miss", nil)
-	memcacheDirtyReadMeter  = metrics.NewRegisteredMeter("hashdb/memcache/dirty/read", nil)
-	memcacheDirtyWriteMeter = metrics.NewRegisteredMeter("hashdb/memcache/dirty/write", nil)
-
-	memcacheFlushTimeTimer  = metrics.NewRegisteredResettingTimer("hashdb/memcache/flush/time", nil)
-	memcacheFlushNodesMeter = metrics.NewRegisteredMeter("hashdb/memcache/flush/nodes", nil)
-	memcacheFlushBytesMeter = metrics.NewRegisteredMeter("hashdb/memcache/flush/bytes", nil)
+// metricSet is the collection of meters reported by a database instance.
+type metricSet struct {
+	memcacheCleanHitMeter   metrics.Meter
+	memcacheCleanMissMeter  metrics.Meter
+	memcacheCleanReadMeter  metrics.Meter
+	memcacheCleanWriteMeter metrics.Meter
+
+	memcacheDirtyHitMeter   metrics.Meter
+	memcacheDirtyMissMeter  metrics.Meter
+	memcacheDirtyReadMeter  metrics.Meter
+	memcacheDirtyWriteMeter metrics.Meter
+
+	memcacheFlushTimeTimer  metrics.ResettingTimer
+	memcacheFlushNodesMeter metrics.Meter
+	memcacheFlushBytesMeter metrics.Meter
+
+	memcacheGCTimeTimer  metrics.ResettingTimer
+	memcacheGCNodesMeter metrics.Meter
+	memcacheGCBytesMeter metrics.Meter
+
+	memcacheCommitTimeTimer  metrics.ResettingTimer
+	memcacheCommitNodesMeter metrics.Meter
+	memcacheCommitBytesMeter metrics.Meter
+}
 
-	memcacheGCTimeTimer  = metrics.NewRegisteredResettingTimer("hashdb/memcache/gc/time", nil)
-	memcacheGCNodesMeter = metrics.NewRegisteredMeter("hashdb/memcache/gc/nodes", nil)
-	memcacheGCBytesMeter = metrics.NewRegisteredMeter("hashdb/memcache/gc/bytes", nil)
+// newMetricSet registers the database meters in the given registry, or in
+// the default one if it's nil. Meters already present are reused.
+func newMetricSet(r metrics.Registry) *metricSet {
+	return &metricSet{
+		memcacheCleanHitMeter:   metrics.GetOrRegisterMeter("hashdb/memcache/clean/hit", r),
+		memcacheCleanMissMeter:  metrics.GetOrRegisterMeter("hashdb/memcache/clean/miss", r),
+		memcacheCleanReadMeter:  metrics.GetOrRegisterMeter("hashdb/memcache/clean/read", r),
+		memcacheCleanWriteMeter: metrics.GetOrRegisterMeter("hashdb/memcache/clean/write", r),
+
+		memcacheDirtyHitMeter:   metrics.GetOrRegisterMeter("hashdb/memcache/dirty/hit", r),
+		memcacheDirtyMissMeter:  metrics.GetOrRegisterMeter("hashdb/memcache/dirty/miss", r),
+		memcacheDirtyReadMeter:  metrics.GetOrRegisterMeter("hashdb/memcache/dirty/read", r),
+		memcacheDirtyWriteMeter: metrics.GetOrRegisterMeter("hashdb/memcache/dirty/write", r),
+
+		memcacheFlushTimeTimer:  metrics.GetOrRegisterResettingTimer("hashdb/memcache/flush/time", r),
+		memcacheFlushNodesMeter: metrics.GetOrRegisterMeter("hashdb/memcache/flush/nodes", r),
+		memcacheFlushBytesMeter: metrics.GetOrRegisterMeter("hashdb/memcache/flush/bytes", r),
+
+		memcacheGCTimeTimer:  metrics.GetOrRegisterResettingTimer("hashdb/memcache/gc/time", r),
+		memcacheGCNodesMeter: metrics.GetOrRegisterMeter("hashdb/memcache/gc/nodes", r),
+		memcacheGCBytesMeter: metrics.GetOrRegisterMeter("hashdb/memcache/gc/bytes", r),
+
+		memcacheCommitTimeTimer:  metrics.GetOrRegisterResettingTimer("hashdb/memcache/commit/time", r),
+		memcacheCommitNodesMeter: metrics.GetOrRegisterMeter("hashdb/memcache/commit/nodes", r),
+		memcacheCommitBytesMeter: metrics.GetOrRegisterMeter("hashdb/memcache/commit/bytes", r),
+	}
+}
 
-	memcacheCommitTimeTimer  = metrics.NewRegisteredResettingTimer("hashdb/memcache/commit/time", nil)
-	memcacheCommitNodesMeter = metrics.NewRegisteredMeter("hashdb/memcache/commit/nodes", nil)
-	memcacheCommitBytesMeter = metrics.NewRegisteredMeter("hashdb/memcache/commit/bytes", nil)
-)
+// defaultMetrics is the metric set registered in the default registry, shared
+// by all databases unless instructed otherwise.
+var defaultMetrics = newMetricSet(nil)
 
 // ChildResolver defines the required method to decode the provided
 // trie node and iterate the children on top.
@@ -67,9 +102,37 @@ type ChildResolver interface {
 
 // Config contains the settings for database.
 type Config struct {
-	CleanCacheSize int // Maximum memory allowance (in bytes) for caching clean nodes
+	CleanCacheSize int                  // Maximum memory allowance (in bytes) for caching clean nodes
+	CommitOrder    trienode.CommitOrder // Order in which account and storage trie nodes are written
+	TrackLocks     bool                 // Flag whether the wait and hold time of the database lock is tracked
+	OnMissingNode  MissingNodeFunc      // Hook to supply the nodes found missing during commit
+	Replicator     trienode.Replicator  // Receiver of the node writes made by commit and flush, nil if not replicated
+	Archive        ethdb.AncientReader  // Archive of the cold nodes moved out of the key-value store, nil if not archived
+
+	// CleanCacheFactory creates the clean cache if it's enabled, fastcache
+	// is used if it's nil.
+	CleanCacheFactory trienode.CleanCacheFactory
+
+	// OnError, if set, is invoked with the failed operation, one of "read",
+	// "flush" or "commit", and the error before it's logged or returned.
+	OnError func(op string, err error)
+
+	// DeferredDereference makes Dereference only mark the root as released,
+	// deferring the garbage collection of its nodes to the next Cap or Commit,
+	// which coalesces the churn of the rapid reorgs. A root referenced again
+	// meanwhile is simply unmarked.
+	DeferredDereference bool
 }
 
+// MissingNodeFunc is consulted during commit for the nodes which are neither
+// cached nor persisted, to supply them before failing. The owner and path are
+// not tracked in hash scheme, so they are always empty.
+type MissingNodeFunc func(owner common.Hash, path []byte, hash common.Hash) ([]byte, error)
+
+// shrinkLimit is the memory allowance of the dirty cache kept by Shrink, the
+// most recent nodes are retained as they are likely to be dereferenced soon.
+const shrinkLimit = 4 * 1024 * 1024
+
 // Defaults is the default setting for database if it's not specified.
 // Notably, clean cache is disabled explicitly,
 var Defaults = &Config{
@@ -88,13 +151,21 @@ var Defaults = &Config{
 // behind this split design is to provide read access to RPC handlers and sync
 // servers even while the trie is executing expensive garbage collection.
 type Database struct {
-	diskdb   ethdb.Database // Persistent storage for matured trie nodes
-	resolver ChildResolver  // The handler to resolve children of nodes
-
-	cleans  *fastcache.Cache            // GC friendly memory cache of clean node RLPs
-	dirties map[common.Hash]*cachedNode // Data and references relationships of dirty trie nodes
-	oldest  common.Hash                 // Oldest tracked node, flush-list head
-	newest  common.Hash                 // Newest tracked node, flush-list tail
+	diskdb   ethdb.Database            // Persistent storage for matured trie nodes
+	resolver ChildResolver             // The handler to resolve children of nodes
+	metrics  atomic.Pointer[metricSet] // Meters for reporting the database activity
+	order    trienode.CommitOrder      // Order in which account and storage trie nodes are written
+	missing  MissingNodeFunc           // Hook to supply missing nodes during commit, nil if unset
+	replica  trienode.Replicator       // Receiver of the persisted node writes, nil if not replicated
+	archive  ethdb.AncientReader       // Archive of the cold nodes, nil if not attached, protected by lock
+	onError  func(string, error)       // Hook to observe the failed operations, nil if unset
+	deferred bool                      // Flag whether the dereferences are deferred to the next Cap or Commit
+
+	cleans     trienode.CleanCache         // GC friendly memory cache of clean node RLPs
+	dirties    map[common.Hash]*cachedNode // Data and references relationships of dirty trie nodes
+	oldest     common.Hash                 // Oldest tracked node, flush-list head
+	newest     common.Hash                 // Newest tracked node, flush-list tail
+	tombstones map[common.Hash]int         // Number of the deferred dereferences of the roots
 
 	gctime  time.Duration      // Time spent on garbage collection since last commit
 	gcnodes uint64             // Nodes garbage collected since last commit
@@ -107,7 +178,15 @@ type Database struct {
 	dirtiesSize  common.StorageSize // Storage size of the dirty node cache (exc. metadata)
 	childrenSize common.StorageSize // Storage size of the external children tracking
 
-	lock sync.RWMutex
+	lastRoot  common.Hash            // Root of the most recently committed trie
+	lastBlock *uint64                // Block number of the most recently committed trie, nil if unknown
+	blocks    map[common.Hash]uint64 // Block numbers of the updated states, dropped once committed or dereferenced
+	lastFlush time.Time              // Time of the most recent write of dirty nodes into disk
+	baseline  common.StorageSize     // Memory held by the cache right after the most recent write
+	written   common.StorageSize     // Data storage written into disk since the database was opened
+	nwritten  uint64                 // Number of nodes written into disk since the database was opened
+
+	lock lockstat.RWMutex
 }
 
 // cachedNode is all the information we know about a single cached trie node
@@ -140,16 +219,35 @@ func New(diskdb ethdb.Database, config *Config, resolver ChildResolver) *Databas
 	if config == nil {
 		config = Defaults
 	}
-	var cleans *fastcache.Cache
+	var cleans trienode.CleanCache
 	if config.CleanCacheSize > 0 {
-		cleans = fastcache.New(config.CleanCacheSize)
+		factory := config.CleanCacheFactory
+		if factory == nil {
+			factory = trienode.NewFastCache
+		}
+		cleans = factory(config.CleanCacheSize)
 	}
-	return &Database{
+	db := &Database{
 		diskdb:   diskdb,
 		resolver: resolver,
+		order:    config.CommitOrder,
+		missing:  config.OnMissingNode,
+		replica:  config.Replicator,
+		archive:  config.Archive,
+		onError:  config.OnError,
+		deferred: config.DeferredDereference,
 		cleans:   cleans,
 		dirties:  make(map[common.Hash]*cachedNode),
+		blocks:   make(map[common.Hash]uint64),
+	}
+	db.metrics.Store(defaultMetrics)
+	if db.deferred {
+		db.tombstones = make(map[common.Hash]int)
+	}
+	if config.TrackLocks {
+		db.lock.Track()
 	}
+	return db
 }
 
 // insert inserts a simplified trie node into the memory database.
@@ -160,7 +258,7 @@ func (db *Database) insert(hash common.Hash, node []byte) {
 	if _, ok := db.dirties[hash]; ok {
 		return
 	}
-	memcacheDirtyWriteMeter.Mark(int64(len(node)))
+	db.metrics.Load().memcacheDirtyWriteMeter.Mark(int64(len(node)))
 
 	// Create the cached entry for this node
 	entry := &cachedNode{
@@ -183,18 +281,31 @@ func (db *Database) insert(hash common.Hash, node []byte) {
 	db.dirtiesSize += common.StorageSize(common.HashLength + len(node))
 }
 
+// reportError passes the error of the failed operation to the configured hook.
+func (db *Database) reportError(op string, err error) {
+	if db.onError != nil {
+		db.onError(op, err)
+	}
+}
+
 // Node retrieves an encoded cached trie node from memory. If it cannot be found
 // cached, the method queries the persistent database for the content.
 func (db *Database) Node(hash common.Hash) ([]byte, error) {
+	return db.node(hash, false)
+}
+
+// node retrieves an encoded cached trie node from memory. If nocache is set,
+// the node loaded from disk won't be inserted into the clean cache.
+func (db *Database) node(hash common.Hash, nocache bool) ([]byte, error) {
 	// It doesn't make sense to retrieve the metaroot
 	if hash == (common.Hash{}) {
 		return nil, errors.New("not found")
 	}
 	// Retrieve the node from the clean cache if available
 	if db.cleans != nil {
-		if enc := db.cleans.Get(nil, hash[:]); enc != nil {
-			memcacheCleanHitMeter.Mark(1)
-			memcacheCleanReadMeter.Mark(int64(len(enc)))
+		if enc := db.cleans.Get(hash[:]); enc != nil {
+			db.metrics.Load().memcacheCleanHitMeter.Mark(1)
+			db.metrics.Load().memcacheCleanReadMeter.Mark(int64(len(enc)))
 			return enc, nil
 		}
 	}
@@ -204,22 +315,32 @@ func (db *Database) Node(hash common.Hash) ([]byte, error) {
 	db.lock.RUnlock()
 
 	if dirty != nil {
-		memcacheDirtyHitMeter.Mark(1)
-		memcacheDirtyReadMeter.Mark(int64(len(dirty.node)))
+		db.metrics.Load().memcacheDirtyHitMeter.Mark(1)
+		db.metrics.Load().memcacheDirtyReadMeter.Mark(int64(len(dirty.node)))
 		return dirty.node, nil
 	}
-	memcacheDirtyMissMeter.Mark(1)
+	db.metrics.Load().memcacheDirtyMissMeter.Mark(1)
 
 	// Content unavailable in memory, attempt to retrieve from disk
 	enc := rawdb.ReadLegacyTrieNode(db.diskdb, hash)
 	if len(enc) != 0 {
-		if db.cleans != nil {
+		if db.cleans != nil && !nocache {
 			db.cleans.Set(hash[:], enc)
-			memcacheCleanMissMeter.Mark(1)
-			memcacheCleanWriteMeter.Mark(int64(len(enc)))
+			db.metrics.Load().memcacheCleanMissMeter.Mark(1)
+			db.metrics.Load().memcacheCleanWriteMeter.Mark(int64(len(enc)))
 		}
 		return enc, nil
 	}
+	// Fall back to the archive if the node has been moved there
+	db.lock.RLock()
+	archive := db.archive
+	db.lock.RUnlock()
+
+	if archive != nil {
+		if enc := rawdb.ReadArchivedTrieNode(db.diskdb, archive, hash); len(enc) != 0 {
+			return enc, nil
+		}
+	}
 	return nil, errors.New("not found")
 }
 
@@ -255,8 +376,17 @@ func (db *Database) reference(child common.Hash, parent common.Hash) {
 	if !ok {
 		return
 	}
-	// The reference is for state root, increase the reference counter.
+	// The reference is for state root, increase the reference counter,
+	// unless it cancels a deferred dereference.
 	if parent == (common.Hash{}) {
+		if n := db.tombstones[child]; n > 0 {
+			if n == 1 {
+				delete(db.tombstones, child)
+			} else {
+				db.tombstones[child] = n - 1
+			}
+			return
+		}
 		node.parents += 1
 		return
 	}
@@ -283,6 +413,30 @@ func (db *Database) Dereference(root common.Hash) {
 	db.lock.Lock()
 	defer db.lock.Unlock()
 
+	if db.deferred {
+		if _, ok := db.dirties[root]; ok {
+			db.tombstones[root]++
+		}
+		return
+	}
+	db.dereferenceRoot(root)
+}
+
+// applyTombstones performs the deferred dereferences. The caller must hold
+// the lock.
+func (db *Database) applyTombstones() {
+	for root, n := range db.tombstones {
+		for i := 0; i < n; i++ {
+			db.dereferenceRoot(root)
+		}
+		delete(db.tombstones, root)
+	}
+}
+
+// dereferenceRoot removes a reference from the root node and collects the
+// nodes left unreferenced. The caller must hold the lock.
+func (db *Database) dereferenceRoot(root common.Hash) {
+	delete(db.blocks, root)
 	nodes, storage, start := len(db.dirties), db.dirtiesSize, time.Now()
 	db.dereference(root)
 
@@ -290,9 +444,9 @@ func (db *Database) Dereference(root common.Hash) {
 	db.gcsize += storage - db.dirtiesSize
 	db.gctime += time.Since(start)
 
-	memcacheGCTimeTimer.Update(time.Since(start))
-	memcacheGCBytesMeter.Mark(int64(storage - db.dirtiesSize))
-	memcacheGCNodesMeter.Mark(int64(nodes - len(db.dirties)))
+	db.metrics.Load().memcacheGCTimeTimer.Update(time.Since(start))
+	db.metrics.Load().memcacheGCBytesMeter.Mark(int64(storage - db.dirtiesSize))
+	db.metrics.Load().memcacheGCNodesMeter.Mark(int64(nodes - len(db.dirties)))
 
 	log.Debug("Dereferenced trie from memory database", "nodes", nodes-len(db.dirties), "size", storage-db.dirtiesSize, "time", time.Since(start),
 		"gcnodes", db.gcnodes, "gcsize", db.gcsize, "gctime", db.gctime, "livenodes", len(db.dirties), "livesize", db.dirtiesSize)
@@ -342,6 +496,48 @@ func (db *Database) dereference(hash common.Hash) {
 	}
 }
 
+// RepairReferences rebuilds the reference counters of all the cached nodes from
+// scratch, treating the given roots as the only live states. Every root is
+// referenced once, and the nodes unreachable from them are left unreferenced
+// and will be flushed on the next Cap.
+func (db *Database) RepairReferences(roots []common.Hash) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	for _, node := range db.dirties {
+		node.parents = 0
+	}
+	var (
+		visited = make(map[common.Hash]struct{})
+		walk    func(hash common.Hash)
+	)
+	walk = func(hash common.Hash) {
+		if _, ok := visited[hash]; ok {
+			return
+		}
+		visited[hash] = struct{}{}
+
+		db.dirties[hash].forChildren(db.resolver, func(child common.Hash) {
+			if node := db.dirties[child]; node != nil {
+				node.parents++
+				walk(child)
+			}
+		})
+	}
+	referenced := make(map[common.Hash]struct{})
+	for _, root := range roots {
+		if _, ok := referenced[root]; ok {
+			continue
+		}
+		referenced[root] = struct{}{}
+
+		if node := db.dirties[root]; node != nil {
+			node.parents++
+			walk(root)
+		}
+	}
+}
+
 // Cap iteratively flushes old but still referenced trie nodes until the total
 // memory usage goes below the given threshold.
 //
@@ -352,6 +548,11 @@ func (db *Database) Cap(limit common.StorageSize) error {
 	// outside code doesn't see an inconsistent state (referenced data removed from
 	// memory cache during commit but not yet in persistent storage). This is ensured
 	// by only uncaching existing data when the database write finalizes.
+	if db.deferred {
+		db.lock.Lock()
+		db.applyTombstones()
+		db.lock.Unlock()
+	}
 	db.lock.RLock()
 	nodes, storage, start := len(db.dirties), db.dirtiesSize, time.Now()
 	// db.dirtiesSize only contains the useful data in the cache, but when reporting
@@ -361,7 +562,7 @@ func (db *Database) Cap(limit common.StorageSize) error {
 	size += db.childrenSize
 	db.lock.RUnlock()
 
-	batch := db.diskdb.NewBatch()
+	batch := trienode.NewReplicatedBatch(db.diskdb.NewBatch(), db.replica)
 
 	// Keep committing nodes from the flush-list until we're below allowance
 	oldest := db.oldest
@@ -376,8 +577,9 @@ func (db *Database) Cap(limit common.StorageSize) error {
 			// If we exceeded the ideal batch size, commit and reset
 			if batch.ValueSize() >= ethdb.IdealBatchSize {
 				if err := batch.Write(); err != nil {
+					db.reportError("flush", err)
 					log.Error("Failed to write flush list to disk", "err", err)
-					return err
+					return &trienode.TransientError{Err: err}
 				}
 				batch.Reset()
 			}
@@ -397,8 +599,9 @@ func (db *Database) Cap(limit common.StorageSize) error {
 	}
 	// Flush out any remainder data from the last batch
 	if err := batch.Write(); err != nil {
+		db.reportError("flush", err)
 		log.Error("Failed to write flush list to disk", "err", err)
-		return err
+		return &trienode.TransientError{Err: err}
 	}
 	// Write successful, clear out the flushed data
 	db.lock.Lock()
@@ -420,10 +623,13 @@ func (db *Database) Cap(limit common.StorageSize) error {
 	db.flushnodes += uint64(nodes - len(db.dirties))
 	db.flushsize += storage - db.dirtiesSize
 	db.flushtime += time.Since(start)
+	db.written += storage - db.dirtiesSize
+	db.nwritten += uint64(nodes - len(db.dirties))
+	db.lastFlush, db.baseline = time.Now(), db.size()
 
-	memcacheFlushTimeTimer.Update(time.Since(start))
-	memcacheFlushBytesMeter.Mark(int64(storage - db.dirtiesSize))
-	memcacheFlushNodesMeter.Mark(int64(nodes - len(db.dirties)))
+	db.metrics.Load().memcacheFlushTimeTimer.Update(time.Since(start))
+	db.metrics.Load().memcacheFlushBytesMeter.Mark(int64(storage - db.dirtiesSize))
+	db.metrics.Load().memcacheFlushNodesMeter.Mark(int64(nodes - len(db.dirties)))
 
 	log.Debug("Persisted nodes from memory database", "nodes", nodes-len(db.dirties), "size", storage-db.dirtiesSize, "time", time.Since(start),
 		"flushnodes", db.flushnodes, "flushsize", db.flushsize, "flushtime", db.flushtime, "livenodes", len(db.dirties), "livesize", db.dirtiesSize)
@@ -431,6 +637,28 @@ func (db *Database) Cap(limit common.StorageSize) error {
 	return nil
 }
 
+// Shrink releases as much memory as safely possible by flushing all but the
+// most recent dirty nodes into disk and emptying the clean cache. The released
+// size is returned.
+//
+// Note, this method is a non-synchronized mutator. It is unsafe to call this
+// concurrently with other mutators.
+func (db *Database) Shrink() (common.StorageSize, error) {
+	before := db.Size()
+	if err := db.Cap(shrinkLimit); err != nil {
+		return 0, err
+	}
+	var released common.StorageSize
+	if after := db.Size(); after < before {
+		released = before - after
+	}
+	if db.cleans != nil {
+		released += common.StorageSize(db.cleans.Len())
+		db.cleans.Reset()
+	}
+	return released, nil
+}
+
 // Commit iterates over all the children of a particular node, writes them out
 // to disk, forcefully tearing down all references in both directions. As a side
 // effect, all pre-images accumulated up to this point are also written.
@@ -443,8 +671,13 @@ func (db *Database) Commit(node common.Hash, report bool) error {
 	// memory cache during commit but not yet in persistent storage). This is ensured
 	// by only uncaching existing data when the database write finalizes.
 	start := time.Now()
-	batch := db.diskdb.NewBatch()
+	batch := trienode.NewReplicatedBatch(db.diskdb.NewBatch(), db.replica)
 
+	if db.deferred {
+		db.lock.Lock()
+		db.applyTombstones()
+		db.lock.Unlock()
+	}
 	// Move all of the accumulated preimages into a write batch
 	db.lock.RLock()
 	// Move the trie itself into the batch, flushing if enough data is accumulated
@@ -452,14 +685,16 @@ func (db *Database) Commit(node common.Hash, report bool) error {
 	db.lock.RUnlock()
 
 	uncacher := &cleaner{db}
-	if err := db.commit(node, batch, uncacher); err != nil {
+	if err := db.commitWithOrder(node, batch, uncacher); err != nil {
+		db.reportError("commit", err)
 		log.Error("Failed to commit trie from trie database", "err", err)
-		return err
+		return trienode.Classify(err)
 	}
 	// Trie mostly committed to disk, flush any batch leftovers
 	if err := batch.Write(); err != nil {
+		db.reportError("commit", err)
 		log.Error("Failed to write trie to disk", "err", err)
-		return err
+		return &trienode.TransientError{Err: err}
 	}
 	// Uncache any leftovers in the last batch
 	db.lock.Lock()
@@ -470,9 +705,11 @@ func (db *Database) Commit(node common.Hash, report bool) error {
 	batch.Reset()
 
 	// Reset the storage counters and bumped metrics
-	memcacheCommitTimeTimer.Update(time.Since(start))
-	memcacheCommitBytesMeter.Mark(int64(storage - db.dirtiesSize))
-	memcacheCommitNodesMeter.Mark(int64(nodes - len(db.dirties)))
+	db.written += storage - db.dirtiesSize
+	db.nwritten += uint64(nodes - len(db.dirties))
+	db.metrics.Load().memcacheCommitTimeTimer.Update(time.Since(start))
+	db.metrics.Load().memcacheCommitBytesMeter.Mark(int64(storage - db.dirtiesSize))
+	db.metrics.Load().memcacheCommitNodesMeter.Mark(int64(nodes - len(db.dirties)))
 
 	logger := log.Info
 	if !report {
@@ -484,29 +721,113 @@ func (db *Database) Commit(node common.Hash, report bool) error {
 	// Reset the garbage collection statistics
 	db.gcnodes, db.gcsize, db.gctime = 0, 0, 0
 	db.flushnodes, db.flushsize, db.flushtime = 0, 0, 0
-
+	db.lastRoot, db.lastFlush, db.baseline = node, time.Now(), db.size()
+
+	// Record the block number of the committed state, dropping the ones of
+	// the states it supersedes.
+	db.lastBlock = nil
+	if block, ok := db.blocks[node]; ok {
+		db.lastBlock = &block
+		for root, number := range db.blocks {
+			if number <= block {
+				delete(db.blocks, root)
+			}
+		}
+	}
 	return nil
 }
 
-// commit is the private locked version of Commit.
-func (db *Database) commit(hash common.Hash, batch ethdb.Batch, uncacher *cleaner) error {
+// commitWithOrder commits the trie with the given root, writing the storage
+// tries referenced by the account trie in the configured order.
+func (db *Database) commitWithOrder(root common.Hash, batch ethdb.Batch, uncacher *cleaner) error {
+	switch db.order {
+	case trienode.StorageFirst:
+		// Commit all the referenced storage tries first, they are
+		// skipped afterwards as they are no longer in the dirty cache.
+		var storages []common.Hash
+		db.lock.RLock()
+		db.externals(root, make(map[common.Hash]struct{}), func(hash common.Hash) {
+			storages = append(storages, hash)
+		})
+		db.lock.RUnlock()
+
+		for _, storage := range storages {
+			if err := db.commit(storage, batch, uncacher, nil); err != nil {
+				return err
+			}
+		}
+		return db.commit(root, batch, uncacher, nil)
+
+	case trienode.AccountFirst:
+		// Commit the account trie first with the storage tries deferred.
+		var storages []common.Hash
+		if err := db.commit(root, batch, uncacher, &storages); err != nil {
+			return err
+		}
+		for _, storage := range storages {
+			if err := db.commit(storage, batch, uncacher, nil); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	default:
+		return db.commit(root, batch, uncacher, nil)
+	}
+}
+
+// externals invokes the callback for all the external children referenced
+// by the dirty nodes of the trie with the given root. The caller must hold
+// the read lock.
+func (db *Database) externals(hash common.Hash, visited map[common.Hash]struct{}, onExternal func(common.Hash)) {
+	node, ok := db.dirties[hash]
+	if !ok {
+		return
+	}
+	if _, ok := visited[hash]; ok {
+		return
+	}
+	visited[hash] = struct{}{}
+
+	for child := range node.external {
+		onExternal(child)
+	}
+	db.resolver.ForEach(node.node, func(child common.Hash) {
+		db.externals(child, visited, onExternal)
+	})
+}
+
+// commit is the private locked version of Commit. If deferred is not nil,
+// the external children are collected into it rather than being committed.
+func (db *Database) commit(hash common.Hash, batch ethdb.Batch, uncacher *cleaner, deferred *[]common.Hash) error {
 	// If the node does not exist, it's a previously committed node
 	db.lock.RLock()
 	node, ok := db.dirties[hash]
 	if !ok {
 		db.lock.RUnlock()
-		return nil
+		if db.missing == nil {
+			return nil
+		}
+		return db.heal(hash, batch, uncacher, deferred)
 	}
 	db.lock.RUnlock()
 
 	var err error
 
 	// Dereference all children and delete the node
-	node.forChildren(db.resolver, func(child common.Hash) {
+	onChild := func(child common.Hash) {
 		if err == nil {
-			err = db.commit(child, batch, uncacher)
+			err = db.commit(child, batch, uncacher, deferred)
 		}
-	})
+	}
+	if deferred == nil {
+		node.forChildren(db.resolver, onChild)
+	} else {
+		for child := range node.external {
+			*deferred = append(*deferred, child)
+		}
+		db.resolver.ForEach(node.node, onChild)
+	}
 	if err != nil {
 		return err
 	}
@@ -514,7 +835,7 @@ func (db *Database) commit(hash common.Hash, batch ethdb.Batch, uncacher *cleane
 	rawdb.WriteLegacyTrieNode(batch, hash, node.node)
 	if batch.ValueSize() >= ethdb.IdealBatchSize {
 		if err := batch.Write(); err != nil {
-			return err
+			return &trienode.TransientError{Err: err}
 		}
 		db.lock.Lock()
 		err := batch.Replay(uncacher)
@@ -527,6 +848,42 @@ func (db *Database) commit(hash common.Hash, batch ethdb.Batch, uncacher *cleane
 	return nil
 }
 
+// heal makes sure the node which is not in the dirty cache is really persisted,
+// either in the key-value store or in the archive, otherwise the missing node
+// hook is asked to supply it. The supplied node is verified against the hash
+// and written along with its missing descendants. Storage tries referenced by
+// the supplied node are not healed.
+func (db *Database) heal(hash common.Hash, batch ethdb.Batch, uncacher *cleaner, deferred *[]common.Hash) error {
+	// The nodes held by the clean cache are known to be persisted, which spares
+	// the disk lookup for most of the children left untouched by the update.
+	if db.cleans != nil && db.cleans.Get(hash[:]) != nil {
+		return nil
+	}
+	if rawdb.HasLegacyTrieNode(db.diskdb, hash) {
+		return nil
+	}
+	if _, ok := rawdb.ReadArchivedTrieNodeNumber(db.diskdb, hash); ok {
+		return nil
+	}
+	blob, err := db.missing(common.Hash{}, nil, hash)
+	if err != nil {
+		return fmt.Errorf("missing trie node %x: %w", hash, err)
+	}
+	if have := crypto.Keccak256Hash(blob); have != hash {
+		return fmt.Errorf("invalid trie node supplied for %x, hash %x", hash, have)
+	}
+	db.resolver.ForEach(blob, func(child common.Hash) {
+		if err == nil {
+			err = db.commit(child, batch, uncacher, deferred)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	rawdb.WriteLegacyTrieNode(batch, hash, blob)
+	return nil
+}
+
 // cleaner is a database batch replayer that takes a batch of write operations
 // and cleans up the trie database from anything written to disk.
 type cleaner struct {
@@ -571,7 +928,7 @@ func (c *cleaner) Put(key []byte, rlp []byte) error {
 	// Move the flushed node into the clean cache to prevent insta-reloads
 	if c.db.cleans != nil {
 		c.db.cleans.Set(hash[:], rlp)
-		memcacheCleanWriteMeter.Mark(int64(len(rlp)))
+		c.db.metrics.Load().memcacheCleanWriteMeter.Mark(int64(len(rlp)))
 	}
 	return nil
 }
@@ -598,6 +955,8 @@ func (db *Database) Update(root common.Hash, parent common.Hash, block uint64, n
 	db.lock.Lock()
 	defer db.lock.Unlock()
 
+	db.blocks[root] = block
+
 	// Insert dirty nodes into the database. In the same tree, it must be
 	// ensured that children are inserted first, then parent so that children
 	// can be linked with their parent correctly.
@@ -645,6 +1004,11 @@ func (db *Database) Size() common.StorageSize {
 	db.lock.RLock()
 	defer db.lock.RUnlock()
 
+	return db.size()
+}
+
+// size is the private lock-free version of Size.
+func (db *Database) size() common.StorageSize {
 	// db.dirtiesSize only contains the useful data in the cache, but when reporting
 	// the total memory consumption, the maintenance metadata is also needed to be
 	// counted.
@@ -652,6 +1016,364 @@ func (db *Database) Size() common.StorageSize {
 	return db.dirtiesSize + db.childrenSize + metadataSize
 }
 
+// Observation is a point-in-time snapshot of the database statistics.
+type Observation struct {
+	Root      common.Hash        // Root of the most recently committed trie
+	Nodes     int                // Number of nodes in the dirty cache
+	Size      common.StorageSize // Memory held by the dirty cache
+	Delta     common.StorageSize // Memory accumulated since the most recent write into disk
+	Cleans    common.StorageSize // Memory held by the clean cache
+	Written   common.StorageSize // Data storage written into disk since the database was opened
+	NWritten  uint64             // Number of nodes written into disk since the database was opened
+	LastFlush time.Time          // Time of the most recent write into disk
+}
+
+// Observe returns a consistent snapshot of the database statistics, taken
+// with a single acquisition of the lock.
+func (db *Database) Observe() Observation {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	o := Observation{
+		Root:      db.lastRoot,
+		Nodes:     len(db.dirties),
+		Size:      db.size(),
+		Written:   db.written,
+		NWritten:  db.nwritten,
+		LastFlush: db.lastFlush,
+	}
+	if o.Size > db.baseline {
+		o.Delta = o.Size - db.baseline
+	}
+	if db.cleans != nil {
+		o.Cleans = common.StorageSize(db.cleans.Len())
+	}
+	return o
+}
+
+// Stats is the statistics of the database activity.
+type Stats struct {
+	Tombstones int // Number of the roots whose dereference is deferred
+}
+
+// Stats returns the statistics of the database activity.
+func (db *Database) Stats() Stats {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	var stats Stats
+	for _, n := range db.tombstones {
+		stats.Tombstones += n
+	}
+	return stats
+}
+
+// LockStats returns the contention statistics of the database lock, all zero
+// unless lock tracking is enabled.
+func (db *Database) LockStats() lockstat.Stats {
+	return db.lock.Stats()
+}
+
+// CleanCache returns the cache of the clean nodes keyed by the node hash, nil
+// if it's disabled.
+func (db *Database) CleanCache() trienode.CleanCache {
+	return db.cleans
+}
+
+// DeltaSize returns the memory accumulated in the cache since dirty nodes were
+// last written into disk.
+func (db *Database) DeltaSize() common.StorageSize {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	if size := db.size(); size > db.baseline {
+		return size - db.baseline
+	}
+	return 0
+}
+
+// Dirty reports whether committing the given state would write any node into
+// disk, namely whether its root node is still held in the dirty cache.
+func (db *Database) Dirty(root common.Hash) bool {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	_, ok := db.dirties[root]
+	return ok
+}
+
+// CountStates returns the number of states which can be served, namely the
+// dirty nodes not referenced by any other dirty node along with the root of
+// the most recently committed trie. The states persisted before it aren't
+// tracked, thus not counted. It iterates the whole dirty cache.
+func (db *Database) CountStates() int {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	children := make(map[common.Hash]struct{})
+	for _, node := range db.dirties {
+		node.forChildren(db.resolver, func(child common.Hash) {
+			children[child] = struct{}{}
+		})
+	}
+	var count int
+	for hash := range db.dirties {
+		if _, ok := children[hash]; !ok {
+			count++
+		}
+	}
+	if db.lastRoot != (common.Hash{}) {
+		if _, ok := db.dirties[db.lastRoot]; !ok {
+			count++
+		}
+	}
+	return count
+}
+
+// LastCommittedBlock returns the block number of the most recently committed
+// trie, if it was updated through the database since it was opened.
+func (db *Database) LastCommittedBlock() (uint64, bool) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	if db.lastBlock == nil {
+		return 0, false
+	}
+	return *db.lastBlock, true
+}
+
+// Quarantine evicts the node with the given hash from the clean cache and
+// deletes it from disk. A copy still held in the dirty cache is left in place,
+// as it's the one freshly committed rather than the one loaded from disk.
+func (db *Database) Quarantine(hash common.Hash) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if db.cleans != nil {
+		db.cleans.Del(hash[:])
+	}
+	rawdb.DeleteLegacyTrieNode(db.diskdb, hash)
+	return nil
+}
+
+// SwapDiskDB re-points the database at another handle of the persistent
+// database, e.g. a copy migrated onto other storage. The most recently committed
+// trie must be present in the new handle. The cached nodes are kept, as they're
+// addressed by hash.
+func (db *Database) SwapDiskDB(diskdb ethdb.Database) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if db.lastRoot != (common.Hash{}) && db.lastRoot != types.EmptyRootHash && !rawdb.HasLegacyTrieNode(diskdb, db.lastRoot) {
+		return fmt.Errorf("committed root %x is missing in the new database", db.lastRoot)
+	}
+	db.diskdb = diskdb
+	return nil
+}
+
+// Rehydrate discards the clean cache, so that the nodes are read afresh from
+// the persistent database, e.g. after it's been written by another process
+// while this one was suspended. The dirty nodes are addressed by hash, thus
+// they stay valid. An error is returned if the persistent database has been
+// switched to the path scheme or the committed root has vanished from it.
+func (db *Database) Rehydrate() error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if scheme := rawdb.ReadStateScheme(db.diskdb); scheme == rawdb.PathScheme {
+		return fmt.Errorf("state scheme is changed to %s", scheme)
+	}
+	if db.lastRoot != (common.Hash{}) && db.lastRoot != types.EmptyRootHash && !rawdb.HasLegacyTrieNode(db.diskdb, db.lastRoot) {
+		return fmt.Errorf("committed root %x is missing", db.lastRoot)
+	}
+	if db.cleans != nil {
+		db.cleans.Reset()
+	}
+	return nil
+}
+
+// DiskRoot returns the root of the most recently committed trie, or an empty
+// hash if nothing has been committed since the database was opened.
+func (db *Database) DiskRoot() common.Hash {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	return db.lastRoot
+}
+
+// Written returns the data storage and the number of nodes written into disk
+// since the database was opened.
+func (db *Database) Written() (common.StorageSize, uint64) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	return db.written, db.nwritten
+}
+
+// LastFlush returns the time at which dirty nodes were last written into disk,
+// either by an explicit commit or by capping the dirty cache.
+func (db *Database) LastFlush() time.Time {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	return db.lastFlush
+}
+
+// Truncate wipes all the trie nodes from both the memory cache and the persistent
+// database, along with the redirects of the archived ones, leaving the database
+// uninitialized. Note the entire key space of the persistent database is
+// iterated, it's only meant to be used in tests and tools.
+func (db *Database) Truncate() error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	batch := db.diskdb.NewBatch()
+	it := db.diskdb.NewIterator(nil, nil)
+	defer it.Release()
+
+	for it.Next() {
+		if !rawdb.IsLegacyTrieNode(it.Key(), it.Value()) && !rawdb.IsArchivedTrieNodeKey(it.Key()) {
+			continue
+		}
+		if err := batch.Delete(it.Key()); err != nil {
+			return err
+		}
+		if batch.ValueSize() >= ethdb.IdealBatchSize {
+			if err := batch.Write(); err != nil {
+				return err
+			}
+			batch.Reset()
+		}
+	}
+	if err := it.Error(); err != nil {
+		return err
+	}
+	if err := batch.Write(); err != nil {
+		return err
+	}
+	// Discard all the cached nodes and the associated statistics
+	db.dirties = make(map[common.Hash]*cachedNode)
+	if db.deferred {
+		db.tombstones = make(map[common.Hash]int)
+	}
+	db.oldest, db.newest = common.Hash{}, common.Hash{}
+	db.dirtiesSize, db.childrenSize = 0, 0
+	db.gcnodes, db.gcsize, db.gctime = 0, 0, 0
+	db.flushnodes, db.flushsize, db.flushtime = 0, 0, 0
+	db.lastRoot, db.lastBlock, db.baseline = common.Hash{}, nil, 0
+	db.blocks = make(map[common.Hash]uint64)
+	if db.cleans != nil {
+		db.cleans.Reset()
+	}
+	return nil
+}
+
+// ArchiveNodes moves the trie nodes in the persistent database which are not
+// kept by the given filter into the trie node archive, leaving a redirect for
+// each of them so that they are still readable. The archive is attached for
+// the following reads, it must be supplied through Config.Archive afterwards.
+// The nodes are appended and synced into the archive before being deleted from
+// the key-value store, a crash in between leaves duplicates but loses nothing.
+// The deletions are not replicated, as the replica has no access to the archive.
+//
+// The entire key space of the persistent database is iterated with the lock
+// held, it's only meant to be used in maintenance windows. The number of nodes
+// moved so far is returned along with the error of the context once it's
+// cancelled.
+func (db *Database) ArchiveNodes(ctx context.Context, archive ethdb.AncientStore, keep func(hash common.Hash) bool) (int, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	db.archive = archive
+
+	var (
+		start   = time.Now()
+		moved   int
+		pending []common.Hash
+		blobs   [][]byte
+		size    int
+	)
+	flush := func() error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if len(pending) == 0 {
+			return nil
+		}
+		next, err := archive.Ancients()
+		if err != nil {
+			return err
+		}
+		_, err = archive.ModifyAncients(func(op ethdb.AncientWriteOp) error {
+			for i, blob := range blobs {
+				if err := op.AppendRaw(rawdb.TrieNodeArchiveTable, next+uint64(i), blob); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if err := archive.Sync(); err != nil {
+			return err
+		}
+		batch := db.diskdb.NewBatch()
+		for i, hash := range pending {
+			rawdb.WriteArchivedTrieNodeNumber(batch, hash, next+uint64(i))
+			rawdb.DeleteLegacyTrieNode(batch, hash)
+		}
+		if err := batch.Write(); err != nil {
+			return err
+		}
+		moved += len(pending)
+		pending, blobs, size = pending[:0], blobs[:0], 0
+		return nil
+	}
+	it := db.diskdb.NewIterator(nil, nil)
+	defer it.Release()
+
+	for count := 0; it.Next(); count++ {
+		if count%1000 == 0 {
+			if err := ctx.Err(); err != nil {
+				return moved, err
+			}
+		}
+		key, val := it.Key(), it.Value()
+		if !rawdb.IsLegacyTrieNode(key, val) {
+			continue
+		}
+		hash := common.BytesToHash(key)
+		if _, ok := db.dirties[hash]; ok || keep(hash) {
+			continue
+		}
+		pending = append(pending, hash)
+		blobs = append(blobs, common.CopyBytes(val))
+		size += len(val)
+
+		if size >= ethdb.IdealBatchSize {
+			if err := flush(); err != nil {
+				return moved, err
+			}
+		}
+	}
+	if err := it.Error(); err != nil {
+		return moved, err
+	}
+	if err := flush(); err != nil {
+		return moved, err
+	}
+	log.Info("Archived cold trie nodes", "nodes", moved, "elapsed", common.PrettyDuration(time.Since(start)))
+	return moved, nil
+}
+
+// SetMetricsRegistry reports the database activity into the given registry
+// rather than the default one. The meters are swapped atomically, thus it's
+// safe to be called while the database is accessed.
+func (db *Database) SetMetricsRegistry(r metrics.Registry) {
+	db.metrics.Store(newMetricSet(r))
+}
+
 // Close closes the trie database and releases all held resources.
 func (db *Database) Close() error {
 	if db.cleans != nil {
@@ -675,14 +1397,29 @@ func (db *Database) Reader(root common.Hash) (*reader, error) {
 	return &reader{db: db}, nil
 }
 
+// ReaderNoCache retrieves a node reader belonging to the given state root,
+// which doesn't insert the nodes loaded from disk into the clean cache.
+func (db *Database) ReaderNoCache(root common.Hash) (*reader, error) {
+	if _, err := db.node(root, true); err != nil {
+		return nil, fmt.Errorf("state %#x is not available, %v", root, err)
+	}
+	return &reader{db: db, nocache: true}, nil
+}
+
 // reader is a state reader of Database which implements the Reader interface.
 type reader struct {
-	db *Database
+	db      *Database
+	nocache bool // Flag whether the clean cache population is bypassed
 }
 
-// Node retrieves the trie node with the given node hash.
-// No error will be returned if the node is not found.
+// Node retrieves the trie node with the given node hash. A trienode.NotFoundError
+// is returned if the node is not found.
 func (reader *reader) Node(owner common.Hash, path []byte, hash common.Hash) ([]byte, error) {
-	blob, _ := reader.db.Node(hash)
+	blob, _ := reader.db.node(hash, reader.nocache)
+	if len(blob) == 0 {
+		err := &trienode.NotFoundError{Owner: owner, Path: path, Hash: hash}
+		reader.db.reportError("read", err)
+		return nil, err
+	}
 	return blob, nil
 }
@@ -0,0 +1,108 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// Package lockstat implements a read-write mutex which optionally records the
+// time spent waiting for and holding it.
+package lockstat
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stats contains the contention statistics of a tracked lock.
+type Stats struct {
+	Acquired uint64        // Number of times the lock was acquired, shared or exclusive
+	Wait     time.Duration // Total time spent waiting for the lock
+	MaxWait  time.Duration // Longest time spent waiting for the lock
+	Hold     time.Duration // Total time the lock was held exclusively
+}
+
+// RWMutex is a drop-in replacement of sync.RWMutex. Once tracking is enabled,
+// the wait time of every acquisition and the hold time of exclusive ones are
+// accumulated. Shared holds are not measured since readers overlap.
+type RWMutex struct {
+	sync.RWMutex
+
+	enabled  bool      // Flag whether the lock is tracked, immutable after first use
+	acquired time.Time // Time of the current exclusive acquisition, protected by the lock
+
+	count   atomic.Uint64
+	wait    atomic.Int64
+	maxWait atomic.Int64
+	hold    atomic.Int64
+}
+
+// Track enables the tracking of the lock. It must be called before the lock
+// is used for the first time.
+func (l *RWMutex) Track() {
+	l.enabled = true
+}
+
+// Lock acquires the lock exclusively.
+func (l *RWMutex) Lock() {
+	if !l.enabled {
+		l.RWMutex.Lock()
+		return
+	}
+	start := time.Now()
+	l.RWMutex.Lock()
+	l.acquired = time.Now()
+	l.record(l.acquired.Sub(start))
+}
+
+// Unlock releases the exclusively held lock.
+func (l *RWMutex) Unlock() {
+	if l.enabled {
+		l.hold.Add(int64(time.Since(l.acquired)))
+	}
+	l.RWMutex.Unlock()
+}
+
+// RLock acquires the lock for reading.
+func (l *RWMutex) RLock() {
+	if !l.enabled {
+		l.RWMutex.RLock()
+		return
+	}
+	start := time.Now()
+	l.RWMutex.RLock()
+	l.record(time.Since(start))
+}
+
+// record accumulates the wait time of an acquisition.
+func (l *RWMutex) record(wait time.Duration) {
+	l.count.Add(1)
+	l.wait.Add(int64(wait))
+	for {
+		cur := l.maxWait.Load()
+		if int64(wait) <= cur || l.maxWait.CompareAndSwap(cur, int64(wait)) {
+			return
+		}
+	}
+}
+
+// Stats returns the statistics accumulated so far, all zero if the lock is
+// not tracked.
+func (l *RWMutex) Stats() Stats {
+	return Stats{
+		Acquired: l.count.Load(),
+		Wait:     time.Duration(l.wait.Load()),
+		MaxWait:  time.Duration(l.maxWait.Load()),
+		Hold:     time.Duration(l.hold.Load()),
+	}
+}
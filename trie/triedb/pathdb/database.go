@@ -21,14 +21,18 @@ import (
 	"fmt"
 	"io"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/VictoriaMetrics/fastcache"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/rawdb"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/metrics"
 	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/trie/triedb/lockstat"
 	"github.com/ethereum/go-ethereum/trie/trienode"
 	"github.com/ethereum/go-ethereum/trie/triestate"
 )
@@ -37,6 +41,10 @@ const (
 	// maxDiffLayers is the maximum diff layers allowed in the layer tree.
 	maxDiffLayers = 128
 
+	// nodeAgeCacheSize is the memory allowance (in bytes) for tracking the
+	// state id at which the nodes are last modified.
+	nodeAgeCacheSize = 16 * 1024 * 1024
+
 	// defaultCleanSize is the default memory allowance of clean cache.
 	defaultCleanSize = 16 * 1024 * 1024
 
@@ -59,8 +67,8 @@ const (
 type layer interface {
 	// Node retrieves the trie node with the node info. An error will be returned
 	// if the read operation exits abnormally. For example, if the layer is already
-	// stale, or the associated state is regarded as corrupted. Notably, no error
-	// will be returned if the requested node is not found in database.
+	// stale, or the associated state is regarded as corrupted. A missing node is
+	// reported with a trienode.NotFoundError.
 	Node(owner common.Hash, path []byte, hash common.Hash) ([]byte, error)
 
 	// rootHash returns the root hash for which this layer was made.
@@ -86,10 +94,54 @@ type layer interface {
 
 // Config contains the settings for database.
 type Config struct {
-	StateHistory   uint64 // Number of recent blocks to maintain state history for
+	StateHistory   uint64 // Number of recent blocks to maintain state history for, zero means keep all
 	CleanCacheSize int    // Maximum memory allowance (in bytes) for caching clean nodes
 	DirtyCacheSize int    // Maximum memory allowance (in bytes) for caching dirty nodes
 	ReadOnly       bool   // Flag whether the database is opened in read only mode.
+
+	CommitOrder  trienode.CommitOrder // Order in which account and storage trie nodes are written
+	TrackNodeAge bool                 // Flag whether the age of the nodes missed by the clean cache is tracked
+	TrackLocks   bool                 // Flag whether the wait and hold time of the database lock is tracked
+	Replicator   trienode.Replicator  // Receiver of the node writes made by flush and revert, nil if not replicated
+
+	// CleanCacheFactory creates the clean cache if it's enabled, fastcache
+	// is used if it's nil.
+	CleanCacheFactory trienode.CleanCacheFactory
+
+	// OnDiskLayerAdvance, if set, is invoked whenever a diff layer is merged
+	// into the disk layer, with the old and the new disk root along with the
+	// block number of the new one. It's called with the database locks held,
+	// thus it must not access the database.
+	OnDiskLayerAdvance func(old, new common.Hash, block uint64)
+
+	// OnError, if set, is invoked with the failed operation, one of "read",
+	// "flush" or "commit", and the error before it's logged or returned. A
+	// flush failing within a commit is reported for both. It may be called
+	// with the database locks held, thus it must not access the database.
+	OnError func(op string, err error)
+
+	// VerifyHistory, if set, makes the trie database verify the state history
+	// of each update with Database.VerifyHistory, failing the update if the
+	// reverse diff doesn't reconstruct the parent state. It's expensive.
+	VerifyHistory bool
+
+	// IdempotentUpdate makes an update be ignored if the state it introduces
+	// is already present as a diff layer upon the same parent, e.g. when the
+	// update is retried, rather than replacing the layer with a duplicate.
+	IdempotentUpdate bool
+
+	// OnReorg, if set, is invoked by an update which switches to another branch
+	// with the roots of the layers abandoned on the previous one, newest first,
+	// before the new layer is installed. The abandoned layers stay readable
+	// until they're dropped by the next flattening into the disk layer. It's
+	// invoked with the database lock held, thus it must not access the database.
+	OnReorg func(discarded []common.Hash)
+
+	// SampleReadLatency is the fraction of the node reads, between zero and
+	// one, whose latency is recorded into the histograms of Stats, split by
+	// the source serving the read: the diff layers or the node buffer, the
+	// clean cache and the disk. Zero disables the sampling.
+	SampleReadLatency float64
 }
 
 // sanitize checks the provided user configurations and changes anything that's
@@ -103,6 +155,13 @@ func (c *Config) sanitize() *Config {
 	return &conf
 }
 
+// reportError passes the error of the failed operation to the configured hook.
+func (c *Config) reportError(op string, err error) {
+	if c.OnError != nil {
+		c.OnError(op, err)
+	}
+}
+
 // Defaults contains default settings for Ethereum mainnet.
 var Defaults = &Config{
 	StateHistory:   params.FullImmutabilityThreshold,
@@ -134,7 +193,14 @@ type Database struct {
 	diskdb     ethdb.Database           // Persistent storage for matured trie nodes
 	tree       *layerTree               // The group for all known layers
 	freezer    *rawdb.ResettableFreezer // Freezer for storing trie histories, nil possible in tests
-	lock       sync.RWMutex             // Lock to prevent mutations from happening at the same time
+	metrics    *metricSet               // Meters for reporting the database activity
+	stats      *statSet                 // Histograms surfaced through Stats
+	ages       *fastcache.Cache         // Cache of the state id at which the nodes are last modified, nil if not tracked
+	head       common.Hash              // Root of the most recently added layer, empty if unknown
+	baseline   common.StorageSize       // Memory held by the layers right after the most recent flush
+	flushed    time.Time                // Time of the flush which the baseline belongs to
+	paused     atomic.Int32             // Number of pauses of the size-triggered flushes in effect
+	lock       lockstat.RWMutex         // Lock to prevent mutations from happening at the same time
 }
 
 // New attempts to load an already existing layer from a persistent key-value
@@ -151,6 +217,14 @@ func New(diskdb ethdb.Database, config *Config) *Database {
 		bufferSize: config.DirtyCacheSize,
 		config:     config,
 		diskdb:     diskdb,
+		metrics:    defaultMetrics,
+		stats:      newStatSet(),
+	}
+	if config.TrackLocks {
+		db.lock.Track()
+	}
+	if config.TrackNodeAge {
+		db.ages = fastcache.New(nodeAgeCacheSize)
 	}
 	// Construct the layer tree by resolving the in-disk singleton state
 	// and in-memory layer journal.
@@ -193,6 +267,85 @@ func (db *Database) Reader(root common.Hash) (layer, error) {
 	return l, nil
 }
 
+// ReaderWithin retrieves a layer belonging to the given state root. If it's not
+// available, the nearest available ancestor at most maxBlocksBehind blocks
+// older is returned instead, along with its root. The ancestry is resolved
+// through the headers in the chain, therefore the requested state must belong
+// to one of the recent blocks of the local chain.
+func (db *Database) ReaderWithin(root common.Hash, maxBlocksBehind uint64) (layer, common.Hash, error) {
+	if l := db.tree.get(root); l != nil {
+		return l, root, nil
+	}
+	// Locate the block of the requested state by walking backwards from the
+	// chain head. The states older than the bottom-most layer are not reachable
+	// anyway, so there is no point in going further.
+	var (
+		header *types.Header
+		hash   = rawdb.ReadHeadHeaderHash(db.diskdb)
+	)
+	for i := uint64(0); i <= maxDiffLayers+maxBlocksBehind; i++ {
+		number := rawdb.ReadHeaderNumber(db.diskdb, hash)
+		if number == nil {
+			break
+		}
+		h := rawdb.ReadHeader(db.diskdb, hash, *number)
+		if h == nil {
+			break
+		}
+		if h.Root == root {
+			header = h
+			break
+		}
+		if *number == 0 {
+			break
+		}
+		hash = h.ParentHash
+	}
+	if header == nil {
+		return nil, common.Hash{}, fmt.Errorf("state %#x is not available", root)
+	}
+	for i := uint64(0); i < maxBlocksBehind && header.Number.Uint64() > 0; i++ {
+		header = rawdb.ReadHeader(db.diskdb, header.ParentHash, header.Number.Uint64()-1)
+		if header == nil {
+			break
+		}
+		if l := db.tree.get(header.Root); l != nil {
+			return l, header.Root, nil
+		}
+	}
+	return nil, common.Hash{}, fmt.Errorf("state %#x is not available within %d blocks", root, maxBlocksBehind)
+}
+
+// ReaderNoCache retrieves a reader belonging to the given state root, which
+// doesn't insert the nodes loaded from disk into the clean cache. It's meant
+// for one-off scans that would otherwise evict the working set.
+func (db *Database) ReaderNoCache(root common.Hash) (*uncachedReader, error) {
+	l := db.tree.get(root)
+	if l == nil {
+		return nil, fmt.Errorf("state %#x is not available", root)
+	}
+	return &uncachedReader{layer: l}, nil
+}
+
+// uncachedReader is a state reader which bypasses the clean cache population.
+type uncachedReader struct {
+	layer layer
+}
+
+// Node retrieves the trie node blob with the provided node information. A
+// trienode.NotFoundError is returned if the node is not found.
+func (r *uncachedReader) Node(owner common.Hash, path []byte, hash common.Hash) ([]byte, error) {
+	switch l := r.layer.(type) {
+	case *diffLayer:
+		blob, _, err := l.node(owner, path, hash, 0, true)
+		return blob, err
+	case *diskLayer:
+		blob, _, err := l.node(owner, path, hash, true)
+		return blob, err
+	}
+	return r.layer.Node(owner, path, hash)
+}
+
 // Update adds a new layer into the tree, if that can be linked to an existing
 // old parent. It is disallowed to insert a disk layer (the origin of all). Apart
 // from that this function will flatten the extra diff layers at bottom into disk
@@ -209,30 +362,109 @@ func (db *Database) Update(root common.Hash, parentRoot common.Hash, block uint6
 	if db.readOnly {
 		return errSnapshotReadOnly
 	}
+	if db.config.IdempotentUpdate {
+		if dl, ok := db.tree.get(root).(*diffLayer); ok && dl.parentLayer().rootHash() == types.TrieRootHash(parentRoot) {
+			log.Debug("Ignored duplicate state update", "root", root, "parent", parentRoot)
+			db.head = types.TrieRootHash(root)
+			return nil
+		}
+	}
+	// Track the layers abandoned by switching to another branch. They are
+	// not discarded yet, but will be once the fork is capped into disk.
+	var abandoned []common.Hash
+	if db.head != (common.Hash{}) && db.head != types.TrieRootHash(parentRoot) {
+		abandoned = db.tree.abandoned(db.head, parentRoot)
+	}
+	if len(abandoned) > 0 && db.config.OnReorg != nil {
+		db.config.OnReorg(abandoned)
+	}
 	if err := db.tree.add(root, parentRoot, block, nodes, states); err != nil {
 		return err
 	}
+	depth := len(abandoned)
+	if depth > 0 {
+		db.updateReorgDepth(uint64(depth))
+	}
+	db.head = types.TrieRootHash(root)
 	// Keep 128 diff layers in the memory, persistent layer is 129th.
 	// - head layer is paired with HEAD state
 	// - head-1 layer is paired with HEAD-1 state
 	// - head-127 layer(bottom-most diff layer) is paired with HEAD-127 state
 	// - head-128 layer(disk layer) is paired with HEAD-128 state
-	return db.tree.cap(root, maxDiffLayers)
+	if err := db.tree.cap(root, maxDiffLayers); err != nil {
+		return trienode.Classify(err)
+	}
+	db.rebase()
+	return nil
 }
 
 // Commit traverses downwards the layer tree from a specified layer with the
 // provided state root and all the layers below are flattened downwards. It
-// can be used alone and mostly for test purposes.
+// can be used alone and mostly for test purposes. Committing the disk layer
+// flushes its node buffer.
 func (db *Database) Commit(root common.Hash, report bool) error {
 	// Hold the lock to prevent concurrent mutations.
 	db.lock.Lock()
 	defer db.lock.Unlock()
 
+	// Short circuit if the database is in read only mode.
+	if db.readOnly {
+		db.config.reportError("commit", errSnapshotReadOnly)
+		return errSnapshotReadOnly
+	}
+	// Committing the disk layer itself only persists its node buffer.
+	var err error
+	if dl := db.tree.bottom(); dl.rootHash() == types.TrieRootHash(root) {
+		err = dl.flush()
+	} else {
+		err = db.tree.cap(root, 0)
+	}
+	// The layers are already merged into the disk layer once its flush fails,
+	// leaving nothing to be retried, thus all the failures are fatal.
+	if err != nil {
+		db.config.reportError("commit", err)
+		return trienode.Classify(err)
+	}
+	db.rebase()
+	return nil
+}
+
+// rebase resets the baseline of the accumulated memory if the node buffer
+// has been flushed since the last check. The caller must hold the lock.
+func (db *Database) rebase() {
+	if flushed := db.LastFlush(); !flushed.Equal(db.flushed) {
+		db.baseline, db.flushed = db.Size(), flushed
+	}
+}
+
+// Shrink releases as much memory as safely possible by flushing the node
+// buffer of the disk layer into disk and emptying the clean cache. The diff
+// layers are retained for handling reorgs. The released size is returned.
+func (db *Database) Shrink() (common.StorageSize, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	released, err := db.tree.bottom().shrink(!db.readOnly)
+	if err != nil {
+		return 0, err
+	}
+	db.rebase()
+	return released, nil
+}
+
+// FlattenTo merges all the layers from the disk layer up to and including the
+// specified one into a single disk layer. The layers on top of the target are
+// left intact.
+func (db *Database) FlattenTo(root common.Hash) error {
+	// Hold the lock to prevent concurrent mutations.
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
 	// Short circuit if the database is in read only mode.
 	if db.readOnly {
 		return errSnapshotReadOnly
 	}
-	return db.tree.cap(root, 0)
+	return db.tree.flatten(root)
 }
 
 // Reset rebuilds the database with the specified state as the base.
@@ -285,10 +517,95 @@ func (db *Database) Reset(root common.Hash) error {
 	// with **empty clean cache and node buffer**.
 	dl := newDiskLayer(root, 0, db, nil, newNodeBuffer(db.bufferSize, nil, 0))
 	db.tree.reset(dl)
+	db.head, db.baseline, db.flushed = common.Hash{}, 0, time.Time{}
 	log.Info("Rebuilt trie database", "root", root)
 	return nil
 }
 
+// Truncate wipes all the trie nodes from the persistent database along with the
+// journal and state histories, and discards all the cached nodes and layers,
+// leaving the database uninitialized. Note the entire key space of persistent
+// database is iterated, it's only meant to be used in tests and tools.
+func (db *Database) Truncate() error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	// Short circuit if the database is in read only mode.
+	if db.readOnly {
+		return errSnapshotReadOnly
+	}
+	batch := db.diskdb.NewBatch()
+	it := db.diskdb.NewIterator(nil, nil)
+	defer it.Release()
+
+	for it.Next() {
+		if !rawdb.IsAccountTrieNode(it.Key()) && !rawdb.IsStorageTrieNode(it.Key()) {
+			continue
+		}
+		if err := batch.Delete(it.Key()); err != nil {
+			return err
+		}
+		if batch.ValueSize() >= ethdb.IdealBatchSize {
+			if err := batch.Write(); err != nil {
+				return err
+			}
+			batch.Reset()
+		}
+	}
+	if err := it.Error(); err != nil {
+		return err
+	}
+	rawdb.DeleteTrieJournal(batch)
+	rawdb.WritePersistentStateID(batch, 0)
+	if err := batch.Write(); err != nil {
+		return err
+	}
+	if db.freezer != nil {
+		if err := db.freezer.Reset(); err != nil {
+			return err
+		}
+	}
+	// Drop all the layers and construct an empty disk layer, the clean
+	// cache is emptied and inherited from the original disk layer.
+	dl := db.tree.bottom()
+	dl.resetCache()
+	if db.ages != nil {
+		db.ages.Reset()
+	}
+	dl.markStale()
+	db.tree.reset(newDiskLayer(types.EmptyRootHash, 0, db, dl.cleans, newNodeBuffer(db.bufferSize, nil, 0)))
+	db.head, db.baseline, db.flushed = common.Hash{}, 0, time.Time{}
+	log.Info("Truncated trie database")
+	return nil
+}
+
+// VerifyHistory checks the state history recorded for the diff layer with the
+// given root, by encoding and decoding it as it would be stored and applying
+// the reverse diff upon the layer, which must reconstruct the parent state.
+// It's expensive and meant for testing or canary nodes. The layers which are
+// not diff layers, carry no state set or an incomplete one are skipped.
+func (db *Database) VerifyHistory(root common.Hash, loader triestate.TrieLoader) error {
+	dl, ok := db.tree.get(types.TrieRootHash(root)).(*diffLayer)
+	if !ok || dl.states == nil {
+		return nil
+	}
+	h := newHistory(dl.rootHash(), dl.parentLayer().rootHash(), dl.block, dl.states)
+	if len(h.meta.incomplete) > 0 {
+		return nil
+	}
+	var (
+		dec                                                      = history{meta: h.meta}
+		accountData, storageData, accountIndexes, storageIndexes = h.encode()
+	)
+	if err := dec.decode(accountData, storageData, accountIndexes, storageIndexes); err != nil {
+		return fmt.Errorf("failed to decode state history of %#x (parent %#x): %w", h.meta.root, h.meta.parent, err)
+	}
+	if _, err := triestate.Apply(dec.meta.parent, dec.meta.root, dec.accounts, dec.storages, loader); err != nil {
+		return fmt.Errorf("state history of %#x doesn't reconstruct parent %#x: %w", dec.meta.root, dec.meta.parent, err)
+	}
+	return nil
+}
+
 // Recover rollbacks the database to a specified historical point.
 // The state is supported as the rollback destination only if it's
 // canonical state and the corresponding trie histories are existent.
@@ -309,7 +626,12 @@ func (db *Database) Recover(root common.Hash, loader triestate.TrieLoader) error
 	var (
 		start = time.Now()
 		dl    = db.tree.bottom()
+		depth = dl.stateID()
 	)
+	// All the layers on top of the disk layer are discarded as well.
+	if head := db.tree.get(db.head); head != nil {
+		depth = head.stateID()
+	}
 	for dl.rootHash() != root {
 		h, err := readHistory(db.freezer, dl.stateID())
 		if err != nil {
@@ -329,6 +651,8 @@ func (db *Database) Recover(root common.Hash, loader triestate.TrieLoader) error
 	if err != nil {
 		return err
 	}
+	db.updateReorgDepth(depth - dl.stateID())
+	db.head = root
 	log.Debug("Recovered state", "root", root, "elapsed", common.PrettyDuration(time.Since(start)))
 	return nil
 }
@@ -363,6 +687,211 @@ func (db *Database) Recoverable(root common.Hash) bool {
 	}) == nil
 }
 
+// CheckHistory scans the state histories retained in the freezer, returning
+// the range of blocks they cover along with the block numbers whose history
+// is missing, namely the ones at which the chain of state roots is broken.
+func (db *Database) CheckHistory() (uint64, uint64, []uint64, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	if db.freezer == nil {
+		return 0, 0, nil, errors.New("state history is not available")
+	}
+	tail, err := db.freezer.Tail()
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	head, err := db.freezer.Ancients()
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	if head <= tail {
+		return 0, 0, nil, nil
+	}
+	var (
+		last   *meta
+		oldest uint64
+		newest uint64
+		gaps   []uint64
+	)
+	err = checkHistories(db.freezer, tail+1, head-tail, func(m *meta) error {
+		if last == nil {
+			oldest = m.block
+		} else if m.parent != last.root {
+			// Report all the skipped blocks, or the block itself if it's
+			// adjacent to the previous one but not linked with it.
+			if m.block > last.block+1 {
+				for n := last.block + 1; n < m.block; n++ {
+					gaps = append(gaps, n)
+				}
+			} else {
+				gaps = append(gaps, m.block)
+			}
+		}
+		last, newest = m, m.block
+		return nil
+	})
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	return oldest, newest, gaps, nil
+}
+
+// LastCommittedBlock returns the block number of the state persisted in disk,
+// looked up in the state history of it. The block number of the state without
+// any history, e.g. the genesis, is reported as zero.
+func (db *Database) LastCommittedBlock() (uint64, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	id := rawdb.ReadPersistentStateID(db.diskdb)
+	if id == 0 {
+		return 0, nil
+	}
+	return db.historyBlock(id)
+}
+
+// Quarantine evicts the node at the given path from the clean cache and
+// deletes it from disk. A newer version of the node still held in the layers
+// or in the node buffer is left in place.
+func (db *Database) Quarantine(owner common.Hash, path []byte) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if db.readOnly {
+		return errSnapshotReadOnly
+	}
+	if cleans := db.tree.bottom().cleans; cleans != nil {
+		cleans.Del(cacheKey(owner, path))
+	}
+	if owner == (common.Hash{}) {
+		rawdb.DeleteAccountTrieNode(db.diskdb, path)
+	} else {
+		rawdb.DeleteStorageTrieNode(db.diskdb, owner, path)
+	}
+	return nil
+}
+
+// historyBlock returns the block number of the state with the given id, looked
+// up in the state history of it.
+func (db *Database) historyBlock(id uint64) (uint64, error) {
+	if db.freezer == nil {
+		return 0, errors.New("state history is not available")
+	}
+	blob := rawdb.ReadStateHistoryMeta(db.freezer, id)
+	if len(blob) == 0 {
+		return 0, fmt.Errorf("state history not found %d", id)
+	}
+	var m meta
+	if err := m.decode(blob); err != nil {
+		return 0, err
+	}
+	return m.block, nil
+}
+
+// PendingDiff returns the number and the size of the trie nodes accumulated in
+// memory above the state persisted in disk, namely the ones in the node buffer
+// and in the diff layers down from the head layer, along with the range of the
+// blocks they belong to. The layer with the highest state id is regarded as the
+// head if the most recently added one is unknown. The blocks of the buffered
+// layers are looked up in the state histories.
+func (db *Database) PendingDiff() (nodes int, size common.StorageSize, from uint64, to uint64, err error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	head := db.tree.get(db.head)
+	if head == nil {
+		db.tree.forEach(func(l layer) {
+			if head == nil || l.stateID() > head.stateID() {
+				head = l
+			}
+		})
+	}
+	for l := head; l != nil; {
+		dl, ok := l.(*diffLayer)
+		if !ok {
+			break
+		}
+		for _, subset := range dl.nodes {
+			for path, n := range subset {
+				nodes, size = nodes+1, size+common.StorageSize(n.Size()+len(path))
+			}
+		}
+		if to == 0 {
+			to = dl.block
+		}
+		from, l = dl.block, dl.parentLayer()
+	}
+	disk := db.tree.bottom()
+	disk.lock.RLock()
+	layers := disk.buffer.layers
+	for _, subset := range disk.buffer.nodes {
+		nodes += len(subset)
+	}
+	size += common.StorageSize(disk.buffer.size)
+	disk.lock.RUnlock()
+
+	if layers > 0 {
+		if from, err = db.historyBlock(disk.id - layers + 1); err != nil {
+			return 0, 0, 0, 0, err
+		}
+		if head == disk {
+			if to, err = db.historyBlock(disk.id); err != nil {
+				return 0, 0, 0, 0, err
+			}
+		}
+	}
+	return nodes, size, from, to, nil
+}
+
+// CountStates returns the number of states which can be served, namely the
+// disk layer and the diff layers, along with the states below the disk layer
+// which are recoverable by applying the state histories. The metadata of all
+// the retained histories is scanned for counting the latter.
+func (db *Database) CountStates() (int, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	count := db.tree.len()
+	if db.freezer == nil {
+		return count, nil
+	}
+	tail, err := db.freezer.Tail()
+	if err != nil {
+		return 0, err
+	}
+	head, err := db.freezer.Ancients()
+	if err != nil {
+		return 0, err
+	}
+	// The state histories in range [tail+1, disk] are required for reverting
+	// the disk layer. A state is recoverable only if all the histories above
+	// it are complete and linked with each other.
+	disk := db.tree.bottom().stateID()
+	if head < disk || disk <= tail {
+		return count, nil
+	}
+	var (
+		floor = tail
+		id    = tail
+		last  *meta
+	)
+	err = checkHistories(db.freezer, tail+1, disk-tail, func(m *meta) error {
+		id++
+		if len(m.incomplete) > 0 {
+			floor = id
+		} else if last != nil && m.parent != last.root {
+			floor = id - 1
+		}
+		last = m
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count + int(disk-floor), nil
+}
+
 // Close closes the trie database and the held freezer.
 func (db *Database) Close() error {
 	db.lock.Lock()
@@ -382,9 +911,116 @@ func (db *Database) Close() error {
 	return db.freezer.Close()
 }
 
+// SwapDiskDB re-points the database at another handle of the persistent
+// database, e.g. a copy migrated onto other storage. The persisted state of the
+// new handle must be the same as the current one. The disk layer reads and
+// flushes through the handle of the database, thus it's switched along, keeping
+// the node buffer and the clean cache. The state history freezer is reopened if
+// the new handle has its ancient store elsewhere.
+func (db *Database) SwapDiskDB(diskdb ethdb.Database) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if db.readOnly {
+		return errSnapshotReadOnly
+	}
+	_, oldRoot := rawdb.ReadAccountTrieNode(db.diskdb, nil)
+	_, newRoot := rawdb.ReadAccountTrieNode(diskdb, nil)
+	if oldRoot != newRoot {
+		return fmt.Errorf("persisted state is mismatched, current: %x, new: %x", oldRoot, newRoot)
+	}
+	oldID, newID := rawdb.ReadPersistentStateID(db.diskdb), rawdb.ReadPersistentStateID(diskdb)
+	if oldID != newID {
+		return fmt.Errorf("persisted state id is mismatched, current: %d, new: %d", oldID, newID)
+	}
+	oldDir, _ := db.diskdb.AncientDatadir()
+	newDir, _ := diskdb.AncientDatadir()
+	if oldDir != newDir {
+		var freezer *rawdb.ResettableFreezer
+		if newDir != "" {
+			f, err := rawdb.NewStateFreezer(newDir, false, 0)
+			if err != nil {
+				return err
+			}
+			freezer = f
+		}
+		if db.freezer != nil {
+			if err := db.freezer.Close(); err != nil {
+				log.Warn("Failed to close state history freezer", "err", err)
+			}
+		}
+		db.freezer = freezer
+	}
+	db.diskdb = diskdb
+	return nil
+}
+
+// Rehydrate rebuilds the disk layer from the state persisted now, e.g. after
+// the persistent database has been advanced by another process while this one
+// was suspended. The clean cache is discarded. If the persisted state is still
+// the one the disk layer is built on, the buffered nodes and the diff layers on
+// top are kept, otherwise they
+// are dropped along with the disk layer, which must have no buffered nodes as
+// they can't be applied on top of the new state. An error is returned if the
+// persistent database has been switched to the hash scheme or its state has
+// gone backwards.
+func (db *Database) Rehydrate() error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if scheme := rawdb.ReadStateScheme(db.diskdb); scheme == rawdb.HashScheme {
+		return fmt.Errorf("state scheme is changed to %s", scheme)
+	}
+	_, root := rawdb.ReadAccountTrieNode(db.diskdb, nil)
+	root = types.TrieRootHash(root)
+	id := rawdb.ReadPersistentStateID(db.diskdb)
+
+	dl := db.tree.bottom()
+	dl.resetCache()
+	baseRoot, baseID := dl.persisted()
+	if root == baseRoot && id == baseID {
+		return nil
+	}
+	if id < baseID {
+		return fmt.Errorf("persisted state id regressed from %d to %d", baseID, id)
+	}
+	if !dl.buffer.empty() {
+		return fmt.Errorf("buffered nodes can't be applied on top of persisted state %x", root)
+	}
+	dl.markStale()
+	db.tree.reset(newDiskLayer(root, id, db, dl.cleans, newNodeBuffer(db.bufferSize, nil, 0)))
+	db.head, db.baseline, db.flushed = common.Hash{}, 0, time.Time{}
+	log.Info("Rehydrated trie database", "root", root, "id", id)
+	return nil
+}
+
+// Config returns a copy of the configuration the database is running with,
+// after the sanitization.
+func (db *Database) Config() *Config {
+	conf := *db.config
+	return &conf
+}
+
+// checkSize is the flag whether Size validates the incrementally maintained
+// size against the slow path walking all the layers, only meant for tests.
+var checkSize = false
+
 // Size returns the current storage size of the memory cache in front of the
-// persistent database layer.
-func (db *Database) Size() (size common.StorageSize) {
+// persistent database layer. The memory of the diff layers is maintained by
+// the layer tree, so it doesn't walk the layers and doesn't allocate.
+func (db *Database) Size() common.StorageSize {
+	size := common.StorageSize(db.tree.memory.Load()) + db.tree.bottom().size()
+	if checkSize {
+		if slow := db.sizeSlow(); slow != size {
+			panic(fmt.Sprintf("size mismatch, fast: %v, slow: %v", size, slow))
+		}
+	}
+	return size
+}
+
+// sizeSlow computes the storage size of the memory cache by walking all the
+// layers.
+func (db *Database) sizeSlow() (size common.StorageSize) {
 	db.tree.forEach(func(layer layer) {
 		if diff, ok := layer.(*diffLayer); ok {
 			size += common.StorageSize(diff.memory)
@@ -396,6 +1032,133 @@ func (db *Database) Size() (size common.StorageSize) {
 	return size
 }
 
+// Stats contains the statistics of the database activity.
+type Stats struct {
+	ReorgDepth metrics.Histogram // Number of layers abandoned or reverted by reorgs
+	NodeAge    metrics.Histogram // Number of blocks since the nodes missed by the clean cache were modified
+
+	ReadLatencyLayer metrics.Histogram // Nanoseconds taken by the sampled reads served by the diff layers or the node buffer
+	ReadLatencyClean metrics.Histogram // Nanoseconds taken by the sampled reads served by the clean cache
+	ReadLatencyDisk  metrics.Histogram // Nanoseconds taken by the sampled reads served by the disk
+
+	OldestHistoryBlock uint64 // Block number of the oldest retained state history, zero if none
+}
+
+// Stats returns the statistics of the database activity.
+func (db *Database) Stats() Stats {
+	stats := Stats{
+		ReorgDepth: db.stats.reorgDepth.Snapshot(),
+		NodeAge:    db.stats.nodeAge.Snapshot(),
+
+		ReadLatencyLayer: db.stats.readLayer.Snapshot(),
+		ReadLatencyClean: db.stats.readClean.Snapshot(),
+		ReadLatencyDisk:  db.stats.readDisk.Snapshot(),
+	}
+	if db.freezer != nil {
+		stats.OldestHistoryBlock, _ = oldestHistoryBlock(db.freezer)
+	}
+	return stats
+}
+
+// Observation is a point-in-time snapshot of the database statistics.
+type Observation struct {
+	Root        common.Hash        // Root of the disk layer
+	Layers      int                // Number of layers, including the disk layer
+	Size        common.StorageSize // Memory held by all the layers
+	Delta       common.StorageSize // Memory accumulated since the node buffer was last flushed
+	Buffer      common.StorageSize // Memory held by the node buffer of the disk layer
+	BufferLimit common.StorageSize // Memory allowance of the node buffer
+	Cleans      common.StorageSize // Memory held by the clean cache
+	Written     common.StorageSize // Data storage flushed into disk since the database was opened
+	NWritten    uint64             // Number of nodes flushed into disk since the database was opened
+	LastFlush   time.Time          // Time of the most recent flush of the node buffer
+}
+
+// Observe returns a consistent snapshot of the database statistics, taken
+// while mutations are blocked.
+func (db *Database) Observe() Observation {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	dl := db.tree.bottom()
+	dl.lock.RLock()
+	o := Observation{
+		Root:        dl.root,
+		Buffer:      common.StorageSize(dl.buffer.size),
+		BufferLimit: common.StorageSize(dl.buffer.limit),
+		Written:     common.StorageSize(dl.buffer.written),
+		NWritten:    dl.buffer.nwritten,
+		LastFlush:   dl.buffer.flushed,
+	}
+	if dl.cleans != nil {
+		o.Cleans = common.StorageSize(dl.cleans.Len())
+	}
+	dl.lock.RUnlock()
+
+	o.Layers, o.Size = db.tree.len(), db.Size()
+	if o.Size > db.baseline {
+		o.Delta = o.Size - db.baseline
+	}
+	return o
+}
+
+// LockStats returns the contention statistics of the database lock, all zero
+// unless lock tracking is enabled.
+func (db *Database) LockStats() lockstat.Stats {
+	return db.lock.Stats()
+}
+
+// CleanCache returns the cache of the clean nodes keyed by the owner and the
+// node path, nil if it's disabled. It's shared by all the disk layers.
+func (db *Database) CleanCache() trienode.CleanCache {
+	return db.tree.bottom().cleans
+}
+
+// DeltaSize returns the memory accumulated in the layers since the node buffer
+// was last flushed into disk.
+func (db *Database) DeltaSize() common.StorageSize {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	if size := db.Size(); size > db.baseline {
+		return size - db.baseline
+	}
+	return 0
+}
+
+// Dirty reports whether committing the given state would write any node into
+// disk, namely whether it's not the disk layer or the node buffer isn't empty.
+func (db *Database) Dirty(root common.Hash) bool {
+	dl := db.tree.bottom()
+	return dl.rootHash() != types.TrieRootHash(root) || dl.size() != 0
+}
+
+// DiskRoot returns the root hash of the persistent disk layer.
+func (db *Database) DiskRoot() common.Hash {
+	return db.tree.bottom().rootHash()
+}
+
+// BufferSize returns the memory held by the node buffer of the disk layer
+// along with its allowance.
+func (db *Database) BufferSize() (common.StorageSize, common.StorageSize) {
+	dl := db.tree.bottom()
+	limit, _ := dl.bufferStats()
+	return dl.size(), limit
+}
+
+// LastFlush returns the time at which the node buffer was last flushed into
+// disk, or zero if it hasn't been flushed since the database was opened.
+func (db *Database) LastFlush() time.Time {
+	_, flushed := db.tree.bottom().bufferStats()
+	return flushed
+}
+
+// Written returns the data storage and the number of nodes flushed into disk
+// since the database was opened.
+func (db *Database) Written() (common.StorageSize, uint64) {
+	return db.tree.bottom().writeStats()
+}
+
 // Initialized returns an indicator if the state data is already
 // initialized in path-based scheme.
 func (db *Database) Initialized(genesisRoot common.Hash) bool {
@@ -421,6 +1184,35 @@ func (db *Database) SetBufferSize(size int) error {
 	return db.tree.bottom().setBufferSize(db.bufferSize)
 }
 
+// PauseFlush holds off flushing the node buffer once it exceeds the allowance
+// until the returned function is called, for a window of flush-free latency.
+// The buffer is flushed anyway if it grows past twice of its allowance while
+// paused. Explicit commits and buffer resizes are not affected. The pauses may
+// be nested, the flushing resumes once all of them are released.
+func (db *Database) PauseFlush() (resume func()) {
+	db.paused.Add(1)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { db.paused.Add(-1) })
+	}
+}
+
+// SetMetricsRegistry reports the database activity into the given registry
+// rather than the default one. It's meant to be called right after the
+// construction, before the database is accessed.
+func (db *Database) SetMetricsRegistry(r metrics.Registry) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	db.metrics = newMetricSet(r)
+	db.tree.forEach(func(layer layer) {
+		if diff, ok := layer.(*diffLayer); ok {
+			diff.metrics = db.metrics
+		}
+	})
+}
+
 // Scheme returns the node scheme used in the database.
 func (db *Database) Scheme() string {
 	return rawdb.PathScheme
@@ -18,12 +18,15 @@ package pathdb
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"math/big"
 	"math/rand"
+	"reflect"
 	"testing"
 
+	"github.com/VictoriaMetrics/fastcache"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/rawdb"
 	"github.com/ethereum/go-ethereum/core/types"
@@ -34,6 +37,11 @@ import (
 	"github.com/ethereum/go-ethereum/trie/triestate"
 )
 
+func init() {
+	// Validate the incrementally maintained size in all the tests.
+	checkSize = true
+}
+
 func updateTrie(addrHash common.Hash, root common.Hash, dirties, cleans map[common.Hash][]byte) (common.Hash, *trienode.NodeSet) {
 	h, err := newTestHasher(addrHash, root, cleans)
 	if err != nil {
@@ -439,6 +447,22 @@ func TestDatabaseRecoverable(t *testing.T) {
 	}
 }
 
+func TestCheckHistory(t *testing.T) {
+	tester := newTester(t)
+	defer tester.release()
+
+	oldest, newest, gaps, err := tester.db.CheckHistory()
+	if err != nil {
+		t.Fatalf("Failed to check state histories, err: %v", err)
+	}
+	if oldest != 0 || newest != uint64(tester.bottomIndex()) {
+		t.Fatalf("Unexpected history range, want: [0, %d], got: [%d, %d]", tester.bottomIndex(), oldest, newest)
+	}
+	if len(gaps) != 0 {
+		t.Fatalf("Unexpected history gaps: %v", gaps)
+	}
+}
+
 func TestReset(t *testing.T) {
 	var (
 		tester = newTester(t)
@@ -498,6 +522,33 @@ func TestCommit(t *testing.T) {
 	}
 }
 
+func TestFlattenTo(t *testing.T) {
+	var (
+		tester = newTester(t)
+		index  = tester.bottomIndex() + 10
+		target = tester.roots[index]
+	)
+	defer tester.release()
+
+	if err := tester.db.FlattenTo(target); err != nil {
+		t.Fatalf("Failed to flatten database, err: %v", err)
+	}
+	if tester.db.tree.bottom().rootHash() != target {
+		t.Fatal("Disk layer is not advanced to the target")
+	}
+	if n, exp := tester.db.tree.len(), len(tester.roots)-index; n != exp {
+		t.Fatalf("Unexpected layer number, want: %d, got: %d", exp, n)
+	}
+	for i := index; i < len(tester.roots); i++ {
+		if err := tester.verifyState(tester.roots[i]); err != nil {
+			t.Fatalf("State is invalid, err: %v", err)
+		}
+	}
+	if err := tester.verifyHistory(); err != nil {
+		t.Fatalf("State history is invalid, err: %v", err)
+	}
+}
+
 func TestJournal(t *testing.T) {
 	tester := newTester(t)
 	defer tester.release()
@@ -522,6 +573,44 @@ func TestJournal(t *testing.T) {
 	}
 }
 
+func TestRehydrateWithBuffer(t *testing.T) {
+	tester := newTester(t)
+	defer tester.release()
+
+	dl := tester.db.tree.bottom()
+	if dl.buffer.empty() {
+		t.Fatal("Node buffer is empty")
+	}
+	layers := tester.db.tree.len()
+	if err := tester.db.Rehydrate(); err != nil {
+		t.Fatalf("Failed to rehydrate, err: %v", err)
+	}
+	if tester.db.tree.len() != layers || tester.db.tree.bottom() != dl {
+		t.Fatal("Layers are dropped on unchanged persisted state")
+	}
+	if err := tester.verifyState(tester.lastHash()); err != nil {
+		t.Fatalf("State is invalid, err: %v", err)
+	}
+	// The persisted state is resolved from the journal as well
+	if err := tester.db.Journal(tester.lastHash()); err != nil {
+		t.Fatalf("Failed to journal, err: %v", err)
+	}
+	tester.db.Close()
+	tester.db = New(tester.db.diskdb, nil)
+	if err := tester.db.Rehydrate(); err != nil {
+		t.Fatalf("Failed to rehydrate journaled database, err: %v", err)
+	}
+	if tester.db.tree.len() != layers {
+		t.Fatal("Layers are dropped on unchanged persisted state")
+	}
+	// The buffered nodes can't be applied on top of an advanced state
+	_, id := tester.db.tree.bottom().persisted()
+	rawdb.WritePersistentStateID(tester.db.diskdb, id+1)
+	if err := tester.db.Rehydrate(); err == nil {
+		t.Fatal("Buffered nodes are applied on top of advanced state")
+	}
+}
+
 func TestCorruptedJournal(t *testing.T) {
 	tester := newTester(t)
 	defer tester.release()
@@ -572,3 +661,486 @@ func copyStorages(set map[common.Hash]map[common.Hash][]byte) map[common.Hash]ma
 	}
 	return copied
 }
+
+func TestReaderNoCache(t *testing.T) {
+	tester := newTester(t)
+	defer tester.release()
+
+	root := tester.lastHash()
+	if err := tester.db.Commit(root, false); err != nil {
+		t.Fatalf("Failed to commit state, err: %v", err)
+	}
+	cleans := tester.db.tree.bottom().cleans
+	cleans.Reset()
+
+	reader, err := tester.db.ReaderNoCache(root)
+	if err != nil {
+		t.Fatalf("Failed to open reader, err: %v", err)
+	}
+	blob, err := reader.Node(common.Hash{}, nil, root)
+	if err != nil || len(blob) == 0 {
+		t.Fatalf("Failed to read root node, err: %v", err)
+	}
+	if cleans.Get(cacheKey(common.Hash{}, nil)) != nil {
+		t.Fatal("Clean cache is populated")
+	}
+	layer, _ := tester.db.Reader(root)
+	if _, err := layer.Node(common.Hash{}, nil, root); err != nil {
+		t.Fatalf("Failed to read root node, err: %v", err)
+	}
+	if cleans.Get(cacheKey(common.Hash{}, nil)) == nil {
+		t.Fatal("Clean cache is not populated")
+	}
+}
+
+func TestReaderWithin(t *testing.T) {
+	tester := newTester(t)
+	defer tester.release()
+
+	// Construct the chain of headers for the states tracked by tester, along
+	// with a head block whose state is not available.
+	var parent common.Hash
+	for i, root := range append(tester.roots, testutil.RandomHash()) {
+		header := &types.Header{Number: big.NewInt(int64(i)), Root: root, ParentHash: parent}
+		rawdb.WriteHeader(tester.db.diskdb, header)
+		parent = header.Hash()
+	}
+	rawdb.WriteHeadHeaderHash(tester.db.diskdb, parent)
+
+	last := tester.lastHash()
+	if _, root, err := tester.db.ReaderWithin(last, 0); err != nil || root != last {
+		t.Fatalf("Unexpected reader, root: %x, err: %v", root, err)
+	}
+	head := rawdb.ReadHeader(tester.db.diskdb, parent, uint64(len(tester.roots))).Root
+	if _, _, err := tester.db.ReaderWithin(head, 0); err == nil {
+		t.Fatal("Expected error for unavailable state")
+	}
+	reader, root, err := tester.db.ReaderWithin(head, 1)
+	if err != nil || root != last {
+		t.Fatalf("Unexpected ancestor, want: %x, got: %x, err: %v", last, root, err)
+	}
+	if reader.rootHash() != last {
+		t.Fatalf("Unexpected reader root, want: %x, got: %x", last, reader.rootHash())
+	}
+	if _, _, err := tester.db.ReaderWithin(testutil.RandomHash(), 1); err == nil {
+		t.Fatal("Expected error for unknown state")
+	}
+}
+
+func TestForkDepth(t *testing.T) {
+	tester := newTester(t)
+	defer tester.release()
+
+	var (
+		last = len(tester.roots) - 1
+		head = tester.roots[last]
+	)
+	if depth := tester.db.tree.forkDepth(head, head); depth != 0 {
+		t.Fatalf("Unexpected depth, want: 0, got: %d", depth)
+	}
+	if depth := tester.db.tree.forkDepth(head, tester.roots[last-3]); depth != 3 {
+		t.Fatalf("Unexpected depth, want: 3, got: %d", depth)
+	}
+	if depth := tester.db.tree.forkDepth(tester.roots[last-3], head); depth != 0 {
+		t.Fatalf("Unexpected depth, want: 0, got: %d", depth)
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	tester := newTester(t)
+	defer tester.release()
+
+	root := tester.lastHash()
+	if err := tester.db.Checkpoint(root, false); err != nil {
+		t.Fatalf("Failed to checkpoint, err: %v", err)
+	}
+	if tester.db.readOnly {
+		t.Fatal("Database is read-only after checkpoint")
+	}
+	if rawdb.ReadTrieJournal(tester.db.diskdb) == nil {
+		t.Fatal("Journal is not stored")
+	}
+	tester.db.Close()
+	tester.db = New(tester.db.diskdb, nil)
+
+	if disk := tester.db.tree.bottom().rootHash(); disk != root {
+		t.Fatalf("Unexpected disk root, want: %x, got: %x", root, disk)
+	}
+	if err := tester.verifyState(root); err != nil {
+		t.Fatalf("Invalid state, err: %v", err)
+	}
+}
+
+func TestTrackNodeAge(t *testing.T) {
+	tester := newTester(t)
+	defer tester.release()
+
+	tester.db.ages = fastcache.New(nodeAgeCacheSize)
+	root := tester.lastHash()
+	if err := tester.db.Commit(root, false); err != nil {
+		t.Fatalf("Failed to commit, err: %v", err)
+	}
+	// The root node is modified by every transition, so it's recorded
+	// with the state id of the latest one.
+	blob := tester.db.ages.Get(nil, cacheKey(common.Hash{}, nil))
+	if len(blob) != 8 {
+		t.Fatal("Node age is not tracked")
+	}
+	if id := binary.BigEndian.Uint64(blob); id != tester.db.tree.bottom().stateID() {
+		t.Fatalf("Unexpected state id, want: %d, got: %d", tester.db.tree.bottom().stateID(), id)
+	}
+}
+
+func TestShrink(t *testing.T) {
+	tester := newTester(t)
+	defer tester.release()
+
+	dl := tester.db.tree.bottom()
+	if dl.buffer.empty() {
+		t.Fatal("Node buffer is empty")
+	}
+	size := dl.size()
+	released, err := tester.db.Shrink()
+	if err != nil {
+		t.Fatalf("Failed to shrink, err: %v", err)
+	}
+	if released < size {
+		t.Fatalf("Unexpected released size, want at least: %v, got: %v", size, released)
+	}
+	if !dl.buffer.empty() || dl.size() != 0 {
+		t.Fatal("Node buffer is not flushed")
+	}
+	if id := rawdb.ReadPersistentStateID(tester.db.diskdb); id != dl.stateID() {
+		t.Fatalf("Unexpected persistent state id, want: %d, got: %d", dl.stateID(), id)
+	}
+	if size := dl.cleans.Len(); size != 0 {
+		t.Fatalf("Clean cache is not emptied, %d bytes left", size)
+	}
+	if err := tester.verifyState(tester.lastHash()); err != nil {
+		t.Fatalf("Invalid state, err: %v", err)
+	}
+}
+
+func TestCommitDiskLayer(t *testing.T) {
+	tester := newTester(t)
+	defer tester.release()
+
+	dl := tester.db.tree.bottom()
+	if !tester.db.Dirty(dl.rootHash()) {
+		t.Fatal("Disk layer with non-empty buffer is not dirty")
+	}
+	if err := tester.db.Commit(dl.rootHash(), false); err != nil {
+		t.Fatalf("Failed to commit disk layer, err: %v", err)
+	}
+	if !dl.buffer.empty() || tester.db.Dirty(dl.rootHash()) {
+		t.Fatal("Node buffer is not flushed")
+	}
+	if id := rawdb.ReadPersistentStateID(tester.db.diskdb); id != dl.stateID() {
+		t.Fatalf("Unexpected persistent state id, want: %d, got: %d", dl.stateID(), id)
+	}
+	if err := tester.verifyState(tester.lastHash()); err != nil {
+		t.Fatalf("Invalid state, err: %v", err)
+	}
+}
+
+func TestOldestHistoryBlock(t *testing.T) {
+	tester := newTester(t)
+	defer tester.release()
+
+	if block := tester.db.Stats().OldestHistoryBlock; block != 0 {
+		t.Fatalf("Unexpected oldest history block, want: 0, got: %d", block)
+	}
+	tester.db.config.StateHistory = 16
+	if err := tester.db.Commit(tester.lastHash(), false); err != nil {
+		t.Fatalf("Failed to commit, err: %v", err)
+	}
+	// The state histories of the blocks [0, 239] are pruned
+	if block := tester.db.Stats().OldestHistoryBlock; block != 240 {
+		t.Fatalf("Unexpected oldest history block, want: 240, got: %d", block)
+	}
+	tail, _ := tester.db.freezer.Tail()
+	if tail != 240 {
+		t.Fatalf("Unexpected freezer tail, want: 240, got: %d", tail)
+	}
+	if err := tester.verifyState(tester.lastHash()); err != nil {
+		t.Fatalf("Invalid state, err: %v", err)
+	}
+}
+
+func TestSize(t *testing.T) {
+	tester := newTester(t)
+	defer tester.release()
+
+	if size, slow := tester.db.Size(), tester.db.sizeSlow(); size != slow || size == 0 {
+		t.Fatalf("Unexpected size, fast: %v, slow: %v", size, slow)
+	}
+	// Flatten everything into the disk layer
+	if err := tester.db.Commit(tester.lastHash(), false); err != nil {
+		t.Fatalf("Failed to commit, err: %v", err)
+	}
+	if size := tester.db.Size(); size != 0 || tester.db.tree.memory.Load() != 0 {
+		t.Fatalf("Unexpected size after commit: %v", size)
+	}
+	// Stack a new layer on top
+	parent := tester.lastHash()
+	root, nodes, states := tester.generate(parent)
+	if err := tester.db.Update(root, parent, uint64(len(tester.roots)), nodes, states); err != nil {
+		t.Fatalf("Failed to update state changes, err: %v", err)
+	}
+	if size, slow := tester.db.Size(), tester.db.sizeSlow(); size != slow || size == 0 {
+		t.Fatalf("Unexpected size, fast: %v, slow: %v", size, slow)
+	}
+}
+
+func TestExportDiffLayers(t *testing.T) {
+	tester := newTester(t)
+	defer tester.release()
+
+	// Persist the buffered nodes, the disk layer is not part of the export.
+	if _, err := tester.db.Shrink(); err != nil {
+		t.Fatalf("Failed to shrink, err: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := tester.db.ExportDiffLayers(&buf); err != nil {
+		t.Fatalf("Failed to export, err: %v", err)
+	}
+	layers := tester.db.tree.len()
+	tester.db.Close()
+	tester.db = New(tester.db.diskdb, nil)
+
+	if err := tester.db.ImportDiffLayers(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatalf("Failed to import, err: %v", err)
+	}
+	if n := tester.db.tree.len(); n != layers {
+		t.Fatalf("Unexpected layer count, want: %d, got: %d", layers, n)
+	}
+	for i := tester.bottomIndex(); i < len(tester.roots); i++ {
+		if err := tester.verifyState(tester.roots[i]); err != nil {
+			t.Fatalf("Invalid state, err: %v", err)
+		}
+	}
+	// Importing on top of a different disk state must be rejected.
+	if err := tester.db.Commit(tester.lastHash(), false); err != nil {
+		t.Fatalf("Failed to commit, err: %v", err)
+	}
+	if err := tester.db.ImportDiffLayers(bytes.NewReader(buf.Bytes())); err == nil {
+		t.Fatal("Expected import failure on mismatched disk root")
+	}
+}
+
+func TestOnDiskLayerAdvance(t *testing.T) {
+	tester := newTester(t)
+	defer tester.release()
+
+	var (
+		disk   = tester.db.tree.bottom().rootHash()
+		blocks []uint64
+	)
+	tester.db.config.OnDiskLayerAdvance = func(old, new common.Hash, block uint64) {
+		if old != disk {
+			t.Errorf("Unexpected old disk root, want: %x, got: %x", disk, old)
+		}
+		disk = new
+		blocks = append(blocks, block)
+	}
+	index := tester.bottomIndex() + 1
+	if err := tester.db.Commit(tester.lastHash(), false); err != nil {
+		t.Fatalf("Failed to commit, err: %v", err)
+	}
+	if disk != tester.lastHash() || disk != tester.db.tree.bottom().rootHash() {
+		t.Fatalf("Unexpected disk root, want: %x, got: %x", tester.lastHash(), disk)
+	}
+	if len(blocks) != len(tester.roots)-index {
+		t.Fatalf("Unexpected advances, want: %d, got: %d", len(tester.roots)-index, len(blocks))
+	}
+	for i, block := range blocks {
+		if block != uint64(index+i) {
+			t.Fatalf("Unexpected block of advance %d, want: %d, got: %d", i, index+i, block)
+		}
+	}
+}
+
+func TestVerifyHistory(t *testing.T) {
+	tester := newTester(t)
+	defer tester.release()
+
+	for i := tester.bottomIndex() + 1; i < len(tester.roots)-1; i++ {
+		root := tester.roots[i]
+		loader := newHashLoader(tester.snapAccounts[root], tester.snapStorages[root])
+		if err := tester.db.VerifyHistory(root, loader); err != nil {
+			t.Fatalf("Failed to verify history of %x, err: %v", root, err)
+		}
+	}
+	// Corrupt the reverse diff of a layer and ensure it's rejected
+	root := tester.roots[len(tester.roots)-2]
+	dl := tester.db.tree.get(root).(*diffLayer)
+	for addr := range dl.states.Accounts {
+		dl.states.Accounts[addr] = types.SlimAccountRLP(generateAccount(types.EmptyRootHash))
+		break
+	}
+	loader := newHashLoader(tester.snapAccounts[root], tester.snapStorages[root])
+	if err := tester.db.VerifyHistory(root, loader); err == nil {
+		t.Fatal("Corrupted history is not detected")
+	}
+}
+
+func TestCountStates(t *testing.T) {
+	tester := newTester(t)
+	defer tester.release()
+
+	// All the states including the empty one are either held in the layers
+	// or recoverable from the state histories.
+	count, err := tester.db.CountStates()
+	if err != nil {
+		t.Fatalf("Failed to count states, err: %v", err)
+	}
+	if count != len(tester.roots)+1 {
+		t.Fatalf("Unexpected state count, want: %d, got: %d", len(tester.roots)+1, count)
+	}
+}
+
+func TestPauseFlush(t *testing.T) {
+	tester := newTester(t)
+	defer tester.release()
+
+	// Accumulate a number of layers in the node buffer without flushing
+	root := tester.lastHash()
+	tester.db.tree.bottom().buffer.limit = 1 << 40
+	if err := tester.db.tree.cap(root, 64); err != nil {
+		t.Fatalf("Failed to cap, err: %v", err)
+	}
+	persisted := rawdb.ReadPersistentStateID(tester.db.diskdb)
+
+	// Exceed the allowance while paused, the buffer must be left unflushed
+	resume := tester.db.PauseFlush()
+	buffer := tester.db.tree.bottom().buffer
+	buffer.limit = buffer.size * 2 / 3
+	if err := tester.db.tree.cap(root, 63); err != nil {
+		t.Fatalf("Failed to cap, err: %v", err)
+	}
+	if id := rawdb.ReadPersistentStateID(tester.db.diskdb); id != persisted || tester.db.tree.bottom().buffer.empty() {
+		t.Fatalf("Node buffer is flushed while paused, id: %d", id)
+	}
+	// Resume, the buffer must be flushed with the next layer
+	resume()
+	resume()
+	if err := tester.db.tree.cap(root, 62); err != nil {
+		t.Fatalf("Failed to cap, err: %v", err)
+	}
+	if id := rawdb.ReadPersistentStateID(tester.db.diskdb); id != tester.db.tree.bottom().stateID() {
+		t.Fatalf("Node buffer is not flushed after resume, want: %d, got: %d", tester.db.tree.bottom().stateID(), id)
+	}
+	if err := tester.verifyState(root); err != nil {
+		t.Fatalf("Invalid state, err: %v", err)
+	}
+}
+
+func TestPendingDiff(t *testing.T) {
+	tester := newTester(t)
+	defer tester.release()
+
+	// The states since the persisted one are pending, state id n belongs to
+	// the block n-1.
+	nodes, size, from, to, err := tester.db.PendingDiff()
+	if err != nil {
+		t.Fatalf("Failed to get pending diff, err: %v", err)
+	}
+	persisted := rawdb.ReadPersistentStateID(tester.db.diskdb)
+	if nodes == 0 || size == 0 || from != persisted || to != uint64(len(tester.roots)-1) {
+		t.Fatalf("Unexpected pending diff, nodes: %d, size: %v, blocks: %d-%d, persisted: %d", nodes, size, from, to, persisted)
+	}
+	if err := tester.db.Commit(tester.lastHash(), false); err != nil {
+		t.Fatalf("Failed to commit, err: %v", err)
+	}
+	nodes, size, from, to, err = tester.db.PendingDiff()
+	if err != nil || nodes != 0 || size != 0 || from != 0 || to != 0 {
+		t.Fatalf("Unexpected pending diff after commit, nodes: %d, size: %v, blocks: %d-%d, err: %v", nodes, size, from, to, err)
+	}
+}
+
+func TestIdempotentUpdate(t *testing.T) {
+	tester := newTester(t)
+	defer tester.release()
+
+	tester.db.config.IdempotentUpdate = true
+	var (
+		root   = tester.lastHash()
+		parent = tester.roots[len(tester.roots)-2]
+		layer  = tester.db.tree.get(root)
+		layers = tester.db.tree.len()
+	)
+	// Retry the most recent update, the layer must be left untouched
+	if err := tester.db.Update(root, parent, uint64(len(tester.roots)-1), trienode.NewMergedNodeSet(), nil); err != nil {
+		t.Fatalf("Failed to retry update, err: %v", err)
+	}
+	if tester.db.tree.get(root) != layer || tester.db.tree.len() != layers {
+		t.Fatal("Duplicate update replaced the layer")
+	}
+}
+
+func TestOnReorg(t *testing.T) {
+	tester := newTester(t)
+	defer tester.release()
+
+	var (
+		last      = len(tester.roots) - 1
+		parent    = tester.roots[last-2]
+		root      = common.Hash{0x1}
+		discarded []common.Hash
+	)
+	tester.db.config.OnReorg = func(roots []common.Hash) {
+		if tester.db.tree.get(root) != nil {
+			t.Fatal("Reorg is reported after installing the new layer")
+		}
+		discarded = roots
+	}
+	states := triestate.New(make(map[common.Address][]byte), make(map[common.Address]map[common.Hash][]byte), nil)
+	if err := tester.db.Update(root, parent, uint64(last), trienode.NewMergedNodeSet(), states); err != nil {
+		t.Fatalf("Failed to update, err: %v", err)
+	}
+	if want := []common.Hash{tester.roots[last], tester.roots[last-1]}; !reflect.DeepEqual(discarded, want) {
+		t.Fatalf("Unexpected discarded layers, want: %x, got: %x", want, discarded)
+	}
+}
+
+func TestSampleReadLatency(t *testing.T) {
+	tester := newTester(t)
+	defer tester.release()
+
+	tester.db.config.SampleReadLatency = 1
+
+	root := tester.lastHash()
+	if err := tester.db.Commit(root, false); err != nil {
+		t.Fatalf("Failed to commit, err: %v", err)
+	}
+	// Read the root node from disk and then from the clean cache
+	dl := tester.db.tree.bottom()
+	dl.resetCache()
+	for i := 0; i < 2; i++ {
+		if _, err := dl.Node(common.Hash{}, nil, root); err != nil {
+			t.Fatalf("Failed to read root node, err: %v", err)
+		}
+	}
+	// Read the root node of a new diff layer
+	next, nodes, states := tester.generate(root)
+	if err := tester.db.Update(next, root, 0, nodes, states); err != nil {
+		t.Fatalf("Failed to update state changes, err: %v", err)
+	}
+	reader, err := tester.db.Reader(next)
+	if err != nil {
+		t.Fatalf("Failed to open reader, err: %v", err)
+	}
+	if _, err := reader.Node(common.Hash{}, nil, next); err != nil {
+		t.Fatalf("Failed to read root node, err: %v", err)
+	}
+	stats := tester.db.Stats()
+	if n := stats.ReadLatencyDisk.Count(); n != 1 {
+		t.Fatalf("Unexpected disk reads sampled, want: 1, got: %d", n)
+	}
+	if n := stats.ReadLatencyClean.Count(); n != 1 {
+		t.Fatalf("Unexpected clean cache reads sampled, want: 1, got: %d", n)
+	}
+	if n := stats.ReadLatencyLayer.Count(); n != 1 {
+		t.Fatalf("Unexpected layer reads sampled, want: 1, got: %d", n)
+	}
+}
@@ -19,6 +19,7 @@ package pathdb
 import (
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/log"
@@ -33,12 +34,15 @@ import (
 // made to the state, that have not yet graduated into a semi-immutable state.
 type diffLayer struct {
 	// Immutables
-	root   common.Hash                               // Root hash to which this layer diff belongs to
-	id     uint64                                    // Corresponding state id
-	block  uint64                                    // Associated block number
-	nodes  map[common.Hash]map[string]*trienode.Node // Cached trie nodes indexed by owner and path
-	states *triestate.Set                            // Associated state change set for building history
-	memory uint64                                    // Approximate guess as to how much memory we use
+	root    common.Hash                               // Root hash to which this layer diff belongs to
+	id      uint64                                    // Corresponding state id
+	block   uint64                                    // Associated block number
+	nodes   map[common.Hash]map[string]*trienode.Node // Cached trie nodes indexed by owner and path
+	states  *triestate.Set                            // Associated state change set for building history
+	memory  uint64                                    // Approximate guess as to how much memory we use
+	metrics *metricSet                                // Meters for reporting the layer activity
+	stats   *statSet                                  // Histograms surfaced through the database statistics
+	sample  float64                                   // Fraction of the node reads whose latency is sampled
 
 	parent layer        // Parent layer modified by this one, never nil, **can be changed**
 	lock   sync.RWMutex // Lock used to protect parent
@@ -58,6 +62,12 @@ func newDiffLayer(parent layer, root common.Hash, id uint64, block uint64, nodes
 		states: states,
 		parent: parent,
 	}
+	switch p := parent.(type) {
+	case *diskLayer:
+		dl.metrics, dl.stats, dl.sample = p.db.metrics, p.db.stats, p.db.config.SampleReadLatency
+	case *diffLayer:
+		dl.metrics, dl.stats, dl.sample = p.metrics, p.stats, p.sample
+	}
 	for _, subset := range nodes {
 		for path, n := range subset {
 			dl.memory += uint64(n.Size() + len(path))
@@ -68,9 +78,9 @@ func newDiffLayer(parent layer, root common.Hash, id uint64, block uint64, nodes
 	if states != nil {
 		dl.memory += uint64(states.Size())
 	}
-	dirtyWriteMeter.Mark(size)
-	diffLayerNodesMeter.Mark(int64(count))
-	diffLayerBytesMeter.Mark(int64(dl.memory))
+	dl.metrics.dirtyWriteMeter.Mark(size)
+	dl.metrics.diffLayerNodesMeter.Mark(int64(count))
+	dl.metrics.diffLayerBytesMeter.Mark(int64(dl.memory))
 	log.Debug("Created new diff layer", "id", id, "block", block, "nodes", count, "size", common.StorageSize(dl.memory))
 	return dl
 }
@@ -98,7 +108,7 @@ func (dl *diffLayer) parentLayer() layer {
 // node retrieves the node with provided node information. It's the internal
 // version of Node function with additional accessed layer tracked. No error
 // will be returned if node is not found.
-func (dl *diffLayer) node(owner common.Hash, path []byte, hash common.Hash, depth int) ([]byte, error) {
+func (dl *diffLayer) node(owner common.Hash, path []byte, hash common.Hash, depth int, nocache bool) ([]byte, readSource, error) {
 	// Hold the lock, ensure the parent won't be changed during the
 	// state accessing.
 	dl.lock.RLock()
@@ -112,28 +122,38 @@ func (dl *diffLayer) node(owner common.Hash, path []byte, hash common.Hash, dept
 			// If the trie node is not hash matched, or marked as removed,
 			// bubble up an error here. It shouldn't happen at all.
 			if n.Hash != hash {
-				dirtyFalseMeter.Mark(1)
+				dl.metrics.dirtyFalseMeter.Mark(1)
 				log.Error("Unexpected trie node in diff layer", "owner", owner, "path", path, "expect", hash, "got", n.Hash)
-				return nil, newUnexpectedNodeError("diff", hash, n.Hash, owner, path)
+				return nil, sourceLayer, newUnexpectedNodeError("diff", hash, n.Hash, owner, path)
 			}
-			dirtyHitMeter.Mark(1)
-			dirtyNodeHitDepthHist.Update(int64(depth))
-			dirtyReadMeter.Mark(int64(len(n.Blob)))
-			return n.Blob, nil
+			dl.metrics.dirtyHitMeter.Mark(1)
+			dl.metrics.dirtyNodeHitDepthHist.Update(int64(depth))
+			dl.metrics.dirtyReadMeter.Mark(int64(len(n.Blob)))
+			return n.Blob, sourceLayer, nil
 		}
 	}
 	// Trie node unknown to this layer, resolve from parent
 	if diff, ok := dl.parent.(*diffLayer); ok {
-		return diff.node(owner, path, hash, depth+1)
+		return diff.node(owner, path, hash, depth+1, nocache)
 	}
 	// Failed to resolve through diff layers, fallback to disk layer
-	return dl.parent.Node(owner, path, hash)
+	return dl.parent.(*diskLayer).node(owner, path, hash, nocache)
 }
 
 // Node implements the layer interface, retrieving the trie node blob with the
-// provided node information. No error will be returned if the node is not found.
+// provided node information. A trienode.NotFoundError is returned if the node
+// is not found.
 func (dl *diffLayer) Node(owner common.Hash, path []byte, hash common.Hash) ([]byte, error) {
-	return dl.node(owner, path, hash, 0)
+	if !sampleRead(dl.sample) {
+		blob, _, err := dl.node(owner, path, hash, 0, false)
+		return blob, err
+	}
+	start := time.Now()
+	blob, source, err := dl.node(owner, path, hash, 0, false)
+	if err == nil {
+		recordRead(dl.metrics, dl.stats, source, time.Since(start))
+	}
+	return blob, err
 }
 
 // update implements the layer interface, creating a new layer on top of the
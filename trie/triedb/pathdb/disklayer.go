@@ -17,11 +17,12 @@
 package pathdb
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"sync"
+	"time"
 
-	"github.com/VictoriaMetrics/fastcache"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/rawdb"
 	"github.com/ethereum/go-ethereum/crypto"
@@ -33,22 +34,26 @@ import (
 
 // diskLayer is a low level persistent layer built on top of a key-value store.
 type diskLayer struct {
-	root   common.Hash      // Immutable, root hash to which this layer was made for
-	id     uint64           // Immutable, corresponding state id
-	db     *Database        // Path-based trie database
-	cleans *fastcache.Cache // GC friendly memory cache of clean node RLPs
-	buffer *nodebuffer      // Node buffer to aggregate writes
-	stale  bool             // Signals that the layer became stale (state progressed)
-	lock   sync.RWMutex     // Lock used to protect stale flag
+	root   common.Hash         // Immutable, root hash to which this layer was made for
+	id     uint64              // Immutable, corresponding state id
+	db     *Database           // Path-based trie database
+	cleans trienode.CleanCache // GC friendly memory cache of clean node RLPs
+	buffer *nodebuffer         // Node buffer to aggregate writes
+	stale  bool                // Signals that the layer became stale (state progressed)
+	lock   sync.RWMutex        // Lock used to protect stale flag
 }
 
 // newDiskLayer creates a new disk layer based on the passing arguments.
-func newDiskLayer(root common.Hash, id uint64, db *Database, cleans *fastcache.Cache, buffer *nodebuffer) *diskLayer {
+func newDiskLayer(root common.Hash, id uint64, db *Database, cleans trienode.CleanCache, buffer *nodebuffer) *diskLayer {
 	// Initialize a clean cache if the memory allowance is not zero
 	// or reuse the provided cache if it is not nil (inherited from
 	// the original disk layer).
 	if cleans == nil && db.config.CleanCacheSize != 0 {
-		cleans = fastcache.New(db.config.CleanCacheSize)
+		factory := db.config.CleanCacheFactory
+		if factory == nil {
+			factory = trienode.NewFastCache
+		}
+		cleans = factory(db.config.CleanCacheSize)
 	}
 	return &diskLayer{
 		root:   root,
@@ -96,46 +101,63 @@ func (dl *diskLayer) markStale() {
 }
 
 // Node implements the layer interface, retrieving the trie node with the
-// provided node info. No error will be returned if the node is not found.
+// provided node info. A trienode.NotFoundError is returned if the node is
+// not found.
 func (dl *diskLayer) Node(owner common.Hash, path []byte, hash common.Hash) ([]byte, error) {
+	if !sampleRead(dl.db.config.SampleReadLatency) {
+		blob, _, err := dl.node(owner, path, hash, false)
+		return blob, err
+	}
+	start := time.Now()
+	blob, source, err := dl.node(owner, path, hash, false)
+	if err == nil {
+		recordRead(dl.db.metrics, dl.db.stats, source, time.Since(start))
+	}
+	return blob, err
+}
+
+// node retrieves the trie node with the provided node info. If nocache is
+// set, the node loaded from disk won't be inserted into the clean cache.
+func (dl *diskLayer) node(owner common.Hash, path []byte, hash common.Hash, nocache bool) ([]byte, readSource, error) {
 	dl.lock.RLock()
 	defer dl.lock.RUnlock()
 
 	if dl.stale {
-		return nil, errSnapshotStale
+		return nil, sourceLayer, errSnapshotStale
 	}
 	// Try to retrieve the trie node from the not-yet-written
 	// node buffer first. Note the buffer is lock free since
 	// it's impossible to mutate the buffer before tagging the
 	// layer as stale.
-	n, err := dl.buffer.node(owner, path, hash)
+	m := dl.db.metrics
+	n, err := dl.buffer.node(owner, path, hash, m)
 	if err != nil {
-		return nil, err
+		return nil, sourceLayer, err
 	}
 	if n != nil {
-		dirtyHitMeter.Mark(1)
-		dirtyReadMeter.Mark(int64(len(n.Blob)))
-		return n.Blob, nil
+		m.dirtyHitMeter.Mark(1)
+		m.dirtyReadMeter.Mark(int64(len(n.Blob)))
+		return n.Blob, sourceLayer, nil
 	}
-	dirtyMissMeter.Mark(1)
+	m.dirtyMissMeter.Mark(1)
 
 	// Try to retrieve the trie node from the clean memory cache
 	key := cacheKey(owner, path)
 	if dl.cleans != nil {
-		if blob := dl.cleans.Get(nil, key); len(blob) > 0 {
+		if blob := dl.cleans.Get(key); len(blob) > 0 {
 			h := newHasher()
 			defer h.release()
 
 			got := h.hash(blob)
 			if got == hash {
-				cleanHitMeter.Mark(1)
-				cleanReadMeter.Mark(int64(len(blob)))
-				return blob, nil
+				m.cleanHitMeter.Mark(1)
+				m.cleanReadMeter.Mark(int64(len(blob)))
+				return blob, sourceClean, nil
 			}
-			cleanFalseMeter.Mark(1)
+			m.cleanFalseMeter.Mark(1)
 			log.Error("Unexpected trie node in clean cache", "owner", owner, "path", path, "expect", hash, "got", got)
 		}
-		cleanMissMeter.Mark(1)
+		m.cleanMissMeter.Mark(1)
 	}
 	// Try to retrieve the trie node from the disk.
 	var (
@@ -147,16 +169,33 @@ func (dl *diskLayer) Node(owner common.Hash, path []byte, hash common.Hash) ([]b
 	} else {
 		nBlob, nHash = rawdb.ReadStorageTrieNode(dl.db.diskdb, owner, path)
 	}
+	if len(nBlob) == 0 {
+		err := &trienode.NotFoundError{Owner: owner, Path: path, Hash: hash}
+		dl.db.config.reportError("read", err)
+		return nil, sourceDisk, err
+	}
 	if nHash != hash {
-		diskFalseMeter.Mark(1)
+		m.diskFalseMeter.Mark(1)
+		err := newUnexpectedNodeError("disk", hash, nHash, owner, path)
+		dl.db.config.reportError("read", err)
 		log.Error("Unexpected trie node in disk", "owner", owner, "path", path, "expect", hash, "got", nHash)
-		return nil, newUnexpectedNodeError("disk", hash, nHash, owner, path)
+		return nil, sourceDisk, err
 	}
-	if dl.cleans != nil && len(nBlob) > 0 {
+	if ages := dl.db.ages; ages != nil && len(nBlob) > 0 {
+		// The nodes modified before the tracked window are ignored,
+		// as their age is unknown.
+		if blob := ages.Get(nil, key); len(blob) == 8 {
+			if id := binary.BigEndian.Uint64(blob); id <= dl.id {
+				m.nodeAgeHist.Update(int64(dl.id - id))
+				dl.db.stats.nodeAge.Update(int64(dl.id - id))
+			}
+		}
+	}
+	if dl.cleans != nil && len(nBlob) > 0 && !nocache {
 		dl.cleans.Set(key, nBlob)
-		cleanWriteMeter.Mark(int64(len(nBlob)))
+		m.cleanWriteMeter.Mark(int64(len(nBlob)))
 	}
-	return nBlob, nil
+	return nBlob, sourceDisk, nil
 }
 
 // update implements the layer interface, returning a new diff layer on top
@@ -194,14 +233,36 @@ func (dl *diskLayer) commit(bottom *diffLayer, force bool) (*diskLayer, error) {
 	}
 	rawdb.WriteStateID(dl.db.diskdb, bottom.rootHash(), bottom.stateID())
 
+	// Record the state id at which the nodes are modified for tracking
+	// their age once they are read back from disk.
+	if ages := dl.db.ages; ages != nil {
+		var id [8]byte
+		binary.BigEndian.PutUint64(id[:], bottom.stateID())
+		for owner, subset := range bottom.nodes {
+			for path := range subset {
+				ages.Set(cacheKey(owner, []byte(path)), id[:])
+			}
+		}
+	}
 	// Construct a new disk layer by merging the nodes from the provided
 	// diff layer, and flush the content in disk layer if there are too
 	// many nodes cached. The clean cache is inherited from the original
 	// disk layer for reusing.
-	ndl := newDiskLayer(bottom.root, bottom.stateID(), dl.db, dl.cleans, dl.buffer.commit(bottom.nodes))
-	err := ndl.buffer.flush(ndl.db.diskdb, ndl.cleans, ndl.id, force)
-	if err != nil {
-		return nil, err
+	if dl.buffer.empty() {
+		dl.buffer.base = dl.root
+	}
+	ndl := newDiskLayer(bottom.root, bottom.stateID(), dl.db, dl.cleans, dl.buffer.commit(bottom.nodes, dl.db.metrics))
+
+	// Hold off the flush while it's paused, unless the buffer has grown past
+	// twice of its allowance.
+	if force || dl.db.paused.Load() == 0 || ndl.buffer.size > 2*ndl.buffer.limit {
+		err := ndl.buffer.flush(ndl.db.diskdb, ndl.cleans, ndl.id, force, ndl.db.config, ndl.db.metrics)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if onAdvance := dl.db.config.OnDiskLayerAdvance; onAdvance != nil {
+		onAdvance(dl.root, bottom.root, bottom.block)
 	}
 	return ndl, nil
 }
@@ -244,8 +305,8 @@ func (dl *diskLayer) revert(h *history, loader triestate.TrieLoader) (*diskLayer
 			return nil, err
 		}
 	} else {
-		batch := dl.db.diskdb.NewBatch()
-		writeNodes(batch, nodes, dl.cleans)
+		batch := trienode.NewReplicatedBatch(dl.db.diskdb.NewBatch(), dl.db.config.Replicator)
+		writeNodes(batch, nodes, dl.cleans, dl.db.config.CommitOrder)
 		rawdb.WritePersistentStateID(batch, dl.id-1)
 		if err := batch.Write(); err != nil {
 			log.Crit("Failed to write states", "err", err)
@@ -262,7 +323,7 @@ func (dl *diskLayer) setBufferSize(size int) error {
 	if dl.stale {
 		return errSnapshotStale
 	}
-	return dl.buffer.setSize(size, dl.db.diskdb, dl.cleans, dl.id)
+	return dl.buffer.setSize(size, dl.db.diskdb, dl.cleans, dl.id, dl.db.config, dl.db.metrics)
 }
 
 // size returns the approximate size of cached nodes in the disk layer.
@@ -276,6 +337,24 @@ func (dl *diskLayer) size() common.StorageSize {
 	return common.StorageSize(dl.buffer.size)
 }
 
+// bufferStats returns the memory allowance of the node buffer and the time
+// it was last flushed into disk.
+func (dl *diskLayer) bufferStats() (common.StorageSize, time.Time) {
+	dl.lock.RLock()
+	defer dl.lock.RUnlock()
+
+	return common.StorageSize(dl.buffer.limit), dl.buffer.flushed
+}
+
+// writeStats returns the data storage and the number of nodes flushed into disk
+// by the node buffer in total.
+func (dl *diskLayer) writeStats() (common.StorageSize, uint64) {
+	dl.lock.RLock()
+	defer dl.lock.RUnlock()
+
+	return common.StorageSize(dl.buffer.written), dl.buffer.nwritten
+}
+
 // resetCache releases the memory held by clean cache to prevent memory leak.
 func (dl *diskLayer) resetCache() {
 	dl.lock.RLock()
@@ -290,6 +369,59 @@ func (dl *diskLayer) resetCache() {
 	}
 }
 
+// persisted returns the root and the id of the state persisted in disk which
+// the disk layer is built on, namely the disk layer itself without the buffered
+// state transitions.
+func (dl *diskLayer) persisted() (common.Hash, uint64) {
+	dl.lock.RLock()
+	defer dl.lock.RUnlock()
+
+	if dl.buffer.empty() {
+		return dl.root, dl.id
+	}
+	return dl.buffer.base, dl.id - dl.buffer.layers
+}
+
+// flush forcibly persists the node buffer into disk, if it's not empty.
+func (dl *diskLayer) flush() error {
+	dl.lock.Lock()
+	defer dl.lock.Unlock()
+
+	if dl.stale {
+		return errSnapshotStale
+	}
+	if dl.buffer.empty() {
+		return nil
+	}
+	return dl.buffer.flush(dl.db.diskdb, dl.cleans, dl.id, true, dl.db.config, dl.db.metrics)
+}
+
+// shrink releases the memory held by the disk layer, the node buffer is
+// forcibly flushed into disk beforehand if requested. The clean cache is
+// emptied afterwards as the flush populates it. The released size is
+// returned. The exclusive lock is held, as flushing resets the buffer which
+// is otherwise read without synchronization.
+func (dl *diskLayer) shrink(flush bool) (common.StorageSize, error) {
+	dl.lock.Lock()
+	defer dl.lock.Unlock()
+
+	if dl.stale {
+		return 0, errSnapshotStale
+	}
+	var released common.StorageSize
+	if flush && !dl.buffer.empty() {
+		released = common.StorageSize(dl.buffer.size)
+		if err := dl.buffer.flush(dl.db.diskdb, dl.cleans, dl.id, true, dl.db.config, dl.db.metrics); err != nil {
+			return 0, err
+		}
+	}
+	if dl.cleans != nil {
+		released += common.StorageSize(dl.cleans.Len())
+		dl.cleans.Reset()
+	}
+	return released, nil
+}
+
 // hasher is used to compute the sha256 hash of the provided data.
 type hasher struct{ sha crypto.KeccakState }
 
@@ -0,0 +1,131 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package pathdb
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// ExportDiffLayers serializes all the in-memory diff layers, including the
+// ones on the side branches, into the writer so that they can be replayed on
+// top of the same disk state with ImportDiffLayers. Unlike the journal, the
+// buffered nodes of the disk layer are not exported, the importing database
+// is expected to have the same aggregated disk state.
+//
+// The layout is the journal version and the disk root, followed by the parent
+// root and the encoded content of each diff layer, parents first.
+func (db *Database) ExportDiffLayers(w io.Writer) error {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	var diffs []*diffLayer
+	db.tree.forEach(func(l layer) {
+		if diff, ok := l.(*diffLayer); ok {
+			diffs = append(diffs, diff)
+		}
+	})
+	// Layers are always stacked on a parent with a lower state id, sorting
+	// by id guarantees the parents are exported ahead of their children.
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i].stateID() < diffs[j].stateID() })
+
+	if err := rlp.Encode(w, journalVersion); err != nil {
+		return err
+	}
+	if err := rlp.Encode(w, db.tree.bottom().rootHash()); err != nil {
+		return err
+	}
+	for _, diff := range diffs {
+		diff.lock.RLock()
+		err := rlp.Encode(w, diff.parent.rootHash())
+		if err == nil {
+			err = diff.encode(w)
+		}
+		diff.lock.RUnlock()
+		if err != nil {
+			return err
+		}
+	}
+	log.Debug("Exported pathdb diff layers", "disk", db.tree.bottom().rootHash(), "layers", len(diffs))
+	return nil
+}
+
+// ImportDiffLayers loads the diff layers exported by ExportDiffLayers and links
+// them into the layer tree. The exported disk root must match the current disk
+// layer of the database, and the layers already present are left untouched.
+func (db *Database) ImportDiffLayers(r io.Reader) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if db.readOnly {
+		return errSnapshotReadOnly
+	}
+	stream := rlp.NewStream(r, 0)
+
+	var version uint64
+	if err := stream.Decode(&version); err != nil {
+		return err
+	}
+	if version != journalVersion {
+		return fmt.Errorf("%w want %d got %d", errUnexpectedVersion, journalVersion, version)
+	}
+	var diskRoot common.Hash
+	if err := stream.Decode(&diskRoot); err != nil {
+		return fmt.Errorf("load disk root: %v", err)
+	}
+	if base := db.tree.bottom().rootHash(); diskRoot != base {
+		return fmt.Errorf("mismatched disk root, exported %#x, current %#x", diskRoot, base)
+	}
+	var imported int
+	for {
+		var parentRoot common.Hash
+		if err := stream.Decode(&parentRoot); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return fmt.Errorf("load parent root: %v", err)
+		}
+		root, block, nodes, states, err := decodeDiff(stream)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		if db.tree.get(root) != nil {
+			continue
+		}
+		parent := db.tree.get(parentRoot)
+		if parent == nil {
+			return fmt.Errorf("triedb parent [%#x] layer missing", parentRoot)
+		}
+		l := parent.update(root, parent.stateID()+1, block, nodes, states)
+
+		db.tree.lock.Lock()
+		db.tree.set(l)
+		db.tree.lock.Unlock()
+		imported++
+	}
+	log.Debug("Imported pathdb diff layers", "disk", diskRoot, "layers", imported)
+	return nil
+}
@@ -540,9 +540,9 @@ func writeHistory(db ethdb.KeyValueStore, freezer *rawdb.ResettableFreezer, dl *
 			return err
 		}
 	}
-	historyDataBytesMeter.Mark(int64(dataSize))
-	historyIndexBytesMeter.Mark(int64(indexSize))
-	historyBuildTimeMeter.UpdateSince(start)
+	dl.metrics.historyDataBytesMeter.Mark(int64(dataSize))
+	dl.metrics.historyIndexBytesMeter.Mark(int64(indexSize))
+	dl.metrics.historyBuildTimeMeter.UpdateSince(start)
 	log.Debug("Stored state history", "id", dl.stateID(), "block", dl.block, "data", dataSize, "index", indexSize, "pruned", n, "elapsed", common.PrettyDuration(time.Since(start)))
 	return nil
 }
@@ -639,3 +639,21 @@ func truncateFromTail(db ethdb.Batcher, freezer *rawdb.ResettableFreezer, ntail
 	}
 	return int(ntail - otail), nil
 }
+
+// oldestHistoryBlock returns the block number of the oldest state history
+// retained in the freezer, or false if there is none.
+func oldestHistoryBlock(freezer *rawdb.ResettableFreezer) (uint64, bool) {
+	tail, err := freezer.Tail()
+	if err != nil {
+		return 0, false
+	}
+	blob := rawdb.ReadStateHistoryMeta(freezer, tail+1)
+	if len(blob) == 0 {
+		return 0, false
+	}
+	var m meta
+	if err := m.decode(blob); err != nil {
+		return 0, false
+	}
+	return m.block, true
+}
@@ -21,6 +21,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"time"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/rawdb"
@@ -98,7 +99,7 @@ func (db *Database) loadJournal(diskRoot common.Hash) (layer, error) {
 		return nil, fmt.Errorf("%w want %x got %x", errUnmatchedJournal, root, diskRoot)
 	}
 	// Load the disk layer from the journal
-	base, err := db.loadDiskLayer(r)
+	base, err := db.loadDiskLayer(r, diskRoot)
 	if err != nil {
 		return nil, err
 	}
@@ -133,8 +134,9 @@ func (db *Database) loadLayers() layer {
 }
 
 // loadDiskLayer reads the binary blob from the layer journal, reconstructing
-// a new disk layer on it.
-func (db *Database) loadDiskLayer(r *rlp.Stream) (layer, error) {
+// a new disk layer on it. The given root is the one of the persisted state,
+// which the nodes in the journal are built on.
+func (db *Database) loadDiskLayer(r *rlp.Stream, diskRoot common.Hash) (layer, error) {
 	// Resolve disk layer root
 	var root common.Hash
 	if err := r.Decode(&root); err != nil {
@@ -170,6 +172,7 @@ func (db *Database) loadDiskLayer(r *rlp.Stream) (layer, error) {
 	}
 	// Calculate the internal state transitions by id difference.
 	base := newDiskLayer(root, id, db, nil, newNodeBuffer(db.bufferSize, nodes, id-stored))
+	base.buffer.base = diskRoot
 	return base, nil
 }
 
@@ -177,22 +180,35 @@ func (db *Database) loadDiskLayer(r *rlp.Stream) (layer, error) {
 // diff and verifying that it can be linked to the requested parent.
 func (db *Database) loadDiffLayer(parent layer, r *rlp.Stream) (layer, error) {
 	// Read the next diff journal entry
-	var root common.Hash
-	if err := r.Decode(&root); err != nil {
+	root, block, nodes, states, err := decodeDiff(r)
+	if err != nil {
 		// The first read may fail with EOF, marking the end of the journal
 		if err == io.EOF {
 			return parent, nil
 		}
-		return nil, fmt.Errorf("load diff root: %v", err)
+		return nil, err
+	}
+	return db.loadDiffLayer(newDiffLayer(parent, root, parent.stateID()+1, block, nodes, states), r)
+}
+
+// decodeDiff reads the contents of a diff layer encoded by encodeDiff. The
+// io.EOF is returned as is if the stream is exhausted.
+func decodeDiff(r *rlp.Stream) (common.Hash, uint64, map[common.Hash]map[string]*trienode.Node, *triestate.Set, error) {
+	var root common.Hash
+	if err := r.Decode(&root); err != nil {
+		if err == io.EOF {
+			return common.Hash{}, 0, nil, nil, err
+		}
+		return common.Hash{}, 0, nil, nil, fmt.Errorf("load diff root: %v", err)
 	}
 	var block uint64
 	if err := r.Decode(&block); err != nil {
-		return nil, fmt.Errorf("load block number: %v", err)
+		return common.Hash{}, 0, nil, nil, fmt.Errorf("load block number: %v", err)
 	}
 	// Read in-memory trie nodes from journal
 	var encoded []journalNodes
 	if err := r.Decode(&encoded); err != nil {
-		return nil, fmt.Errorf("load diff nodes: %v", err)
+		return common.Hash{}, 0, nil, nil, fmt.Errorf("load diff nodes: %v", err)
 	}
 	nodes := make(map[common.Hash]map[string]*trienode.Node)
 	for _, entry := range encoded {
@@ -215,13 +231,13 @@ func (db *Database) loadDiffLayer(parent layer, r *rlp.Stream) (layer, error) {
 		incomplete = make(map[common.Address]struct{})
 	)
 	if err := r.Decode(&jaccounts); err != nil {
-		return nil, fmt.Errorf("load diff accounts: %v", err)
+		return common.Hash{}, 0, nil, nil, fmt.Errorf("load diff accounts: %v", err)
 	}
 	for i, addr := range jaccounts.Addresses {
 		accounts[addr] = jaccounts.Accounts[i]
 	}
 	if err := r.Decode(&jstorages); err != nil {
-		return nil, fmt.Errorf("load diff storages: %v", err)
+		return common.Hash{}, 0, nil, nil, fmt.Errorf("load diff storages: %v", err)
 	}
 	for _, entry := range jstorages {
 		set := make(map[common.Hash][]byte)
@@ -237,7 +253,7 @@ func (db *Database) loadDiffLayer(parent layer, r *rlp.Stream) (layer, error) {
 		}
 		storages[entry.Account] = set
 	}
-	return db.loadDiffLayer(newDiffLayer(parent, root, parent.stateID()+1, block, nodes, triestate.New(accounts, storages, incomplete)), r)
+	return root, block, nodes, triestate.New(accounts, storages, incomplete), nil
 }
 
 // journal implements the layer interface, marshaling the un-flushed trie nodes
@@ -285,6 +301,16 @@ func (dl *diffLayer) journal(w io.Writer) error {
 		return err
 	}
 	// Everything below was journaled, persist this layer too
+	if err := dl.encode(w); err != nil {
+		return err
+	}
+	log.Debug("Journaled pathdb diff layer", "root", dl.root, "parent", dl.parent.rootHash(), "id", dl.stateID(), "block", dl.block, "nodes", len(dl.nodes))
+	return nil
+}
+
+// encode writes the contents of the diff layer, excluding its parent, into the
+// writer. The caller must hold the layer lock.
+func (dl *diffLayer) encode(w io.Writer) error {
 	if err := rlp.Encode(w, dl.root); err != nil {
 		return err
 	}
@@ -327,7 +353,6 @@ func (dl *diffLayer) journal(w io.Writer) error {
 	if err := rlp.Encode(w, storage); err != nil {
 		return err
 	}
-	log.Debug("Journaled pathdb diff layer", "root", dl.root, "parent", dl.parent.rootHash(), "id", dl.stateID(), "block", dl.block, "nodes", len(dl.nodes))
 	return nil
 }
 
@@ -349,6 +374,51 @@ func (db *Database) Journal(root common.Hash) error {
 	if db.readOnly {
 		return errSnapshotReadOnly
 	}
+	if err := db.journal(l); err != nil {
+		return err
+	}
+	// Set the db in read only mode to reject all following mutations
+	db.readOnly = true
+	return nil
+}
+
+// Checkpoint flattens all the layers up to the specified state into disk and
+// stores the journal of the resulting disk layer. Unlike Journal, the database
+// is still writable afterwards. The stale journal is deleted upfront, so that
+// a crash in between leaves the persisted state, which is what the journal
+// refers to, as the checkpoint rather than a mismatched journal.
+func (db *Database) Checkpoint(root common.Hash, report bool) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	// Short circuit if the database is in read only mode.
+	if db.readOnly {
+		return errSnapshotReadOnly
+	}
+	if db.tree.get(root) == nil {
+		return fmt.Errorf("triedb layer [%#x] missing", root)
+	}
+	start := time.Now()
+	rawdb.DeleteTrieJournal(db.diskdb)
+	if err := db.tree.cap(root, 0); err != nil {
+		return err
+	}
+	db.rebase()
+
+	if err := db.journal(db.tree.bottom()); err != nil {
+		return err
+	}
+	logger := log.Info
+	if !report {
+		logger = log.Debug
+	}
+	logger("Checkpointed trie database", "root", root, "elapsed", common.PrettyDuration(time.Since(start)))
+	return nil
+}
+
+// journal writes the journal of the given layer along with all the layers
+// below it into the database. The caller must hold the lock.
+func (db *Database) journal(l layer) error {
 	// Firstly write out the metadata of journal
 	journal := new(bytes.Buffer)
 	if err := rlp.Encode(journal, journalVersion); err != nil {
@@ -370,9 +440,6 @@ func (db *Database) Journal(root common.Hash) error {
 	}
 	// Store the journal into the database and return
 	rawdb.WriteTrieJournal(db.diskdb, journal.Bytes())
-
-	// Set the db in read only mode to reject all following mutations
-	db.readOnly = true
 	log.Info("Stored journal in triedb", "disk", diskroot, "size", common.StorageSize(journal.Len()))
 	return nil
 }
@@ -20,6 +20,7 @@ import (
 	"errors"
 	"fmt"
 	"sync"
+	"sync/atomic"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
@@ -35,6 +36,7 @@ import (
 type layerTree struct {
 	lock   sync.RWMutex
 	layers map[common.Hash]layer
+	memory atomic.Uint64 // Memory held by the diff layers in total, maintained on mutation
 }
 
 // newLayerTree constructs the layerTree with the given head layer.
@@ -50,12 +52,34 @@ func (tree *layerTree) reset(head layer) {
 	tree.lock.Lock()
 	defer tree.lock.Unlock()
 
-	var layers = make(map[common.Hash]layer)
+	tree.layers = make(map[common.Hash]layer)
+	tree.memory.Store(0)
 	for head != nil {
-		layers[head.rootHash()] = head
+		tree.set(head)
 		head = head.parentLayer()
 	}
-	tree.layers = layers
+}
+
+// set links the layer into the tree, replacing the one with the same root.
+// The caller must hold the tree lock.
+func (tree *layerTree) set(l layer) {
+	root := l.rootHash()
+	if old, ok := tree.layers[root].(*diffLayer); ok {
+		tree.memory.Add(-old.memory)
+	}
+	if diff, ok := l.(*diffLayer); ok {
+		tree.memory.Add(diff.memory)
+	}
+	tree.layers[root] = l
+}
+
+// drop unlinks the layer with the given root from the tree. The caller must
+// hold the tree lock.
+func (tree *layerTree) drop(root common.Hash) {
+	if old, ok := tree.layers[root].(*diffLayer); ok {
+		tree.memory.Add(-old.memory)
+	}
+	delete(tree.layers, root)
 }
 
 // get retrieves a layer belonging to the given state root.
@@ -85,6 +109,33 @@ func (tree *layerTree) len() int {
 	return len(tree.layers)
 }
 
+// forkDepth returns the number of layers on top of the common ancestor of the
+// given two states on the branch of the first one, namely how many layers are
+// abandoned if the second state is picked as the base for the next layer.
+func (tree *layerTree) forkDepth(head common.Hash, parent common.Hash) int {
+	return len(tree.abandoned(head, parent))
+}
+
+// abandoned returns the roots of the layers on top of the common ancestor of
+// the given two states on the branch of the first one, from the first state
+// downwards. None is returned if the states don't share an ancestor.
+func (tree *layerTree) abandoned(head common.Hash, parent common.Hash) []common.Hash {
+	var (
+		branch    []common.Hash
+		ancestors = make(map[common.Hash]int)
+	)
+	for l, depth := tree.get(head), 0; l != nil; l, depth = l.parentLayer(), depth+1 {
+		ancestors[l.rootHash()] = depth
+		branch = append(branch, l.rootHash())
+	}
+	for l := tree.get(parent); l != nil; l = l.parentLayer() {
+		if depth, ok := ancestors[l.rootHash()]; ok {
+			return branch[:depth]
+		}
+	}
+	return nil
+}
+
 // add inserts a new layer into the tree if it can be linked to an existing old parent.
 func (tree *layerTree) add(root common.Hash, parentRoot common.Hash, block uint64, nodes *trienode.MergedNodeSet, states *triestate.Set) error {
 	// Reject noop updates to avoid self-loops. This is a special case that can
@@ -104,7 +155,7 @@ func (tree *layerTree) add(root common.Hash, parentRoot common.Hash, block uint6
 	l := parent.update(root, parent.stateID()+1, block, nodes.Flatten(), states)
 
 	tree.lock.Lock()
-	tree.layers[l.rootHash()] = l
+	tree.set(l)
 	tree.lock.Unlock()
 	return nil
 }
@@ -133,6 +184,7 @@ func (tree *layerTree) cap(root common.Hash, layers int) error {
 		}
 		// Replace the entire layer tree with the flat base
 		tree.layers = map[common.Hash]layer{base.rootHash(): base}
+		tree.memory.Store(0)
 		return nil
 	}
 	// Dive until we run out of layers or reach the persistent database
@@ -161,7 +213,7 @@ func (tree *layerTree) cap(root common.Hash, layers int) error {
 			diff.lock.Unlock()
 			return err
 		}
-		tree.layers[base.rootHash()] = base
+		tree.set(base)
 		diff.parent = base
 
 		diff.lock.Unlock()
@@ -169,7 +221,57 @@ func (tree *layerTree) cap(root common.Hash, layers int) error {
 	default:
 		panic(fmt.Sprintf("unknown data layer in triedb: %T", parent))
 	}
-	// Remove any layer that is stale or links into a stale layer
+	tree.removeStale()
+	return nil
+}
+
+// flatten merges the layers from the disk layer up to and including the one
+// with the given state root into a new disk layer. The layers on top of the
+// target are kept and relinked onto the new disk layer.
+func (tree *layerTree) flatten(root common.Hash) error {
+	root = types.TrieRootHash(root)
+	l := tree.get(root)
+	if l == nil {
+		return fmt.Errorf("triedb layer [%#x] missing", root)
+	}
+	diff, ok := l.(*diffLayer)
+	if !ok {
+		return nil // Already the disk layer, nothing to flatten
+	}
+	tree.lock.Lock()
+	defer tree.lock.Unlock()
+
+	// Hold the locks of the direct children to prevent any read operations
+	// until the new parent is linked correctly.
+	var children []*diffLayer
+	for _, layer := range tree.layers {
+		if child, ok := layer.(*diffLayer); ok && child.parentLayer() == l {
+			children = append(children, child)
+		}
+	}
+	for _, child := range children {
+		child.lock.Lock()
+	}
+	base, err := diff.persist(false)
+	if err == nil {
+		tree.set(base)
+	}
+	for _, child := range children {
+		if err == nil {
+			child.parent = base
+		}
+		child.lock.Unlock()
+	}
+	if err != nil {
+		return err
+	}
+	tree.removeStale()
+	return nil
+}
+
+// removeStale removes any layer that is stale or links into a stale layer.
+// The caller must hold the tree lock.
+func (tree *layerTree) removeStale() {
 	children := make(map[common.Hash][]common.Hash)
 	for root, layer := range tree.layers {
 		if dl, ok := layer.(*diffLayer); ok {
@@ -179,7 +281,7 @@ func (tree *layerTree) cap(root common.Hash, layers int) error {
 	}
 	var remove func(root common.Hash)
 	remove = func(root common.Hash) {
-		delete(tree.layers, root)
+		tree.drop(root)
 		for _, child := range children[root] {
 			remove(child)
 		}
@@ -190,7 +292,6 @@ func (tree *layerTree) cap(root common.Hash, layers int) error {
 			remove(root)
 		}
 	}
-	return nil
 }
 
 // bottom returns the bottom-most disk layer in this tree.
@@ -16,35 +16,158 @@
 
 package pathdb
 
-import "github.com/ethereum/go-ethereum/metrics"
+import (
+	"math/rand"
+	"time"
 
-var (
-	cleanHitMeter   = metrics.NewRegisteredMeter("pathdb/clean/hit", nil)
-	cleanMissMeter  = metrics.NewRegisteredMeter("pathdb/clean/miss", nil)
-	cleanReadMeter  = metrics.NewRegisteredMeter("pathdb/clean/read", nil)
-	cleanWriteMeter = metrics.NewRegisteredMeter("pathdb/clean/write", nil)
+	"github.com/ethereum/go-ethereum/metrics"
+)
+
+// metricSet is the collection of meters reported by a database instance.
+type metricSet struct {
+	cleanHitMeter   metrics.Meter
+	cleanMissMeter  metrics.Meter
+	cleanReadMeter  metrics.Meter
+	cleanWriteMeter metrics.Meter
+
+	dirtyHitMeter         metrics.Meter
+	dirtyMissMeter        metrics.Meter
+	dirtyReadMeter        metrics.Meter
+	dirtyWriteMeter       metrics.Meter
+	dirtyNodeHitDepthHist metrics.Histogram
+
+	cleanFalseMeter metrics.Meter
+	dirtyFalseMeter metrics.Meter
+	diskFalseMeter  metrics.Meter
+
+	commitTimeTimer  metrics.Timer
+	commitNodesMeter metrics.Meter
+	commitBytesMeter metrics.Meter
+
+	gcNodesMeter metrics.Meter
+	gcBytesMeter metrics.Meter
+
+	diffLayerBytesMeter metrics.Meter
+	diffLayerNodesMeter metrics.Meter
+
+	historyBuildTimeMeter  metrics.Timer
+	historyDataBytesMeter  metrics.Meter
+	historyIndexBytesMeter metrics.Meter
+
+	reorgDepthHist metrics.Histogram
+	nodeAgeHist    metrics.Histogram
+
+	readLayerHist metrics.Histogram
+	readCleanHist metrics.Histogram
+	readDiskHist  metrics.Histogram
+}
+
+// newMetricSet registers the database meters in the given registry, or in
+// the default one if it's nil. Meters already present are reused.
+func newMetricSet(r metrics.Registry) *metricSet {
+	return &metricSet{
+		cleanHitMeter:   metrics.GetOrRegisterMeter("pathdb/clean/hit", r),
+		cleanMissMeter:  metrics.GetOrRegisterMeter("pathdb/clean/miss", r),
+		cleanReadMeter:  metrics.GetOrRegisterMeter("pathdb/clean/read", r),
+		cleanWriteMeter: metrics.GetOrRegisterMeter("pathdb/clean/write", r),
 
-	dirtyHitMeter         = metrics.NewRegisteredMeter("pathdb/dirty/hit", nil)
-	dirtyMissMeter        = metrics.NewRegisteredMeter("pathdb/dirty/miss", nil)
-	dirtyReadMeter        = metrics.NewRegisteredMeter("pathdb/dirty/read", nil)
-	dirtyWriteMeter       = metrics.NewRegisteredMeter("pathdb/dirty/write", nil)
-	dirtyNodeHitDepthHist = metrics.NewRegisteredHistogram("pathdb/dirty/depth", nil, metrics.NewExpDecaySample(1028, 0.015))
+		dirtyHitMeter:         metrics.GetOrRegisterMeter("pathdb/dirty/hit", r),
+		dirtyMissMeter:        metrics.GetOrRegisterMeter("pathdb/dirty/miss", r),
+		dirtyReadMeter:        metrics.GetOrRegisterMeter("pathdb/dirty/read", r),
+		dirtyWriteMeter:       metrics.GetOrRegisterMeter("pathdb/dirty/write", r),
+		dirtyNodeHitDepthHist: metrics.GetOrRegisterHistogram("pathdb/dirty/depth", r, metrics.NewExpDecaySample(1028, 0.015)),
 
-	cleanFalseMeter = metrics.NewRegisteredMeter("pathdb/clean/false", nil)
-	dirtyFalseMeter = metrics.NewRegisteredMeter("pathdb/dirty/false", nil)
-	diskFalseMeter  = metrics.NewRegisteredMeter("pathdb/disk/false", nil)
+		cleanFalseMeter: metrics.GetOrRegisterMeter("pathdb/clean/false", r),
+		dirtyFalseMeter: metrics.GetOrRegisterMeter("pathdb/dirty/false", r),
+		diskFalseMeter:  metrics.GetOrRegisterMeter("pathdb/disk/false", r),
 
-	commitTimeTimer  = metrics.NewRegisteredTimer("pathdb/commit/time", nil)
-	commitNodesMeter = metrics.NewRegisteredMeter("pathdb/commit/nodes", nil)
-	commitBytesMeter = metrics.NewRegisteredMeter("pathdb/commit/bytes", nil)
+		commitTimeTimer:  metrics.GetOrRegisterTimer("pathdb/commit/time", r),
+		commitNodesMeter: metrics.GetOrRegisterMeter("pathdb/commit/nodes", r),
+		commitBytesMeter: metrics.GetOrRegisterMeter("pathdb/commit/bytes", r),
 
-	gcNodesMeter = metrics.NewRegisteredMeter("pathdb/gc/nodes", nil)
-	gcBytesMeter = metrics.NewRegisteredMeter("pathdb/gc/bytes", nil)
+		gcNodesMeter: metrics.GetOrRegisterMeter("pathdb/gc/nodes", r),
+		gcBytesMeter: metrics.GetOrRegisterMeter("pathdb/gc/bytes", r),
 
-	diffLayerBytesMeter = metrics.NewRegisteredMeter("pathdb/diff/bytes", nil)
-	diffLayerNodesMeter = metrics.NewRegisteredMeter("pathdb/diff/nodes", nil)
+		diffLayerBytesMeter: metrics.GetOrRegisterMeter("pathdb/diff/bytes", r),
+		diffLayerNodesMeter: metrics.GetOrRegisterMeter("pathdb/diff/nodes", r),
 
-	historyBuildTimeMeter  = metrics.NewRegisteredTimer("pathdb/history/time", nil)
-	historyDataBytesMeter  = metrics.NewRegisteredMeter("pathdb/history/bytes/data", nil)
-	historyIndexBytesMeter = metrics.NewRegisteredMeter("pathdb/history/bytes/index", nil)
+		historyBuildTimeMeter:  metrics.GetOrRegisterTimer("pathdb/history/time", r),
+		historyDataBytesMeter:  metrics.GetOrRegisterMeter("pathdb/history/bytes/data", r),
+		historyIndexBytesMeter: metrics.GetOrRegisterMeter("pathdb/history/bytes/index", r),
+
+		reorgDepthHist: metrics.GetOrRegisterHistogram("pathdb/reorg/depth", r, metrics.NewExpDecaySample(1028, 0.015)),
+		nodeAgeHist:    metrics.GetOrRegisterHistogram("pathdb/clean/age", r, metrics.NewExpDecaySample(1028, 0.015)),
+
+		readLayerHist: metrics.GetOrRegisterHistogram("pathdb/read/latency/layer", r, metrics.NewExpDecaySample(1028, 0.015)),
+		readCleanHist: metrics.GetOrRegisterHistogram("pathdb/read/latency/clean", r, metrics.NewExpDecaySample(1028, 0.015)),
+		readDiskHist:  metrics.GetOrRegisterHistogram("pathdb/read/latency/disk", r, metrics.NewExpDecaySample(1028, 0.015)),
+	}
+}
+
+// statSet is the collection of histograms surfaced through Stats. Unlike the
+// meters, they are owned by the database instance and tracked regardless of
+// whether the metrics collection is enabled.
+type statSet struct {
+	reorgDepth metrics.Histogram
+	nodeAge    metrics.Histogram
+
+	readLayer metrics.Histogram
+	readClean metrics.Histogram
+	readDisk  metrics.Histogram
+}
+
+// newStatSet constructs an empty set of database statistics.
+func newStatSet() *statSet {
+	hist := func() metrics.Histogram {
+		return metrics.NewHistogramForced(metrics.NewExpDecaySampleForced(1028, 0.015))
+	}
+	return &statSet{
+		reorgDepth: hist(),
+		nodeAge:    hist(),
+		readLayer:  hist(),
+		readClean:  hist(),
+		readDisk:   hist(),
+	}
+}
+
+// updateReorgDepth records the number of layers abandoned or reverted by a
+// reorg.
+func (db *Database) updateReorgDepth(depth uint64) {
+	db.metrics.reorgDepthHist.Update(int64(depth))
+	db.stats.reorgDepth.Update(int64(depth))
+}
+
+// readSource is the source serving a node read.
+type readSource int
+
+const (
+	sourceLayer readSource = iota // Diff layers or node buffer
+	sourceClean                   // Clean cache
+	sourceDisk                    // Persistent database
 )
+
+// sampleRead reports whether the latency of a node read is to be recorded,
+// given the fraction of the reads sampled.
+func sampleRead(rate float64) bool {
+	return rate > 0 && (rate >= 1 || rand.Float64() < rate)
+}
+
+// recordRead records the latency of a sampled node read served by the given
+// source, both in the meters and in the statistics.
+func recordRead(m *metricSet, s *statSet, source readSource, elapsed time.Duration) {
+	switch source {
+	case sourceLayer:
+		m.readLayerHist.Update(int64(elapsed))
+		s.readLayer.Update(int64(elapsed))
+	case sourceClean:
+		m.readCleanHist.Update(int64(elapsed))
+		s.readClean.Update(int64(elapsed))
+	case sourceDisk:
+		m.readDiskHist.Update(int64(elapsed))
+		s.readDisk.Update(int64(elapsed))
+	}
+}
+
+// defaultMetrics is the metric set registered in the default registry, shared
+// by all databases unless instructed otherwise.
+var defaultMetrics = newMetricSet(nil)
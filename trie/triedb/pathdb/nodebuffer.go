@@ -20,7 +20,6 @@ import (
 	"fmt"
 	"time"
 
-	"github.com/VictoriaMetrics/fastcache"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/rawdb"
 	"github.com/ethereum/go-ethereum/crypto"
@@ -33,10 +32,14 @@ import (
 // write. The content of the nodebuffer must be checked before diving into
 // disk (since it basically is not-yet-written data).
 type nodebuffer struct {
-	layers uint64                                    // The number of diff layers aggregated inside
-	size   uint64                                    // The size of aggregated writes
-	limit  uint64                                    // The maximum memory allowance in bytes
-	nodes  map[common.Hash]map[string]*trienode.Node // The dirty node set, mapped by owner and path
+	layers   uint64                                    // The number of diff layers aggregated inside
+	size     uint64                                    // The size of aggregated writes
+	limit    uint64                                    // The maximum memory allowance in bytes
+	nodes    map[common.Hash]map[string]*trienode.Node // The dirty node set, mapped by owner and path
+	flushed  time.Time                                 // The time of the last flush into disk
+	written  uint64                                    // The size of writes flushed into disk in total
+	nwritten uint64                                    // The number of nodes flushed into disk in total
+	base     common.Hash                               // The persisted state root the nodes are built on, meaningful only if not empty
 }
 
 // newNodeBuffer initializes the node buffer with the provided nodes.
@@ -59,7 +62,7 @@ func newNodeBuffer(limit int, nodes map[common.Hash]map[string]*trienode.Node, l
 }
 
 // node retrieves the trie node with given node info.
-func (b *nodebuffer) node(owner common.Hash, path []byte, hash common.Hash) (*trienode.Node, error) {
+func (b *nodebuffer) node(owner common.Hash, path []byte, hash common.Hash, m *metricSet) (*trienode.Node, error) {
 	subset, ok := b.nodes[owner]
 	if !ok {
 		return nil, nil
@@ -69,7 +72,7 @@ func (b *nodebuffer) node(owner common.Hash, path []byte, hash common.Hash) (*tr
 		return nil, nil
 	}
 	if n.Hash != hash {
-		dirtyFalseMeter.Mark(1)
+		m.dirtyFalseMeter.Mark(1)
 		log.Error("Unexpected trie node in node buffer", "owner", owner, "path", path, "expect", hash, "got", n.Hash)
 		return nil, newUnexpectedNodeError("dirty", hash, n.Hash, owner, path)
 	}
@@ -80,7 +83,7 @@ func (b *nodebuffer) node(owner common.Hash, path []byte, hash common.Hash) (*tr
 // the ownership of the nodes map which belongs to the bottom-most diff layer.
 // It will just hold the node references from the given map which are safe to
 // copy.
-func (b *nodebuffer) commit(nodes map[common.Hash]map[string]*trienode.Node) *nodebuffer {
+func (b *nodebuffer) commit(nodes map[common.Hash]map[string]*trienode.Node, m *metricSet) *nodebuffer {
 	var (
 		delta         int64
 		overwrite     int64
@@ -116,8 +119,8 @@ func (b *nodebuffer) commit(nodes map[common.Hash]map[string]*trienode.Node) *no
 	}
 	b.updateSize(delta)
 	b.layers++
-	gcNodesMeter.Mark(overwrite)
-	gcBytesMeter.Mark(overwriteSize)
+	m.gcNodesMeter.Mark(overwrite)
+	m.gcBytesMeter.Mark(overwriteSize)
 	return b
 }
 
@@ -199,47 +202,54 @@ func (b *nodebuffer) empty() bool {
 
 // setSize sets the buffer size to the provided number, and invokes a flush
 // operation if the current memory usage exceeds the new limit.
-func (b *nodebuffer) setSize(size int, db ethdb.KeyValueStore, clean *fastcache.Cache, id uint64) error {
+func (b *nodebuffer) setSize(size int, db ethdb.KeyValueStore, clean trienode.CleanCache, id uint64, config *Config, m *metricSet) error {
 	b.limit = uint64(size)
-	return b.flush(db, clean, id, false)
+	return b.flush(db, clean, id, false, config, m)
 }
 
 // flush persists the in-memory dirty trie node into the disk if the configured
 // memory threshold is reached. Note, all data must be written atomically.
-func (b *nodebuffer) flush(db ethdb.KeyValueStore, clean *fastcache.Cache, id uint64, force bool) error {
+func (b *nodebuffer) flush(db ethdb.KeyValueStore, clean trienode.CleanCache, id uint64, force bool, config *Config, m *metricSet) error {
 	if b.size <= b.limit && !force {
 		return nil
 	}
 	// Ensure the target state id is aligned with the internal counter.
 	head := rawdb.ReadPersistentStateID(db)
 	if head+b.layers != id {
-		return fmt.Errorf("buffer layers (%d) cannot be applied on top of persisted state id (%d) to reach requested state id (%d)", b.layers, head, id)
+		err := fmt.Errorf("buffer layers (%d) cannot be applied on top of persisted state id (%d) to reach requested state id (%d)", b.layers, head, id)
+		config.reportError("flush", err)
+		return &trienode.FatalError{Err: err}
 	}
 	var (
 		start = time.Now()
-		batch = db.NewBatchWithSize(int(b.size))
+		batch = trienode.NewReplicatedBatch(db.NewBatchWithSize(int(b.size)), config.Replicator)
 	)
-	nodes := writeNodes(batch, b.nodes, clean)
+	nodes := writeNodes(batch, b.nodes, clean, config.CommitOrder)
 	rawdb.WritePersistentStateID(batch, id)
 
 	// Flush all mutations in a single batch
 	size := batch.ValueSize()
 	if err := batch.Write(); err != nil {
+		config.reportError("flush", err)
 		return err
 	}
-	commitBytesMeter.Mark(int64(size))
-	commitNodesMeter.Mark(int64(nodes))
-	commitTimeTimer.UpdateSince(start)
+	b.written += uint64(size)
+	b.nwritten += uint64(nodes)
+	m.commitBytesMeter.Mark(int64(size))
+	m.commitNodesMeter.Mark(int64(nodes))
+	m.commitTimeTimer.UpdateSince(start)
 	log.Debug("Persisted pathdb nodes", "nodes", len(b.nodes), "bytes", common.StorageSize(size), "elapsed", common.PrettyDuration(time.Since(start)))
 	b.reset()
+	b.flushed = time.Now()
 	return nil
 }
 
-// writeNodes writes the trie nodes into the provided database batch.
-// Note this function will also inject all the newly written nodes
-// into clean cache.
-func writeNodes(batch ethdb.Batch, nodes map[common.Hash]map[string]*trienode.Node, clean *fastcache.Cache) (total int) {
-	for owner, subset := range nodes {
+// writeNodes writes the trie nodes into the provided database batch in the
+// given order of account and storage tries. Note this function will also
+// inject all the newly written nodes into clean cache.
+func writeNodes(batch ethdb.Batch, nodes map[common.Hash]map[string]*trienode.Node, clean trienode.CleanCache, order trienode.CommitOrder) (total int) {
+	for _, owner := range commitOwners(nodes, order) {
+		subset := nodes[owner]
 		for path, n := range subset {
 			if n.IsDeleted() {
 				if owner == (common.Hash{}) {
@@ -266,6 +276,26 @@ func writeNodes(batch ethdb.Batch, nodes map[common.Hash]map[string]*trienode.No
 	return total
 }
 
+// commitOwners returns the owners of the given node set, the account trie
+// is placed at the position specified by the order.
+func commitOwners(nodes map[common.Hash]map[string]*trienode.Node, order trienode.CommitOrder) []common.Hash {
+	owners := make([]common.Hash, 0, len(nodes))
+	for owner := range nodes {
+		if owner != (common.Hash{}) || order == trienode.Unordered {
+			owners = append(owners, owner)
+		}
+	}
+	if _, ok := nodes[common.Hash{}]; ok {
+		switch order {
+		case trienode.StorageFirst:
+			owners = append(owners, common.Hash{})
+		case trienode.AccountFirst:
+			owners = append([]common.Hash{{}}, owners...)
+		}
+	}
+	return owners
+}
+
 // cacheKey constructs the unique key of clean cache.
 func cacheKey(owner common.Hash, path []byte) []byte {
 	if owner == (common.Hash{}) {
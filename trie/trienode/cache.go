@@ -0,0 +1,220 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trienode
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/VictoriaMetrics/fastcache"
+)
+
+// CleanCache is the cache of clean trie nodes loaded from or written into the
+// persistent database, keyed by the scheme specific node key. Implementations
+// must be safe for concurrent use and may evict entries at any time.
+type CleanCache interface {
+	// Get returns the cached value of the key, or nil if it's not cached.
+	Get(key []byte) []byte
+
+	// Set caches the value under the key. Both slices may be retained.
+	Set(key []byte, value []byte)
+
+	// Del evicts the key from the cache.
+	Del(key []byte)
+
+	// Len returns the memory held by the cached entries in bytes.
+	Len() int
+
+	// Reset evicts all the entries from the cache.
+	Reset()
+}
+
+// CleanCacheSerializer is implemented by the clean caches whose content can be
+// serialized, e.g. to warm up the cache of a freshly started node.
+type CleanCacheSerializer interface {
+	// Save writes all the cached entries into the writer.
+	Save(w io.Writer) error
+
+	// Load replaces the cached entries with the ones written by Save.
+	Load(r io.Reader) error
+}
+
+// CleanCacheFactory creates a clean cache with the given memory allowance in
+// bytes.
+type CleanCacheFactory func(bytes int) CleanCache
+
+// NewFastCache creates the default clean cache backed by fastcache.
+func NewFastCache(bytes int) CleanCache {
+	c := &fastCache{bytes: bytes}
+	c.cache.Store(fastcache.New(bytes))
+	return c
+}
+
+// fastCache is the CleanCache implementation wrapping a fastcache.
+type fastCache struct {
+	cache atomic.Pointer[fastcache.Cache] // Swapped as a whole when loading
+	bytes int                             // Memory allowance of the cache
+}
+
+// Get implements CleanCache, returning the value associated with the key.
+func (c *fastCache) Get(key []byte) []byte {
+	return c.cache.Load().Get(nil, key)
+}
+
+// Set implements CleanCache, caching the key-value pair.
+func (c *fastCache) Set(key []byte, value []byte) {
+	c.cache.Load().Set(key, value)
+}
+
+// Del implements CleanCache, evicting the key.
+func (c *fastCache) Del(key []byte) {
+	c.cache.Load().Del(key)
+}
+
+// Len implements CleanCache, returning the memory allocated by the cache.
+func (c *fastCache) Len() int {
+	var stats fastcache.Stats
+	c.cache.Load().UpdateStats(&stats)
+	return int(stats.BytesSize)
+}
+
+// Reset implements CleanCache, evicting all the entries.
+func (c *fastCache) Reset() {
+	c.cache.Load().Reset()
+}
+
+// fastCacheSizeEntry is the name of the tar entry holding the memory allowance
+// of the saved cache, the others are the files written by fastcache.
+const fastCacheSizeEntry = "maxbytes"
+
+// Save implements CleanCacheSerializer, writing the files of the cache saved by
+// fastcache into the writer as a tar stream.
+func (c *fastCache) Save(w io.Writer) error {
+	dir, err := os.MkdirTemp("", "cleancache")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	if err := c.cache.Load().SaveToFileConcurrent(dir, runtime.GOMAXPROCS(0)); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(w)
+	size := []byte(strconv.Itoa(c.bytes))
+	if err := tw.WriteHeader(&tar.Header{Name: fastCacheSizeEntry, Mode: 0600, Size: int64(len(size))}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(size); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := saveFile(tw, filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// saveFile writes the file with the given path into the tar stream.
+func saveFile(tw *tar.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: info.Name(), Mode: 0600, Size: info.Size()}); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// Load implements CleanCacheSerializer, replacing the cache with the one saved
+// by Save. The saved cache must have the same memory allowance.
+func (c *fastCache) Load(r io.Reader) error {
+	dir, err := os.MkdirTemp("", "cleancache")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	var sized bool
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Name == fastCacheSizeEntry {
+			blob, err := io.ReadAll(tr)
+			if err != nil {
+				return err
+			}
+			if size, err := strconv.Atoi(string(blob)); err != nil || size != c.bytes {
+				return fmt.Errorf("mismatched cache size, saved %q, want %d", blob, c.bytes)
+			}
+			sized = true
+			continue
+		}
+		if err := loadFile(tr, dir, hdr.Name); err != nil {
+			return err
+		}
+	}
+	if !sized {
+		return errors.New("cache size is missing")
+	}
+	cache, err := fastcache.LoadFromFile(dir)
+	if err != nil {
+		return err
+	}
+	c.cache.Swap(cache).Reset()
+	return nil
+}
+
+// loadFile writes the current entry of the tar stream into the directory.
+func loadFile(tr *tar.Reader, dir string, name string) error {
+	if name != filepath.Base(name) {
+		return fmt.Errorf("invalid cache file name %q", name)
+	}
+	f, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(f, tr)
+	return err
+}
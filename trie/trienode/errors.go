@@ -0,0 +1,105 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trienode
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// ErrNodeNotFound is returned by the node readers of the database backends if
+// the requested trie node is not present, as opposed to a node which exists but
+// is corrupted or unexpected. It's always wrapped in a NotFoundError.
+var ErrNodeNotFound = errors.New("trie node not found")
+
+// NotFoundError is returned by the node readers if the requested trie node is
+// not present. It matches ErrNodeNotFound with errors.Is.
+type NotFoundError struct {
+	Owner common.Hash // Owner of the trie, zero for the account trie
+	Path  []byte      // Hex-encoded path of the node
+	Hash  common.Hash // Hash of the node
+}
+
+// Unwrap returns ErrNodeNotFound, making the error matchable with errors.Is.
+func (err *NotFoundError) Unwrap() error {
+	return ErrNodeNotFound
+}
+
+func (err *NotFoundError) Error() string {
+	if err.Owner == (common.Hash{}) {
+		return fmt.Sprintf("%v %x (path %x)", ErrNodeNotFound, err.Hash, err.Path)
+	}
+	return fmt.Sprintf("%v %x (owner %x) (path %x)", ErrNodeNotFound, err.Hash, err.Owner, err.Path)
+}
+
+// TransientError wraps the error of a failed commit or flush of the trie nodes
+// which is caused by the environment rather than the data, e.g. a failed write
+// of the key-value store, thus retrying the operation is safe and might succeed.
+type TransientError struct {
+	Err error // Underlying cause of the failure
+}
+
+// Unwrap returns the underlying cause of the failure.
+func (err *TransientError) Unwrap() error {
+	return err.Err
+}
+
+func (err *TransientError) Error() string {
+	return err.Err.Error()
+}
+
+// FatalError wraps the error of a failed commit or flush of the trie nodes
+// which is caused by the data, e.g. a missing or corrupted node, or whose cause
+// is unknown, thus retrying the operation is pointless.
+type FatalError struct {
+	Err error // Underlying cause of the failure
+}
+
+// Unwrap returns the underlying cause of the failure.
+func (err *FatalError) Unwrap() error {
+	return err.Err
+}
+
+func (err *FatalError) Error() string {
+	return err.Err.Error()
+}
+
+// Classify wraps the error of a failed commit or flush into a FatalError,
+// unless it's already classified. Nil is returned as is.
+func Classify(err error) error {
+	var (
+		transient *TransientError
+		fatal     *FatalError
+	)
+	if err == nil || errors.As(err, &transient) || errors.As(err, &fatal) {
+		return err
+	}
+	return &FatalError{Err: err}
+}
+
+// IsRetryable reports whether the failed commit or flush is safe to retry. It's
+// conservative, only the errors classified as transient and not as fatal are
+// retryable.
+func IsRetryable(err error) bool {
+	var (
+		transient *TransientError
+		fatal     *FatalError
+	)
+	return errors.As(err, &transient) && !errors.As(err, &fatal)
+}
@@ -130,6 +130,26 @@ func (set *NodeSet) Size() (int, int) {
 	return set.updates, set.deletes
 }
 
+// Copy returns a deep copy of the set.
+func (set *NodeSet) Copy() *NodeSet {
+	cpy := &NodeSet{
+		Owner:   set.Owner,
+		Nodes:   make(map[string]*Node, len(set.Nodes)),
+		updates: set.updates,
+		deletes: set.deletes,
+	}
+	for path, n := range set.Nodes {
+		cpy.Nodes[path] = New(n.Hash, common.CopyBytes(n.Blob))
+	}
+	if set.Leaves != nil {
+		cpy.Leaves = make([]*leaf, 0, len(set.Leaves))
+		for _, l := range set.Leaves {
+			cpy.Leaves = append(cpy.Leaves, &leaf{Blob: common.CopyBytes(l.Blob), Parent: l.Parent})
+		}
+	}
+	return cpy
+}
+
 // Hashes returns the hashes of all updated nodes. TODO(rjl493456442) how can
 // we get rid of it?
 func (set *NodeSet) Hashes() []common.Hash {
@@ -189,6 +209,15 @@ func (set *MergedNodeSet) Merge(other *NodeSet) error {
 	return nil
 }
 
+// Copy returns a deep copy of the merged set.
+func (set *MergedNodeSet) Copy() *MergedNodeSet {
+	cpy := &MergedNodeSet{Sets: make(map[common.Hash]*NodeSet, len(set.Sets))}
+	for owner, subset := range set.Sets {
+		cpy.Sets[owner] = subset.Copy()
+	}
+	return cpy
+}
+
 // Flatten returns a two-dimensional map for internal nodes.
 func (set *MergedNodeSet) Flatten() map[common.Hash]map[string]*Node {
 	nodes := make(map[common.Hash]map[string]*Node)
@@ -197,3 +226,29 @@ func (set *MergedNodeSet) Flatten() map[common.Hash]map[string]*Node {
 	}
 	return nodes
 }
+
+// CommitOrder defines the order in which the dirty nodes of the account trie
+// and storage tries are written into disk. It matters if the writes can't be
+// applied atomically, a crash in the middle leaves a consistent prefix of the
+// state only if the referenced nodes are written first.
+type CommitOrder int
+
+const (
+	Unordered    CommitOrder = iota // Nodes are written in an arbitrary order
+	StorageFirst                    // Storage trie nodes are written before the account trie
+	AccountFirst                    // Account trie nodes are written before the storage tries
+)
+
+// String implements fmt.Stringer.
+func (o CommitOrder) String() string {
+	switch o {
+	case Unordered:
+		return "unordered"
+	case StorageFirst:
+		return "storage-first"
+	case AccountFirst:
+		return "account-first"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(o))
+	}
+}
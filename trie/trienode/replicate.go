@@ -0,0 +1,82 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trienode
+
+import "github.com/ethereum/go-ethereum/ethdb"
+
+// Replicator receives the trie node and preimage writes made by the database,
+// e.g. to forward them to a standby key-value store. The writes are delivered
+// in order once they are persisted locally, a nil value denotes a deletion.
+// Replicate is invoked in the commit path and must not block, the replicator
+// is expected to buffer internally. The passed slices must not be retained.
+type Replicator interface {
+	Replicate(key, value []byte)
+}
+
+// NewReplicatedBatch wraps the batch to forward all of its mutations to the
+// replicator whenever it's written. The batch is returned as is if there is
+// no replicator.
+func NewReplicatedBatch(batch ethdb.Batch, replicator Replicator) ethdb.Batch {
+	if replicator == nil {
+		return batch
+	}
+	return &replicatedBatch{Batch: batch, replicator: replicator}
+}
+
+// replicatedBatch is a batch which replays the written data into a replicator.
+type replicatedBatch struct {
+	ethdb.Batch
+	replicator Replicator
+}
+
+// Write flushes the accumulated data into disk and then into the replicator.
+func (b *replicatedBatch) Write() error {
+	if err := b.Batch.Write(); err != nil {
+		return err
+	}
+	return b.Batch.Replay(replicaWriter{b.replicator})
+}
+
+// WriteNoSync flushes the accumulated data without forcing an fsync if it's
+// supported by the wrapped batch, and then into the replicator.
+func (b *replicatedBatch) WriteNoSync() error {
+	w, ok := b.Batch.(ethdb.NoSyncWriter)
+	if !ok {
+		return b.Write()
+	}
+	if err := w.WriteNoSync(); err != nil {
+		return err
+	}
+	return b.Batch.Replay(replicaWriter{b.replicator})
+}
+
+// replicaWriter is a key-value writer forwarding everything to a replicator.
+type replicaWriter struct {
+	replicator Replicator
+}
+
+// Put implements ethdb.KeyValueWriter.
+func (w replicaWriter) Put(key []byte, value []byte) error {
+	w.replicator.Replicate(key, value)
+	return nil
+}
+
+// Delete implements ethdb.KeyValueWriter.
+func (w replicaWriter) Delete(key []byte) error {
+	w.replicator.Replicate(key, nil)
+	return nil
+}
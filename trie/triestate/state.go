@@ -74,6 +74,30 @@ func New(accounts map[common.Address][]byte, storages map[common.Address]map[com
 	}
 }
 
+// Copy returns a deep copy of the state set.
+func (s *Set) Copy() *Set {
+	cpy := &Set{
+		Accounts:   make(map[common.Address][]byte, len(s.Accounts)),
+		Storages:   make(map[common.Address]map[common.Hash][]byte, len(s.Storages)),
+		Incomplete: make(map[common.Address]struct{}, len(s.Incomplete)),
+		size:       s.size,
+	}
+	for addr, blob := range s.Accounts {
+		cpy.Accounts[addr] = common.CopyBytes(blob)
+	}
+	for addr, slots := range s.Storages {
+		subset := make(map[common.Hash][]byte, len(slots))
+		for key, blob := range slots {
+			subset[key] = common.CopyBytes(blob)
+		}
+		cpy.Storages[addr] = subset
+	}
+	for addr := range s.Incomplete {
+		cpy.Incomplete[addr] = struct{}{}
+	}
+	return cpy
+}
+
 // Size returns the approximate memory size occupied by the set.
 func (s *Set) Size() common.StorageSize {
 	if s.size != 0 {
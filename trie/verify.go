@@ -0,0 +1,94 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// VerifyRoot returns the root of the most recent state persisted by the backend
+// and verifies that its root node is present and intact. In path scheme, the
+// root node is read from the persistent state if it's not shadowed by the node
+// buffer of the disk layer. The hash scheme only knows the root committed since
+// the database was opened, an empty hash is returned if there is none.
+func (db *Database) VerifyRoot() (common.Hash, error) {
+	root := db.backend.DiskRoot()
+	if root == (common.Hash{}) || root == types.EmptyRootHash {
+		return root, nil
+	}
+	var blob []byte
+	switch db.Scheme() {
+	case rawdb.HashScheme:
+		blob = rawdb.ReadLegacyTrieNode(db.diskdb, root)
+	case rawdb.PathScheme:
+		var hash common.Hash
+		blob, hash = rawdb.ReadAccountTrieNode(db.diskdb, nil)
+		if hash != root {
+			// The persistent state lags behind the disk layer, resolve
+			// the root node through the node buffer.
+			reader, err := db.Reader(root)
+			if err != nil {
+				return root, err
+			}
+			blob, err = reader.Node(common.Hash{}, nil, root)
+			if err != nil {
+				return root, fmt.Errorf("root node %x is not available: %v", root, err)
+			}
+		}
+	}
+	if len(blob) == 0 {
+		return root, fmt.Errorf("root node %x is missing", root)
+	}
+	if hash := crypto.Keccak256Hash(blob); hash != root {
+		return root, fmt.Errorf("root node %x has mismatched hash %x", root, hash)
+	}
+	if _, err := decodeNode(root.Bytes(), blob); err != nil {
+		return root, fmt.Errorf("root node %x is corrupted: %v", root, err)
+	}
+	return root, nil
+}
+
+// RootExists reports whether the root node of the state with the given root is
+// present, either in memory or on disk, without verifying the rest of the state.
+// In path scheme, the root node is looked up in the layer of the state, falling
+// through the ancestors into the disk. The empty state is regarded as present.
+// An error is only returned if the lookup fails for reasons other than absence.
+func (db *Database) RootExists(root common.Hash) (bool, error) {
+	if root == types.EmptyRootHash {
+		return true, nil
+	}
+	reader, err := db.Reader(root)
+	if err != nil {
+		// The backends only fail to construct a reader if the state is
+		// unknown, which means the root node is absent as well.
+		return false, nil
+	}
+	blob, err := reader.Node(common.Hash{}, nil, root)
+	if errors.Is(err, ErrNodeNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return len(blob) > 0, nil
+}
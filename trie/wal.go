@@ -0,0 +1,196 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// walPrefix is the prefix of the records in the write-ahead log, followed by
+// the big-endian sequence number of the record.
+var walPrefix = []byte("trie-wal-")
+
+// errWALPending is returned by the batch writes while a record of a failed
+// write is left in the write-ahead log, until it's replayed by RecoverWAL.
+var errWALPending = errors.New("write-ahead log has pending records")
+
+// walEntry is a single mutation of a batch recorded in the write-ahead log.
+type walEntry struct {
+	Key    []byte
+	Value  []byte
+	Delete bool
+}
+
+// walRecorder is a key-value writer collecting the replayed mutations.
+type walRecorder []walEntry
+
+// Put implements ethdb.KeyValueWriter.
+func (r *walRecorder) Put(key []byte, value []byte) error {
+	*r = append(*r, walEntry{Key: key, Value: value})
+	return nil
+}
+
+// Delete implements ethdb.KeyValueWriter.
+func (r *walRecorder) Delete(key []byte) error {
+	*r = append(*r, walEntry{Key: key, Delete: true})
+	return nil
+}
+
+// walDatabase is a key-value store appending the content of every batch to the
+// write-ahead log before writing it, and dropping the record once the write is
+// completed. The records left behind, e.g. by a crash amid a write, are
+// replayed by recover.
+type walDatabase struct {
+	ethdb.Database
+	wal ethdb.KeyValueStore
+
+	lock    sync.Mutex
+	seq     uint64 // Sequence number of the next record
+	pending bool   // Flag whether a record of a failed write is left behind
+}
+
+// newWALDatabase wraps the key-value store to log its batches into the given
+// write-ahead log.
+func newWALDatabase(diskdb ethdb.Database, wal ethdb.KeyValueStore) *walDatabase {
+	db := &walDatabase{Database: diskdb, wal: wal}
+
+	it := wal.NewIterator(walPrefix, nil)
+	for it.Next() {
+		db.seq = binary.BigEndian.Uint64(it.Key()[len(walPrefix):]) + 1
+		db.pending = true
+	}
+	it.Release()
+	return db
+}
+
+// walKey returns the key of the record with the given sequence number.
+func walKey(seq uint64) []byte {
+	return binary.BigEndian.AppendUint64(append([]byte{}, walPrefix...), seq)
+}
+
+// NewBatch implements ethdb.Batcher, logging the batch once it's written.
+func (db *walDatabase) NewBatch() ethdb.Batch {
+	return &walBatch{Batch: db.Database.NewBatch(), db: db}
+}
+
+// NewBatchWithSize implements ethdb.Batcher, logging the batch once it's written.
+func (db *walDatabase) NewBatchWithSize(size int) ethdb.Batch {
+	return &walBatch{Batch: db.Database.NewBatchWithSize(size), db: db}
+}
+
+// write logs the content of the batch, writes it and drops the record. The
+// record is kept if the write fails, as it might be torn, and the later writes
+// are rejected until it's replayed, lest the replay reverts them.
+func (db *walDatabase) write(batch ethdb.Batch) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if db.pending {
+		return errWALPending
+	}
+	var record walRecorder
+	if err := batch.Replay(&record); err != nil {
+		return err
+	}
+	blob, err := rlp.EncodeToBytes(record)
+	if err != nil {
+		return err
+	}
+	key := walKey(db.seq)
+	if err := db.wal.Put(key, blob); err != nil {
+		return fmt.Errorf("failed to append write-ahead log: %w", err)
+	}
+	db.seq++
+	if err := batch.Write(); err != nil {
+		db.pending = true
+		return err
+	}
+	return db.wal.Delete(key)
+}
+
+// recover replays the records left in the write-ahead log in order, dropping
+// each once it's written.
+func (db *walDatabase) recover() error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	var replayed int
+	it := db.wal.NewIterator(walPrefix, nil)
+	defer it.Release()
+	for it.Next() {
+		var record []walEntry
+		if err := rlp.DecodeBytes(it.Value(), &record); err != nil {
+			return fmt.Errorf("invalid write-ahead log record %x: %v", it.Key(), err)
+		}
+		batch := db.Database.NewBatch()
+		for _, entry := range record {
+			if entry.Delete {
+				batch.Delete(entry.Key)
+			} else {
+				batch.Put(entry.Key, entry.Value)
+			}
+		}
+		if err := batch.Write(); err != nil {
+			return err
+		}
+		if err := db.wal.Delete(it.Key()); err != nil {
+			return err
+		}
+		replayed++
+	}
+	if err := it.Error(); err != nil {
+		return err
+	}
+	if replayed > 0 {
+		log.Warn("Replayed write-ahead log", "records", replayed)
+	}
+	db.pending = false
+	return nil
+}
+
+// walBatch is a batch logged into the write-ahead log before it's written.
+type walBatch struct {
+	ethdb.Batch
+	db *walDatabase
+}
+
+// Write implements ethdb.Batch, logging the batch before writing it.
+func (b *walBatch) Write() error {
+	return b.db.write(b.Batch)
+}
+
+// RecoverWAL replays the records left in the write-ahead log configured with
+// Config.WAL, e.g. by a crash amid a write, into the persistent database. It's
+// invoked when the database is opened, it only needs to be invoked again once
+// a write fails, which leaves its record behind and rejects the later writes
+// until it's replayed.
+func (db *Database) RecoverWAL() error {
+	if db.wal == nil {
+		return nil
+	}
+	db.flushLock.Lock()
+	defer db.flushLock.Unlock()
+
+	return db.wal.recover()
+}
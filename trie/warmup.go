@@ -0,0 +1,117 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// WarmupFromDisk preloads the clean cache of the backend with the account trie
+// nodes closest to the root of the persisted state, breadth first, until the
+// given amount of bytes is loaded or the trie is exhausted. It gives a warm
+// start if no exported cache is available, see ImportCleanCache. The path scheme
+// walks the persistent state, while the hash scheme walks the state committed
+// since the database was opened, falling back to the state of the head header.
+// Nothing is loaded if the state can't be located.
+func (db *Database) WarmupFromDisk(maxBytes int) error {
+	cache := db.backend.CleanCache()
+	if cache == nil {
+		return errCleanCacheDisabled
+	}
+	var (
+		scheme = db.Scheme()
+		root   common.Hash
+	)
+	switch scheme {
+	case rawdb.HashScheme:
+		root = db.committedRoot()
+	case rawdb.PathScheme:
+		_, root = rawdb.ReadAccountTrieNode(db.diskdb, nil)
+	default:
+		return ErrNotSupported
+	}
+	if root == (common.Hash{}) || root == types.EmptyRootHash {
+		return nil
+	}
+	type entry struct {
+		path []byte
+		hash common.Hash
+	}
+	var (
+		queue  = []entry{{hash: root}}
+		loaded int
+		nodes  int
+	)
+	for len(queue) > 0 {
+		next := queue[0]
+		queue = queue[1:]
+
+		var key, blob []byte
+		if scheme == rawdb.HashScheme {
+			key, blob = next.hash.Bytes(), rawdb.ReadLegacyTrieNode(db.diskdb, next.hash)
+		} else {
+			key = next.path
+			blob, _ = rawdb.ReadAccountTrieNode(db.diskdb, next.path)
+		}
+		if len(blob) == 0 {
+			continue
+		}
+		if loaded+len(key)+len(blob) > maxBytes {
+			break
+		}
+		cache.Set(key, blob)
+		loaded += len(key) + len(blob)
+		nodes++
+
+		n, err := decodeNode(next.hash.Bytes(), blob)
+		if err != nil {
+			return err
+		}
+		switch n := n.(type) {
+		case *shortNode:
+			if child, ok := n.Val.(hashNode); ok {
+				path := append(common.CopyBytes(next.path), n.Key...)
+				queue = append(queue, entry{path: path, hash: common.BytesToHash(child)})
+			}
+		case *fullNode:
+			for i, child := range n.Children[:16] {
+				if child, ok := child.(hashNode); ok {
+					path := append(common.CopyBytes(next.path), byte(i))
+					queue = append(queue, entry{path: path, hash: common.BytesToHash(child)})
+				}
+			}
+		}
+	}
+	log.Info("Warmed up clean cache from disk", "root", root, "nodes", nodes, "size", common.StorageSize(loaded))
+	return nil
+}
+
+// committedRoot returns the root of the state committed since the database was
+// opened, falling back to the state of the head header, in the hash scheme. An
+// empty hash is returned if neither is known.
+func (db *Database) committedRoot() common.Hash {
+	if root := db.backend.DiskRoot(); root != (common.Hash{}) {
+		return root
+	}
+	if head := rawdb.ReadHeadHeader(db.diskdb); head != nil {
+		return head.Root
+	}
+	return common.Hash{}
+}